@@ -47,7 +47,11 @@ func (p Permission) Authorized(user discordgo.Member) bool {
 
 // Handler of message sent events. TODO: Jesus past me, this can't be the best way to do it
 type Handler func(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []Command)
-type Init func(s *discordgo.Session, db *sql.DB)
+type Init func(s *discordgo.Session, db *sql.DB, guildID string)
+
+// ReactionHandler of reactions being added to or removed from messages.
+// Every reaction is passed to every reaction handler, so ignore messages the handler does not know about.
+type ReactionHandler func(s *discordgo.Session, r *discordgo.MessageReaction, added bool, db *sql.DB, guildID string)
 
 type Command struct {
 	CallPhrase string
@@ -58,7 +62,7 @@ type Command struct {
 	SubCommands     []Command
 	HelpDescription string
 	Handler         Handler
-	// Init is called before the handler. Put it as nil if there's no need.
+	// Init is called once when the bot starts, for subcommands too. Put it as nil if there's no need.
 	Init Init
 	Help Help
 }
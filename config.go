@@ -13,8 +13,7 @@ const (
 
 // Config for OutBot.
 type Config struct {
-	Guild  `json:"guild"`
-	Sheets `json:"sheets"`
+	Guild `json:"guild"`
 }
 
 // Guild config contains information about the discord guild.
@@ -23,10 +22,6 @@ type Guild struct {
 	// TODO: Add channel parameters
 }
 
-type Sheets struct {
-	AuthCode string `json:"authCode"`
-}
-
 // readConfig in the dir.
 // If one does not exist at the directory then a placeholder will be created.
 func readConfig(dir string) Config {
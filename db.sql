@@ -3,16 +3,315 @@ CREATE TABLE IF NOT EXISTS events (
     description text,
     time timestamp,
     expired boolean NOT NULL DEFAULT false,
-    PRIMARY KEY (description, time)
+    author_id text NOT NULL DEFAULT '',
+    recurrence_seconds bigint NOT NULL DEFAULT 0
 );
 
-CREATE TYPE participant_instance AS ENUM ('Main A', 'Main B', 'Academy A', 'Academy B');
+CREATE TABLE IF NOT EXISTS event_notices (
+    event_id integer NOT NULL REFERENCES events (id) ON DELETE CASCADE,
+    offset_seconds bigint NOT NULL,
+    sent boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (event_id, offset_seconds)
+);
+
+CREATE TABLE IF NOT EXISTS event_settings (
+    guild_id text PRIMARY KEY,
+    notice_offsets bigint[] NOT NULL DEFAULT '{0}',
+    catch_up_grace_seconds bigint NOT NULL DEFAULT 0,
+    catch_up_skip_recurring boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS ws_instances (
+    name text PRIMARY KEY,
+    code text NOT NULL,
+    corp text NOT NULL,
+    role_id text NOT NULL DEFAULT '',
+    UNIQUE (corp, code)
+);
+
+CREATE TABLE IF NOT EXISTS ws_instance_channels (
+    instance text NOT NULL REFERENCES ws_instances (name) ON DELETE CASCADE ON UPDATE CASCADE,
+    channel_id text NOT NULL,
+    PRIMARY KEY (instance, channel_id)
+);
+
+-- The instances used to be a fixed enum, with the academy channels hard-coded
+INSERT INTO ws_instances (name, code, corp, role_id) VALUES
+    ('Main A', 'A', 'Main', '442643047541374977'),
+    ('Main B', 'B', 'Main', '442643047541374977'),
+    ('Academy A', 'A', 'Academy', '442643047541374977'),
+    ('Academy B', 'B', 'Academy', '442643047541374977')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO ws_instance_channels (instance, channel_id) VALUES
+    ('Academy A', '488859067947941909'),
+    ('Academy A', '488401533063659530'),
+    ('Academy A', '488478592297336834'),
+    ('Academy A', '512368438266691594'),
+    ('Academy A', '489510100705214464'),
+    ('Academy B', '488859067947941909'),
+    ('Academy B', '488401533063659530'),
+    ('Academy B', '488478592297336834'),
+    ('Academy B', '512368438266691594'),
+    ('Academy B', '489510100705214464')
+ON CONFLICT DO NOTHING;
 
 CREATE TABLE IF NOT EXISTS participants (
-    instance participant_instance NOT NULL,
+    instance text NOT NULL,
     name text NOT NULL,
     participating boolean NOT NULL,
     preferred_role text NOT NULL DEFAULT 'No preference',
     user_id text NOT NULL DEFAULT '',
-    PRIMARY KEY (instance, name)
-);
\ No newline at end of file
+    PRIMARY KEY (instance, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_timezones (
+    user_id text PRIMARY KEY,
+    zone text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS calendar_feeds (
+    guild_id text PRIMARY KEY,
+    token text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_rounds (
+    id SERIAL PRIMARY KEY,
+    instance text NOT NULL,
+    phase text NOT NULL,
+    opened_at timestamp NOT NULL,
+    phase_changed_at timestamp NOT NULL,
+    end_event_id integer REFERENCES events (id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_round_participants (
+    round_id integer NOT NULL REFERENCES ws_rounds (id) ON DELETE CASCADE,
+    name text NOT NULL,
+    user_id text NOT NULL,
+    participating boolean NOT NULL,
+    preferred_role text NOT NULL,
+    PRIMARY KEY (round_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS ws_roster_targets (
+    instance text NOT NULL,
+    size integer NOT NULL,
+    defense integer NOT NULL,
+    offense integer NOT NULL,
+    hunter integer NOT NULL,
+    PRIMARY KEY (instance, size)
+);
+
+CREATE TABLE IF NOT EXISTS ws_roster_picks (
+    instance text NOT NULL,
+    user_id text NOT NULL,
+    pick text NOT NULL,
+    PRIMARY KEY (instance, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS ws_rosters (
+    instance text NOT NULL PRIMARY KEY,
+    size integer NOT NULL,
+    notes text NOT NULL,
+    approved boolean NOT NULL,
+    built_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_roster_picks_built (
+    instance text NOT NULL REFERENCES ws_rosters (instance) ON DELETE CASCADE,
+    position integer NOT NULL,
+    name text NOT NULL,
+    user_id text NOT NULL,
+    role text NOT NULL,
+    reason text NOT NULL,
+    PRIMARY KEY (instance, position)
+);
+
+CREATE TABLE IF NOT EXISTS ws_signup_emoji (
+    guild_id text NOT NULL,
+    role text NOT NULL,
+    emoji text NOT NULL,
+    PRIMARY KEY (guild_id, role)
+);
+
+CREATE TABLE IF NOT EXISTS ws_signup_messages (
+    instance text NOT NULL PRIMARY KEY,
+    guild_id text NOT NULL,
+    channel_id text NOT NULL,
+    message_id text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS ws_deadlines (
+    instance text NOT NULL PRIMARY KEY,
+    channel_id text NOT NULL,
+    time timestamp NOT NULL,
+    reminder_offsets bigint[] NOT NULL,
+    sent_offsets bigint[] NOT NULL DEFAULT '{}',
+    closed boolean NOT NULL DEFAULT false
+);
+
+CREATE TABLE IF NOT EXISTS ws_pending_exclusions (
+    user_id text NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS ws_nudge_opt_outs (
+    user_id text NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS ws_match_timers (
+    instance text NOT NULL PRIMARY KEY,
+    channel_id text NOT NULL,
+    started_at timestamp NOT NULL,
+    sent_offsets bigint[] NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE IF NOT EXISTS ws_ship_cooldowns (
+    guild_id text NOT NULL,
+    ship text NOT NULL,
+    cooldown bigint NOT NULL,
+    PRIMARY KEY (guild_id, ship)
+);
+
+CREATE TABLE IF NOT EXISTS ws_ship_downs (
+    instance text NOT NULL,
+    enemy boolean NOT NULL,
+    owner text NOT NULL,
+    name text NOT NULL,
+    ship text NOT NULL,
+    channel_id text NOT NULL,
+    destroyed_at timestamp NOT NULL,
+    returns_at timestamp NOT NULL,
+    PRIMARY KEY (instance, enemy, owner, ship)
+);
+
+CREATE TABLE IF NOT EXISTS member_modules (
+    user_id text NOT NULL,
+    module text NOT NULL,
+    level integer NOT NULL,
+    PRIMARY KEY (user_id, module)
+);
+
+CREATE TABLE IF NOT EXISTS module_stats (
+    module text NOT NULL,
+    level integer NOT NULL,
+    position integer NOT NULL,
+    name text NOT NULL,
+    value text NOT NULL,
+    PRIMARY KEY (module, level, position)
+);
+
+CREATE TABLE IF NOT EXISTS ws_tech_requirements (
+    guild_id text NOT NULL,
+    module text NOT NULL,
+    min_level integer NOT NULL,
+    count integer NOT NULL,
+    PRIMARY KEY (guild_id, module)
+);
+
+CREATE TABLE IF NOT EXISTS rs_levels (
+    user_id text PRIMARY KEY,
+    level integer NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rs_queue_expiry (
+    guild_id text PRIMARY KEY,
+    expiry bigint NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rs_queue (
+    level integer NOT NULL,
+    user_id text NOT NULL,
+    name text NOT NULL,
+    channel_id text NOT NULL,
+    joined_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    PRIMARY KEY (level, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS star_runs (
+    id serial PRIMARY KEY,
+    kind text NOT NULL,
+    level integer NOT NULL,
+    score integer NOT NULL,
+    logged_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS star_run_members (
+    run_id integer NOT NULL REFERENCES star_runs (id) ON DELETE CASCADE,
+    user_id text NOT NULL,
+    name text NOT NULL,
+    PRIMARY KEY (run_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS weekly_posts (
+    guild_id text NOT NULL,
+    name text NOT NULL,
+    channel_id text NOT NULL,
+    last_posted_at timestamp NOT NULL,
+    PRIMARY KEY (guild_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS member_snapshots (
+    user_id text PRIMARY KEY,
+    name text NOT NULL,
+    roles text[] NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS member_events (
+    id serial PRIMARY KEY,
+    user_id text NOT NULL,
+    name text NOT NULL,
+    kind text NOT NULL,
+    role text NOT NULL,
+    happened_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_availability_polls (
+    round_id integer PRIMARY KEY REFERENCES ws_rounds (id) ON DELETE CASCADE,
+    channel_id text NOT NULL,
+    message_id text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ws_availability_windows (
+    round_id integer NOT NULL REFERENCES ws_availability_polls (round_id) ON DELETE CASCADE,
+    number integer NOT NULL,
+    starts_at timestamp NOT NULL,
+    PRIMARY KEY (round_id, number)
+);
+
+CREATE TABLE IF NOT EXISTS ws_availability_votes (
+    round_id integer NOT NULL REFERENCES ws_availability_polls (round_id) ON DELETE CASCADE,
+    user_id text NOT NULL,
+    number integer NOT NULL,
+    by_reaction boolean NOT NULL DEFAULT false,
+    PRIMARY KEY (round_id, user_id, number, by_reaction)
+);
+
+ALTER TABLE events ADD COLUMN IF NOT EXISTS author_id text NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN IF NOT EXISTS recurrence_seconds bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE participants ALTER COLUMN instance TYPE text;
+ALTER TABLE ws_rounds ALTER COLUMN instance TYPE text;
+DROP TYPE IF EXISTS participant_instance;
+
+ALTER TABLE ws_rounds ADD COLUMN IF NOT EXISTS ended_at timestamp;
+ALTER TABLE ws_rounds ADD COLUMN IF NOT EXISTS roster_size integer;
+ALTER TABLE ws_rounds ADD COLUMN IF NOT EXISTS outcome text;
+ALTER TABLE ws_round_participants ADD COLUMN IF NOT EXISTS roster_role text;
+UPDATE ws_rounds SET ended_at = phase_changed_at WHERE phase = 'Ended' AND ended_at IS NULL;
+
+-- Participants used to be keyed by username, rows without a user ID get a placeholder until the bot resolves them
+UPDATE participants SET user_id = 'name:' || name WHERE user_id = '';
+UPDATE ws_round_participants SET user_id = 'name:' || name WHERE user_id = '';
+DELETE FROM participants a USING participants b
+WHERE a.instance = b.instance AND a.user_id = b.user_id AND a.ctid < b.ctid;
+ALTER TABLE participants DROP CONSTRAINT IF EXISTS participants_pkey;
+ALTER TABLE participants ADD PRIMARY KEY (instance, user_id);
+DELETE FROM ws_round_participants a USING ws_round_participants b
+WHERE a.round_id = b.round_id AND a.user_id = b.user_id AND a.ctid < b.ctid;
+ALTER TABLE ws_round_participants DROP CONSTRAINT IF EXISTS ws_round_participants_pkey;
+ALTER TABLE ws_round_participants ADD PRIMARY KEY (round_id, user_id);
+
+ALTER TABLE ws_rounds ADD COLUMN IF NOT EXISTS opponent text;
+ALTER TABLE ws_rounds ADD COLUMN IF NOT EXISTS our_score integer;
+ALTER TABLE ws_rounds ADD COLUMN IF NOT EXISTS their_score integer;
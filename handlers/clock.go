@@ -0,0 +1,17 @@
+package handlers
+
+import "time"
+
+// clock tells the current time, it's replaced in tests to simulate time passing.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// eventClock is used by the event timers.
+var eventClock clock = systemClock{}
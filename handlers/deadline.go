@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// defaultDeadlineReminders are the offsets of the reminders before a sign-up deadline, 0 is when it closes.
+var defaultDeadlineReminders = []time.Duration{24 * time.Hour, time.Hour, 0}
+
+// wsDeadline is the sign-up deadline of an instance.
+type wsDeadline struct {
+	instance instance
+	// channelID reminders and the final roster are posted to.
+	channelID string
+	time      time.Time
+	// reminders are the offsets before the deadline, sorted with the earliest first and always including 0.
+	reminders []time.Duration
+	sent      map[time.Duration]bool
+	closed    bool
+}
+
+// dueReminders returns the reminders which should have been sent at now but have not, earliest first.
+func (d wsDeadline) dueReminders(now time.Time) []time.Duration {
+	var due []time.Duration
+	for _, offset := range d.reminders {
+		if !d.sent[offset] && !d.time.Add(-offset).After(now) {
+			due = append(due, offset)
+		}
+	}
+	return due
+}
+
+// markDueReminders marks the reminders which should have been sent at now as sent and returns them, earliest first.
+func (d *wsDeadline) markDueReminders(now time.Time) []time.Duration {
+	due := d.dueReminders(now)
+	for _, offset := range due {
+		d.sent[offset] = true
+	}
+	return due
+}
+
+// restoreDeadlines starts the timers of the open sign-up deadlines.
+// Deadlines which passed while the bot was offline close now and only the latest missed reminder is sent.
+func restoreDeadlines(s *discordgo.Session, db *sql.DB, guildID string) {
+	deadlines, err := getOpenDeadlinesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get deadlines:", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, d := range deadlines {
+		due := d.markDueReminders(now)
+		if len(due) > 0 {
+			err = setRemindersSentInDatabase(db, d.instance, due)
+			if err != nil {
+				fmt.Println("Failed to set deadline reminders sent:", err.Error())
+			}
+
+			latest := due[len(due)-1]
+			if latest == 0 {
+				closeSignUp(d, s, db, guildID)
+				continue
+			}
+			sendDeadlineReminder(d, s)
+		}
+
+		startDeadlineTimers(d, s, db, guildID)
+	}
+}
+
+// WSDeadlineCommand for the sign-up deadline of a White Star.
+func WSDeadlineCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "deadline",
+		Permission:      commands.Members,
+		HelpDescription: "Show the WS sign-up deadline",
+		Handler:         HandleDeadline,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "set",
+				Permission:      commands.Officers,
+				HelpDescription: "Set the WS sign-up deadline",
+				Handler:         HandleSetDeadline,
+				Help: commands.Help{
+					Summary: "Set the WS sign-up deadline",
+					DetailedDescription: "Set when members can no longer opt in or out themselves, officers can still use `!setoptin`. " +
+						"The time is a duration from now or a time in your time zone (see `tz`). " +
+						"Reminders are posted to the instance channel before it, by default 24h and 1h before, change them with `notify:`. " +
+						"The participants are posted when it closes. The deadline is cleared when the White Star ends.",
+					Syntax:  "ws deadline set [instance] <time> [notify:<durations>]",
+					Example: "ws deadline set A 2018-09-14 20:00 notify:48h,2h",
+				},
+			},
+			{
+				CallPhrase:      "clear",
+				Permission:      commands.Officers,
+				HelpDescription: "Clear the WS sign-up deadline",
+				Handler:         HandleClearDeadline,
+				Help: commands.Help{
+					Summary:             "Clear the WS sign-up deadline",
+					DetailedDescription: "Remove the deadline, reopening the sign-up if it has closed.",
+					Syntax:              "ws deadline clear [instance]",
+					Example:             "ws deadline clear A",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "Show the WS sign-up deadline",
+			DetailedDescription: "Show when the sign-up of the White Star closes.",
+			Syntax:              "ws deadline [instance]",
+			Example:             "ws deadline A",
+		},
+	}
+}
+
+// HandleDeadline handles showing the deadline.
+func HandleDeadline(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	d, err := getDeadlineFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get deadline:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Color:       infoColor,
+		Description: fmt.Sprintf("There's no sign-up deadline for %v.", instance),
+	}
+	if !d.time.IsZero() {
+		response.Description = formatDeadline(d, userLocation(db, m.Author.ID))
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func formatDeadline(d wsDeadline, loc *time.Location) string {
+	description := fmt.Sprintf("Sign-up deadline for %v: %v", d.instance, formatRelativeTime(d.time, time.Now(), loc))
+	if d.closed {
+		return description + "\nThe sign-up has closed."
+	}
+
+	var reminders []time.Duration
+	for _, offset := range d.reminders {
+		if offset != 0 {
+			reminders = append(reminders, offset)
+		}
+	}
+	if len(reminders) > 0 {
+		description += fmt.Sprintf("\nReminders: %v", formatNoticeOffsets(reminders))
+	}
+	return description
+}
+
+// HandleSetDeadline handles setting the deadline.
+func HandleSetDeadline(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	loc := userLocation(db, m.Author.ID)
+	now := time.Now()
+
+	// The time follows the instance, which is the words before the first one parsing as a time
+	var (
+		deadline time.Time
+		start    int
+		used     int
+		err      error
+	)
+	for start = 0; start < len(args); start++ {
+		deadline, used, err = parseTime(args[start:], now, loc)
+		if err == nil {
+			break
+		}
+	}
+	if start == len(args) || !deadline.After(now) {
+		sendFailMessage("Incorrect syntax for time, it has to be a duration or a future time, check `!help ws deadline set`.", s, m)
+		return
+	}
+
+	reminders := defaultDeadlineReminders
+	for _, option := range args[start+used:] {
+		if !strings.HasPrefix(option, noticeOptionPrefix) {
+			sendFailMessage(fmt.Sprintf("Unknown option %q, check `!help ws deadline set`.", option), s, m)
+			return
+		}
+		reminders, err = parseNoticeOffsets(strings.Split(strings.TrimPrefix(option, noticeOptionPrefix), ","))
+		if err != nil {
+			sendFailMessage(fmt.Sprintf("%v, check `!help ws deadline set`.", err), s, m)
+			return
+		}
+	}
+
+	instance, ok := instanceFromMessage(strings.Join(args[:start], " "), s, m, db)
+	if !ok {
+		return
+	}
+
+	channelID := m.ChannelID
+	i, err := getInstanceFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get instance:", err.Error())
+	} else if len(i.channelIDs) > 0 {
+		channelID = i.channelIDs[0]
+	}
+
+	d := wsDeadline{
+		instance:  instance,
+		channelID: channelID,
+		time:      deadline.Truncate(time.Second),
+		reminders: reminders,
+		sent:      make(map[time.Duration]bool),
+	}
+	err = setDeadlineInDatabase(db, d)
+	if err != nil {
+		fmt.Println("Failed to set deadline:", err.Error())
+		return
+	}
+	// Reminders earlier than the time left are skipped
+	if passed := d.markDueReminders(now); len(passed) > 0 {
+		err = setRemindersSentInDatabase(db, d.instance, passed)
+		if err != nil {
+			fmt.Println("Failed to set deadline reminders sent:", err.Error())
+		}
+	}
+	startDeadlineTimers(d, s, db, guildID)
+	updateSignUpMessages(instance, s, db)
+
+	response := discordgo.MessageEmbed{
+		Title:       "Deadline set!",
+		Color:       successColor,
+		Description: formatDeadline(d, loc),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleClearDeadline handles clearing the deadline.
+func HandleClearDeadline(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	err := deleteDeadlineFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to delete deadline:", err.Error())
+		return
+	}
+	updateSignUpMessages(instance, s, db)
+
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: fmt.Sprintf("Cleared the sign-up deadline for %v.", instance),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// startDeadlineTimers for the reminders which have not been sent yet.
+func startDeadlineTimers(d wsDeadline, s *discordgo.Session, db *sql.DB, guildID string) {
+	for _, offset := range d.reminders {
+		if d.sent[offset] {
+			continue
+		}
+		go waitForDeadlineTimer(d, offset, time.After(time.Until(d.time.Add(-offset))), s, db, guildID)
+	}
+}
+
+// waitForDeadlineTimer sends the reminder, or closes the sign-up, when the timer expires.
+// Nothing is done if the deadline has been changed or cleared in the meantime.
+func waitForDeadlineTimer(d wsDeadline, offset time.Duration, c <-chan time.Time, s *discordgo.Session, db *sql.DB, guildID string) {
+	<-c
+
+	current, err := getDeadlineFromDatabase(db, d.instance)
+	if err != nil {
+		fmt.Println("Failed to get deadline:", err.Error())
+		return
+	}
+	if !current.time.Equal(d.time) || current.closed || current.sent[offset] {
+		return
+	}
+
+	err = setRemindersSentInDatabase(db, d.instance, []time.Duration{offset})
+	if err != nil {
+		fmt.Println("Failed to set deadline reminder sent:", err.Error())
+	}
+	if offset == 0 {
+		closeSignUp(current, s, db, guildID)
+		return
+	}
+	sendDeadlineReminder(current, s)
+}
+
+func sendDeadlineReminder(d wsDeadline, s *discordgo.Session) {
+	msg := discordgo.MessageEmbed{
+		Title: fmt.Sprintf("Sign-up for %v closes in %v", d.instance, formatDuration(time.Until(d.time))),
+		Color: infoColor,
+		Description: fmt.Sprintf("Opt in with `!optin %v [preferred role]` or opt out with `!optout %v` before <t:%d:f>.",
+			d.instance, d.instance, d.time.Unix()),
+	}
+	_, err := s.ChannelMessageSendEmbed(d.channelID, &msg)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// closeSignUp closes the sign-up and posts the participants, or the roster if one has been built.
+func closeSignUp(d wsDeadline, s *discordgo.Session, db *sql.DB, guildID string) {
+	err := setDeadlineClosedInDatabase(db, d.instance)
+	if err != nil {
+		fmt.Println("Failed to close deadline:", err.Error())
+		return
+	}
+	updateSignUpMessages(d.instance, s, db)
+
+	msg := discordgo.MessageEmbed{
+		Title: fmt.Sprintf("Sign-up for %v closed", d.instance),
+		Color: successColor,
+	}
+	r, err := getRosterFromDatabase(db, d.instance)
+	if err != nil {
+		fmt.Println("Failed to get roster:", err.Error())
+	}
+	if len(r.picks) > 0 {
+		msg.Description = fmt.Sprintf("**Roster** (%d/%d):\n%v", len(r.picks), r.size, formatRoster(r))
+	} else {
+		msg.Description, err = optStatus(d.instance, s, db, guildID)
+		if err != nil {
+			fmt.Println("Failed to get participation status:", err.Error())
+			msg.Description = "[Failed to get participation status]"
+		}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(d.channelID, &msg)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+const deadlineColumns = "instance, channel_id, time, reminder_offsets, sent_offsets, closed"
+
+func scanDeadline(row interface{ Scan(...interface{}) error }) (wsDeadline, error) {
+	var (
+		d        wsDeadline
+		reminder []int64
+		sent     []int64
+	)
+	err := row.Scan(&d.instance, &d.channelID, &d.time, pq.Array(&reminder), pq.Array(&sent), &d.closed)
+	if err != nil {
+		return d, err
+	}
+
+	d.reminders = make([]time.Duration, len(reminder))
+	for i, sec := range reminder {
+		d.reminders[i] = time.Duration(sec) * time.Second
+	}
+	d.sent = make(map[time.Duration]bool)
+	for _, sec := range sent {
+		d.sent[time.Duration(sec)*time.Second] = true
+	}
+	return d, nil
+}
+
+// getDeadlineFromDatabase returns the deadline of the instance, with a zero time if it has none.
+func getDeadlineFromDatabase(db *sql.DB, instance instance) (wsDeadline, error) {
+	row := db.QueryRow("SELECT "+deadlineColumns+" FROM ws_deadlines WHERE instance = $1", instance)
+	d, err := scanDeadline(row)
+	if err == sql.ErrNoRows {
+		return wsDeadline{instance: instance, sent: make(map[time.Duration]bool)}, nil
+	}
+	return d, errors.Wrap(err, "failed to do query")
+}
+
+func getOpenDeadlinesFromDatabase(db *sql.DB) ([]wsDeadline, error) {
+	rows, err := db.Query("SELECT " + deadlineColumns + " FROM ws_deadlines WHERE NOT closed")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var deadlines []wsDeadline
+	for rows.Next() {
+		d, err := scanDeadline(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		deadlines = append(deadlines, d)
+	}
+
+	return deadlines, nil
+}
+
+// setDeadlineInDatabase replaces the deadline of the instance, reopening the sign-up if it had closed.
+func setDeadlineInDatabase(db *sql.DB, d wsDeadline) error {
+	seconds := make([]int64, len(d.reminders))
+	for i, offset := range d.reminders {
+		seconds[i] = int64(offset / time.Second)
+	}
+
+	statement := `INSERT INTO ws_deadlines (instance, channel_id, time, reminder_offsets, sent_offsets, closed) VALUES ($1, $2, $3, $4, '{}', false)
+	ON CONFLICT (instance) DO UPDATE SET channel_id = $2, time = $3, reminder_offsets = $4, sent_offsets = '{}', closed = false`
+	_, err := db.Exec(statement, d.instance, d.channelID, d.time.UTC().Format(dbTimeFormat), pq.Array(seconds))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func setRemindersSentInDatabase(db *sql.DB, instance instance, offsets []time.Duration) error {
+	seconds := make([]int64, len(offsets))
+	for i, offset := range offsets {
+		seconds[i] = int64(offset / time.Second)
+	}
+
+	statement := "UPDATE ws_deadlines SET sent_offsets = sent_offsets || $2::bigint[] WHERE instance = $1"
+	_, err := db.Exec(statement, instance, pq.Array(seconds))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func setDeadlineClosedInDatabase(db *sql.DB, instance instance) error {
+	_, err := db.Exec("UPDATE ws_deadlines SET closed = true WHERE instance = $1", instance)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func deleteDeadlineFromDatabase(db *sql.DB, instance instance) error {
+	_, err := db.Exec("DELETE FROM ws_deadlines WHERE instance = $1", instance)
+	return errors.Wrap(err, "failed to execute query")
+}
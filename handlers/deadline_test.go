@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_wsDeadline_markDueReminders(t *testing.T) {
+	now := time.Date(2018, 9, 14, 19, 30, 0, 0, time.UTC)
+	d := wsDeadline{
+		time:      now.Add(30 * time.Minute),
+		reminders: defaultDeadlineReminders,
+		sent:      make(map[time.Duration]bool),
+	}
+
+	due := d.markDueReminders(now)
+	if expected := []time.Duration{24 * time.Hour, time.Hour}; !reflect.DeepEqual(due, expected) {
+		t.Errorf("Due reminders were %v, expected %v", due, expected)
+	}
+	if expected := map[time.Duration]bool{24 * time.Hour: true, time.Hour: true}; !reflect.DeepEqual(d.sent, expected) {
+		t.Errorf("Sent reminders were %v, expected %v", d.sent, expected)
+	}
+	if due := d.markDueReminders(now); len(due) != 0 {
+		t.Errorf("Reminders %v were due again", due)
+	}
+}
+
+func Test_dueReminders(t *testing.T) {
+	deadline := time.Date(2018, 9, 14, 20, 0, 0, 0, time.UTC)
+	d := wsDeadline{
+		time:      deadline,
+		reminders: []time.Duration{24 * time.Hour, time.Hour, 0},
+		sent:      map[time.Duration]bool{24 * time.Hour: true},
+	}
+
+	testData := []struct {
+		now      time.Time
+		expected []time.Duration
+	}{
+		{now: deadline.Add(-48 * time.Hour), expected: nil},
+		{now: deadline.Add(-2 * time.Hour), expected: nil},
+		{now: deadline.Add(-time.Hour), expected: []time.Duration{time.Hour}},
+		{now: deadline.Add(time.Minute), expected: []time.Duration{time.Hour, 0}},
+	}
+
+	for _, data := range testData {
+		actual := d.dueReminders(data.now)
+		if !reflect.DeepEqual(actual, data.expected) {
+			t.Errorf("due reminders at %v were %v, expected %v", data.now, actual, data.expected)
+		}
+	}
+}
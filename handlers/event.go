@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"github.com/MattiasBerlin/outbot/commands"
 	"github.com/bwmarrin/discordgo"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,12 +17,40 @@ const (
 	botEventChannelID = "466576270285602823"
 
 	eventExpiredColor = 0x4286f4
+
+	dbTimeFormat = "2006-01-02 15:04:05"
+
+	// noticeOptionPrefix marks the optional argument overriding the notice offsets of an event.
+	noticeOptionPrefix = "notify:"
+	// recurrenceOptionPrefix marks the optional argument making an event repeat.
+	recurrenceOptionPrefix = "every:"
+	minRecurrenceInterval  = time.Minute
+
+	eventHistoryPageSize = 10
+	historyFromPrefix    = "from:"
+	historyToPrefix      = "to:"
+	historyDateFormat    = "2006-01-02"
 )
 
+// defaultNoticeOffsets are used when a guild has not configured its own.
+var defaultNoticeOffsets = []time.Duration{0}
+
 type event struct {
+	id          int
+	authorID    string
 	description string
 	time        time.Time
 	expired     bool
+	notices     []notice
+	// interval between occurrences of a recurring event, 0 if it does not repeat.
+	interval time.Duration
+}
+
+// notice is sent offset before the event occurs.
+// An offset of 0 is the notice sent when the event expires.
+type notice struct {
+	offset time.Duration
+	sent   bool
 }
 
 // EventCommand for reminders.
@@ -30,13 +61,19 @@ func EventCommand() commands.Command {
 		HelpDescription: "Set reminders, useful for WS",
 		SubCommands: []commands.Command{
 			EventAddCommand(),
+			EventRemoveCommand(),
+			EventNoticesCommand(),
+			EventCalendarCommand(),
+			EventCatchUpCommand(),
 		},
 		Handler: HandleEvent,
 		Init:    InitEvent,
 		Help: commands.Help{
 			Summary: "Set reminders, useful for WS",
 			DetailedDescription: "Set reminders for events that will occur after a specific duration.\n" +
-				"Available subcommands are: `add`, `upcoming` and `history` (*I'll add functionality to get help on subcommands too soon*)",
+				"Available subcommands are: `add`, `remove`, `upcoming`, `history`, `notices`, `catchup` and `ics` (*I'll add functionality to get help on subcommands too soon*)\n\n" +
+				"`history [page] [from:<date>] [to:<date>] [@author] [keywords]` lists past events, newest first. " +
+				"Dates are written as 2018-11-24, use the arrow reactions to browse the pages.",
 		},
 	}
 }
@@ -49,54 +86,194 @@ func EventAddCommand() commands.Command {
 		HelpDescription: "Add a reminder",
 		Handler:         HandleAddEvent,
 		Help: commands.Help{
-			Summary:             "Add a reminder",
-			DetailedDescription: "Add a reminder.",
-			Syntax:              "!event add <duration> <message>",
-			Example:             "!event add 1h5m Write a message here",
+			Summary: "Add a reminder",
+			DetailedDescription: "Add a reminder, either after a duration or at a time (`20:00` or `2018-11-24 20:00`) in your time zone, see `!help tz`.\n" +
+				"Advance notices are sent before the event according to the guild's defaults (see `!event notices`), " +
+				"override them with `notify:` followed by comma separated durations.\n" +
+				"Make the event repeat with `every:` followed by `daily`, `weekly` or an interval like `3d` or `12h`.",
+			Syntax:  "!event add <duration|time> [notify:<offsets>] [every:<interval>] <message>",
+			Example: "!event add 2h notify:1h,15m,0 every:weekly WS jump",
+		},
+	}
+}
+
+// EventRemoveCommand for removing upcoming events, including recurring ones.
+func EventRemoveCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "remove",
+		Permission:      commands.Members,
+		HelpDescription: "Remove an upcoming event",
+		Handler:         HandleRemoveEvent,
+		Help: commands.Help{
+			Summary: "Remove an upcoming event",
+			DetailedDescription: "Remove an upcoming event by its number, shown in `!event upcoming`. " +
+				"Recurring events stop repeating when removed. Only the author of the event or an officer can remove it.",
+			Syntax:  "!event remove <number>",
+			Example: "!event remove 12",
+		},
+	}
+}
+
+// EventNoticesCommand for configuring the default advance notices of events.
+func EventNoticesCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "notices",
+		Permission:      commands.Officers,
+		HelpDescription: "Set the default advance notices for events",
+		Handler:         HandleEventNotices,
+		Help: commands.Help{
+			Summary: "Set the default advance notices for events",
+			DetailedDescription: "Set how long before an event notices are sent by default, " +
+				"a notice is always sent when the event expires. Leave out the offsets to show the current defaults.",
+			Syntax:  "!event notices [offsets]",
+			Example: "!event notices 1h 15m",
+		},
+	}
+}
+
+// EventCatchUpCommand for configuring what happens to events missed while the bot was offline.
+func EventCatchUpCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "catchup",
+		Permission:      commands.Officers,
+		HelpDescription: "Set what happens to events missed while the bot was offline",
+		Handler:         HandleEventCatchUp,
+		Help: commands.Help{
+			Summary: "Set what happens to events missed while the bot was offline",
+			DetailedDescription: "Events missed by less than the grace go off as usual with a note about the delay, " +
+				"older ones are listed together in one message. With `skip` recurring events missed by more than the grace " +
+				"silently skip to their next occurrence. Leave out the arguments to show the current policy.",
+			Syntax:  "!event catchup [grace] [skip]",
+			Example: "!event catchup 30m skip",
 		},
 	}
 }
 
+// timeDBFormat formats the time in UTC, which is also how it's read back from the database.
 func (e event) timeDBFormat() string {
-	return e.time.Format("2006-01-02 15:04:05")
+	return e.time.UTC().Format(dbTimeFormat)
 }
 
-func InitEvent(s *discordgo.Session, db *sql.DB) {
+func InitEvent(s *discordgo.Session, db *sql.DB, guildID string) {
 	events, err := getEventsFromDatabase(db, 0, false)
 	if err != nil {
 		fmt.Println("Failed to get events from database on init:", err.Error())
 		return
 	}
 
+	policy, err := getCatchUpPolicyFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get catch-up policy, using the default:", err.Error())
+	}
+
 	// Check if any events should have went off while the bot was offline, otherwise set a timer
-	var missedEvents string
-	for _, e := range events {
-		if e.time.Before(time.Now()) {
-			// Event should have went off while bot was offline
-			err = setEventExpiredInDatabase(db, e, true)
-			if err != nil {
-				fmt.Println("Failed to set event expired in db:", err.Error())
-			}
-			missedEvents += fmt.Sprintf("* %v ago: %q\n", e.time.String()[1:], e.description)
-		} else {
-			startEventTimer(e, s, db)
-			fmt.Println(fmt.Sprintf("Started timer for %q", e.description))
-		}
+	now := eventClock.Now()
+	plan := planCatchUp(events, now, policy)
+	for _, e := range plan.delayed {
+		sendNotice(e, notice{}, now.Sub(e.time), s)
+		expireEvent(e, now, s, db)
+	}
+	for _, e := range plan.missed {
+		expireEvent(e, now, s, db)
+	}
+	for _, e := range plan.skipped {
+		fmt.Println(fmt.Sprintf("Skipped missed occurrence of %q", e.description))
+		expireEvent(e, now, s, db)
 	}
-	if missedEvents != "" {
-		_, err := s.ChannelMessageSend(botEventChannelID, fmt.Sprintf("Events expired while bot was offline:\n%v", missedEvents))
+	for _, e := range plan.upcoming {
+		sendOverdueNotice(e, s, db)
+		startEventTimer(e, s, db)
+		fmt.Println(fmt.Sprintf("Started timer for %q", e.description))
+	}
+
+	if len(plan.missed) > 0 {
+		msg := discordgo.MessageEmbed{
+			Title:       "Events expired while the bot was offline",
+			Color:       eventExpiredColor,
+			Description: formatMissedEvents(plan.missed, now),
+		}
+		_, err := s.ChannelMessageSendEmbed(botEventChannelID, &msg)
 		if err != nil {
 			fmt.Println("Failed to send message:", err)
 		}
 	}
 }
 
+// catchUpPolicy decides what happens to events which should have went off while the bot was offline.
+type catchUpPolicy struct {
+	// grace is how late an event may be and still go off as usual, with a note about the delay.
+	grace time.Duration
+	// skipRecurring makes recurring events missed by more than the grace silently skip to their next occurrence.
+	skipRecurring bool
+}
+
+// catchUpPlan groups events by what should be done with them.
+type catchUpPlan struct {
+	// delayed events should go off now.
+	delayed []event
+	// missed events should be listed in a digest.
+	missed []event
+	// skipped events should be rescheduled without telling anyone.
+	skipped []event
+	// upcoming events should have their timers started.
+	upcoming []event
+}
+
+func planCatchUp(events []event, now time.Time, policy catchUpPolicy) catchUpPlan {
+	var plan catchUpPlan
+	for _, e := range events {
+		late := now.Sub(e.time)
+		switch {
+		case late <= 0:
+			plan.upcoming = append(plan.upcoming, e)
+		case late <= policy.grace:
+			plan.delayed = append(plan.delayed, e)
+		case e.interval != 0 && policy.skipRecurring:
+			plan.skipped = append(plan.skipped, e)
+		default:
+			plan.missed = append(plan.missed, e)
+		}
+	}
+	return plan
+}
+
+// formatMissedEvents lists the events with how long ago they should have went off, oldest first.
+func formatMissedEvents(events []event, now time.Time) string {
+	var content string
+	for _, e := range events {
+		content += fmt.Sprintf("* %v: %v\n", formatRelativeTime(e.time, now, time.UTC), e.description)
+	}
+	return content
+}
+
+// sendOverdueNotice sends the latest notice which should have been sent while the bot was offline.
+// Earlier overdue notices are only marked as sent, they would show the same countdown.
+func sendOverdueNotice(e event, s *discordgo.Session, db *sql.DB) {
+	var overdue []notice
+	for _, n := range e.notices {
+		if !n.sent && e.time.Add(-n.offset).Before(eventClock.Now()) {
+			overdue = append(overdue, n)
+		}
+	}
+	if len(overdue) == 0 {
+		return
+	}
+
+	err := setNoticesSentInDatabase(db, e, overdue)
+	if err != nil {
+		fmt.Println("Failed to set notices sent in db:", err.Error())
+		return
+	}
+
+	sendNotice(e, overdue[len(overdue)-1], 0, s)
+}
+
 func HandleEvent(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
 	split := strings.Split(msg, " ")
 
-	switch split[1] {
+	switch split[0] {
 	case "add":
-		if len(split) < 2 {
+		if len(split) < 3 {
 			msg := discordgo.MessageEmbed{
 				Title:       "Incorrect syntax",
 				Color:       failColor,
@@ -109,7 +286,7 @@ func HandleEvent(msg string, s *discordgo.Session, m *discordgo.MessageCreate, d
 			return
 		}
 
-		err := addEvent(s, m, split, db)
+		err := addEvent(s, m, split[1:], db, guildID)
 		if err != nil {
 			fmt.Println("Failed to add event:", err.Error())
 			return
@@ -126,10 +303,15 @@ func HandleEvent(msg string, s *discordgo.Session, m *discordgo.MessageCreate, d
 			return
 		}
 
-		// content := "**Upcoming events:**\n"
+		loc := userLocation(db, m.Author.ID)
+		now := time.Now()
 		var content string
 		for _, e := range upcoming {
-			content += fmt.Sprintf("* In %v: %v\n", e.time.Sub(time.Now()).Round(time.Second), e.description)
+			content += fmt.Sprintf("* `#%d` %v: %v", e.id, formatRelativeTime(e.time, now, loc), e.description)
+			if e.interval != 0 {
+				content += fmt.Sprintf(" (every %v)", formatDuration(e.interval))
+			}
+			content += "\n"
 		}
 
 		msg := discordgo.MessageEmbed{
@@ -143,30 +325,29 @@ func HandleEvent(msg string, s *discordgo.Session, m *discordgo.MessageCreate, d
 			return
 		}
 	case "history":
-		pastEvents, err := getEventsFromDatabase(db, 10, true)
+		loc := userLocation(db, m.Author.ID)
+		page, filter, err := parseEventHistoryArgs(split[1:], m.Mentions, loc)
 		if err != nil {
-			fmt.Println("Failed to get past events:", err.Error())
-			_, err = s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to get events: %v", err))
+			msg := discordgo.MessageEmbed{
+				Title:       "Incorrect syntax",
+				Color:       failColor,
+				Description: fmt.Sprintf("%v, check `!help event`", err),
+			}
+			_, err = s.ChannelMessageSendEmbed(m.ChannelID, &msg)
 			if err != nil {
 				fmt.Println("Failed to send message:", err.Error())
-				return
 			}
 			return
 		}
 
-		var content string
-		for _, e := range pastEvents {
-			content += fmt.Sprintf("* %v ago: %v\n", e.time.Sub(time.Now()).Round(time.Second).String()[1:], e.description) // TODO: Pretty this
-		}
-
-		msg := discordgo.MessageEmbed{
-			Title:       "Past events",
-			Color:       infoColor,
-			Description: content,
-		}
-		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &msg)
+		err = sendPagedMessage(s, m.ChannelID, db, page, eventHistoryPage(filter, loc))
 		if err != nil {
-			fmt.Println("Failed to send message:", err.Error())
+			fmt.Println("Failed to send event history:", err.Error())
+			_, err = s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to get events: %v", err))
+			if err != nil {
+				fmt.Println("Failed to send message:", err.Error())
+				return
+			}
 			return
 		}
 	default:
@@ -200,31 +381,173 @@ func HandleAddEvent(msg string, s *discordgo.Session, m *discordgo.MessageCreate
 		return
 	}
 
-	err := addEvent(s, m, split, db)
+	err := addEvent(s, m, split, db, guildID)
 	if err != nil {
 		fmt.Println("Failed to add event:", err.Error())
 		return
 	}
 }
 
-func addEvent(s *discordgo.Session, m *discordgo.MessageCreate, splitMsg []string, db *sql.DB) error {
-	duration, err := time.ParseDuration(splitMsg[0])
+// HandleRemoveEvent handles removing an upcoming event.
+func HandleRemoveEvent(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(msg), "#"))
+	if err != nil {
+		msg := discordgo.MessageEmbed{
+			Title:       "Incorrect syntax",
+			Color:       failColor,
+			Description: "Give the number of the event to remove, check `!help event remove`",
+		}
+		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &msg)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return
+	}
+
+	e, err := getEventFromDatabase(db, id)
+	if err == sql.ErrNoRows || (err == nil && e.expired) {
+		sendFailMessage(fmt.Sprintf("There's no upcoming event #%d.", id), s, m)
+		return
+	} else if err != nil {
+		fmt.Println("Failed to get event:", err.Error())
+		return
+	}
+
+	if e.authorID != m.Author.ID {
+		member, err := s.GuildMember(guildID, m.Author.ID)
+		if err != nil {
+			fmt.Println("Failed to get guild member:", err.Error())
+			return
+		}
+		if !commands.Officers.Authorized(*member) {
+			sendFailMessage("Only the author of the event or an officer can remove it.", s, m)
+			return
+		}
+	}
+
+	// Timers of the event stop when they find it removed
+	err = deleteEventFromDatabase(db, e.id)
+	if err != nil {
+		fmt.Println("Failed to remove event:", err.Error())
+		sendFailMessage("Failed to remove the event", s, m)
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       "Event removed!",
+		Color:       successColor,
+		Description: e.description,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+	}
+}
+
+// HandleEventNotices handles setting and showing the default notice offsets.
+func HandleEventNotices(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	var response discordgo.MessageEmbed
+
+	if strings.TrimSpace(msg) == "" {
+		offsets, err := getDefaultNoticeOffsetsFromDatabase(db, guildID)
+		if err != nil {
+			fmt.Println("Failed to get default notice offsets:", err.Error())
+			return
+		}
+
+		response = discordgo.MessageEmbed{
+			Title:       "Default notices",
+			Color:       infoColor,
+			Description: formatNoticeOffsets(offsets),
+		}
+	} else {
+		offsets, err := parseNoticeOffsets(strings.Fields(strings.Replace(msg, ",", " ", -1)))
+		if err != nil {
+			response = discordgo.MessageEmbed{
+				Title:       "Incorrect syntax",
+				Color:       failColor,
+				Description: fmt.Sprintf("%v, check `!help event`", err),
+			}
+		} else if err = setDefaultNoticeOffsetsInDatabase(db, guildID, offsets); err != nil {
+			fmt.Println("Failed to set default notice offsets:", err.Error())
+			response = discordgo.MessageEmbed{
+				Color:       failColor,
+				Description: "Failed to set default notices",
+			}
+		} else {
+			response = discordgo.MessageEmbed{
+				Title:       "Default notices set!",
+				Color:       successColor,
+				Description: formatNoticeOffsets(offsets),
+			}
+		}
+	}
+
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
 	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func addEvent(s *discordgo.Session, m *discordgo.MessageCreate, splitMsg []string, db *sql.DB, guildID string) error {
+	loc := userLocation(db, m.Author.ID)
+	now := time.Now()
+	eventTime, used, err := parseTime(splitMsg, now, loc)
+	if err != nil || !eventTime.After(now) {
 		msg := discordgo.MessageEmbed{
 			Title:       "Incorrect syntax",
 			Color:       failColor,
-			Description: "Incorrect syntax for duration, check `!help event`",
+			Description: "Incorrect syntax for time, it has to be a duration or a future time, check `!help event`",
 		}
 		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &msg)
 		return errors.Wrap(err, "failed to send message")
 	}
 
+	var (
+		offsets     []time.Duration
+		interval    time.Duration
+		description = splitMsg[used:]
+	)
+	for len(description) > 0 {
+		option := description[0]
+		if strings.HasPrefix(option, noticeOptionPrefix) {
+			offsets, err = parseNoticeOffsets(strings.Split(strings.TrimPrefix(option, noticeOptionPrefix), ","))
+		} else if strings.HasPrefix(option, recurrenceOptionPrefix) {
+			interval, err = parseInterval(strings.TrimPrefix(option, recurrenceOptionPrefix))
+		} else {
+			break
+		}
+		if err != nil {
+			msg := discordgo.MessageEmbed{
+				Title:       "Incorrect syntax",
+				Color:       failColor,
+				Description: fmt.Sprintf("%v, check `!help event`", err),
+			}
+			_, err = s.ChannelMessageSendEmbed(m.ChannelID, &msg)
+			return errors.Wrap(err, "failed to send message")
+		}
+		description = description[1:]
+	}
+	if offsets == nil {
+		offsets, err = getDefaultNoticeOffsetsFromDatabase(db, guildID)
+		if err != nil {
+			fmt.Println("Failed to get default notice offsets, using built-in defaults:", err.Error())
+			offsets = defaultNoticeOffsets
+		}
+	}
+
 	event := event{
-		description: strings.Join(splitMsg[1:], " "),
-		time:        time.Now().Add(duration),
+		authorID:    m.Author.ID,
+		description: strings.Join(description, " "),
+		time:        eventTime,
+		interval:    interval,
+	}
+	for _, offset := range offsets {
+		event.notices = append(event.notices, notice{offset: offset})
 	}
 
-	err = addEventToDatabase(db, event)
+	event.id, err = addEventToDatabase(db, event)
 	if err != nil {
 		fmt.Println("Failed to add event:", err.Error())
 		_, err = s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to add event: %v", err))
@@ -236,7 +559,10 @@ func addEvent(s *discordgo.Session, m *discordgo.MessageCreate, splitMsg []strin
 	msg := discordgo.MessageEmbed{
 		Title:       "Event added!",
 		Color:       successColor,
-		Description: fmt.Sprintf("In %v: %q", duration.String(), event.description),
+		Description: fmt.Sprintf("%v: %q\nNotices: %v", formatRelativeTime(event.time, now, loc), event.description, formatNoticeOffsets(offsets)),
+	}
+	if event.interval != 0 {
+		msg.Description += fmt.Sprintf("\nRepeats every %v", formatDuration(event.interval))
 	}
 	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &msg)
 	if err != nil {
@@ -246,42 +572,398 @@ func addEvent(s *discordgo.Session, m *discordgo.MessageCreate, splitMsg []strin
 	return nil
 }
 
+// eventFilter for searching the event history.
+// Empty fields are not filtered on.
+type eventFilter struct {
+	keyword  string
+	authorID string
+	from     time.Time
+	to       time.Time
+}
+
+// parseEventHistoryArgs returns the requested page and filter of the history command.
+// Dates are read in loc and the to date is inclusive.
+func parseEventHistoryArgs(args []string, mentions []*discordgo.User, loc *time.Location) (int, eventFilter, error) {
+	var (
+		filter   eventFilter
+		keywords []string
+	)
+	page := 1
+
+	for i, arg := range args {
+		switch {
+		case arg == "":
+		case i == 0 && isNumber(arg):
+			page, _ = strconv.Atoi(arg)
+			if page < 1 {
+				return 0, filter, errors.Errorf("incorrect page %q", arg)
+			}
+		case strings.HasPrefix(arg, historyFromPrefix):
+			from, err := time.ParseInLocation(historyDateFormat, strings.TrimPrefix(arg, historyFromPrefix), loc)
+			if err != nil {
+				return 0, filter, errors.Errorf("incorrect date %q", arg)
+			}
+			filter.from = from
+		case strings.HasPrefix(arg, historyToPrefix):
+			to, err := time.ParseInLocation(historyDateFormat, strings.TrimPrefix(arg, historyToPrefix), loc)
+			if err != nil {
+				return 0, filter, errors.Errorf("incorrect date %q", arg)
+			}
+			filter.to = to.AddDate(0, 0, 1)
+		case isMention(arg):
+			for _, user := range mentions {
+				if user != nil && strings.Trim(arg, "<@!>") == user.ID {
+					filter.authorID = user.ID
+				}
+			}
+		default:
+			keywords = append(keywords, arg)
+		}
+	}
+	filter.keyword = strings.Join(keywords, " ")
+
+	return page, filter, nil
+}
+
+func isNumber(text string) bool {
+	_, err := strconv.Atoi(text)
+	return err == nil
+}
+
+func isMention(text string) bool {
+	return strings.HasPrefix(text, "<@") && strings.HasSuffix(text, ">")
+}
+
+// eventHistoryPage renders pages of past events matching the filter with times in loc.
+func eventHistoryPage(filter eventFilter, loc *time.Location) renderPage {
+	return func(db *sql.DB, page int) (*discordgo.MessageEmbed, int, error) {
+		pastEvents, total, err := getEventHistoryFromDatabase(db, filter, eventHistoryPageSize, (page-1)*eventHistoryPageSize)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		now := time.Now()
+		var content string
+		for _, e := range pastEvents {
+			content += fmt.Sprintf("* %v: %v", formatRelativeTime(e.time, now, loc), e.description)
+			if e.authorID != "" {
+				content += fmt.Sprintf(" (by <@%v>)", e.authorID)
+			}
+			content += "\n"
+		}
+		if content == "" {
+			content = "No events found"
+		}
+
+		pages := (total + eventHistoryPageSize - 1) / eventHistoryPageSize
+		msg := &discordgo.MessageEmbed{
+			Title:       "Past events",
+			Color:       infoColor,
+			Description: content,
+			Footer: &discordgo.MessageEmbedFooter{
+				Text: fmt.Sprintf("Page %d of %d (%d events)", page, pages, total),
+			},
+		}
+		return msg, pages, nil
+	}
+}
+
+// parseInterval parses the interval of a recurring event.
+// Besides the usual durations days and weeks are accepted, e.g. "3d" or "weekly".
+func parseInterval(text string) (time.Duration, error) {
+	var interval time.Duration
+	switch {
+	case text == "daily":
+		interval = 24 * time.Hour
+	case text == "weekly":
+		interval = 7 * 24 * time.Hour
+	case strings.HasSuffix(text, "d") || strings.HasSuffix(text, "w"):
+		amount, err := strconv.Atoi(text[:len(text)-1])
+		if err != nil {
+			return 0, errors.Errorf("incorrect interval %q", text)
+		}
+		interval = time.Duration(amount) * 24 * time.Hour
+		if strings.HasSuffix(text, "w") {
+			interval *= 7
+		}
+	default:
+		var err error
+		interval, err = time.ParseDuration(text)
+		if err != nil {
+			return 0, errors.Errorf("incorrect interval %q", text)
+		}
+	}
+
+	if interval < minRecurrenceInterval {
+		return 0, errors.Errorf("interval %q is shorter than %v", text, formatDuration(minRecurrenceInterval))
+	}
+	return interval, nil
+}
+
+// nextOccurrence of a recurring event after now.
+func (e event) nextOccurrence(now time.Time) time.Time {
+	if !e.time.After(now) {
+		missed := now.Sub(e.time)/e.interval + 1
+		return e.time.Add(missed * e.interval)
+	}
+	return e.time
+}
+
+// reschedule a recurring event to its next occurrence after now.
+// The passed occurrence is kept in the history.
+func rescheduleEvent(e event, now time.Time, s *discordgo.Session, db *sql.DB) {
+	err := addOccurrenceToDatabase(db, e)
+	if err != nil {
+		fmt.Println("Failed to add occurrence of recurring event to history:", err.Error())
+	}
+
+	e.time = e.nextOccurrence(now)
+	for i := range e.notices {
+		e.notices[i].sent = false
+	}
+
+	err = rescheduleEventInDatabase(db, e)
+	if err != nil {
+		fmt.Println("Failed to reschedule event in db:", err.Error())
+		return
+	}
+
+	startEventTimer(e, s, db)
+}
+
+// HandleEventCatchUp handles setting and showing the catch-up policy.
+func HandleEventCatchUp(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	var response discordgo.MessageEmbed
+
+	args := strings.Fields(msg)
+	if len(args) == 0 {
+		policy, err := getCatchUpPolicyFromDatabase(db, guildID)
+		if err != nil {
+			fmt.Println("Failed to get catch-up policy:", err.Error())
+			return
+		}
+
+		response = discordgo.MessageEmbed{
+			Title:       "Catch-up policy",
+			Color:       infoColor,
+			Description: policy.String(),
+		}
+	} else if policy, err := parseCatchUpPolicy(args); err != nil {
+		response = discordgo.MessageEmbed{
+			Title:       "Incorrect syntax",
+			Color:       failColor,
+			Description: fmt.Sprintf("%v, check `!help event`", err),
+		}
+	} else if err = setCatchUpPolicyInDatabase(db, guildID, policy); err != nil {
+		fmt.Println("Failed to set catch-up policy:", err.Error())
+		response = discordgo.MessageEmbed{
+			Color:       failColor,
+			Description: "Failed to set catch-up policy",
+		}
+	} else {
+		response = discordgo.MessageEmbed{
+			Title:       "Catch-up policy set!",
+			Color:       successColor,
+			Description: policy.String(),
+		}
+	}
+
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func parseCatchUpPolicy(args []string) (catchUpPolicy, error) {
+	var policy catchUpPolicy
+
+	grace, err := time.ParseDuration(args[0])
+	if err != nil || grace < 0 {
+		return policy, errors.Errorf("incorrect grace %q", args[0])
+	}
+	policy.grace = grace
+
+	if len(args) > 1 {
+		if args[1] != "skip" {
+			return policy, errors.Errorf("unknown option %q", args[1])
+		}
+		policy.skipRecurring = true
+	}
+	return policy, nil
+}
+
+func (p catchUpPolicy) String() string {
+	text := fmt.Sprintf("Events missed by up to %v go off late, older ones are listed together.", formatDuration(p.grace))
+	if p.skipRecurring {
+		text += "\nOlder occurrences of recurring events are skipped."
+	}
+	return text
+}
+
+// parseNoticeOffsets parses durations to notice offsets.
+// The offsets are sorted with the earliest notice first and always include the notice at expiry.
+func parseNoticeOffsets(durations []string) ([]time.Duration, error) {
+	seen := map[time.Duration]bool{0: true}
+	offsets := []time.Duration{0}
+	for _, d := range durations {
+		if d == "" {
+			continue
+		}
+
+		offset, err := time.ParseDuration(d)
+		if err != nil {
+			return nil, errors.Errorf("incorrect notice offset %q", d)
+		}
+		if offset < 0 {
+			return nil, errors.Errorf("notice offset %q can't be negative", d)
+		}
+		// Offsets are stored in seconds
+		if offset%time.Second != 0 {
+			return nil, errors.Errorf("notice offset %q must be in whole seconds", d)
+		}
+		if !seen[offset] {
+			seen[offset] = true
+			offsets = append(offsets, offset)
+		}
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets, nil
+}
+
+func formatNoticeOffsets(offsets []time.Duration) string {
+	formatted := make([]string, len(offsets))
+	for i, offset := range offsets {
+		if offset == 0 {
+			formatted[i] = "T0"
+		} else {
+			formatted[i] = "T-" + formatDuration(offset)
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// startEventTimer starts a timer for every notice of the event which has not been sent yet.
+// Notices which should already have been sent are marked as sent instead, they would only repeat a later notice.
 func startEventTimer(event event, s *discordgo.Session, db *sql.DB) {
-	duration := event.time.Sub(time.Now())
-	timer := time.NewTimer(duration)
-	go waitForEventTimerExpire(event, timer.C, s, db)
+	var passed []notice
+	for _, n := range event.notices {
+		if n.sent {
+			continue
+		}
+
+		duration := event.time.Add(-n.offset).Sub(eventClock.Now())
+		if duration < 0 && n.offset != 0 {
+			passed = append(passed, n)
+			continue
+		}
+		timer := time.NewTimer(duration)
+		go waitForEventTimerExpire(event, n, timer.C, s, db)
+	}
+
+	if len(passed) > 0 {
+		err := setNoticesSentInDatabase(db, event, passed)
+		if err != nil {
+			fmt.Println("Failed to set notices sent in db:", err.Error())
+		}
+	}
 }
 
-func waitForEventTimerExpire(event event, c <-chan time.Time, s *discordgo.Session, db *sql.DB) {
+func waitForEventTimerExpire(event event, n notice, c <-chan time.Time, s *discordgo.Session, db *sql.DB) {
 	<-c
-	fmt.Println(event.description, "expired")
 
-	err := setEventExpiredInDatabase(db, event, true)
+	// The event might have been removed or rescheduled since the timer was started
+	current, err := isEventScheduledInDatabase(db, event)
+	if err != nil {
+		fmt.Println("Failed to check if event is still scheduled:", err.Error())
+	} else if !current {
+		return
+	}
+
+	sendNotice(event, n, 0, s)
+
+	if n.offset == 0 {
+		fmt.Println(event.description, "expired")
+		expireEvent(event, eventClock.Now(), s, db)
+		return
+	}
+
+	err = setNoticesSentInDatabase(db, event, []notice{n})
+	if err != nil {
+		fmt.Println("Failed to set notice sent in db:", err.Error())
+	}
+}
+
+// expireEvent marks the event as expired, or reschedules it if it's recurring.
+func expireEvent(e event, now time.Time, s *discordgo.Session, db *sql.DB) {
+	if e.interval != 0 {
+		rescheduleEvent(e, now, s, db)
+		return
+	}
+
+	err := setNoticesSentInDatabase(db, e, e.notices)
+	if err != nil {
+		fmt.Println("Failed to set notices sent in db:", err.Error())
+	}
+	err = setEventExpiredInDatabase(db, e, true)
 	if err != nil {
 		fmt.Println("Failed to set event expired in db:", err.Error())
 	}
+}
 
+// sendNotice sends the notice to the event channel with a countdown to the event.
+// delay is how late the notice is, it's mentioned if it's not 0.
+func sendNotice(event event, n notice, delay time.Duration, s *discordgo.Session) {
 	msg := discordgo.MessageEmbed{
 		Title:       "Event expired",
 		Color:       infoColor,
 		Description: event.description,
 	}
-	_, err = s.ChannelMessageSendEmbed(botEventChannelID, &msg)
+	if n.offset != 0 {
+		msg.Title = fmt.Sprintf("Event in %v", formatDuration(event.time.Sub(eventClock.Now())))
+		msg.Description = fmt.Sprintf("%v\n\nStarts <t:%d:R>", event.description, event.time.Unix())
+	}
+	if delay > 0 {
+		msg.Title += fmt.Sprintf(" (delayed by %v)", formatDuration(delay))
+	}
+
+	_, err := s.ChannelMessageSendEmbed(botEventChannelID, &msg)
 	if err != nil {
 		fmt.Println("Failed to send message:", err.Error())
 		return
 	}
 }
 
-func addEventToDatabase(db *sql.DB, event event) error {
-	_, err := db.Exec("INSERT INTO events (description, time) VALUES ($1, $2)", event.description, event.timeDBFormat())
-	return err
+// addEventToDatabase together with its notices and return the id of the event.
+func addEventToDatabase(db *sql.DB, event event) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var id int
+	statement := "INSERT INTO events (description, time, author_id, recurrence_seconds) VALUES ($1, $2, $3, $4) RETURNING id"
+	err = tx.QueryRow(statement, event.description, event.timeDBFormat(), event.authorID, int64(event.interval/time.Second)).Scan(&id)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to insert event")
+	}
+
+	for _, n := range event.notices {
+		_, err = tx.Exec("INSERT INTO event_notices (event_id, offset_seconds) VALUES ($1, $2)", id, int64(n.offset/time.Second))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to insert notice")
+		}
+	}
+
+	return id, errors.Wrap(tx.Commit(), "failed to commit transaction")
 }
 
 // getEventsFromDatabase.
 // If limit is <=0 then no limit will be used.
 func getEventsFromDatabase(db *sql.DB, limit int, expired bool) ([]event, error) {
-	query := "SELECT description, time, expired FROM events WHERE expired = $1 ORDER BY time ASC"
+	query := "SELECT id, author_id, description, time, expired, recurrence_seconds FROM events WHERE expired = $1 ORDER BY time ASC"
 	args := []interface{}{expired}
 	if limit > 0 {
 		query += " LIMIT $2"
@@ -296,19 +978,238 @@ func getEventsFromDatabase(db *sql.DB, limit int, expired bool) ([]event, error)
 	upcoming := make([]event, 0, limit)
 
 	for rows.Next() {
-		var event event
-		err = rows.Scan(&event.description, &event.time, &event.expired)
+		var (
+			event           event
+			intervalSeconds int64
+		)
+		err = rows.Scan(&event.id, &event.authorID, &event.description, &event.time, &event.expired, &intervalSeconds)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to scan row")
 		}
+		event.interval = time.Duration(intervalSeconds) * time.Second
 
 		upcoming = append(upcoming, event)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate rows")
+	}
+
+	for i := range upcoming {
+		upcoming[i].notices, err = getNoticesFromDatabase(db, upcoming[i].id)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return upcoming, nil
 }
 
+// getEventFromDatabase returns the event without its notices, sql.ErrNoRows is returned if it doesn't exist.
+func getEventFromDatabase(db *sql.DB, id int) (event, error) {
+	var (
+		e               event
+		intervalSeconds int64
+	)
+	query := "SELECT id, author_id, description, time, expired, recurrence_seconds FROM events WHERE id = $1"
+	err := db.QueryRow(query, id).Scan(&e.id, &e.authorID, &e.description, &e.time, &e.expired, &intervalSeconds)
+	if err == sql.ErrNoRows {
+		return e, err
+	} else if err != nil {
+		return e, errors.Wrap(err, "failed to do query")
+	}
+	e.interval = time.Duration(intervalSeconds) * time.Second
+	return e, nil
+}
+
+// getEventHistoryFromDatabase returns expired events matching the filter, newest first,
+// together with the total amount of matching events.
+func getEventHistoryFromDatabase(db *sql.DB, filter eventFilter, limit int, offset int) ([]event, int, error) {
+	where := []string{"expired = true"}
+	args := []interface{}{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.keyword != "" {
+		escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(filter.keyword)
+		addCondition("description ILIKE $%d", "%"+escaped+"%")
+	}
+	if filter.authorID != "" {
+		addCondition("author_id = $%d", filter.authorID)
+	}
+	if !filter.from.IsZero() {
+		addCondition("time >= $%d", filter.from.UTC().Format(dbTimeFormat))
+	}
+	if !filter.to.IsZero() {
+		addCondition("time < $%d", filter.to.UTC().Format(dbTimeFormat))
+	}
+	conditions := strings.Join(where, " AND ")
+
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM events WHERE "+conditions, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to count events")
+	}
+
+	query := fmt.Sprintf("SELECT id, author_id, description, time, expired FROM events WHERE %v ORDER BY time DESC LIMIT $%d OFFSET $%d", conditions, len(args)+1, len(args)+2)
+	rows, err := db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var events []event
+	for rows.Next() {
+		var e event
+		err = rows.Scan(&e.id, &e.authorID, &e.description, &e.time, &e.expired)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to scan row")
+		}
+
+		events = append(events, e)
+	}
+
+	return events, total, nil
+}
+
+// getNoticesFromDatabase for an event, sorted with the earliest notice first.
+func getNoticesFromDatabase(db *sql.DB, eventID int) ([]notice, error) {
+	rows, err := db.Query("SELECT offset_seconds, sent FROM event_notices WHERE event_id = $1 ORDER BY offset_seconds DESC", eventID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var notices []notice
+	for rows.Next() {
+		var (
+			n       notice
+			seconds int64
+		)
+		err = rows.Scan(&seconds, &n.sent)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		n.offset = time.Duration(seconds) * time.Second
+
+		notices = append(notices, n)
+	}
+
+	return notices, nil
+}
+
+// addOccurrenceToDatabase adds a passed occurrence of a recurring event as an expired event.
+func addOccurrenceToDatabase(db *sql.DB, e event) error {
+	statement := "INSERT INTO events (description, time, author_id, expired) VALUES ($1, $2, $3, true)"
+	_, err := db.Exec(statement, e.description, e.timeDBFormat(), e.authorID)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// rescheduleEventInDatabase updates the time of the event and marks its notices as not sent.
+func rescheduleEventInDatabase(db *sql.DB, e event) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE events SET time = $1 WHERE id = $2", e.timeDBFormat(), e.id)
+	if err != nil {
+		return errors.Wrap(err, "failed to update event")
+	}
+	_, err = tx.Exec("UPDATE event_notices SET sent = false WHERE event_id = $1", e.id)
+	if err != nil {
+		return errors.Wrap(err, "failed to update notices")
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// isEventScheduledInDatabase returns whether the event still exists, has not expired and has not been moved.
+func isEventScheduledInDatabase(db *sql.DB, e event) (bool, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM events WHERE id = $1 AND time = $2 AND expired = false"
+	err := db.QueryRow(query, e.id, e.timeDBFormat()).Scan(&count)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to do query")
+	}
+	return count > 0, nil
+}
+
+func deleteEventFromDatabase(db *sql.DB, id int) error {
+	_, err := db.Exec("DELETE FROM events WHERE id = $1", id)
+	return errors.Wrap(err, "failed to execute query")
+}
+
 func setEventExpiredInDatabase(db *sql.DB, e event, expired bool) error {
-	_, err := db.Exec("UPDATE events SET expired = $1 WHERE description = $2 AND time = $3", expired, e.description, e.timeDBFormat())
+	_, err := db.Exec("UPDATE events SET expired = $1 WHERE id = $2", expired, e.id)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func setNoticesSentInDatabase(db *sql.DB, e event, notices []notice) error {
+	for _, n := range notices {
+		_, err := db.Exec("UPDATE event_notices SET sent = true WHERE event_id = $1 AND offset_seconds = $2", e.id, int64(n.offset/time.Second))
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+	}
+	return nil
+}
+
+// getCatchUpPolicyFromDatabase for the guild.
+// The default policy, where every missed event is listed together, is returned if the guild has not configured one.
+func getCatchUpPolicyFromDatabase(db *sql.DB, guildID string) (catchUpPolicy, error) {
+	var (
+		policy       catchUpPolicy
+		graceSeconds int64
+	)
+	err := db.QueryRow("SELECT catch_up_grace_seconds, catch_up_skip_recurring FROM event_settings WHERE guild_id = $1", guildID).Scan(&graceSeconds, &policy.skipRecurring)
+	if err == sql.ErrNoRows {
+		return policy, nil
+	}
+	if err != nil {
+		return policy, errors.Wrap(err, "failed to do query")
+	}
+
+	policy.grace = time.Duration(graceSeconds) * time.Second
+	return policy, nil
+}
+
+func setCatchUpPolicyInDatabase(db *sql.DB, guildID string, policy catchUpPolicy) error {
+	statement := `INSERT INTO event_settings (guild_id, catch_up_grace_seconds, catch_up_skip_recurring) VALUES ($1, $2, $3)
+	ON CONFLICT (guild_id) DO UPDATE SET catch_up_grace_seconds = $2, catch_up_skip_recurring = $3`
+	_, err := db.Exec(statement, guildID, int64(policy.grace/time.Second), policy.skipRecurring)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getDefaultNoticeOffsetsFromDatabase for the guild.
+// The built-in defaults are returned if the guild has not configured any.
+func getDefaultNoticeOffsetsFromDatabase(db *sql.DB, guildID string) ([]time.Duration, error) {
+	var seconds []int64
+	err := db.QueryRow("SELECT notice_offsets FROM event_settings WHERE guild_id = $1", guildID).Scan(pq.Array(&seconds))
+	if err == sql.ErrNoRows {
+		return defaultNoticeOffsets, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+
+	offsets := make([]time.Duration, len(seconds))
+	for i, sec := range seconds {
+		offsets[i] = time.Duration(sec) * time.Second
+	}
+	return offsets, nil
+}
+
+func setDefaultNoticeOffsetsInDatabase(db *sql.DB, guildID string, offsets []time.Duration) error {
+	seconds := make([]int64, len(offsets))
+	for i, offset := range offsets {
+		seconds[i] = int64(offset / time.Second)
+	}
+
+	statement := `INSERT INTO event_settings (guild_id, notice_offsets) VALUES ($1, $2)
+	ON CONFLICT (guild_id) DO UPDATE SET notice_offsets = $2`
+	_, err := db.Exec(statement, guildID, pq.Array(seconds))
 	return errors.Wrap(err, "failed to execute query")
 }
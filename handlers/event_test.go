@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseNoticeOffsets(t *testing.T) {
+	testData := []struct {
+		input    []string
+		expected []time.Duration
+		fail     bool
+	}{
+		{input: nil, expected: []time.Duration{0}},
+		{input: []string{"15m", "1h"}, expected: []time.Duration{time.Hour, 15 * time.Minute, 0}},
+		{input: []string{"1h", "0", "60m", ""}, expected: []time.Duration{time.Hour, 0}},
+		{input: []string{"soon"}, fail: true},
+		{input: []string{"-5m"}, fail: true},
+		{input: []string{"1500ms"}, fail: true},
+	}
+
+	for _, d := range testData {
+		offsets, err := parseNoticeOffsets(d.input)
+		if d.fail {
+			if err == nil {
+				t.Errorf("%q should not be accepted", d.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q should be accepted: %v", d.input, err)
+		}
+		if !reflect.DeepEqual(offsets, d.expected) {
+			t.Errorf("%q should be parsed as %v, not %v", d.input, d.expected, offsets)
+		}
+	}
+}
+
+func Test_event_timeDBFormat(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := event{time: time.Date(2018, 11, 24, 19, 30, 0, 0, stockholm)}
+
+	if actual := e.timeDBFormat(); actual != "2018-11-24 18:30:00" {
+		t.Errorf("Stored time was %v, expected it in UTC", actual)
+	}
+}
+
+func Test_parseEventHistoryArgs(t *testing.T) {
+	author := &discordgo.User{ID: "123"}
+
+	page, filter, err := parseEventHistoryArgs([]string{"2", "from:2018-11-01", "to:2018-11-30", "<@!123>", "ws", "jump"}, []*discordgo.User{author}, time.UTC)
+	if err != nil {
+		t.Fatal("Should be accepted:", err)
+	}
+	expected := eventFilter{
+		keyword:  "ws jump",
+		authorID: "123",
+		from:     time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC),
+		to:       time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if page != 2 {
+		t.Errorf("Page should be 2, not %d", page)
+	}
+	if !reflect.DeepEqual(filter, expected) {
+		t.Errorf("Filter should be %+v, not %+v", expected, filter)
+	}
+
+	page, filter, err = parseEventHistoryArgs([]string{""}, nil, time.UTC)
+	if err != nil || page != 1 || !reflect.DeepEqual(filter, eventFilter{}) {
+		t.Errorf("No arguments should give the first page without filters, got page %d, filter %+v, error %v", page, filter, err)
+	}
+
+	for _, args := range [][]string{{"0"}, {"from:yesterday"}, {"to:2018-13-01"}} {
+		if _, _, err = parseEventHistoryArgs(args, nil, time.UTC); err == nil {
+			t.Errorf("%q should not be accepted", args)
+		}
+	}
+}
+
+func Test_nextOccurrence(t *testing.T) {
+	start := time.Date(2018, 11, 24, 20, 0, 0, 0, time.UTC)
+	e := event{time: start, interval: 24 * time.Hour}
+
+	testData := []struct {
+		now      time.Time
+		expected time.Time
+	}{
+		{now: start.Add(-time.Hour), expected: start},
+		{now: start, expected: start.Add(24 * time.Hour)},
+		{now: start.Add(50 * time.Hour), expected: start.Add(72 * time.Hour)},
+	}
+
+	for _, d := range testData {
+		if next := e.nextOccurrence(d.now); !next.Equal(d.expected) {
+			t.Errorf("Next occurrence at %v should be %v, not %v", d.now, d.expected, next)
+		}
+	}
+}
+
+func Test_parseInterval(t *testing.T) {
+	testData := map[string]time.Duration{
+		"daily":  24 * time.Hour,
+		"weekly": 7 * 24 * time.Hour,
+		"3d":     3 * 24 * time.Hour,
+		"2w":     14 * 24 * time.Hour,
+		"12h":    12 * time.Hour,
+	}
+	for text, expected := range testData {
+		if interval, err := parseInterval(text); err != nil || interval != expected {
+			t.Errorf("%q should be parsed as %v, not %v (%v)", text, expected, interval, err)
+		}
+	}
+
+	for _, text := range []string{"monthly", "10s", "xd", ""} {
+		if _, err := parseInterval(text); err == nil {
+			t.Errorf("%q should not be accepted", text)
+		}
+	}
+}
+
+func Test_planCatchUp(t *testing.T) {
+	start := time.Date(2018, 11, 24, 20, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	events := []event{
+		{id: 1, description: "First", time: start.Add(time.Minute)},
+		{id: 2, description: "Second", time: start.Add(10 * time.Minute)},
+		{id: 3, description: "Recurring", time: start.Add(5 * time.Minute), interval: 24 * time.Hour},
+		{id: 4, description: "Upcoming", time: start.Add(2 * time.Hour)},
+	}
+
+	// Simulate the bot being offline for an hour
+	clock.Advance(time.Hour)
+	testData := []struct {
+		policy   catchUpPolicy
+		delayed  []int
+		missed   []int
+		skipped  []int
+		upcoming []int
+	}{
+		{policy: catchUpPolicy{}, missed: []int{1, 2, 3}, upcoming: []int{4}},
+		{policy: catchUpPolicy{grace: 55 * time.Minute}, delayed: []int{2, 3}, missed: []int{1}, upcoming: []int{4}},
+		{policy: catchUpPolicy{grace: 30 * time.Minute, skipRecurring: true}, missed: []int{1, 2}, skipped: []int{3}, upcoming: []int{4}},
+		{policy: catchUpPolicy{grace: 2 * time.Hour, skipRecurring: true}, delayed: []int{1, 2, 3}, upcoming: []int{4}},
+	}
+
+	ids := func(events []event) []int {
+		var ids []int
+		for _, e := range events {
+			ids = append(ids, e.id)
+		}
+		return ids
+	}
+	for _, d := range testData {
+		plan := planCatchUp(events, clock.Now(), d.policy)
+		if !reflect.DeepEqual(ids(plan.delayed), d.delayed) ||
+			!reflect.DeepEqual(ids(plan.missed), d.missed) ||
+			!reflect.DeepEqual(ids(plan.skipped), d.skipped) ||
+			!reflect.DeepEqual(ids(plan.upcoming), d.upcoming) {
+			t.Errorf("Policy %+v should delay %v, list %v, skip %v and keep %v, not %v, %v, %v and %v", d.policy,
+				d.delayed, d.missed, d.skipped, d.upcoming,
+				ids(plan.delayed), ids(plan.missed), ids(plan.skipped), ids(plan.upcoming))
+		}
+	}
+
+	if digest := formatMissedEvents(events[1:2], clock.Now()); digest != "* 50m ago (Sat 24 Nov 20:10 UTC): Second\n" {
+		t.Errorf("Unexpected digest %q", digest)
+	}
+}
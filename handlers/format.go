@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+)
+
+// formatDuration rounded to seconds without trailing zero units, e.g. "1h5m" instead of "1h5m0s".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d == 0 {
+		return "0s"
+	}
+
+	text := d.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_formatDuration(t *testing.T) {
+	testData := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{duration: 0, expected: "0s"},
+		{duration: 45 * time.Second, expected: "45s"},
+		{duration: 15 * time.Minute, expected: "15m"},
+		{duration: time.Hour, expected: "1h"},
+		{duration: time.Hour + 5*time.Minute, expected: "1h5m"},
+		{duration: time.Hour + 3*time.Second, expected: "1h0m3s"},
+		{duration: 90*time.Minute + 400*time.Millisecond, expected: "1h30m"},
+		{duration: -10 * time.Minute, expected: "-10m"},
+	}
+
+	for _, d := range testData {
+		if formatted := formatDuration(d.duration); formatted != d.expected {
+			t.Errorf("%v should be formatted as %q, not %q", d.duration, d.expected, formatted)
+		}
+	}
+}
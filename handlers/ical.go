@@ -0,0 +1,600 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	calendarFileName = "events.ics"
+	calendarFeedPath = "/calendar/"
+
+	icalTimeFormat      = "20060102T150405Z"
+	icalLocalTimeFormat = "20060102T150405"
+	icalDateFormat      = "20060102"
+	// icalLineLength is the maximum length in octets of a line before it has to be folded.
+	icalLineLength = 75
+
+	// maxCalendarImportSize in bytes of an imported attachment.
+	maxCalendarImportSize = 1 << 20
+)
+
+// CalendarFeedURL is the public address the calendar feed is served at, e.g. "https://example.com".
+// It's only used to show officers the full URL of the feed.
+var CalendarFeedURL string
+
+// calendarImportClient downloads the attachments of imported calendars.
+var calendarImportClient = &http.Client{Timeout: 30 * time.Second}
+
+// icalFrequencies maps the RRULE frequencies to their interval.
+// Monthly and yearly frequencies are not supported since they don't have a fixed length.
+var icalFrequencies = []struct {
+	name     string
+	interval time.Duration
+}{
+	{name: "WEEKLY", interval: 7 * 24 * time.Hour},
+	{name: "DAILY", interval: 24 * time.Hour},
+	{name: "HOURLY", interval: time.Hour},
+	{name: "MINUTELY", interval: time.Minute},
+	{name: "SECONDLY", interval: time.Second},
+}
+
+// EventCalendarCommand for exporting events to calendars.
+func EventCalendarCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "ics",
+		Permission:      commands.Members,
+		HelpDescription: "Export upcoming events to your calendar",
+		Handler:         HandleEventCalendar,
+		SubCommands: []commands.Command{
+			EventCalendarFeedCommand(),
+			EventCalendarImportCommand(),
+		},
+		Help: commands.Help{
+			Summary: "Export upcoming events to your calendar",
+			DetailedDescription: "Upload an iCalendar file with the upcoming events which can be imported to most calendars.\n" +
+				"Officers can also use `feed` to get a calendar feed URL and `import` to add events from an attached .ics file.",
+			Syntax:  "event ics",
+			Example: "event ics",
+		},
+	}
+}
+
+// EventCalendarFeedCommand for getting the URL of the calendar feed.
+func EventCalendarFeedCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "feed",
+		Permission:      commands.Officers,
+		HelpDescription: "Get the URL of the calendar feed",
+		Handler:         HandleEventCalendarFeed,
+		Help: commands.Help{
+			Summary: "Get the URL of the calendar feed",
+			DetailedDescription: "Get the secret URL of the guild's calendar feed in a direct message. " +
+				"Use `reset` to replace the secret if the URL has leaked, which stops the old URL from working.",
+			Syntax:  "event ics feed [reset]",
+			Example: "event ics feed",
+		},
+	}
+}
+
+// EventCalendarImportCommand for adding events from an iCalendar file.
+func EventCalendarImportCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "import",
+		Permission:      commands.Officers,
+		HelpDescription: "Add events from an attached .ics file",
+		Handler:         HandleEventCalendarImport,
+		Help: commands.Help{
+			Summary: "Add events from an attached .ics file",
+			DetailedDescription: "Add every upcoming event in the attached iCalendar file. " +
+				"Daily, weekly and other fixed interval recurring events are kept recurring.",
+			Syntax:  "event ics import",
+			Example: "event ics import",
+		},
+	}
+}
+
+// HandleEventCalendar handles uploading the upcoming events as an iCalendar file.
+func HandleEventCalendar(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	upcoming, err := getEventsFromDatabase(db, 0, false)
+	if err != nil {
+		fmt.Println("Failed to get upcoming events:", err.Error())
+		_, err = s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Failed to get events: %v", err))
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return
+	}
+
+	var calendar bytes.Buffer
+	err = writeCalendar(&calendar, upcoming, time.Now())
+	if err != nil {
+		fmt.Println("Failed to write calendar:", err.Error())
+		return
+	}
+
+	_, err = s.ChannelFileSendWithMessage(m.ChannelID, fmt.Sprintf("%d upcoming events", len(upcoming)), calendarFileName, &calendar)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleEventCalendarFeed handles sending the calendar feed URL to the caller.
+func HandleEventCalendarFeed(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	token, err := getCalendarFeedTokenFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get calendar feed token:", err.Error())
+		return
+	}
+
+	if token == "" || strings.TrimSpace(msg) == "reset" {
+		token, err = newCalendarFeedToken()
+		if err != nil {
+			fmt.Println("Failed to create calendar feed token:", err.Error())
+			return
+		}
+
+		err = setCalendarFeedTokenInDatabase(db, guildID, token)
+		if err != nil {
+			fmt.Println("Failed to set calendar feed token:", err.Error())
+			return
+		}
+	}
+
+	channel, err := s.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		fmt.Println("Failed to create DM channel:", err.Error())
+		return
+	}
+
+	feedURL := fmt.Sprintf("%v%v%v.ics?token=%v", CalendarFeedURL, calendarFeedPath, guildID, token)
+	response := discordgo.MessageEmbed{
+		Title: "Calendar feed",
+		Color: infoColor,
+		Description: fmt.Sprintf("Subscribe to %v in your calendar app.\n"+
+			"Keep the URL secret, use `!event ics feed reset` to replace it.", feedURL),
+	}
+	_, err = s.ChannelMessageSendEmbed(channel.ID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+
+	response = discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: "The calendar feed URL has been sent to you in a direct message.",
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleEventCalendarImport handles adding the events of an attached iCalendar file.
+func HandleEventCalendarImport(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	if len(m.Attachments) == 0 {
+		response := discordgo.MessageEmbed{
+			Title:       "Incorrect syntax",
+			Color:       failColor,
+			Description: "Attach an .ics file to the message, check `!help event`",
+		}
+		_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return
+	}
+
+	resp, err := calendarImportClient.Get(m.Attachments[0].URL)
+	if err != nil {
+		fmt.Println("Failed to download attachment:", err.Error())
+		sendFailMessage("Failed to download the attached calendar", s, m)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Failed to download attachment:", resp.Status)
+		sendFailMessage("Failed to download the attached calendar", s, m)
+		return
+	}
+
+	now := time.Now()
+	imported, skipped, err := parseCalendar(io.LimitReader(resp.Body, maxCalendarImportSize), now, userLocation(db, m.Author.ID))
+	if err != nil {
+		response := discordgo.MessageEmbed{
+			Color:       failColor,
+			Description: fmt.Sprintf("Failed to read the calendar: %v", err),
+		}
+		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return
+	}
+
+	offsets, err := getDefaultNoticeOffsetsFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get default notice offsets, using built-in defaults:", err.Error())
+		offsets = defaultNoticeOffsets
+	}
+
+	var added int
+	for _, e := range imported {
+		if e.interval != 0 {
+			e.time = e.nextOccurrence(now)
+		} else if !e.time.After(now) {
+			skipped++
+			continue
+		}
+
+		e.authorID = m.Author.ID
+		for _, offset := range offsets {
+			e.notices = append(e.notices, notice{offset: offset})
+		}
+
+		e.id, err = addEventToDatabase(db, e)
+		if err != nil {
+			fmt.Println("Failed to add event:", err.Error())
+			skipped++
+			continue
+		}
+		startEventTimer(e, s, db)
+		added++
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       "Events imported!",
+		Color:       successColor,
+		Description: fmt.Sprintf("Added %d events, skipped %d past or unsupported events.", added, skipped),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+type calendarFeed struct {
+	db *sql.DB
+}
+
+// NewCalendarFeed returns a handler serving the upcoming events of a guild as an iCalendar feed
+// at /calendar/<guild ID>.ics?token=<token>.
+func NewCalendarFeed(db *sql.DB) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(calendarFeedPath, calendarFeed{db: db})
+	return mux
+}
+
+func (f calendarFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	guildID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, calendarFeedPath), ".ics")
+
+	token, err := getCalendarFeedTokenFromDatabase(f.db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get calendar feed token:", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	given := r.URL.Query().Get("token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(given)) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	upcoming, err := getEventsFromDatabase(f.db, 0, false)
+	if err != nil {
+		fmt.Println("Failed to get upcoming events:", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	err = writeCalendar(w, upcoming, time.Now())
+	if err != nil {
+		fmt.Println("Failed to write calendar feed:", err.Error())
+	}
+}
+
+// writeCalendar writes the events in the iCalendar format (RFC 5545).
+func writeCalendar(w io.Writer, events []event, now time.Time) error {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//OutBot//Events//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:Corp events",
+	}
+
+	for _, e := range events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:event-%d@outbot", e.id),
+			"DTSTAMP:"+now.UTC().Format(icalTimeFormat),
+			"DTSTART:"+e.time.UTC().Format(icalTimeFormat),
+			"SUMMARY:"+icalEscape(e.description),
+		)
+		if e.interval != 0 {
+			lines = append(lines, "RRULE:"+rrule(e.interval))
+		}
+		for _, n := range e.notices {
+			if n.offset == 0 {
+				continue
+			}
+			lines = append(lines,
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				"TRIGGER:-"+icalDuration(n.offset),
+				"DESCRIPTION:"+icalEscape(e.description),
+				"END:VALARM",
+			)
+		}
+		lines = append(lines, "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		_, err := io.WriteString(w, icalFold(line)+"\r\n")
+		if err != nil {
+			return errors.Wrap(err, "failed to write line")
+		}
+	}
+	return nil
+}
+
+// parseCalendar returns the events of an iCalendar file and how many events could not be read.
+// Times without a time zone are read in loc.
+func parseCalendar(r io.Reader, now time.Time, loc *time.Location) ([]event, int, error) {
+	lines, err := icalUnfold(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		events  []event
+		skipped int
+		current *event
+		invalid bool
+	)
+	for _, line := range lines {
+		name, params, value := icalProperty(line)
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			current = &event{}
+			invalid = false
+		case name == "END" && value == "VEVENT" && current != nil:
+			if invalid || current.time.IsZero() {
+				skipped++
+			} else {
+				events = append(events, *current)
+			}
+			current = nil
+		case current == nil:
+		case name == "SUMMARY":
+			current.description = icalUnescape(value)
+		case name == "DTSTART":
+			current.time, err = icalTime(value, params, loc)
+			if err != nil {
+				invalid = true
+			}
+		case name == "RRULE":
+			current.interval, err = parseRRule(value)
+			if err != nil {
+				invalid = true
+			}
+		}
+	}
+
+	if len(events) == 0 && skipped == 0 {
+		return nil, 0, errors.New("no events found")
+	}
+	return events, skipped, nil
+}
+
+// rrule returns the recurrence rule for an interval.
+func rrule(interval time.Duration) string {
+	for _, f := range icalFrequencies {
+		if interval%f.interval == 0 {
+			return fmt.Sprintf("FREQ=%v;INTERVAL=%d", f.name, interval/f.interval)
+		}
+	}
+	return fmt.Sprintf("FREQ=SECONDLY;INTERVAL=%d", interval/time.Second)
+}
+
+// parseRRule returns the interval of a recurrence rule.
+// Only rules repeating with a fixed interval are supported.
+func parseRRule(rule string) (time.Duration, error) {
+	var (
+		frequency time.Duration
+		interval  int64 = 1
+	)
+	for _, part := range strings.Split(rule, ";") {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return 0, errors.Errorf("incorrect rule part %q", part)
+		}
+
+		switch keyValue[0] {
+		case "FREQ":
+			for _, f := range icalFrequencies {
+				if f.name == keyValue[1] {
+					frequency = f.interval
+				}
+			}
+		case "INTERVAL":
+			var err error
+			interval, err = strconv.ParseInt(keyValue[1], 10, 64)
+			if err != nil || interval < 1 {
+				return 0, errors.Errorf("incorrect interval %q", keyValue[1])
+			}
+		case "WKST":
+		default:
+			return 0, errors.Errorf("unsupported rule part %q", part)
+		}
+	}
+
+	if frequency == 0 {
+		return 0, errors.Errorf("unsupported frequency in rule %q", rule)
+	}
+	if interval > math.MaxInt64/int64(frequency) {
+		return 0, errors.Errorf("interval of rule %q is too long", rule)
+	}
+	if frequency*time.Duration(interval) < minRecurrenceInterval {
+		return 0, errors.Errorf("interval of rule %q is shorter than %v", rule, formatDuration(minRecurrenceInterval))
+	}
+	return frequency * time.Duration(interval), nil
+}
+
+// icalDuration formats a positive duration, e.g. "PT1H15M" or "P1D".
+func icalDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+
+	text := "P"
+	if days > 0 {
+		text += fmt.Sprintf("%dD", days)
+	}
+	if d > 0 {
+		text += "T"
+		for _, unit := range []struct {
+			duration time.Duration
+			suffix   string
+		}{{time.Hour, "H"}, {time.Minute, "M"}, {time.Second, "S"}} {
+			if d >= unit.duration {
+				text += fmt.Sprintf("%d%v", d/unit.duration, unit.suffix)
+				d %= unit.duration
+			}
+		}
+	}
+	if text == "P" {
+		text = "PT0S"
+	}
+	return text
+}
+
+func icalTime(value string, params map[string]string, loc *time.Location) (time.Time, error) {
+	if params["VALUE"] == "DATE" {
+		return time.ParseInLocation(icalDateFormat, value, loc)
+	}
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse(icalTimeFormat, value)
+	}
+	if tzid, exists := params["TZID"]; exists {
+		zone, err := loadLocation(tzid)
+		if err != nil {
+			return time.Time{}, err
+		}
+		loc = zone
+	}
+	return time.ParseInLocation(icalLocalTimeFormat, value, loc)
+}
+
+// icalProperty splits a content line into its name, parameters and value.
+func icalProperty(line string) (string, map[string]string, string) {
+	nameAndParams := line
+	var value string
+	if i := strings.Index(line, ":"); i >= 0 {
+		nameAndParams = line[:i]
+		value = line[i+1:]
+	}
+
+	split := strings.Split(nameAndParams, ";")
+	params := make(map[string]string)
+	for _, param := range split[1:] {
+		keyValue := strings.SplitN(param, "=", 2)
+		if len(keyValue) == 2 {
+			params[strings.ToUpper(keyValue[0])] = strings.Trim(keyValue[1], `"`)
+		}
+	}
+
+	return strings.ToUpper(split[0]), params, value
+}
+
+// icalUnfold reads the content lines, joining lines that have been folded.
+func icalUnfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, errors.Wrap(scanner.Err(), "failed to read calendar")
+}
+
+// icalFold splits lines longer than allowed without splitting multi-byte characters.
+func icalFold(line string) string {
+	var (
+		folded strings.Builder
+		length int
+	)
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > icalLineLength {
+			folded.WriteString("\r\n ")
+			length = 1
+		}
+		folded.WriteRune(r)
+		length += size
+	}
+	return folded.String()
+}
+
+var (
+	icalEscaper   = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+	icalUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+)
+
+func icalEscape(text string) string {
+	return icalEscaper.Replace(text)
+}
+
+func icalUnescape(text string) string {
+	return icalUnescaper.Replace(text)
+}
+
+func newCalendarFeedToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read random bytes")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getCalendarFeedTokenFromDatabase returns the feed token of the guild, or an empty string if it has none.
+func getCalendarFeedTokenFromDatabase(db *sql.DB, guildID string) (string, error) {
+	var token string
+	err := db.QueryRow("SELECT token FROM calendar_feeds WHERE guild_id = $1", guildID).Scan(&token)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return token, errors.Wrap(err, "failed to do query")
+}
+
+func setCalendarFeedTokenInDatabase(db *sql.DB, guildID string, token string) error {
+	statement := `INSERT INTO calendar_feeds (guild_id, token) VALUES ($1, $2)
+	ON CONFLICT (guild_id) DO UPDATE SET token = $2`
+	_, err := db.Exec(statement, guildID, token)
+	return errors.Wrap(err, "failed to execute query")
+}
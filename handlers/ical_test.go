@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_writeAndParseCalendar(t *testing.T) {
+	now := time.Date(2018, 11, 24, 12, 0, 0, 0, time.UTC)
+	events := []event{
+		{
+			id:          7,
+			description: "WS jump; bring shields, all of you\nand " + strings.Repeat("ä", 60),
+			time:        time.Date(2018, 11, 25, 20, 0, 0, 0, time.UTC),
+			notices:     []notice{{offset: time.Hour}, {offset: 0}},
+		},
+		{
+			id:          8,
+			description: "Weekly scan",
+			time:        time.Date(2018, 11, 26, 18, 30, 0, 0, time.UTC),
+			interval:    2 * 7 * 24 * time.Hour,
+		},
+	}
+
+	var calendar bytes.Buffer
+	err := writeCalendar(&calendar, events, now)
+	if err != nil {
+		t.Fatal("Failed to write calendar:", err)
+	}
+	for _, line := range strings.Split(calendar.String(), "\r\n") {
+		if len(line) > icalLineLength {
+			t.Errorf("Line is longer than %d octets: %q", icalLineLength, line)
+		}
+	}
+	for _, expected := range []string{"UID:event-7@outbot", "RRULE:FREQ=WEEKLY;INTERVAL=2", "TRIGGER:-PT1H"} {
+		if !strings.Contains(calendar.String(), expected) {
+			t.Errorf("Calendar should contain %q", expected)
+		}
+	}
+
+	parsed, skipped, err := parseCalendar(&calendar, now, time.UTC)
+	if err != nil {
+		t.Fatal("Failed to parse calendar:", err)
+	}
+	if skipped != 0 || len(parsed) != len(events) {
+		t.Fatalf("Should parse %d events without skipping, got %d and skipped %d", len(events), len(parsed), skipped)
+	}
+	for i, e := range events {
+		if parsed[i].description != e.description || !parsed[i].time.Equal(e.time) || parsed[i].interval != e.interval {
+			t.Errorf("Event %+v should be parsed as %+v", parsed[i], e)
+		}
+	}
+}
+
+func Test_parseCalendar(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip("time zone database not available:", err)
+	}
+
+	calendar := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Local time\r\nDTSTART;TZID=Europe/Stockholm:20181124T200000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Floating\r\nDTSTART:20181124T200000\r\nRRULE:FREQ=DAILY\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Monthly\r\nDTSTART:20181124T200000Z\r\nRRULE:FREQ=MONTHLY\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:No start\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Every second\r\nDTSTART:20181124T200000Z\r\nRRULE:FREQ=SECONDLY\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Overflowing\r\nDTSTART:20181124T200000Z\r\nRRULE:FREQ=WEEKLY;INTERVAL=9223372036854775807\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Every 90 seconds\r\nDTSTART:20181124T200000Z\r\nRRULE:FREQ=SECONDLY;INTERVAL=90\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	parsed, skipped, err := parseCalendar(strings.NewReader(calendar), time.Now(), time.UTC)
+	if err != nil {
+		t.Fatal("Failed to parse calendar:", err)
+	}
+	if skipped != 4 {
+		t.Errorf("Should skip the monthly, too short and too long events and the one without a start, skipped %d", skipped)
+	}
+	if len(parsed) != 3 {
+		t.Fatalf("Should parse 3 events, not %d", len(parsed))
+	}
+	if expected := time.Date(2018, 11, 24, 20, 0, 0, 0, stockholm); !parsed[0].time.Equal(expected) {
+		t.Errorf("%q should be at %v, not %v", parsed[0].description, expected, parsed[0].time)
+	}
+	if expected := time.Date(2018, 11, 24, 20, 0, 0, 0, time.UTC); !parsed[1].time.Equal(expected) || parsed[1].interval != 24*time.Hour {
+		t.Errorf("%q should be at %v every day, not %v every %v", parsed[1].description, expected, parsed[1].time, parsed[1].interval)
+	}
+	if parsed[2].interval != 90*time.Second {
+		t.Errorf("%q should repeat every 90s, not every %v", parsed[2].description, parsed[2].interval)
+	}
+}
+
+func Test_icalDuration(t *testing.T) {
+	testData := map[time.Duration]string{
+		0:                                     "PT0S",
+		15 * time.Minute:                      "PT15M",
+		time.Hour + 30*time.Second:            "PT1H30S",
+		24 * time.Hour:                        "P1D",
+		26*time.Hour + 5*time.Minute:          "P1DT2H5M",
+		7 * 24 * time.Hour:                    "P7D",
+		90*time.Minute + 400*time.Millisecond: "PT1H30M",
+	}
+
+	for d, expected := range testData {
+		if formatted := icalDuration(d); formatted != expected {
+			t.Errorf("%v should be formatted as %q, not %q", d, expected, formatted)
+		}
+	}
+}
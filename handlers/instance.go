@@ -0,0 +1,572 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// instance is the name of a White Star instance.
+type instance string
+
+// wsInstance is a White Star instance of a corp, e.g. the second instance "Main B" with the code "B" of the corp "Main".
+type wsInstance struct {
+	name instance
+	code string
+	corp string
+	// roleID of the role given to participants when a match is found, empty if there's none.
+	roleID string
+	// channelIDs of the channels where the instance is used when none is given.
+	channelIDs []string
+}
+
+// resolveInstance returns the instance named by arg, which can be either the name or code of the instance.
+// Codes are looked up among the instances of the corps whose instances are bound to the channel first,
+// in channels without instances the instances which are not bound to any channel are preferred.
+// If arg is empty the instance of the channel is returned. Channels without instances use the first instance
+// which is not bound to any channel, or the first instance if all are bound.
+// A number which isn't a code is the n-th instance of the corp of the channel's instance, e.g. 2 for its B instance.
+func resolveInstance(instances []wsInstance, channelID string, arg string) (instance, error) {
+	if len(instances) == 0 {
+		return "", errors.New("there are no instances, officers can add one with `!instance add`")
+	}
+
+	// Corps with instances bound to the channel
+	var (
+		bound []wsInstance
+		corps = make(map[string]bool)
+	)
+	for _, i := range instances {
+		for _, id := range i.channelIDs {
+			if id == channelID {
+				bound = append(bound, i)
+				corps[i.corp] = true
+			}
+		}
+	}
+
+	channelInstance := instances[0]
+	if len(bound) > 0 {
+		channelInstance = bound[0]
+	} else {
+		for _, i := range instances {
+			if len(i.channelIDs) == 0 {
+				channelInstance = i
+				break
+			}
+		}
+	}
+
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return channelInstance.name, nil
+	}
+
+	for _, i := range instances {
+		if strings.EqualFold(string(i.name), arg) {
+			return i.name, nil
+		}
+	}
+
+	var matches []wsInstance
+	for _, i := range instances {
+		if strings.EqualFold(i.code, arg) && (len(corps) == 0 || corps[i.corp]) {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 && len(corps) > 0 {
+		// Not an instance of the channel's corp, try the other corps
+		for _, i := range instances {
+			if strings.EqualFold(i.code, arg) {
+				matches = append(matches, i)
+			}
+		}
+	}
+	if len(matches) > 1 && len(corps) == 0 {
+		// Instances bound to other channels are meant to be used there
+		var unbound []wsInstance
+		for _, i := range matches {
+			if len(i.channelIDs) == 0 {
+				unbound = append(unbound, i)
+			}
+		}
+		if len(unbound) > 0 {
+			matches = unbound
+		}
+	}
+
+	if n, err := strconv.Atoi(arg); err == nil && n > 0 && len(matches) == 0 {
+		var corpInstances []wsInstance
+		for _, i := range instances {
+			if i.corp == channelInstance.corp {
+				corpInstances = append(corpInstances, i)
+			}
+		}
+		if n <= len(corpInstances) {
+			return corpInstances[n-1].name, nil
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", errors.Errorf("unknown instance %q, check `!instance`", arg)
+	case 1:
+		return matches[0].name, nil
+	default:
+		names := make([]string, len(matches))
+		for i, match := range matches {
+			names[i] = string(match.name)
+		}
+		return "", errors.Errorf("%q could be any of %v, use the full name", arg, strings.Join(names, ", "))
+	}
+}
+
+// leadingInstanceArg splits the instance off the start of args when they start with the full name of an instance,
+// or with a code only one instance has. At least following args must be left after it, otherwise args are returned as is.
+func leadingInstanceArg(instances []wsInstance, args []string, following int) (string, []string) {
+	for words := 2; words >= 1; words-- {
+		if len(args) < words+following {
+			continue
+		}
+		arg := strings.Join(args[:words], " ")
+
+		var matches int
+		for _, i := range instances {
+			if strings.EqualFold(string(i.name), arg) || (words == 1 && strings.EqualFold(i.code, arg)) {
+				matches++
+			}
+		}
+		if matches == 1 {
+			return arg, args[words:]
+		}
+	}
+	return "", args
+}
+
+// instanceFromMessage returns the instance named by arg in the channel of the message.
+// If the instance is unknown a message is sent about it and false is returned.
+func instanceFromMessage(arg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) (instance, bool) {
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get instances:", err.Error())
+		_, err = s.ChannelMessageSend(m.ChannelID, "Failed to get instances")
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return "", false
+	}
+
+	instance, err := resolveInstance(instances, m.ChannelID, arg)
+	if err != nil {
+		response := discordgo.MessageEmbed{
+			Title:       "Unknown instance",
+			Color:       failColor,
+			Description: strings.ToUpper(err.Error()[:1]) + err.Error()[1:] + ".",
+		}
+		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return "", false
+	}
+
+	return instance, true
+}
+
+// InstanceCommand for managing the White Star instances.
+func InstanceCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "instance",
+		Permission:      commands.Members,
+		HelpDescription: "List the WS instances",
+		Handler:         HandleInstance,
+		SubCommands: []commands.Command{
+			InstanceAddCommand(),
+			InstanceRemoveCommand(),
+			InstanceBindCommand(),
+			InstanceUnbindCommand(),
+		},
+		Help: commands.Help{
+			Summary: "List the WS instances",
+			DetailedDescription: "List the White Star instances with their codes, channels and roles.\n" +
+				"Commands take the name or code of an instance, or its number in the corp of the channel, e.g. `2` for its B instance.\n" +
+				"Officers manage them with the subcommands `add`, `remove`, `bind` and `unbind`.",
+			Syntax:  "instance",
+			Example: "instance",
+		},
+	}
+}
+
+// InstanceAddCommand for adding or updating a White Star instance.
+func InstanceAddCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "add",
+		Permission:      commands.Officers,
+		HelpDescription: "Add or update a WS instance",
+		Handler:         HandleAddInstance,
+		Help: commands.Help{
+			Summary: "Add or update a WS instance",
+			DetailedDescription: "Add a White Star instance, or update the code, corp and role of an existing one. " +
+				"The code is used to pick the instance in commands, e.g. `!optin B`. Mention a role to give it to participants when a match is found.",
+			Syntax:  "instance add <code> <corp> <name> [@role]",
+			Example: "instance add B Academy Academy B @Current Whitestar",
+		},
+	}
+}
+
+// InstanceRemoveCommand for removing a White Star instance.
+func InstanceRemoveCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "remove",
+		Permission:      commands.Officers,
+		HelpDescription: "Remove a WS instance",
+		Handler:         HandleRemoveInstance,
+		Help: commands.Help{
+			Summary:             "Remove a WS instance",
+			DetailedDescription: "Remove a White Star instance, its participation list has to be cleared first.",
+			Syntax:              "instance remove <instance>",
+			Example:             "instance remove Academy B",
+		},
+	}
+}
+
+// InstanceBindCommand for binding channels to a White Star instance.
+func InstanceBindCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "bind",
+		Permission:      commands.Officers,
+		HelpDescription: "Bind channels to a WS instance",
+		Handler:         instanceBindHandler(true),
+		Help: commands.Help{
+			Summary: "Bind channels to a WS instance",
+			DetailedDescription: "Bind channels to a White Star instance, it's used in them when no instance is given " +
+				"and codes are looked up among its corp's instances first. The current channel is used if none is mentioned.",
+			Syntax:  "instance bind <instance> [#channels]",
+			Example: "instance bind Academy A #academy-whitestar",
+		},
+	}
+}
+
+// InstanceUnbindCommand for unbinding channels from a White Star instance.
+func InstanceUnbindCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "unbind",
+		Permission:      commands.Officers,
+		HelpDescription: "Unbind channels from a WS instance",
+		Handler:         instanceBindHandler(false),
+		Help: commands.Help{
+			Summary:             "Unbind channels from a WS instance",
+			DetailedDescription: "Unbind channels from a White Star instance. The current channel is used if none is mentioned.",
+			Syntax:              "instance unbind <instance> [#channels]",
+			Example:             "instance unbind Academy A #academy-whitestar",
+		},
+	}
+}
+
+// HandleInstance handles listing the instances.
+func HandleInstance(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get instances:", err.Error())
+		return
+	}
+
+	content := formatInstances(instances)
+	if content == "" {
+		content = "There are no instances, officers can add one with `!instance add`."
+	}
+	response := discordgo.MessageEmbed{
+		Title:       "White Star instances",
+		Color:       infoColor,
+		Description: content,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func formatInstances(instances []wsInstance) string {
+	byCorp := make(map[string][]wsInstance)
+	var corps []string
+	for _, i := range instances {
+		if _, exists := byCorp[i.corp]; !exists {
+			corps = append(corps, i.corp)
+		}
+		byCorp[i.corp] = append(byCorp[i.corp], i)
+	}
+	sort.Strings(corps)
+
+	var content string
+	for _, corp := range corps {
+		content += fmt.Sprintf("**%v**\n", corp)
+		for _, i := range byCorp[corp] {
+			content += fmt.Sprintf("* %v (`%v`)", i.name, i.code)
+			if i.roleID != "" {
+				content += fmt.Sprintf(", role <@&%v>", i.roleID)
+			}
+			if len(i.channelIDs) > 0 {
+				channels := make([]string, len(i.channelIDs))
+				for j, id := range i.channelIDs {
+					channels[j] = fmt.Sprintf("<#%v>", id)
+				}
+				content += ", channels " + strings.Join(channels, " ")
+			}
+			content += "\n"
+		}
+	}
+	return content
+}
+
+// HandleAddInstance handles adding or updating an instance.
+func HandleAddInstance(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	var args []string
+	for _, arg := range strings.Fields(msg) {
+		if !strings.HasPrefix(arg, "<@&") {
+			args = append(args, arg)
+		}
+	}
+	if len(args) < 3 {
+		sendIncorrectInstanceSyntax(s, m)
+		return
+	}
+
+	i := wsInstance{
+		code: strings.ToUpper(args[0]),
+		corp: args[1],
+		name: instance(strings.Join(args[2:], " ")),
+	}
+	if len(m.MentionRoles) > 0 {
+		i.roleID = m.MentionRoles[0]
+	}
+
+	var response discordgo.MessageEmbed
+	err := setInstanceInDatabase(db, i)
+	if err != nil {
+		fmt.Println("Failed to set instance:", err.Error())
+		response = discordgo.MessageEmbed{
+			Color:       failColor,
+			Description: fmt.Sprintf("Failed to add %v, the code %v might already be used in %v.", i.name, i.code, i.corp),
+		}
+	} else {
+		response = discordgo.MessageEmbed{
+			Title:       "Instance added!",
+			Color:       successColor,
+			Description: formatInstances([]wsInstance{i}),
+		}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleRemoveInstance handles removing an instance.
+func HandleRemoveInstance(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	if strings.TrimSpace(msg) == "" {
+		sendIncorrectInstanceSyntax(s, m)
+		return
+	}
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	var response discordgo.MessageEmbed
+	participants, err := getParticipantsFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get participants:", err.Error())
+		return
+	}
+	if len(participants) > 0 {
+		response = discordgo.MessageEmbed{
+			Color:       failColor,
+			Description: fmt.Sprintf("%v still has participants, clear them first with `!clear`.", instance),
+		}
+	} else if err = removeInstanceFromDatabase(db, instance); err != nil {
+		fmt.Println("Failed to remove instance:", err.Error())
+		response = discordgo.MessageEmbed{
+			Color:       failColor,
+			Description: "Failed to remove instance",
+		}
+	} else {
+		response = discordgo.MessageEmbed{
+			Color:       successColor,
+			Description: fmt.Sprintf("Removed %v!", instance),
+		}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// instanceBindHandler returns a handler binding, or unbinding, channels to an instance.
+func instanceBindHandler(bind bool) commands.Handler {
+	return func(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+		var (
+			nameArgs   []string
+			channelIDs []string
+		)
+		for _, arg := range strings.Fields(msg) {
+			if strings.HasPrefix(arg, "<#") && strings.HasSuffix(arg, ">") {
+				channelIDs = append(channelIDs, strings.Trim(arg, "<#>"))
+			} else {
+				nameArgs = append(nameArgs, arg)
+			}
+		}
+		if len(nameArgs) == 0 {
+			sendIncorrectInstanceSyntax(s, m)
+			return
+		}
+		if len(channelIDs) == 0 {
+			channelIDs = []string{m.ChannelID}
+		}
+
+		instance, ok := instanceFromMessage(strings.Join(nameArgs, " "), s, m, db)
+		if !ok {
+			return
+		}
+
+		var (
+			err    error
+			action string
+		)
+		if bind {
+			err = bindChannelsInDatabase(db, instance, channelIDs)
+			action = "Bound"
+		} else {
+			err = unbindChannelsInDatabase(db, instance, channelIDs)
+			action = "Unbound"
+		}
+		if err != nil {
+			fmt.Println("Failed to bind channels:", err.Error())
+			return
+		}
+
+		channels := make([]string, len(channelIDs))
+		for i, id := range channelIDs {
+			channels[i] = fmt.Sprintf("<#%v>", id)
+		}
+		response := discordgo.MessageEmbed{
+			Color:       successColor,
+			Description: fmt.Sprintf("%v %v for %v!", action, strings.Join(channels, " "), instance),
+		}
+		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+			return
+		}
+	}
+}
+
+func sendIncorrectInstanceSyntax(s *discordgo.Session, m *discordgo.MessageCreate) {
+	response := discordgo.MessageEmbed{
+		Title:       "Incorrect syntax",
+		Color:       failColor,
+		Description: "Too few arguments for the instance command, check `!help instance`",
+	}
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+	}
+}
+
+// getInstancesFromDatabase ordered by corp and code, with the channels bound to them.
+func getInstancesFromDatabase(db *sql.DB) ([]wsInstance, error) {
+	rows, err := db.Query("SELECT name, code, corp, role_id FROM ws_instances ORDER BY corp, code")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var instances []wsInstance
+	for rows.Next() {
+		var i wsInstance
+		err = rows.Scan(&i.name, &i.code, &i.corp, &i.roleID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		instances = append(instances, i)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate rows")
+	}
+
+	channels, err := db.Query("SELECT instance, channel_id FROM ws_instance_channels ORDER BY channel_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer channels.Close()
+
+	for channels.Next() {
+		var name, channelID string
+		err = channels.Scan(&name, &channelID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		for i := range instances {
+			if string(instances[i].name) == name {
+				instances[i].channelIDs = append(instances[i].channelIDs, channelID)
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// getInstanceFromDatabase returns the instance with the name.
+func getInstanceFromDatabase(db *sql.DB, name instance) (wsInstance, error) {
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		return wsInstance{}, err
+	}
+	for _, i := range instances {
+		if i.name == name {
+			return i, nil
+		}
+	}
+	return wsInstance{}, errors.Errorf("instance %q does not exist", name)
+}
+
+func setInstanceInDatabase(db *sql.DB, i wsInstance) error {
+	statement := `INSERT INTO ws_instances (name, code, corp, role_id) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (name) DO UPDATE SET code = $2, corp = $3, role_id = $4`
+	_, err := db.Exec(statement, i.name, i.code, i.corp, i.roleID)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func removeInstanceFromDatabase(db *sql.DB, name instance) error {
+	_, err := db.Exec("DELETE FROM ws_instances WHERE name = $1", name)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func bindChannelsInDatabase(db *sql.DB, name instance, channelIDs []string) error {
+	for _, id := range channelIDs {
+		_, err := db.Exec("INSERT INTO ws_instance_channels (instance, channel_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", name, id)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+	}
+	return nil
+}
+
+func unbindChannelsInDatabase(db *sql.DB, name instance, channelIDs []string) error {
+	for _, id := range channelIDs {
+		_, err := db.Exec("DELETE FROM ws_instance_channels WHERE instance = $1 AND channel_id = $2", name, id)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_resolveInstance(t *testing.T) {
+	instances := []wsInstance{
+		{name: "Academy A", code: "A", corp: "Academy", channelIDs: []string{"academy"}},
+		{name: "Academy B", code: "B", corp: "Academy"},
+		{name: "Main A", code: "A", corp: "Main"},
+		{name: "Main B", code: "B", corp: "Main"},
+		{name: "Main C", code: "C", corp: "Main", channelIDs: []string{"main-c"}},
+	}
+
+	testData := []struct {
+		channelID string
+		arg       string
+		expected  instance
+		fail      bool
+	}{
+		{channelID: "academy", arg: "", expected: "Academy A"},
+		{channelID: "academy", arg: "b", expected: "Academy B"},
+		{channelID: "academy", arg: "main b", expected: "Main B"},
+		{channelID: "academy", arg: "C", expected: "Main C"},
+		{channelID: "general", arg: "", expected: "Academy B"},
+		{channelID: "main-c", arg: "", expected: "Main C"},
+		{channelID: "main-c", arg: "A", expected: "Main A"},
+		{channelID: "general", arg: "A", expected: "Main A"},
+		{channelID: "general", arg: "B", fail: true},
+		{channelID: "academy", arg: "2", expected: "Academy B"},
+		{channelID: "general", arg: "1", expected: "Academy A"},
+		{channelID: "main-c", arg: "2", expected: "Main B"},
+		{channelID: "academy", arg: "3", fail: true},
+		{channelID: "academy", arg: "0", fail: true},
+		{channelID: "academy", arg: "def", fail: true},
+	}
+
+	for _, d := range testData {
+		resolved, err := resolveInstance(instances, d.channelID, d.arg)
+		if d.fail {
+			if err == nil {
+				t.Errorf("%q in %v should not be resolved, got %q", d.arg, d.channelID, resolved)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q in %v should be resolved: %v", d.arg, d.channelID, err)
+		}
+		if resolved != d.expected {
+			t.Errorf("%q in %v should be resolved to %q, not %q", d.arg, d.channelID, d.expected, resolved)
+		}
+	}
+
+	if _, err := resolveInstance(nil, "general", ""); err == nil {
+		t.Error("Should not resolve an instance when there are none")
+	}
+}
+
+func Test_leadingInstanceArg(t *testing.T) {
+	instances := []wsInstance{
+		{name: "Academy A", code: "A", corp: "Academy"},
+		{name: "Main A", code: "A", corp: "Main"},
+		{name: "Main C", code: "C", corp: "Main"},
+	}
+
+	testData := []struct {
+		args      []string
+		following int
+		instance  string
+		rest      []string
+	}{
+		{args: []string{"C", "The", "Empire"}, following: 1, instance: "C", rest: []string{"The", "Empire"}},
+		{args: []string{"main", "a", "A", "Team"}, following: 1, instance: "main a", rest: []string{"A", "Team"}},
+		{args: []string{"A", "Team"}, following: 1, rest: []string{"A", "Team"}},
+		{args: []string{"C"}, following: 1, rest: []string{"C"}},
+		{args: []string{"C"}, following: 0, instance: "C", rest: []string{}},
+		{args: []string{"Main", "A"}, following: 1, rest: []string{"Main", "A"}},
+		{args: nil, following: 0, rest: nil},
+	}
+
+	for _, d := range testData {
+		instance, rest := leadingInstanceArg(instances, d.args, d.following)
+		if instance != d.instance || !reflect.DeepEqual(rest, d.rest) {
+			t.Errorf("%q followed by %d should give instance %q and %q, not %q and %q", d.args, d.following, d.instance, d.rest, instance, rest)
+		}
+	}
+}
+
+func Test_instanceAndRoleArgs(t *testing.T) {
+	testData := []struct {
+		args     []string
+		instance string
+		role     wsRole
+	}{
+		{args: nil, instance: "", role: defaultRole},
+		{args: []string{"B"}, instance: "B", role: defaultRole},
+		{args: []string{"def"}, instance: "", role: defense},
+		{args: []string{"B", "hunter"}, instance: "B", role: hunter},
+		{args: []string{"Main", "A"}, instance: "Main A", role: defaultRole},
+		{args: []string{"Main", "A", "off"}, instance: "Main A", role: offense},
+	}
+
+	for _, d := range testData {
+		instance, role := instanceAndRoleArgs(d.args)
+		if instance != d.instance || role != d.role {
+			t.Errorf("%q should give instance %q and role %q, not %q and %q", d.args, d.instance, d.role, instance, role)
+		}
+	}
+}
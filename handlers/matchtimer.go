@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// matchCheckpoints are the times left of a White Star match when a checkpoint is posted, earliest first.
+// The ones on whole days are the daily summaries with the standing of the match.
+var matchCheckpoints = []time.Duration{96 * time.Hour, 72 * time.Hour, 48 * time.Hour, 24 * time.Hour, 6 * time.Hour, time.Hour}
+
+// wsMatchTimer tracks a running White Star match of an instance.
+type wsMatchTimer struct {
+	instance instance
+	// channelID checkpoints are posted to.
+	channelID string
+	started   time.Time
+	// sent are the checkpoints which have been posted, by time left.
+	sent map[time.Duration]bool
+}
+
+func (t wsMatchTimer) end() time.Time {
+	return t.started.Add(wsDuration)
+}
+
+// dueCheckpoints returns the checkpoints which should have been posted at now but have not, earliest first.
+func (t wsMatchTimer) dueCheckpoints(now time.Time) []time.Duration {
+	var due []time.Duration
+	for _, left := range matchCheckpoints {
+		if !t.sent[left] && !t.end().Add(-left).After(now) {
+			due = append(due, left)
+		}
+	}
+	return due
+}
+
+// restoreMatchTimers starts the timers of the running matches.
+// Only the latest checkpoint missed while the bot was offline is posted, and none if the match is over.
+func restoreMatchTimers(s *discordgo.Session, db *sql.DB) {
+	timers, err := getMatchTimersFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get match timers:", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, t := range timers {
+		due := t.dueCheckpoints(now)
+		if len(due) > 0 {
+			err = setCheckpointsSentInDatabase(db, t.instance, due)
+			if err != nil {
+				fmt.Println("Failed to set match checkpoints sent:", err.Error())
+			}
+			for _, left := range due {
+				t.sent[left] = true
+			}
+
+			if now.Before(t.end()) {
+				sendMatchCheckpoint(t, due[len(due)-1], s, db)
+			}
+		}
+
+		startMatchTimers(t, s, db)
+	}
+}
+
+// WSTimeCommand for showing how far a White Star match has come.
+func WSTimeCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "time",
+		Permission:      commands.Members,
+		HelpDescription: "Show the time left of the WS match",
+		Handler:         HandleWSTime,
+		Help: commands.Help{
+			Summary: "Show the time left of the WS match",
+			DetailedDescription: "Show how long the White Star match has been running and how long is left. " +
+				"The match timer starts with `ws start`, checkpoints are posted to the instance channel 24h, 6h and 1h before the end, " +
+				"and every day a summary with the opponent and the destroyed ships of both sides.",
+			Syntax:  "ws time [instance]",
+			Example: "ws time A",
+		},
+	}
+}
+
+// HandleWSTime handles showing the elapsed and remaining time of the match.
+func HandleWSTime(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	t, err := getMatchTimerFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get match timer:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Color:       infoColor,
+		Description: fmt.Sprintf("The White Star match in %v has not started, officers start it with `!ws start`.", instance),
+	}
+	if !t.started.IsZero() {
+		response.Title = fmt.Sprintf("White Star in %v", instance)
+		response.Description = formatMatchTime(t, time.Now(), userLocation(db, m.Author.ID))
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func formatMatchTime(t wsMatchTimer, now time.Time, loc *time.Location) string {
+	description := fmt.Sprintf("Started: %v", formatRelativeTime(t.started, now, loc))
+	if !now.Before(t.end()) {
+		return description + fmt.Sprintf("\nThe match is over, it ended %v.", formatRelativeTime(t.end(), now, loc))
+	}
+
+	day := int(now.Sub(t.started)/(24*time.Hour)) + 1
+	return description + fmt.Sprintf("\nDay %d of %d, %v left\nEnds: %v",
+		day, int(wsDuration/(24*time.Hour)), formatDuration(t.end().Sub(now)), formatRelativeTime(t.end(), now, loc))
+}
+
+// startMatchTimer stores the timer of a match started at the given time and starts it.
+// The checkpoints are posted to the first channel of the instance, or the event channel if it has none.
+func startMatchTimer(instance instance, started time.Time, s *discordgo.Session, db *sql.DB) error {
+	channelID := botEventChannelID
+	i, err := getInstanceFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get instance:", err.Error())
+	} else if len(i.channelIDs) > 0 {
+		channelID = i.channelIDs[0]
+	}
+
+	t := wsMatchTimer{
+		instance:  instance,
+		channelID: channelID,
+		started:   started.Truncate(time.Second),
+		sent:      make(map[time.Duration]bool),
+	}
+	// Checkpoints which passed before the match was marked as started are skipped
+	for _, left := range t.dueCheckpoints(time.Now()) {
+		t.sent[left] = true
+	}
+
+	err = setMatchTimerInDatabase(db, t)
+	if err != nil {
+		return err
+	}
+	startMatchTimers(t, s, db)
+	return nil
+}
+
+// startMatchTimers for the checkpoints which have not been posted yet.
+func startMatchTimers(t wsMatchTimer, s *discordgo.Session, db *sql.DB) {
+	for _, left := range matchCheckpoints {
+		if t.sent[left] {
+			continue
+		}
+		go waitForMatchCheckpoint(t, left, time.After(time.Until(t.end().Add(-left))), s, db)
+	}
+}
+
+// waitForMatchCheckpoint posts the checkpoint when the timer expires.
+// Nothing is done if the match has ended or been restarted in the meantime.
+func waitForMatchCheckpoint(t wsMatchTimer, left time.Duration, c <-chan time.Time, s *discordgo.Session, db *sql.DB) {
+	<-c
+
+	current, err := getMatchTimerFromDatabase(db, t.instance)
+	if err != nil {
+		fmt.Println("Failed to get match timer:", err.Error())
+		return
+	}
+	if !current.started.Equal(t.started) || current.sent[left] {
+		return
+	}
+
+	err = setCheckpointsSentInDatabase(db, t.instance, []time.Duration{left})
+	if err != nil {
+		fmt.Println("Failed to set match checkpoint sent:", err.Error())
+	}
+	sendMatchCheckpoint(current, left, s, db)
+}
+
+func sendMatchCheckpoint(t wsMatchTimer, left time.Duration, s *discordgo.Session, db *sql.DB) {
+	msg := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("White Star in %v: %v left", t.instance, formatDuration(left)),
+		Color:       infoColor,
+		Description: fmt.Sprintf("The match ends <t:%d:f>.", t.end().Unix()),
+	}
+	if left%(24*time.Hour) == 0 && left > 24*time.Hour {
+		days := int(wsDuration / (24 * time.Hour))
+		msg.Title = fmt.Sprintf("White Star in %v: day %d of %d is over", t.instance, days-int(left/(24*time.Hour)), days)
+		msg.Description = fmt.Sprintf("%v left, the match ends <t:%d:f>.", formatDuration(left), t.end().Unix())
+		msg.Fields = matchStandingFields(t.instance, db)
+	}
+
+	_, err := s.ChannelMessageSendEmbed(t.channelID, &msg)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// matchStandingFields returns the opponent and destroyed ships of the match for the daily summaries.
+func matchStandingFields(instance instance, db *sql.DB) []*discordgo.MessageEmbedField {
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return nil
+	}
+	opponent, err := getOpponentFromDatabase(db, round.id)
+	if err != nil {
+		fmt.Println("Failed to get opponent:", err.Error())
+		return nil
+	}
+	downs, err := getShipDownsFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get destroyed ships:", err.Error())
+		return nil
+	}
+
+	if opponent == "" {
+		opponent = "Not set, officers set it with `!ws opponent`"
+	}
+	ours, theirs := countShipsDown(downs)
+	return []*discordgo.MessageEmbedField{
+		{Name: "Opponent", Value: opponent},
+		{Name: "Our ships down", Value: ours, Inline: true},
+		{Name: "Enemy ships down", Value: theirs, Inline: true},
+	}
+}
+
+const matchTimerColumns = "instance, channel_id, started_at, sent_offsets"
+
+func scanMatchTimer(row interface{ Scan(...interface{}) error }) (wsMatchTimer, error) {
+	var (
+		t    wsMatchTimer
+		sent []int64
+	)
+	err := row.Scan(&t.instance, &t.channelID, &t.started, pq.Array(&sent))
+	if err != nil {
+		return t, err
+	}
+
+	t.sent = make(map[time.Duration]bool)
+	for _, sec := range sent {
+		t.sent[time.Duration(sec)*time.Second] = true
+	}
+	return t, nil
+}
+
+// getMatchTimerFromDatabase returns the match timer of the instance, with a zero start if it has none.
+func getMatchTimerFromDatabase(db *sql.DB, instance instance) (wsMatchTimer, error) {
+	row := db.QueryRow("SELECT "+matchTimerColumns+" FROM ws_match_timers WHERE instance = $1", instance)
+	t, err := scanMatchTimer(row)
+	if err == sql.ErrNoRows {
+		return wsMatchTimer{instance: instance, sent: make(map[time.Duration]bool)}, nil
+	}
+	return t, errors.Wrap(err, "failed to do query")
+}
+
+func getMatchTimersFromDatabase(db *sql.DB) ([]wsMatchTimer, error) {
+	rows, err := db.Query("SELECT " + matchTimerColumns + " FROM ws_match_timers")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var timers []wsMatchTimer
+	for rows.Next() {
+		t, err := scanMatchTimer(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		timers = append(timers, t)
+	}
+
+	return timers, nil
+}
+
+// setMatchTimerInDatabase replaces the match timer of the instance.
+func setMatchTimerInDatabase(db *sql.DB, t wsMatchTimer) error {
+	seconds := make([]int64, 0, len(t.sent))
+	for left := range t.sent {
+		seconds = append(seconds, int64(left/time.Second))
+	}
+
+	statement := `INSERT INTO ws_match_timers (instance, channel_id, started_at, sent_offsets) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (instance) DO UPDATE SET channel_id = $2, started_at = $3, sent_offsets = $4`
+	_, err := db.Exec(statement, t.instance, t.channelID, t.started.UTC().Format(dbTimeFormat), pq.Array(seconds))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func setCheckpointsSentInDatabase(db *sql.DB, instance instance, checkpoints []time.Duration) error {
+	seconds := make([]int64, len(checkpoints))
+	for i, left := range checkpoints {
+		seconds[i] = int64(left / time.Second)
+	}
+
+	statement := "UPDATE ws_match_timers SET sent_offsets = sent_offsets || $2::bigint[] WHERE instance = $1"
+	_, err := db.Exec(statement, instance, pq.Array(seconds))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func deleteMatchTimerFromDatabase(db *sql.DB, instance instance) error {
+	_, err := db.Exec("DELETE FROM ws_match_timers WHERE instance = $1", instance)
+	return errors.Wrap(err, "failed to execute query")
+}
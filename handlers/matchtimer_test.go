@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_dueCheckpoints(t *testing.T) {
+	started := time.Date(2018, 9, 14, 20, 0, 0, 0, time.UTC)
+	timer := wsMatchTimer{
+		started: started,
+		sent:    map[time.Duration]bool{96 * time.Hour: true},
+	}
+
+	testData := []struct {
+		now      time.Time
+		expected []time.Duration
+	}{
+		{now: started, expected: nil},
+		{now: started.Add(30 * time.Hour), expected: nil},
+		{now: started.Add(48 * time.Hour), expected: []time.Duration{72 * time.Hour}},
+		{now: started.Add(115 * time.Hour), expected: []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour, 6 * time.Hour}},
+		{now: started.Add(wsDuration), expected: []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour, 6 * time.Hour, time.Hour}},
+	}
+
+	for _, data := range testData {
+		actual := timer.dueCheckpoints(data.now)
+		if !reflect.DeepEqual(actual, data.expected) {
+			t.Errorf("due checkpoints at %v were %v, expected %v", data.now, actual, data.expected)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memberEventKind is something that happened to a member of the guild.
+type memberEventKind string
+
+const (
+	memberJoined memberEventKind = "joined"
+	memberLeft   memberEventKind = "left"
+	roleGranted  memberEventKind = "granted"
+	roleLost     memberEventKind = "lost"
+)
+
+// trackedRoles are the roles changes are recorded for, in the order they're listed.
+var trackedRoles = []struct {
+	id   string
+	name string
+}{
+	{id: commands.AcademyRoleID, name: "Academy"},
+	{id: commands.MemberRoleID, name: "Member"},
+	{id: commands.OfficerRoleID, name: "Officer"},
+}
+
+// memberEvent is an entry in the timeline of a member.
+type memberEvent struct {
+	userID string
+	name   string
+	kind   memberEventKind
+	// role is the name of the role granted or lost.
+	role string
+	at   time.Time
+}
+
+func (e memberEvent) String() string {
+	switch e.kind {
+	case roleGranted:
+		return fmt.Sprintf("Became %v", e.role)
+	case roleLost:
+		return fmt.Sprintf("No longer %v", e.role)
+	}
+	return strings.Title(string(e.kind))
+}
+
+// trackedRoleNames returns the names of the tracked roles among the role IDs.
+func trackedRoleNames(roleIDs []string) []string {
+	names := []string{}
+	for _, role := range trackedRoles {
+		for _, id := range roleIDs {
+			if id == role.id {
+				names = append(names, role.name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// roleChanges returns the roles which are only in after, and the ones only in before.
+func roleChanges(before []string, after []string) ([]string, []string) {
+	contains := func(roles []string, role string) bool {
+		for _, r := range roles {
+			if r == role {
+				return true
+			}
+		}
+		return false
+	}
+
+	var granted, lost []string
+	for _, role := range after {
+		if !contains(before, role) {
+			granted = append(granted, role)
+		}
+	}
+	for _, role := range before {
+		if !contains(after, role) {
+			lost = append(lost, role)
+		}
+	}
+	return granted, lost
+}
+
+// memberSnapshot is what was last known about a member, to tell what changed.
+type memberSnapshot struct {
+	userID string
+	name   string
+	roles  []string
+}
+
+// roleEvents returns the events of the member's tracked roles changing from the snapshot.
+func roleEvents(snapshot memberSnapshot, roles []string, at time.Time) []memberEvent {
+	granted, lost := roleChanges(snapshot.roles, roles)
+	var events []memberEvent
+	for _, role := range granted {
+		events = append(events, memberEvent{userID: snapshot.userID, name: snapshot.name, kind: roleGranted, role: role, at: at})
+	}
+	for _, role := range lost {
+		events = append(events, memberEvent{userID: snapshot.userID, name: snapshot.name, kind: roleLost, role: role, at: at})
+	}
+	return events
+}
+
+// MemberCommand for the history of the guild members.
+func MemberCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "member",
+		Permission:      commands.Officers,
+		HelpDescription: "Show when members joined, left and changed roles",
+		Init:            InitMemberTimeline,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "history",
+				Permission:      commands.Officers,
+				HelpDescription: "Show the timeline of a member",
+				Handler:         HandleMemberHistory,
+				Help: commands.Help{
+					Summary:             "Show the timeline of a member",
+					DetailedDescription: "Show when the member joined or left the server and got or lost the Academy, Member and Officer roles.",
+					Syntax:              "member history @member",
+					Example:             "member history @Rick",
+				},
+			},
+			{
+				CallPhrase:      "digest",
+				Permission:      commands.Officers,
+				HelpDescription: "Set the channel of the weekly joined and left digest",
+				Handler:         HandleMemberDigest,
+				Help: commands.Help{
+					Summary: "Set the channel of the weekly joined and left digest",
+					DetailedDescription: "Set the channel a digest of who joined and left the server is posted to every Monday, " +
+						"or turn it off with `off`. Without arguments the digest of the current week is shown.",
+					Syntax:  "member digest [#channel|off]",
+					Example: "member digest #officers",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary: "Show when members joined, left and changed roles",
+			DetailedDescription: "Joining and leaving the server and getting or losing the Academy, Member and Officer roles are recorded for every member. " +
+				"Members who leave are removed from the Red Star queues and from the WS sign-ups and rosters that haven't been matched yet.",
+			Syntax:  "member history @member",
+			Example: "member history @Rick",
+		},
+	}
+}
+
+// memberDigest is the weekly digest of who joined and left the server.
+var memberDigest = weeklyPost{name: "member digest", helpCommand: "member digest", build: buildMemberDigest}
+
+// InitMemberTimeline records what changed while the bot was offline and starts posting the weekly digests.
+// The first time the members are only stored.
+func InitMemberTimeline(s *discordgo.Session, db *sql.DB, guildID string) {
+	go startWeeklyPosts(memberDigest, s, db, guildID)
+
+	snapshots, err := getMemberSnapshotsFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get member snapshots:", err.Error())
+		return
+	}
+	members, err := getGuildMembers(s, guildID)
+	if err != nil {
+		fmt.Println("Failed to get guild members:", err.Error())
+		return
+	}
+
+	firstRun := len(snapshots) == 0
+	now := time.Now()
+	for _, member := range members {
+		if member.User == nil || member.User.Bot {
+			continue
+		}
+		snapshot, ok := snapshots[member.User.ID]
+		delete(snapshots, member.User.ID)
+		switch {
+		case firstRun:
+			err = setMemberSnapshotInDatabase(db, newMemberSnapshot(member))
+		case ok:
+			err = recordRoleChanges(snapshot, member, now, db)
+		default:
+			err = recordMemberJoined(member, now, db)
+		}
+		if err != nil {
+			fmt.Println("Failed to record member changes:", err.Error())
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		recordMemberLeft(snapshot, now, s, db)
+	}
+}
+
+func newMemberSnapshot(member *discordgo.Member) memberSnapshot {
+	return memberSnapshot{userID: member.User.ID, name: memberName(member), roles: trackedRoleNames(member.Roles)}
+}
+
+// HandleMemberAdd records that a member joined the guild.
+func HandleMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd, db *sql.DB, guildID string) {
+	if m.User == nil || m.User.Bot {
+		return
+	}
+	err := recordMemberJoined(m.Member, time.Now(), db)
+	if err != nil {
+		fmt.Println("Failed to record member joining:", err.Error())
+	}
+}
+
+// HandleMemberUpdate records the tracked roles the member got or lost.
+func HandleMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate, db *sql.DB, guildID string) {
+	if m.User == nil || m.User.Bot {
+		return
+	}
+	snapshot, ok, err := getMemberSnapshotFromDatabase(db, m.User.ID)
+	if err != nil {
+		fmt.Println("Failed to get member snapshot:", err.Error())
+		return
+	}
+	if !ok {
+		err = setMemberSnapshotInDatabase(db, newMemberSnapshot(m.Member))
+	} else {
+		err = recordRoleChanges(snapshot, m.Member, time.Now(), db)
+	}
+	if err != nil {
+		fmt.Println("Failed to record member changes:", err.Error())
+	}
+}
+
+// HandleMemberRemove records that a member left the guild and removes them from the sign-ups, rosters and queues.
+func HandleMemberRemove(s *discordgo.Session, m *discordgo.GuildMemberRemove, db *sql.DB, guildID string) {
+	if m.User == nil || m.User.Bot {
+		return
+	}
+	snapshot, ok, err := getMemberSnapshotFromDatabase(db, m.User.ID)
+	if err != nil {
+		fmt.Println("Failed to get member snapshot:", err.Error())
+	}
+	if !ok {
+		snapshot = memberSnapshot{userID: m.User.ID, name: m.User.Username}
+	}
+	recordMemberLeft(snapshot, time.Now(), s, db)
+}
+
+func recordMemberJoined(member *discordgo.Member, at time.Time, db *sql.DB) error {
+	snapshot := newMemberSnapshot(member)
+	events := []memberEvent{{userID: snapshot.userID, name: snapshot.name, kind: memberJoined, at: at}}
+	events = append(events, roleEvents(memberSnapshot{userID: snapshot.userID, name: snapshot.name}, snapshot.roles, at)...)
+	return setMemberEventsInDatabase(db, snapshot, events)
+}
+
+func recordRoleChanges(snapshot memberSnapshot, member *discordgo.Member, at time.Time, db *sql.DB) error {
+	current := newMemberSnapshot(member)
+	snapshot.name = current.name
+	return setMemberEventsInDatabase(db, current, roleEvents(snapshot, current.roles, at))
+}
+
+// recordMemberLeft records that the member left and removes them from everything they were waiting for.
+func recordMemberLeft(snapshot memberSnapshot, at time.Time, s *discordgo.Session, db *sql.DB) {
+	event := memberEvent{userID: snapshot.userID, name: snapshot.name, kind: memberLeft, at: at}
+	err := addMemberLeftToDatabase(db, event)
+	if err != nil {
+		fmt.Println("Failed to record member leaving:", err.Error())
+	}
+
+	instances, err := deleteMemberFromRostersInDatabase(db, snapshot.userID)
+	if err != nil {
+		fmt.Println("Failed to remove departed member from the rosters:", err.Error())
+	}
+	for _, instance := range instances {
+		updateSignUpMessages(instance, s, db)
+	}
+	_, err = deleteRedStarEntriesFromDatabase(db, snapshot.userID, nil)
+	if err != nil {
+		fmt.Println("Failed to remove departed member from the Red Star queues:", err.Error())
+	}
+}
+
+// HandleMemberHistory handles showing the timeline of a member.
+func HandleMemberHistory(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	if len(m.Mentions) == 0 {
+		sendFailMessage("Incorrect syntax, mention the member. Check `!help member history`.", s, m)
+		return
+	}
+	user := m.Mentions[0]
+
+	events, err := getMemberEventsFromDatabase(db, user.ID, time.Time{}, time.Now())
+	if err != nil {
+		fmt.Println("Failed to get member events:", err.Error())
+		return
+	}
+
+	now := time.Now()
+	loc := userLocation(db, m.Author.ID)
+	var content string
+	for _, e := range events {
+		content += fmt.Sprintf("%v: %v\n", formatRelativeTime(e.at, now, loc), e)
+	}
+	if content == "" {
+		content = fmt.Sprintf("Nothing has been recorded for %v.", user.Username)
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Timeline of %v", displayName(s, guildID, user.ID, user.Username)),
+		Color:       infoColor,
+		Description: content,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleMemberDigest handles setting the channel of the weekly digest, or showing the digest of the current week.
+func HandleMemberDigest(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	handleWeeklyPost(memberDigest, msg, s, m, db, guildID)
+}
+
+// buildMemberDigest builds the digest of who joined and left from the start up until the end.
+func buildMemberDigest(start time.Time, end time.Time, db *sql.DB) (*discordgo.MessageEmbed, error) {
+	events, err := getMemberEventsFromDatabase(db, "", start, end)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get member events")
+	}
+
+	names := make(map[memberEventKind][]string)
+	for _, e := range events {
+		if e.kind == memberJoined || e.kind == memberLeft {
+			names[e.kind] = append(names[e.kind], e.name)
+		}
+	}
+
+	var fields []*discordgo.MessageEmbedField
+	for _, kind := range []memberEventKind{memberJoined, memberLeft} {
+		if len(names[kind]) == 0 {
+			continue
+		}
+		sort.Slice(names[kind], func(i, j int) bool { return strings.ToLower(names[kind][i]) < strings.ToLower(names[kind][j]) })
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   fmt.Sprintf("%v (%d)", strings.Title(string(kind)), len(names[kind])),
+			Value:  strings.Join(names[kind], "\n"),
+			Inline: true,
+		})
+	}
+
+	msg := discordgo.MessageEmbed{
+		Title:  fmt.Sprintf("Members of the week of %v", start.Format("Jan 2")),
+		Color:  infoColor,
+		Fields: fields,
+	}
+	if len(fields) == 0 {
+		msg.Description = "Nobody joined or left."
+	}
+	return &msg, nil
+}
+
+// getMemberSnapshotsFromDatabase returns the snapshots of the members mapped by user ID.
+func getMemberSnapshotsFromDatabase(db *sql.DB) (map[string]memberSnapshot, error) {
+	rows, err := db.Query("SELECT user_id, name, roles FROM member_snapshots")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	snapshots := make(map[string]memberSnapshot)
+	for rows.Next() {
+		var snapshot memberSnapshot
+		err = rows.Scan(&snapshot.userID, &snapshot.name, pq.Array(&snapshot.roles))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		snapshots[snapshot.userID] = snapshot
+	}
+
+	return snapshots, nil
+}
+
+// getMemberSnapshotFromDatabase returns the snapshot of the member and whether there is one.
+func getMemberSnapshotFromDatabase(db *sql.DB, userID string) (memberSnapshot, bool, error) {
+	snapshot := memberSnapshot{userID: userID}
+	err := db.QueryRow("SELECT name, roles FROM member_snapshots WHERE user_id = $1", userID).Scan(&snapshot.name, pq.Array(&snapshot.roles))
+	if err == sql.ErrNoRows {
+		return snapshot, false, nil
+	}
+	if err != nil {
+		return snapshot, false, errors.Wrap(err, "failed to do query")
+	}
+	return snapshot, true, nil
+}
+
+func setMemberSnapshotInDatabase(db *sql.DB, snapshot memberSnapshot) error {
+	return setMemberEventsInDatabase(db, snapshot, nil)
+}
+
+// setMemberEventsInDatabase adds the events of the member and replaces the snapshot.
+func setMemberEventsInDatabase(db *sql.DB, snapshot memberSnapshot, events []memberEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	statement := `INSERT INTO member_snapshots (user_id, name, roles) VALUES ($1, $2, $3)
+	ON CONFLICT (user_id) DO UPDATE SET name = $2, roles = $3`
+	_, err = tx.Exec(statement, snapshot.userID, snapshot.name, pq.Array(snapshot.roles))
+	if err != nil {
+		return errors.Wrap(err, "failed to set snapshot")
+	}
+	for _, e := range events {
+		statement = "INSERT INTO member_events (user_id, name, kind, role, happened_at) VALUES ($1, $2, $3, $4, $5)"
+		_, err = tx.Exec(statement, e.userID, e.name, e.kind, e.role, e.at.UTC().Format(dbTimeFormat))
+		if err != nil {
+			return errors.Wrap(err, "failed to add event")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// addMemberLeftToDatabase adds the event of the member leaving and deletes the snapshot.
+func addMemberLeftToDatabase(db *sql.DB, e memberEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM member_snapshots WHERE user_id = $1", e.userID)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete snapshot")
+	}
+	statement := "INSERT INTO member_events (user_id, name, kind, role, happened_at) VALUES ($1, $2, $3, $4, $5)"
+	_, err = tx.Exec(statement, e.userID, e.name, e.kind, e.role, e.at.UTC().Format(dbTimeFormat))
+	if err != nil {
+		return errors.Wrap(err, "failed to add event")
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// getMemberEventsFromDatabase returns the events of the member, or of everyone if the user ID is empty, from the start up until the end.
+func getMemberEventsFromDatabase(db *sql.DB, userID string, start time.Time, end time.Time) ([]memberEvent, error) {
+	query := `SELECT user_id, name, kind, role, happened_at FROM member_events
+	WHERE ($1 = '' OR user_id = $1) AND happened_at >= $2 AND happened_at < $3
+	ORDER BY happened_at, id`
+	rows, err := db.Query(query, userID, start.UTC().Format(dbTimeFormat), end.UTC().Format(dbTimeFormat))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var events []memberEvent
+	for rows.Next() {
+		var e memberEvent
+		err = rows.Scan(&e.userID, &e.name, &e.kind, &e.role, &e.at)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+// deleteMemberFromRostersInDatabase removes the member from the sign-ups and rosters of the instances that haven't been matched yet,
+// returning the instances they were signed up for.
+func deleteMemberFromRostersInDatabase(db *sql.DB, userID string) ([]instance, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	// Instances without a round haven't opened sign-ups yet, which counts as before the match too.
+	beforeMatch := ` AND instance NOT IN (SELECT r.instance FROM ws_rounds r
+	WHERE r.id = (SELECT MAX(id) FROM ws_rounds WHERE instance = r.instance) AND r.phase NOT IN ($2, $3))`
+
+	rows, err := tx.Query("DELETE FROM participants WHERE user_id = $1"+beforeMatch+" RETURNING instance", userID, signUpOpen, scanning)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to delete participant")
+	}
+	var instances []instance
+	for rows.Next() {
+		var i instance
+		err = rows.Scan(&i)
+		if err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		instances = append(instances, i)
+	}
+	rows.Close()
+
+	for _, statement := range []string{
+		"DELETE FROM ws_roster_picks WHERE user_id = $1" + beforeMatch,
+		"DELETE FROM ws_roster_picks_built WHERE user_id = $1" + beforeMatch,
+	} {
+		_, err = tx.Exec(statement, userID, signUpOpen, scanning)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to execute query")
+		}
+	}
+
+	return instances, errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"github.com/MattiasBerlin/outbot/commands"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_trackedRoleNames(t *testing.T) {
+	testData := []struct {
+		roleIDs  []string
+		expected []string
+	}{
+		{roleIDs: nil, expected: []string{}},
+		{roleIDs: []string{"123", commands.OfficerRoleID, commands.MemberRoleID}, expected: []string{"Member", "Officer"}},
+		{roleIDs: []string{commands.AcademyRoleID}, expected: []string{"Academy"}},
+	}
+
+	for _, data := range testData {
+		actual := trackedRoleNames(data.roleIDs)
+		if !reflect.DeepEqual(actual, data.expected) {
+			t.Errorf("Tracked roles of %q were %q, expected %q", data.roleIDs, actual, data.expected)
+		}
+	}
+}
+
+func Test_roleEvents(t *testing.T) {
+	at := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	snapshot := memberSnapshot{userID: "1", name: "amy", roles: []string{"Academy"}}
+
+	testData := []struct {
+		roles    []string
+		expected []memberEvent
+	}{
+		{roles: []string{"Academy"}, expected: nil},
+		{roles: []string{"Member"}, expected: []memberEvent{
+			{userID: "1", name: "amy", kind: roleGranted, role: "Member", at: at},
+			{userID: "1", name: "amy", kind: roleLost, role: "Academy", at: at},
+		}},
+		{roles: []string{"Academy", "Officer"}, expected: []memberEvent{
+			{userID: "1", name: "amy", kind: roleGranted, role: "Officer", at: at},
+		}},
+	}
+
+	for _, data := range testData {
+		actual := roleEvents(snapshot, data.roles, at)
+		if !reflect.DeepEqual(actual, data.expected) {
+			t.Errorf("Events for %q were %+v, expected %+v", data.roles, actual, data.expected)
+		}
+	}
+}
@@ -1,12 +1,26 @@
 package handlers
 
 import (
+	"database/sql"
 	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
 	"golang.org/x/net/html"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// supportModulesURL is the wiki page listing the stats of the support modules.
+const supportModulesURL = "https://hades-star.fandom.com/wiki/Support_Modules"
+
+// wikiClient fetches the wiki pages.
+var wikiClient = &http.Client{Timeout: 30 * time.Second}
+
+// module with its stats per level, as listed on the wiki.
 type module struct {
 	name   string
 	levels []level
@@ -17,31 +31,498 @@ type level struct {
 	values []value
 }
 
+// value of a stat at a level.
 type value struct {
-	name  string
+	name string
+	// value of the stat as a number, durations are in seconds. It's 0 if the stat isn't a number, e.g. "3 sectors".
 	value int
+	// text of the stat as written on the wiki, e.g. "2,500" or "1m 30s".
+	text string
+}
+
+func newValue(name string, text string) value {
+	return value{name: name, value: parseStatValue(text), text: text}
+}
+
+// parseStatValue returns the number written in the text, like "2,500", or the seconds of a duration like "1d 12h".
+// 0 is returned for any other text.
+func parseStatValue(text string) int {
+	if n, err := strconv.Atoi(strings.Replace(text, ",", "", -1)); err == nil {
+		return n
+	}
+
+	// Durations can start with days, which time.ParseDuration has no unit for
+	duration := strings.Replace(text, " ", "", -1)
+	var days int
+	if i := strings.Index(duration, "d"); i > 0 {
+		if n, err := strconv.Atoi(duration[:i]); err == nil {
+			days, duration = n, duration[i+1:]
+		}
+	}
+	if days > 0 && duration == "" {
+		return days * 24 * 60 * 60
+	}
+	if d, err := time.ParseDuration(duration); err == nil {
+		return days*24*60*60 + int(d/time.Second)
+	}
+	return 0
+}
+
+// moduleParser parses the modules listed on a wiki page.
+type moduleParser interface {
+	parseModules(r io.Reader) ([]module, error)
+}
+
+// wikiTableParser reads each module from the first stat table after its heading.
+// Tables can list the levels either as columns or as rows.
+type wikiTableParser struct{}
+
+// tableReader collects the text of the cells of a table, row by row.
+type tableReader struct {
+	rows [][]string
+	row  []string
+	// cell is nil outside of cells.
+	cell    *strings.Builder
+	colspan int
+	// nested is how many tables deep inside the table the tokenizer is, their content is skipped.
+	nested int
+}
+
+func (t *tableReader) startTag(tok html.Token) {
+	switch tok.Data {
+	case "tr":
+		t.row = nil
+	case "th", "td":
+		t.cell = &strings.Builder{}
+		t.colspan = 1
+		if span, err := strconv.Atoi(attr(tok, "colspan")); err == nil && span > 1 {
+			t.colspan = span
+		}
+	case "br":
+		if t.cell != nil {
+			t.cell.WriteString(" ")
+		}
+	}
+}
+
+func (t *tableReader) endTag(tok html.Token) {
+	switch tok.Data {
+	case "tr":
+		if len(t.row) > 0 {
+			t.rows = append(t.rows, t.row)
+		}
+		t.row = nil
+	case "th", "td":
+		if t.cell == nil {
+			return
+		}
+		text := cleanText(t.cell.String())
+		for i := 0; i < t.colspan; i++ {
+			t.row = append(t.row, text)
+		}
+		t.cell = nil
+	}
+}
+
+func (wikiTableParser) parseModules(r io.Reader) ([]module, error) {
+	z := html.NewTokenizer(r)
+	var (
+		modules []module
+		// heading is the name of the latest module heading whose table hasn't been read.
+		heading string
+		// headline is how many spans deep inside a headline the tokenizer is, 0 outside of one.
+		headline     int
+		headlineText strings.Builder
+		table        *tableReader
+	)
+
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return modules, nil
+			}
+			return nil, errors.Wrap(z.Err(), "failed to read page")
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch {
+			case headline > 0 && tok.Data == "span":
+				headline++
+			case tok.Data == "span" && hasClass(tok, "mw-headline"):
+				headline = 1
+				headlineText.Reset()
+			case table != nil && tok.Data == "table":
+				table.nested++
+			case table != nil && table.nested == 0:
+				table.startTag(tok)
+			case tok.Data == "table" && heading != "" && hasClass(tok, "wikitable"):
+				table = &tableReader{}
+			}
+
+		case html.EndTagToken:
+			tok := z.Token()
+			switch {
+			case headline > 0 && tok.Data == "span":
+				headline--
+				if headline == 0 {
+					heading = cleanText(headlineText.String())
+				}
+			case table != nil && tok.Data == "table" && table.nested > 0:
+				table.nested--
+			case table != nil && tok.Data == "table":
+				if m, ok := moduleFromTable(heading, table.rows); ok {
+					modules = append(modules, m)
+				}
+				heading = ""
+				table = nil
+			case table != nil && table.nested == 0:
+				table.endTag(tok)
+			}
+
+		case html.TextToken:
+			text := string(z.Text())
+			if headline > 0 {
+				headlineText.WriteString(text)
+			}
+			if table != nil && table.nested == 0 && table.cell != nil {
+				table.cell.WriteString(text)
+			}
+		}
+	}
 }
 
-func getModules() ([]module, error) {
-	resp, err := http.Get("https://hades-star.fandom.com/wiki/Support_Modules")
+// moduleFromTable reads the levels of the module from the rows of its table.
+// The first cell is "Level" and either the rest of the first row or the first cells of the other rows are the levels.
+func moduleFromTable(name string, rows [][]string) (module, bool) {
+	m := module{name: name}
+	if len(rows) < 2 || len(rows[0]) < 2 || !strings.EqualFold(rows[0][0], "level") {
+		return m, false
+	}
+	header := rows[0]
+
+	if _, err := strconv.Atoi(header[1]); err == nil {
+		// Levels as columns, each row is a stat
+		columns := make([]int, len(header)-1)
+		for i, cell := range header[1:] {
+			columns[i] = -1
+			n, err := strconv.Atoi(cell)
+			if err != nil {
+				continue
+			}
+			columns[i] = len(m.levels)
+			m.levels = append(m.levels, level{level: n})
+		}
+		for _, row := range rows[1:] {
+			for i, cell := range row[1:] {
+				if i < len(columns) && columns[i] >= 0 && cell != "" {
+					m.levels[columns[i]].values = append(m.levels[columns[i]].values, newValue(row[0], cell))
+				}
+			}
+		}
+		return m, len(m.levels) > 0
+	}
+
+	// Levels as rows, each column is a stat
+	for _, row := range rows[1:] {
+		n, err := strconv.Atoi(row[0])
+		if err != nil {
+			continue
+		}
+		l := level{level: n}
+		for i, cell := range row[1:] {
+			if i+1 < len(header) && cell != "" {
+				l.values = append(l.values, newValue(header[i+1], cell))
+			}
+		}
+		m.levels = append(m.levels, l)
+	}
+	return m, len(m.levels) > 0
+}
+
+// cleanText trims the text and collapses its whitespace.
+func cleanText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+func attr(tok html.Token, key string) string {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasClass(tok html.Token, class string) bool {
+	for _, c := range strings.Fields(attr(tok, "class")) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// getModules fetches the page and parses its modules.
+func getModules(url string, parser moduleParser) ([]module, error) {
+	resp, err := wikiClient.Get(url)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to reach wiki")
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("wiki responded with %v", resp.Status)
+	}
 
-	for {
-		z := html.NewTokenizer(resp.Body)
-		token := z.Next()
-		fmt.Println(token.String())
-		switch token {
-		case html.ErrorToken:
-			fmt.Println("Error:", z.Err())
-			return nil, nil
-		case html.StartTagToken, html.EndTagToken:
-			tn, _ := z.TagName()
-			fmt.Println("TagName:", tn)
+	return parser.parseModules(resp.Body)
+}
+
+// ModInfoCommand for showing the stats of a module.
+func ModInfoCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "modinfo",
+		Permission:      commands.Members,
+		HelpDescription: "Show the stats of a support module",
+		Handler:         HandleModInfo,
+		Init:            InitModInfo,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "refresh",
+				Permission:      commands.Officers,
+				HelpDescription: "Fetch the module stats from the wiki again",
+				Handler:         HandleRefreshModInfo,
+				Help: commands.Help{
+					Summary:             "Fetch the module stats from the wiki again",
+					DetailedDescription: "Replace the stored module stats with the ones on the wiki, " + supportModulesURL,
+					Syntax:              "modinfo refresh",
+					Example:             "modinfo refresh",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary: "Show the stats of a support module",
+			DetailedDescription: "Show the stats of every level of a support module, or of one level, as listed on the wiki. " +
+				"Modules can be given by name or abbreviation, see `mods list`. The stats are fetched from the wiki when the bot starts if none are stored.",
+			Syntax:  "modinfo <module> [level]",
+			Example: "modinfo tw 5",
+		},
+	}
+}
+
+// InitModInfo fetches the module stats in the background if none have been stored yet.
+func InitModInfo(s *discordgo.Session, db *sql.DB, guildID string) {
+	count, err := countModulesInDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to count stored modules:", err.Error())
+		return
+	}
+	if count > 0 {
+		return
+	}
+
+	go func() {
+		_, err := refreshModuleCache(db)
+		if err != nil {
+			fmt.Println("Failed to fetch module stats:", err.Error())
+		}
+	}()
+}
+
+// HandleModInfo handles showing the stats of a module.
+func HandleModInfo(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	lvl := 0
+	if len(args) > 1 {
+		if n, err := strconv.Atoi(args[len(args)-1]); err == nil {
+			lvl = n
+			args = args[:len(args)-1]
+		}
+	}
+	if len(args) == 0 {
+		sendFailMessage("Missing module, check `!help modinfo`.", s, m)
+		return
+	}
+	name := strings.Join(args, " ")
+	if def, ok := findModule(name); ok {
+		name = def.name
+	}
+
+	mod, err := getModuleFromDatabase(db, name)
+	if err == sql.ErrNoRows {
+		// Nothing has been fetched yet if no modules are stored at all
+		var count int
+		count, err = countModulesInDatabase(db)
+		if err == nil && count == 0 {
+			_, err = refreshModuleCache(db)
+			if err == nil {
+				mod, err = getModuleFromDatabase(db, name)
+			}
+		}
+	}
+	if err == sql.ErrNoRows {
+		sendFailMessage(fmt.Sprintf("There are no stats for %q, only support modules are listed.", name), s, m)
+		return
+	}
+	if err != nil {
+		fmt.Println("Failed to get module stats:", err.Error())
+		sendFailMessage("Failed to get the module stats.", s, m)
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       mod.name,
+		Color:       infoColor,
+		Description: formatModuleStats(mod),
+		URL:         supportModulesURL,
+	}
+	if lvl != 0 {
+		response.Title = fmt.Sprintf("%v level %d", mod.name, lvl)
+		response.Description = ""
+		for _, l := range mod.levels {
+			if l.level != lvl {
+				continue
+			}
+			for _, v := range l.values {
+				response.Description += fmt.Sprintf("**%v**: %v\n", v.name, v.text)
+			}
+		}
+		if response.Description == "" {
+			sendFailMessage(fmt.Sprintf("%v has no level %d.", mod.name, lvl), s, m)
+			return
+		}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// formatModuleStats lists every stat with its value on each level, e.g. "**Cost**: 1,000 / 2,000".
+// Levels without the stat are shown as "-", so the values stay under their level.
+func formatModuleStats(mod module) string {
+	var names []string
+	values := make(map[string][]string)
+	for i, l := range mod.levels {
+		for _, v := range l.values {
+			if _, exists := values[v.name]; !exists {
+				names = append(names, v.name)
+				values[v.name] = make([]string, len(mod.levels))
+			}
+			values[v.name][i] = v.text
+		}
+	}
+
+	content := fmt.Sprintf("Levels %d-%d\n", mod.levels[0].level, mod.levels[len(mod.levels)-1].level)
+	for _, name := range names {
+		for i, text := range values[name] {
+			if text == "" {
+				values[name][i] = "-"
+			}
+		}
+		content += fmt.Sprintf("**%v**: %v\n", name, strings.Join(values[name], " / "))
+	}
+	return content
+}
+
+// HandleRefreshModInfo handles fetching the module stats again.
+func HandleRefreshModInfo(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	count, err := refreshModuleCache(db)
+	if err != nil {
+		fmt.Println("Failed to refresh module stats:", err.Error())
+		sendFailMessage("Failed to fetch the module stats from the wiki.", s, m)
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: fmt.Sprintf("Fetched the stats of %d modules.", count),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// refreshModuleCache fetches the modules from the wiki and stores them, returning how many there were.
+func refreshModuleCache(db *sql.DB) (int, error) {
+	modules, err := getModules(supportModulesURL, wikiTableParser{})
+	if err != nil {
+		return 0, err
+	}
+	if len(modules) == 0 {
+		return 0, errors.New("no modules found on the wiki page")
+	}
+	return len(modules), setModulesInDatabase(db, modules)
+}
+
+// getModuleFromDatabase returns the stored module with the name, ignoring case.
+// sql.ErrNoRows is returned if there's none.
+func getModuleFromDatabase(db *sql.DB, name string) (module, error) {
+	query := `SELECT module, level, name, value FROM module_stats WHERE lower(module) = lower($1)
+	ORDER BY level, position`
+	rows, err := db.Query(query, name)
+	if err != nil {
+		return module{}, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var mod module
+	for rows.Next() {
+		var (
+			n int
+			v value
+		)
+		err = rows.Scan(&mod.name, &n, &v.name, &v.text)
+		if err != nil {
+			return module{}, errors.Wrap(err, "failed to scan row")
+		}
+		v.value = parseStatValue(v.text)
+		if len(mod.levels) == 0 || mod.levels[len(mod.levels)-1].level != n {
+			mod.levels = append(mod.levels, level{level: n})
+		}
+		mod.levels[len(mod.levels)-1].values = append(mod.levels[len(mod.levels)-1].values, v)
+	}
+
+	if len(mod.levels) == 0 {
+		return mod, sql.ErrNoRows
+	}
+	return mod, nil
+}
+
+func countModulesInDatabase(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(DISTINCT module) FROM module_stats").Scan(&count)
+	return count, errors.Wrap(err, "failed to do query")
+}
+
+// setModulesInDatabase replaces the stored modules.
+func setModulesInDatabase(db *sql.DB, modules []module) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM module_stats")
+	if err != nil {
+		return errors.Wrap(err, "failed to clear module stats")
+	}
+
+	statement := `INSERT INTO module_stats (module, level, position, name, value) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT DO NOTHING`
+	for _, mod := range modules {
+		for _, l := range mod.levels {
+			for i, v := range l.values {
+				_, err = tx.Exec(statement, mod.name, l.level, i, v.name, v.text)
+				if err != nil {
+					return errors.Wrap(err, "failed to insert module stat")
+				}
+			}
 		}
 	}
 
-	return nil, nil
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
 }
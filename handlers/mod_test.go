@@ -1,10 +1,92 @@
 package handlers
 
 import (
+	"os"
+	"reflect"
 	"testing"
 )
 
-func Test_getModules(t *testing.T) {
-	getModules()
-	t.Fail()
+func Test_wikiTableParser(t *testing.T) {
+	f, err := os.Open("testdata/support_modules.html")
+	if err != nil {
+		t.Fatal("Failed to open fixture:", err)
+	}
+	defer f.Close()
+
+	var parser moduleParser = wikiTableParser{}
+	modules, err := parser.parseModules(f)
+	if err != nil {
+		t.Fatal("Failed to parse modules:", err)
+	}
+
+	expected := []module{
+		{name: "Time Warp", levels: []level{
+			{level: 1, values: []value{{"Blueprints required", 0, "0"}, {"Credit cost", 4000, "4,000"}, {"Time to unlock", 600, "10m"}, {"Time factor", 0, "2x"}, {"Duration", 20, "20s"}}},
+			{level: 2, values: []value{{"Blueprints required", 5, "5"}, {"Credit cost", 12000, "12,000"}, {"Time to unlock", 5400, "1h 30m"}, {"Time factor", 0, "2.5x"}, {"Duration", 20, "20s"}}},
+			{level: 3, values: []value{{"Blueprints required", 10, "10"}, {"Credit cost", 40000, "40,000"}, {"Time to unlock", 14400, "4h"}, {"Time factor", 0, "3x"}, {"Duration", 20, "20s"}}},
+			{level: 4, values: []value{{"Blueprints required", 20, "20"}, {"Credit cost", 120000, "120,000"}, {"Time to unlock", 43200, "12h"}, {"Time factor", 0, "3.5x"}, {"Duration", 20, "20s"}}},
+		}},
+		{name: "Teleport", levels: []level{
+			{level: 1, values: []value{{"Credit cost", 2000, "2,000"}, {"Max range", 0, "3 sectors"}, {"Notes", 0, "Only to friendly ships"}}},
+			{level: 2, values: []value{{"Credit cost", 8000, "8,000"}, {"Max range", 0, "4 sectors"}}},
+		}},
+	}
+	if !reflect.DeepEqual(modules, expected) {
+		t.Errorf("Modules were %+v, expected %+v", modules, expected)
+	}
+}
+
+func Test_parseStatValue(t *testing.T) {
+	testData := []struct {
+		text     string
+		expected int
+	}{
+		{text: "120,000", expected: 120000},
+		{text: "1h 30m", expected: 5400},
+		{text: "20s", expected: 20},
+		{text: "1d 12h", expected: 129600},
+		{text: "2d", expected: 172800},
+		{text: "1d 30m 10s", expected: 88210},
+		{text: "2.5x", expected: 0},
+		{text: "3 sectors", expected: 0},
+	}
+
+	for _, data := range testData {
+		if actual := parseStatValue(data.text); actual != data.expected {
+			t.Errorf("%q was parsed to %d, expected %d", data.text, actual, data.expected)
+		}
+	}
+}
+
+func Test_formatModuleStats(t *testing.T) {
+	mod := module{name: "Teleport", levels: []level{
+		{level: 1, values: []value{newValue("Cost", "2,000"), newValue("Range", "3 sectors")}},
+		{level: 2, values: []value{newValue("Cost", "8,000")}},
+		{level: 3, values: []value{newValue("Cost", "20,000"), newValue("Range", "5 sectors")}},
+	}}
+
+	expected := "Levels 1-3\n**Cost**: 2,000 / 8,000 / 20,000\n**Range**: 3 sectors / - / 5 sectors\n"
+	if actual := formatModuleStats(mod); actual != expected {
+		t.Errorf("Stats were formatted as %q, expected %q", actual, expected)
+	}
+}
+
+func Test_moduleFromTable(t *testing.T) {
+	testData := []struct {
+		rows     [][]string
+		expectOk bool
+	}{
+		{rows: [][]string{{"Level", "1", "2"}, {"Cost", "1", "2"}}, expectOk: true},
+		{rows: [][]string{{"Level", "Cost"}, {"1", "5"}}, expectOk: true},
+		{rows: [][]string{{"Module", "Unlocked at"}, {"Time Warp", "RS 3"}}, expectOk: false},
+		{rows: [][]string{{"Level", "1"}}, expectOk: false},
+		{rows: [][]string{{"Level", "Cost"}, {"Total", "5"}}, expectOk: false},
+	}
+
+	for _, data := range testData {
+		_, ok := moduleFromTable("Test", data.rows)
+		if ok != data.expectOk {
+			t.Errorf("Table %q should give a module: %v", data.rows, data.expectOk)
+		}
+	}
 }
@@ -1,44 +1,362 @@
 package handlers
 
-// import (
-// 	"database/sql"
-// 	"fmt"
-// 	"github.com/MattiasBerlin/outbot/commands"
-// 	"github.com/bwmarrin/discordgo"
-// 	"golang.org/x/oauth2/google"
-// 	"io/ioutil"
-// )
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// maxModuleLevel is the highest level a module can have.
+const maxModuleLevel = 12
+
+// moduleCategory is the kind of slot a module goes in.
+type moduleCategory string
 
 const (
-	googleAPICredentialsFile = "credentials.json"
-	spreadsheetID            = ""
+	weapons moduleCategory = "Weapons"
+	shields moduleCategory = "Shields"
+	support moduleCategory = "Support"
+	mining  moduleCategory = "Mining"
+	trade   moduleCategory = "Trade"
 )
 
-// func InitMod(s *discordgo.Session, db *sql.DB) {
-// 	b, err := ioutil.ReadFile(googleAPICredentialsFile)
-// 	if err != nil {
-// 		fmt.Println("Unable to read Google API credentials file:", err.Error())
-// 		return
-// 	}
-
-// 	// If modifying these scopes, delete your previously saved token.json
-// 	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/spreadsheets.readonly")
-// 	if err != nil {
-// 		fmt.Println("Unable to parse Google API credentials file to config:", err.Error())
-// 	}
-// }
-
-// // EventCommand for reminders.
-// func ModCommand() commands.Command {
-// 	return commands.Command{
-// 		CallPhrase:      "mods",
-// 		Permission:      commands.Members,
-// 		HelpDescription: "Get member's module levels",
-// 		Handler:         HandleEvent,
-// 		Init:            InitEvent,
-// 		Help: commands.Help{
-// 			Summary:             "Get member's module levels",
-// 			DetailedDescription: "<TODO>",
-// 		},
-// 	}
-// }
+// moduleCategories in the order they're listed.
+var moduleCategories = []moduleCategory{weapons, shields, support, mining, trade}
+
+// moduleDef is a module members can have, with the abbreviations it's known by.
+type moduleDef struct {
+	name     string
+	category moduleCategory
+	aliases  []string
+}
+
+// moduleDefs is the canonical list of modules.
+var moduleDefs = []moduleDef{
+	{name: "Battery", category: weapons, aliases: []string{"bat"}},
+	{name: "Laser", category: weapons, aliases: []string{"la"}},
+	{name: "Mass Battery", category: weapons, aliases: []string{"mba"}},
+	{name: "Dual Laser", category: weapons, aliases: []string{"dl"}},
+	{name: "Barrage", category: weapons, aliases: []string{"brg"}},
+	{name: "Dart Launcher", category: weapons, aliases: []string{"dart"}},
+
+	{name: "Alpha Shield", category: shields, aliases: []string{"as"}},
+	{name: "Delta Shield", category: shields, aliases: []string{"ds"}},
+	{name: "Passive Shield", category: shields, aliases: []string{"ps"}},
+	{name: "Omega Shield", category: shields, aliases: []string{"os"}},
+	{name: "Mirror Shield", category: shields, aliases: []string{"ms"}},
+	{name: "Blast Shield", category: shields, aliases: []string{"bls"}},
+	{name: "Area Shield", category: shields, aliases: []string{"ars"}},
+
+	{name: "EMP", category: support},
+	{name: "Teleport", category: support, aliases: []string{"tp"}},
+	{name: "Red Star Life Extender", category: support, aliases: []string{"rse", "rsle"}},
+	{name: "Remote Repair", category: support, aliases: []string{"rr"}},
+	{name: "Time Warp", category: support, aliases: []string{"tw"}},
+	{name: "Unity", category: support, aliases: []string{"un"}},
+	{name: "Sanctuary", category: support, aliases: []string{"sanc"}},
+	{name: "Stealth", category: support, aliases: []string{"st"}},
+	{name: "Fortify", category: support, aliases: []string{"fo"}},
+	{name: "Impulse", category: support, aliases: []string{"imp"}},
+	{name: "Alpha Rocket", category: support, aliases: []string{"ar"}},
+	{name: "Salvage", category: support, aliases: []string{"sal"}},
+	{name: "Suppress", category: support, aliases: []string{"sup"}},
+	{name: "Destiny", category: support, aliases: []string{"des"}},
+	{name: "Barrier", category: support, aliases: []string{"bar"}},
+	{name: "Vengeance", category: support, aliases: []string{"ven"}},
+	{name: "Delta Rocket", category: support, aliases: []string{"dr"}},
+	{name: "Leap", category: support},
+	{name: "Bond", category: support},
+	{name: "Alpha Drone", category: support, aliases: []string{"ad"}},
+	{name: "Omega Rocket", category: support, aliases: []string{"or"}},
+
+	{name: "Mining Boost", category: mining, aliases: []string{"mb"}},
+	{name: "Hydrogen Bay Extension", category: mining, aliases: []string{"hbe"}},
+	{name: "Enrich", category: mining, aliases: []string{"en"}},
+	{name: "Remote Mining", category: mining, aliases: []string{"rm"}},
+	{name: "Hydrogen Upload", category: mining, aliases: []string{"hu"}},
+	{name: "Mining Unity", category: mining, aliases: []string{"mu"}},
+	{name: "Crunch", category: mining, aliases: []string{"cr"}},
+	{name: "Genesis", category: mining, aliases: []string{"gen"}},
+	{name: "Mining Drone", category: mining, aliases: []string{"md"}},
+
+	{name: "Cargo Bay Extension", category: trade, aliases: []string{"cbe"}},
+	{name: "Shipment Computer", category: trade, aliases: []string{"sc"}},
+	{name: "Trade Boost", category: trade, aliases: []string{"tb"}},
+	{name: "Rush", category: trade},
+	{name: "Trade Burst", category: trade, aliases: []string{"tbu"}},
+	{name: "Shipment Drone", category: trade, aliases: []string{"sd"}},
+	{name: "Offload", category: trade, aliases: []string{"ol"}},
+	{name: "Shipment Beam", category: trade, aliases: []string{"sb"}},
+	{name: "Entrust", category: trade, aliases: []string{"ent"}},
+	{name: "Dispatch", category: trade, aliases: []string{"dis"}},
+	{name: "Recall", category: trade, aliases: []string{"rec"}},
+}
+
+// normalizeModuleName for looking up a module ignoring case, spaces and dashes.
+func normalizeModuleName(name string) string {
+	return strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(name))
+}
+
+// moduleLookup maps the normalized names and aliases to the modules.
+var moduleLookup = func() map[string]moduleDef {
+	lookup := make(map[string]moduleDef)
+	for _, def := range moduleDefs {
+		lookup[normalizeModuleName(def.name)] = def
+		for _, alias := range def.aliases {
+			lookup[alias] = def
+		}
+	}
+	return lookup
+}()
+
+// findModule returns the module with the name or alias.
+func findModule(name string) (moduleDef, bool) {
+	def, ok := moduleLookup[normalizeModuleName(name)]
+	return def, ok
+}
+
+// moduleLevel is the level of a module a member has, level 0 means they don't have it.
+type moduleLevel struct {
+	module string
+	level  int
+}
+
+// parseModuleLevels parses modules each followed by its level, e.g. "tw 5 mining boost 8".
+// The names of the modules can span several words.
+func parseModuleLevels(args []string) ([]moduleLevel, error) {
+	var (
+		levels []moduleLevel
+		words  []string
+	)
+	for _, arg := range args {
+		level, err := strconv.Atoi(arg)
+		if err != nil {
+			words = append(words, arg)
+			continue
+		}
+
+		name := strings.Join(words, " ")
+		if name == "" {
+			return nil, errors.Errorf("level %v isn't preceded by a module", arg)
+		}
+		def, ok := findModule(name)
+		if !ok {
+			return nil, errors.Errorf("unknown module %q, check `!mods list`", name)
+		}
+		if level < 0 || level > maxModuleLevel {
+			return nil, errors.Errorf("level %v of %v isn't between 0 and %d", arg, def.name, maxModuleLevel)
+		}
+		levels = append(levels, moduleLevel{module: def.name, level: level})
+		words = nil
+	}
+
+	if len(words) > 0 {
+		return nil, errors.Errorf("missing level of %q", strings.Join(words, " "))
+	}
+	if len(levels) == 0 {
+		return nil, errors.New("missing module and level")
+	}
+	return levels, nil
+}
+
+// formatModuleProfile lists the levels by category, in the order of the canonical list.
+func formatModuleProfile(levels map[string]int) []*discordgo.MessageEmbedField {
+	var fields []*discordgo.MessageEmbedField
+	for _, category := range moduleCategories {
+		var modules []string
+		for _, def := range moduleDefs {
+			if def.category == category && levels[def.name] > 0 {
+				modules = append(modules, fmt.Sprintf("%v %d", def.name, levels[def.name]))
+			}
+		}
+		if len(modules) > 0 {
+			fields = append(fields, &discordgo.MessageEmbedField{Name: string(category), Value: strings.Join(modules, "\n"), Inline: true})
+		}
+	}
+	return fields
+}
+
+// ModCommand for the module levels of the members.
+func ModCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "mods",
+		Permission:      commands.Members,
+		HelpDescription: "Get member's module levels",
+		Handler:         HandleMods,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "set",
+				Permission:      commands.Members,
+				HelpDescription: "Set your module levels",
+				Handler:         HandleSetMods,
+				Help: commands.Help{
+					Summary: "Set your module levels",
+					DetailedDescription: "Set the level of one or more of your modules, each module followed by its level. " +
+						"Modules can be given by name or abbreviation, see `mods list`. Level 0 removes the module.",
+					Syntax:  "mods set <module> <level> [<module> <level>...]",
+					Example: "mods set tw 5 mining boost 8 rush 3",
+				},
+			},
+			{
+				CallPhrase:      "list",
+				Permission:      commands.Members,
+				HelpDescription: "List the modules and their abbreviations",
+				Handler:         HandleListMods,
+				Help: commands.Help{
+					Summary:             "List the modules and their abbreviations",
+					DetailedDescription: "List the modules which can be set with `mods set` by category, with their abbreviations.",
+					Syntax:              "mods list",
+					Example:             "mods list",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "Get member's module levels",
+			DetailedDescription: "Show the module levels of a member by category, or your own if no one is mentioned.",
+			Syntax:              "mods [@member]",
+			Example:             "mods @Rick",
+		},
+	}
+}
+
+// HandleMods handles showing the module levels of a member.
+func HandleMods(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	user := m.Author
+	if len(m.Mentions) > 0 {
+		user = m.Mentions[0]
+	}
+	name := displayName(s, guildID, user.ID, user.Username)
+
+	levels, err := getModuleLevelsFromDatabase(db, user.ID)
+	if err != nil {
+		fmt.Println("Failed to get module levels:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:  fmt.Sprintf("Modules of %v", name),
+		Color:  infoColor,
+		Fields: formatModuleProfile(levels),
+	}
+	if len(response.Fields) == 0 {
+		response.Description = fmt.Sprintf("%v hasn't set any module levels, use `!mods set`.", name)
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleSetMods handles setting module levels of the caller.
+func HandleSetMods(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	levels, err := parseModuleLevels(strings.Fields(msg))
+	if err != nil {
+		sendFailMessage(fmt.Sprintf("%v, check `!help mods set`.", strings.ToUpper(err.Error()[:1])+err.Error()[1:]), s, m)
+		return
+	}
+
+	err = setModuleLevelsInDatabase(db, m.Author.ID, levels)
+	if err != nil {
+		fmt.Println("Failed to set module levels:", err.Error())
+		return
+	}
+	scheduleSheetSync(s, db)
+
+	changes := make([]string, len(levels))
+	for i, l := range levels {
+		changes[i] = fmt.Sprintf("%v %d", l.module, l.level)
+		if l.level == 0 {
+			changes[i] = fmt.Sprintf("%v removed", l.module)
+		}
+	}
+	response := discordgo.MessageEmbed{
+		Title:       "Modules set!",
+		Color:       successColor,
+		Description: strings.Join(changes, "\n"),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleListMods handles listing the canonical modules.
+func HandleListMods(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	var fields []*discordgo.MessageEmbedField
+	for _, category := range moduleCategories {
+		var content string
+		for _, def := range moduleDefs {
+			if def.category != category {
+				continue
+			}
+			content += def.name
+			if len(def.aliases) > 0 {
+				content += fmt.Sprintf(" (%v)", strings.Join(def.aliases, ", "))
+			}
+			content += "\n"
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: string(category), Value: content, Inline: true})
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:  "Modules",
+		Color:  infoColor,
+		Fields: fields,
+	}
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// getModuleLevelsFromDatabase returns the levels of the modules the member has, mapped by module name.
+func getModuleLevelsFromDatabase(db *sql.DB, userID string) (map[string]int, error) {
+	rows, err := db.Query("SELECT module, level FROM member_modules WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	levels := make(map[string]int)
+	for rows.Next() {
+		var l moduleLevel
+		err = rows.Scan(&l.module, &l.level)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		levels[l.module] = l.level
+	}
+
+	return levels, nil
+}
+
+// setModuleLevelsInDatabase sets the levels of the member's modules, removing the ones with level 0.
+func setModuleLevelsInDatabase(db *sql.DB, userID string, levels []moduleLevel) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	for _, l := range levels {
+		if l.level == 0 {
+			_, err = tx.Exec("DELETE FROM member_modules WHERE user_id = $1 AND module = $2", userID, l.module)
+		} else {
+			statement := `INSERT INTO member_modules (user_id, module, level) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, module) DO UPDATE SET level = $3`
+			_, err = tx.Exec(statement, userID, l.module, l.level)
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
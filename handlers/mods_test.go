@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_moduleAliases(t *testing.T) {
+	seen := make(map[string]string)
+	for _, def := range moduleDefs {
+		names := append([]string{normalizeModuleName(def.name)}, def.aliases...)
+		for _, name := range names {
+			if other, exists := seen[name]; exists {
+				t.Errorf("%q is used for both %v and %v", name, other, def.name)
+			}
+			seen[name] = def.name
+		}
+	}
+}
+
+func Test_parseModuleLevels(t *testing.T) {
+	testData := []struct {
+		args        []string
+		expected    []moduleLevel
+		expectError bool
+	}{
+		{args: []string{"tw", "5"}, expected: []moduleLevel{{module: "Time Warp", level: 5}}},
+		{args: []string{"TW", "5", "mining", "boost", "8", "Red-Star", "Life", "Extender", "0"}, expected: []moduleLevel{
+			{module: "Time Warp", level: 5}, {module: "Mining Boost", level: 8}, {module: "Red Star Life Extender", level: 0}}},
+		{args: []string{}, expectError: true},
+		{args: []string{"5"}, expectError: true},
+		{args: []string{"tw"}, expectError: true},
+		{args: []string{"warp", "drive", "3"}, expectError: true},
+		{args: []string{"tw", "13"}, expectError: true},
+		{args: []string{"tw", "-1"}, expectError: true},
+	}
+
+	for _, data := range testData {
+		actual, err := parseModuleLevels(data.args)
+		if data.expectError {
+			if err == nil {
+				t.Errorf("expected an error for %q", data.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", data.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, data.expected) {
+			t.Errorf("%q was parsed to %+v, expected %+v", data.args, actual, data.expected)
+		}
+	}
+}
@@ -7,17 +7,12 @@ import (
 	"github.com/bwmarrin/discordgo"
 	"github.com/pkg/errors"
 	"strings"
+	"time"
 )
 
 const (
 	successColor = 0x00ff00
 	failColor    = 0xff0000
-
-	academyWhiteStarChannel   = "488859067947941909"
-	academyGeneralChannel     = "488401533063659530"
-	academyMessagesChannel    = "488478592297336834"
-	academyOfficersChannel    = "512368438266691594"
-	academySpreadsheetChannel = "489510100705214464"
 )
 
 type wsRole string
@@ -51,44 +46,14 @@ func wsRoleFromString(text string) wsRole {
 	return role
 }
 
-type instance string
-
-const (
-	mainA    instance = "Main A"
-	mainB    instance = "Main B"
-	academyA instance = "Academy A"
-	academyB instance = "Academy B"
-)
-
-func secondInstance(instanceString string) bool {
-	instanceString = strings.ToLower(instanceString)
-	return instanceString == "b" || instanceString == "2"
+// isWSRole returns whether the text is one of the preferred roles, rather than e.g. an instance.
+func isWSRole(text string) bool {
+	return wsRoleFromString(text) != defaultRole
 }
 
-func channelToInstance(channelID string, instanceString string) instance {
-	var instance instance
-
-	switch channelID {
-	case academyWhiteStarChannel,
-		academyGeneralChannel,
-		academyMessagesChannel,
-		academyOfficersChannel,
-		academySpreadsheetChannel:
-		if secondInstance(instanceString) {
-			instance = academyB
-		} else {
-			instance = academyA
-		}
-	default:
-		if secondInstance(instanceString) {
-			instance = mainB
-		} else {
-			instance = mainA
-		}
-	}
-
-	return instance
-}
+// userIDPlaceholderPrefix is prefixed to the name of participants stored before they were keyed by user ID,
+// until the user ID is resolved.
+const userIDPlaceholderPrefix = "name:"
 
 type participant struct {
 	instance
@@ -108,8 +73,8 @@ func OptInCommand() commands.Command {
 		Help: commands.Help{
 			Summary: "Opt in for the next WS",
 			DetailedDescription: `Opt in for the next White Star match.
-				Instances: A or B
-				Accepted preferred roles: def, off, hunter`,
+				Instances: the name or code of an instance, or its number in the channel's corp, see !instance
+				Accepted preferred roles: def, off, hunter, filler`,
 			Syntax:  "optin [instance] [preferred role]",
 			Example: "optin A defense",
 		},
@@ -173,7 +138,7 @@ func ClearParticipantsCommand() commands.Command {
 		Handler:         HandleClearParticipants,
 		Help: commands.Help{
 			Summary:             "Clear the participation list",
-			DetailedDescription: "Clear the participation list.",
+			DetailedDescription: "Clear the participation list, ending the White Star. The participants are archived, see `ws history`.",
 			Syntax:              "clear [instance]",
 			Example:             "clear A",
 		},
@@ -182,49 +147,101 @@ func ClearParticipantsCommand() commands.Command {
 
 // HandleSetOptIn handles opt in commands for mentioned users.
 func HandleSetOptIn(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
-	splitMsg := strings.Split(msg, " ")
-	var instanceString string
-	role := defaultRole
-	if len(splitMsg) >= 1 {
-		instanceString = splitMsg[0]
-		if len(splitMsg) >= 2 {
-			role = wsRoleFromString(splitMsg[1])
+	var args []string
+	for _, arg := range strings.Fields(msg) {
+		if !isMention(arg) {
+			args = append(args, arg)
 		}
 	}
-	instance := channelToInstance(m.ChannelID, instanceString)
-
-	message := fmt.Sprintf("You've opted in %d members.", len(m.Mentions))
+	instanceString, role := instanceAndRoleArgs(args)
+	instance, ok := instanceFromMessage(instanceString, s, m, db)
+	if !ok {
+		return
+	}
 
-	for i, user := range m.Mentions {
-		if user != nil {
-			m.Author = user
-			setParticipation(true, instance, role, message, i == len(m.Mentions)-1, s, m, db)
+	var optedIn int
+	for _, user := range m.Mentions {
+		if user == nil {
+			continue
+		}
+		err := updateParticipation(newParticipant(user, true, instance, role, s, guildID), s, db)
+		if err != nil {
+			fmt.Println("Failed to set participation:", err.Error())
+			continue
 		}
+		optedIn++
 	}
+
+	listParticipants(fmt.Sprintf("You've opted in %d members.\n\n", optedIn), instance, s, m, db, guildID)
 }
 
 // HandleOptIn handles opt in commands.
 func HandleOptIn(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
-	splitMsg := strings.Split(msg, " ")
-	instance := splitMsg[0]
-	var wsRole string
-	if len(splitMsg) >= 2 {
-		wsRole = splitMsg[1]
+	instanceString, role := instanceAndRoleArgs(strings.Fields(msg))
+	instance, ok := instanceFromMessage(instanceString, s, m, db)
+	if !ok {
+		return
+	}
+	if !checkOptInsOpen(instance, s, m, db) {
+		return
 	}
-	setParticipation(true, channelToInstance(m.ChannelID, instance), wsRoleFromString(wsRole), fmt.Sprintf("You've opted in, %v!", m.Author.Username), true, s, m, db)
+	setParticipation(true, instance, role, fmt.Sprintf("You've opted in, %v!", m.Author.Username), s, m, db, guildID)
+}
+
+// instanceAndRoleArgs returns the instance and preferred role of "[instance] [preferred role]".
+// The instance can be left out even if a preferred role is given.
+func instanceAndRoleArgs(args []string) (string, wsRole) {
+	if len(args) == 0 {
+		return "", defaultRole
+	}
+
+	last := args[len(args)-1]
+	if isWSRole(last) {
+		return strings.Join(args[:len(args)-1], " "), wsRoleFromString(last)
+	}
+	return strings.Join(args, " "), defaultRole
 }
 
 // HandleOptOut handles opt out commands.
 func HandleOptOut(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
-	setParticipation(false, channelToInstance(m.ChannelID, msg), wsRoleFromString(""), fmt.Sprintf("You've opted out, %v!", m.Author.Username), true, s, m, db)
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+	if !checkOptInsOpen(instance, s, m, db) {
+		return
+	}
+	setParticipation(false, instance, wsRoleFromString(""), fmt.Sprintf("You've opted out, %v!", m.Author.Username), s, m, db, guildID)
 }
 
 // HandleClearParticipants handles clearing the participation list.
 func HandleClearParticipants(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
-	instance := channelToInstance(m.ChannelID, msg)
-	rolesRemoved := removeRolesForParticipants(instance, s, db, guildID)
-	err := clearParticipantsFromDatabase(db, instance)
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	// Clearing ends the round, so the participants are archived with it
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return
+	}
+	now := time.Now()
+	if round.id == 0 || round.phase == ended {
+		round = wsRound{instance: instance, phase: signUpOpen, opened: now, phaseChanged: now}
+		err = setRoundInDatabase(db, &round)
+		if err != nil {
+			fmt.Println("Failed to set WS round:", err.Error())
+			return
+		}
+	}
+	round.phase = ended
+	round.phaseChanged = now
+
+	err = endRound(&round, db)
 	if err != nil {
+		fmt.Println("Failed to archive participants:", err.Error())
 		_, err = s.ChannelMessageSend(m.ChannelID, "Failed to clear participants")
 		if err != nil {
 			fmt.Println("Failed to send message:", err.Error())
@@ -232,10 +249,15 @@ func HandleClearParticipants(msg string, s *discordgo.Session, m *discordgo.Mess
 		}
 		return
 	}
+	err = setRoundInDatabase(db, &round)
+	if err != nil {
+		fmt.Println("Failed to set WS round:", err.Error())
+	}
+	updateSignUpMessages(instance, s, db)
 
 	response := discordgo.MessageEmbed{
 		Color:       successColor,
-		Description: fmt.Sprintf("Participation list cleared!\nCleared roles from %d members.", rolesRemoved),
+		Description: "Participation list archived and cleared!\n" + reconcileInstanceRole(instance, s, db, guildID),
 	}
 	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
 	if err != nil {
@@ -246,11 +268,15 @@ func HandleClearParticipants(msg string, s *discordgo.Session, m *discordgo.Mess
 
 // HandleListParticipants handles the command for listing participants.
 func HandleListParticipants(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
-	listParticipants("", channelToInstance(m.ChannelID, msg), s, m, db)
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+	listParticipants("", instance, s, m, db, guildID)
 }
 
-func listParticipants(prefix string, instance instance, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) {
-	status, err := optStatus(db, instance)
+func listParticipants(prefix string, instance instance, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string) {
+	status, err := optStatus(instance, s, db, guildID)
 	if err != nil {
 		fmt.Println("Failed to get participation status:", err.Error())
 		status = "[Failed to get participation status]"
@@ -267,29 +293,67 @@ func listParticipants(prefix string, instance instance, s *discordgo.Session, m
 	}
 }
 
-func setParticipation(participating bool, instance instance, preferredRole wsRole, updateMessage string, sendMessage bool, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) {
-	participant := participant{
+// setParticipation of the author of the message and list the participants with the update message.
+func setParticipation(participating bool, instance instance, preferredRole wsRole, updateMessage string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string) {
+	participant := newParticipant(m.Author, participating, instance, preferredRole, s, guildID)
+	err := updateParticipation(participant, s, db)
+	if err != nil {
+		fmt.Println("Failed to set participation:", err.Error())
+		return
+	}
+	listParticipants(fmt.Sprintf("%v\n\n", updateMessage), participant.instance, s, m, db, guildID)
+}
+
+// newParticipant of the user, named by their display name in the guild.
+func newParticipant(user *discordgo.User, participating bool, instance instance, preferredRole wsRole, s *discordgo.Session, guildID string) participant {
+	return participant{
 		instance:      instance,
-		name:          m.Author.Username,
+		name:          displayName(s, guildID, user.ID, user.Username),
 		participating: participating,
 		preferredRole: preferredRole,
-		userID:        m.Author.ID,
+		userID:        user.ID,
 	}
-	err := setParticipatingInDatabase(db, participant)
+}
+
+// displayName returns the guild nickname of the user.
+// The fallback is returned if the member has no nickname or is not known to the bot.
+func displayName(s *discordgo.Session, guildID string, userID string, fallback string) string {
+	member, err := s.State.Member(guildID, userID)
+	if err != nil || member.User == nil {
+		return fallback
+	}
+	return memberName(member)
+}
+
+// withDisplayNames replaces the stored names of the participants with their current display names.
+func withDisplayNames(participants []participant, s *discordgo.Session, guildID string) []participant {
+	for i, p := range participants {
+		participants[i].name = displayName(s, guildID, p.userID, p.name)
+	}
+	return participants
+}
+
+// updateParticipation stores the participation, opening a new round if the last one has ended,
+// and updates the sign-up messages of the instance.
+func updateParticipation(participant participant, s *discordgo.Session, db *sql.DB) error {
+	err := openRoundIfEnded(db, participant.instance)
 	if err != nil {
-		fmt.Println("Failed to set participation:", err.Error())
-		return
+		fmt.Println("Failed to open WS round:", err.Error())
 	}
-	if sendMessage {
-		listParticipants(fmt.Sprintf("%v\n\n", updateMessage), participant.instance, s, m, db)
+	err = setParticipatingInDatabase(db, participant)
+	if err != nil {
+		return err
 	}
+	updateSignUpMessages(participant.instance, s, db)
+	return nil
 }
 
-func optStatus(db *sql.DB, instance instance) (string, error) {
+func optStatus(instance instance, s *discordgo.Session, db *sql.DB, guildID string) (string, error) {
 	participants, err := getParticipantsFromDatabase(db, instance)
 	if err != nil {
 		return "", err
 	}
+	participants = withDisplayNames(participants, s, guildID)
 
 	roleMap := make(map[string][]string)
 	var optIn, optOut []string
@@ -338,7 +402,7 @@ func optStatus(db *sql.DB, instance instance) (string, error) {
 
 func setParticipatingInDatabase(db *sql.DB, participant participant) error {
 	statement := `INSERT INTO participants (instance, name, participating, preferred_role, user_id) VALUES ($1, $2, $3, $4, $5)
-	ON CONFLICT (instance, name) DO UPDATE SET participating = $3, preferred_role = $4`
+	ON CONFLICT (instance, user_id) DO UPDATE SET name = $2, participating = $3, preferred_role = $4`
 	_, err := db.Exec(statement, participant.instance, participant.name, participant.participating, participant.preferredRole, participant.userID)
 	return err
 }
@@ -364,7 +428,112 @@ func getParticipantsFromDatabase(db *sql.DB, instance instance) ([]participant,
 	return participants, nil
 }
 
-func clearParticipantsFromDatabase(db *sql.DB, instance instance) error {
-	_, err := db.Exec("DELETE FROM participants WHERE instance = $1", instance)
-	return err
+// matchUserIDs returns the user IDs of the members with the names, by username or nickname.
+// Names matching no member, or more than one, are left out.
+func matchUserIDs(names []string, members []*discordgo.Member) map[string]string {
+	matches := make(map[string]map[string]bool)
+	for _, member := range members {
+		if member.User == nil {
+			continue
+		}
+		for _, name := range []string{member.User.Username, member.Nick} {
+			if name == "" {
+				continue
+			}
+			if matches[name] == nil {
+				matches[name] = make(map[string]bool)
+			}
+			matches[name][member.User.ID] = true
+		}
+	}
+
+	userIDs := make(map[string]string)
+	for _, name := range names {
+		if len(matches[name]) != 1 {
+			continue
+		}
+		for userID := range matches[name] {
+			userIDs[name] = userID
+		}
+	}
+	return userIDs
+}
+
+// resolveParticipantPlaceholders replaces the placeholder user IDs of participants with the IDs of the members with their names.
+func resolveParticipantPlaceholders(s *discordgo.Session, db *sql.DB, guildID string) {
+	names, err := getPlaceholderNamesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get participants without user ID:", err.Error())
+		return
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	members, err := getGuildMembers(s, guildID)
+	if err != nil {
+		fmt.Println("Failed to get guild members:", err.Error())
+		return
+	}
+
+	userIDs := matchUserIDs(names, members)
+	for name, userID := range userIDs {
+		err = replacePlaceholderInDatabase(db, name, userID)
+		if err != nil {
+			fmt.Printf("Failed to set user ID of participant %v: %v\n", name, err)
+		}
+	}
+	if len(userIDs) < len(names) {
+		fmt.Printf("Could not resolve the user ID of %d participants\n", len(names)-len(userIDs))
+	}
+}
+
+func getPlaceholderNamesFromDatabase(db *sql.DB) ([]string, error) {
+	query := `SELECT name FROM participants WHERE user_id LIKE $1
+	UNION SELECT name FROM ws_round_participants WHERE user_id LIKE $1`
+	rows, err := db.Query(query, userIDPlaceholderPrefix+"%")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// replacePlaceholderInDatabase sets the user ID of the participants with the placeholder of the name.
+// Placeholder rows are dropped where the user already has a row of their own.
+func replacePlaceholderInDatabase(db *sql.DB, name string, userID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	placeholder := userIDPlaceholderPrefix + name
+	statements := []string{
+		`DELETE FROM participants p WHERE user_id = $1
+		AND EXISTS (SELECT 1 FROM participants q WHERE q.instance = p.instance AND q.user_id = $2)`,
+		"UPDATE participants SET user_id = $2 WHERE user_id = $1",
+		`DELETE FROM ws_round_participants p WHERE user_id = $1
+		AND EXISTS (SELECT 1 FROM ws_round_participants q WHERE q.round_id = p.round_id AND q.user_id = $2)`,
+		"UPDATE ws_round_participants SET user_id = $2 WHERE user_id = $1",
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement, placeholder, userID)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
 }
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	previousPageEmoji = "\u2b05"
+	nextPageEmoji     = "\u27a1"
+
+	// emojiVariationSelector is appended to some emoji by Discord.
+	emojiVariationSelector = "\ufe0f"
+
+	// pagerIdleTimeout is how long a paged message can be browsed after it was last used.
+	pagerIdleTimeout = time.Hour
+)
+
+// renderPage renders the page (starting at 1) of a paged message together with the total amount of pages.
+type renderPage func(db *sql.DB, page int) (*discordgo.MessageEmbed, int, error)
+
+type pager struct {
+	page     int
+	pages    int
+	render   renderPage
+	lastUsed time.Time
+}
+
+// pagers of sent messages mapped by message ID.
+// Paging only works for messages sent since the bot was started and used within pagerIdleTimeout.
+var pagers = struct {
+	sync.Mutex
+	m map[string]*pager
+}{m: make(map[string]*pager)}
+
+// sendPagedMessage sends the page and adds reactions for browsing the other pages if there are any.
+func sendPagedMessage(s *discordgo.Session, channelID string, db *sql.DB, page int, render renderPage) error {
+	embed, pages, err := render(db, page)
+	if err != nil {
+		return errors.Wrap(err, "failed to render page")
+	}
+	// Show the last page rather than one past it
+	if page > pages && pages > 0 {
+		page = pages
+		embed, pages, err = render(db, page)
+		if err != nil {
+			return errors.Wrap(err, "failed to render page")
+		}
+	}
+
+	msg, err := s.ChannelMessageSendEmbed(channelID, embed)
+	if err != nil {
+		return errors.Wrap(err, "failed to send message")
+	}
+	if pages <= 1 {
+		return nil
+	}
+
+	now := time.Now()
+	pagers.Lock()
+	prunePagers(pagers.m, now)
+	pagers.m[msg.ID] = &pager{page: page, pages: pages, render: render, lastUsed: now}
+	pagers.Unlock()
+
+	for _, emoji := range []string{previousPageEmoji, nextPageEmoji} {
+		err = s.MessageReactionAdd(channelID, msg.ID, emoji)
+		if err != nil {
+			return errors.Wrap(err, "failed to add reaction")
+		}
+	}
+
+	return nil
+}
+
+// HandlePageReaction browses paged messages when the previous or next page reaction is used.
+func HandlePageReaction(s *discordgo.Session, r *discordgo.MessageReaction, added bool, db *sql.DB, guildID string) {
+	if !added {
+		return
+	}
+
+	var step int
+	switch strings.TrimSuffix(r.Emoji.Name, emojiVariationSelector) {
+	case previousPageEmoji:
+		step = -1
+	case nextPageEmoji:
+		step = 1
+	default:
+		return
+	}
+
+	pagers.Lock()
+	now := time.Now()
+	prunePagers(pagers.m, now)
+	p, exists := pagers.m[r.MessageID]
+	if !exists {
+		pagers.Unlock()
+		return
+	}
+	page := p.page + step
+	if page < 1 || page > p.pages {
+		pagers.Unlock()
+		removeUserReaction(s, r)
+		return
+	}
+	p.page = page
+	p.lastUsed = now
+	render := p.render
+	pagers.Unlock()
+
+	embed, pages, err := render(db, page)
+	if err != nil {
+		fmt.Println("Failed to render page:", err.Error())
+		return
+	}
+
+	pagers.Lock()
+	p.pages = pages
+	pagers.Unlock()
+
+	_, err = s.ChannelMessageEditEmbed(r.ChannelID, r.MessageID, embed)
+	if err != nil {
+		fmt.Println("Failed to edit message:", err.Error())
+		return
+	}
+
+	removeUserReaction(s, r)
+}
+
+// prunePagers removes the pagers which have not been used within pagerIdleTimeout.
+func prunePagers(m map[string]*pager, now time.Time) {
+	for id, p := range m {
+		if now.Sub(p.lastUsed) > pagerIdleTimeout {
+			delete(m, id)
+		}
+	}
+}
+
+// removeUserReaction so the user can use it again.
+// It requires the manage messages permission, without it the user has to remove it themselves.
+func removeUserReaction(s *discordgo.Session, r *discordgo.MessageReaction) {
+	err := s.MessageReactionRemove(r.ChannelID, r.MessageID, r.Emoji.APIName(), r.UserID)
+	if err != nil {
+		fmt.Println("Failed to remove reaction:", err.Error())
+	}
+}
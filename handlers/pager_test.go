@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_prunePagers(t *testing.T) {
+	now := time.Date(2018, 11, 24, 12, 0, 0, 0, time.UTC)
+	m := map[string]*pager{
+		"recent": {lastUsed: now.Add(-time.Minute)},
+		"idle":   {lastUsed: now.Add(-pagerIdleTimeout - time.Second)},
+	}
+
+	prunePagers(m, now)
+
+	if _, exists := m["recent"]; !exists {
+		t.Error("The recently used pager should be kept")
+	}
+	if _, exists := m["idle"]; exists {
+		t.Error("The idle pager should be removed")
+	}
+}
@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// guildMembersPageSize is the most members Discord returns per request.
+const guildMembersPageSize = 1000
+
+// nonResponders returns the members with the Member or Academy role who have neither opted in nor out, sorted by name.
+// Excluded members, mapped by user ID, are left out.
+func nonResponders(members []*discordgo.Member, participants []participant, excluded map[string]bool) []*discordgo.Member {
+	responded := make(map[string]bool)
+	for _, p := range participants {
+		responded[p.userID] = true
+	}
+
+	var pending []*discordgo.Member
+	for _, member := range members {
+		if member.User == nil || member.User.Bot || responded[member.User.ID] || excluded[member.User.ID] {
+			continue
+		}
+		for _, role := range member.Roles {
+			if role == commands.MemberRoleID || role == commands.AcademyRoleID {
+				pending = append(pending, member)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return strings.ToLower(memberName(pending[i])) < strings.ToLower(memberName(pending[j]))
+	})
+	return pending
+}
+
+// memberName returns the nickname of the member, or the username if there's none.
+func memberName(member *discordgo.Member) string {
+	if member.Nick != "" {
+		return member.Nick
+	}
+	return member.User.Username
+}
+
+// getGuildMembers returns all members of the guild.
+func getGuildMembers(s *discordgo.Session, guildID string) ([]*discordgo.Member, error) {
+	var members []*discordgo.Member
+	after := ""
+	for {
+		page, err := s.GuildMembers(guildID, after, guildMembersPageSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get guild members")
+		}
+		members = append(members, page...)
+		if len(page) < guildMembersPageSize {
+			return members, nil
+		}
+		after = page[len(page)-1].User.ID
+	}
+}
+
+// WSPendingCommand for the members who have not answered the sign-up.
+func WSPendingCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "pending",
+		Permission:      commands.Officers,
+		HelpDescription: "List members who haven't opted in or out",
+		Handler:         HandlePending,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "nudge",
+				Permission:      commands.Officers,
+				HelpDescription: "Remind members who haven't opted in or out",
+				Handler:         HandleNudgePending,
+				Help: commands.Help{
+					Summary: "Remind members who haven't opted in or out",
+					DetailedDescription: "Send a direct message to the members who haven't opted in or out. " +
+						"Members who turned off reminders with `ws nudges off` are skipped.",
+					Syntax:  "ws pending nudge [instance]",
+					Example: "ws pending nudge A",
+				},
+			},
+			{
+				CallPhrase:      "exclude",
+				Permission:      commands.Officers,
+				HelpDescription: "Leave inactive members out of the pending list",
+				Handler:         pendingExclusionHandler(true),
+				Help: commands.Help{
+					Summary:             "Leave inactive members out of the pending list",
+					DetailedDescription: "Leave the mentioned members, e.g. long-term inactive ones, out of the pending list of every instance.",
+					Syntax:              "ws pending exclude <members>",
+					Example:             "ws pending exclude @Maro",
+				},
+			},
+			{
+				CallPhrase:      "include",
+				Permission:      commands.Officers,
+				HelpDescription: "List excluded members as pending again",
+				Handler:         pendingExclusionHandler(false),
+				Help: commands.Help{
+					Summary:             "List excluded members as pending again",
+					DetailedDescription: "Undo `ws pending exclude` for the mentioned members.",
+					Syntax:              "ws pending include <members>",
+					Example:             "ws pending include @Maro",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "List members who haven't opted in or out",
+			DetailedDescription: "List the members with the Member or Academy role who have neither opted in nor out of the White Star.",
+			Syntax:              "ws pending [instance]",
+			Example:             "ws pending A",
+		},
+	}
+}
+
+// WSNudgesCommand for turning sign-up reminders on or off.
+func WSNudgesCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "nudges",
+		Permission:      commands.Members,
+		HelpDescription: "Turn WS sign-up reminders on or off",
+		Handler:         HandleNudges,
+		Help: commands.Help{
+			Summary:             "Turn WS sign-up reminders on or off",
+			DetailedDescription: "Turn the direct messages officers send when you haven't opted in or out on or off.",
+			Syntax:              "ws nudges <on/off>",
+			Example:             "ws nudges off",
+		},
+	}
+}
+
+// pendingMembers returns the members of the guild who have not answered the sign-up of the instance.
+func pendingMembers(instance instance, s *discordgo.Session, db *sql.DB, guildID string) ([]*discordgo.Member, error) {
+	members, err := getGuildMembers(s, guildID)
+	if err != nil {
+		return nil, err
+	}
+	participants, err := getParticipantsFromDatabase(db, instance)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get participants")
+	}
+	excluded, err := getPendingExclusionsFromDatabase(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get exclusions")
+	}
+
+	return nonResponders(members, participants, excluded), nil
+}
+
+// HandlePending handles listing the members who have not answered the sign-up.
+func HandlePending(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	pending, err := pendingMembers(instance, s, db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get pending members:", err.Error())
+		return
+	}
+
+	names := make([]string, len(pending))
+	for i, member := range pending {
+		names[i] = memberName(member)
+	}
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Pending in %v (%d)", instance, len(pending)),
+		Color:       infoColor,
+		Description: strings.Join(names, ", "),
+	}
+	if len(pending) == 0 {
+		response.Description = "Everyone has opted in or out!"
+	} else {
+		response.Description += "\n\nRemind them with `!ws pending nudge`."
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleNudgePending handles sending reminders to the members who have not answered the sign-up.
+func HandleNudgePending(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	pending, err := pendingMembers(instance, s, db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get pending members:", err.Error())
+		return
+	}
+	optedOut, err := getNudgeOptOutsFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get nudge opt outs:", err.Error())
+		return
+	}
+	deadline, err := getDeadlineFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get deadline:", err.Error())
+	}
+
+	reminder := fmt.Sprintf("You haven't signed up for the White Star in %v yet.\n"+
+		"Opt in with `!optin %v [preferred role]` or opt out with `!optout %v`.", instance, instance, instance)
+	if !deadline.time.IsZero() && !deadline.closed {
+		reminder += fmt.Sprintf("\nThe sign-up closes <t:%d:R>.", deadline.time.Unix())
+	}
+	reminder += "\n\nTurn off these reminders with `!ws nudges off`."
+
+	var sent, skipped, failed int
+	for _, member := range pending {
+		if optedOut[member.User.ID] {
+			skipped++
+			continue
+		}
+
+		err = sendNudge(s, member.User.ID, reminder)
+		if err != nil {
+			fmt.Println("Failed to nudge member:", err.Error())
+			failed++
+			continue
+		}
+		sent++
+	}
+
+	description := fmt.Sprintf("Reminded %d members.", sent)
+	if skipped > 0 {
+		description += fmt.Sprintf("\n%d members have turned off reminders.", skipped)
+	}
+	if failed > 0 {
+		description += fmt.Sprintf("\nFailed to remind %d members, they might not accept direct messages.", failed)
+	}
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: description,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func sendNudge(s *discordgo.Session, userID string, reminder string) error {
+	channel, err := s.UserChannelCreate(userID)
+	if err != nil {
+		return errors.Wrap(err, "failed to create DM channel")
+	}
+
+	msg := discordgo.MessageEmbed{
+		Title:       "White Star sign-up",
+		Color:       infoColor,
+		Description: reminder,
+	}
+	_, err = s.ChannelMessageSendEmbed(channel.ID, &msg)
+	return errors.Wrap(err, "failed to send message")
+}
+
+// pendingExclusionHandler returns a handler excluding, or including again, the mentioned members in the pending list.
+func pendingExclusionHandler(exclude bool) commands.Handler {
+	return func(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+		if len(m.Mentions) == 0 {
+			sendFailMessage("Mention the members, check `!help ws pending`.", s, m)
+			return
+		}
+
+		var names []string
+		for _, user := range m.Mentions {
+			err := setPendingExclusionInDatabase(db, user.ID, exclude)
+			if err != nil {
+				fmt.Println("Failed to set pending exclusion:", err.Error())
+				return
+			}
+			names = append(names, user.Username)
+		}
+
+		description := fmt.Sprintf("%v are listed as pending again.", strings.Join(names, ", "))
+		if exclude {
+			description = fmt.Sprintf("%v are no longer listed as pending.", strings.Join(names, ", "))
+		}
+		response := discordgo.MessageEmbed{
+			Color:       successColor,
+			Description: description,
+		}
+		_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+			return
+		}
+	}
+}
+
+// HandleNudges handles turning sign-up reminders on or off.
+func HandleNudges(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	var optOut bool
+	switch strings.ToLower(strings.TrimSpace(msg)) {
+	case "on":
+		optOut = false
+	case "off":
+		optOut = true
+	default:
+		sendFailMessage("Incorrect syntax, check `!help ws nudges`.", s, m)
+		return
+	}
+
+	err := setNudgeOptOutInDatabase(db, m.Author.ID, optOut)
+	if err != nil {
+		fmt.Println("Failed to set nudge opt out:", err.Error())
+		return
+	}
+
+	description := "You'll get reminders when you haven't signed up for a White Star."
+	if optOut {
+		description = "You'll no longer get reminders when you haven't signed up for a White Star."
+	}
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: description,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// getUserSetFromDatabase returns the user IDs of the query as a set.
+func getUserSetFromDatabase(db *sql.DB, query string) (map[string]bool, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	users := make(map[string]bool)
+	for rows.Next() {
+		var userID string
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		users[userID] = true
+	}
+
+	return users, nil
+}
+
+func getPendingExclusionsFromDatabase(db *sql.DB) (map[string]bool, error) {
+	return getUserSetFromDatabase(db, "SELECT user_id FROM ws_pending_exclusions")
+}
+
+func setPendingExclusionInDatabase(db *sql.DB, userID string, exclude bool) error {
+	statement := "DELETE FROM ws_pending_exclusions WHERE user_id = $1"
+	if exclude {
+		statement = "INSERT INTO ws_pending_exclusions (user_id) VALUES ($1) ON CONFLICT DO NOTHING"
+	}
+	_, err := db.Exec(statement, userID)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func getNudgeOptOutsFromDatabase(db *sql.DB) (map[string]bool, error) {
+	return getUserSetFromDatabase(db, "SELECT user_id FROM ws_nudge_opt_outs")
+}
+
+func setNudgeOptOutInDatabase(db *sql.DB, userID string, optOut bool) error {
+	statement := "DELETE FROM ws_nudge_opt_outs WHERE user_id = $1"
+	if optOut {
+		statement = "INSERT INTO ws_nudge_opt_outs (user_id) VALUES ($1) ON CONFLICT DO NOTHING"
+	}
+	_, err := db.Exec(statement, userID)
+	return errors.Wrap(err, "failed to execute query")
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"reflect"
+	"testing"
+)
+
+func Test_nonResponders(t *testing.T) {
+	member := func(id string, name string, nick string, bot bool, roles ...string) *discordgo.Member {
+		return &discordgo.Member{User: &discordgo.User{ID: id, Username: name, Bot: bot}, Nick: nick, Roles: roles}
+	}
+	members := []*discordgo.Member{
+		member("1", "zed", "", false, commands.MemberRoleID),
+		member("2", "amy", "", false, commands.AcademyRoleID),
+		member("3", "bob", "", false, commands.MemberRoleID),
+		member("4", "guest", "", false),
+		member("5", "outbot", "", true, commands.MemberRoleID),
+		member("6", "carl", "Alpha", false, commands.MemberRoleID, commands.OfficerRoleID),
+		member("7", "idle", "", false, commands.MemberRoleID),
+	}
+	participants := []participant{
+		{name: "bob", participating: true, userID: "3"},
+		{name: "zed-old", participating: false, userID: "8"},
+	}
+	excluded := map[string]bool{"7": true}
+
+	var actual []string
+	for _, m := range nonResponders(members, participants, excluded) {
+		actual = append(actual, memberName(m))
+	}
+	expected := []string{"Alpha", "amy", "zed"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("non-responders were %v, expected %v", actual, expected)
+	}
+}
+
+func Test_matchUserIDs(t *testing.T) {
+	members := []*discordgo.Member{
+		{User: &discordgo.User{ID: "1", Username: "amy"}},
+		{User: &discordgo.User{ID: "2", Username: "bob"}, Nick: "Bobby"},
+		{User: &discordgo.User{ID: "3", Username: "twin"}},
+		{User: &discordgo.User{ID: "4", Username: "other"}, Nick: "twin"},
+	}
+
+	actual := matchUserIDs([]string{"amy", "Bobby", "bob", "twin", "gone"}, members)
+	expected := map[string]string{"amy": "1", "Bobby": "2", "bob": "2"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("user IDs were %v, expected %v", actual, expected)
+	}
+}
@@ -0,0 +1,525 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxRedStarLevel  = 12
+	redStarGroupSize = 4
+	// defaultRedStarQueueExpiry is how long members stay queued unless the guild has configured otherwise.
+	defaultRedStarQueueExpiry = time.Hour
+)
+
+// redStarEntry is a member queued for a Red Star level.
+type redStarEntry struct {
+	level  int
+	userID string
+	name   string
+	// channelID the member queued in, the group is pinged there when the queue fills up.
+	channelID string
+	joined    time.Time
+	expires   time.Time
+}
+
+// parseRedStarLevels parses levels and ranges of levels, e.g. "5" or "4-6", returning them in ascending order.
+func parseRedStarLevels(args []string) ([]int, error) {
+	unique := make(map[int]bool)
+	for _, arg := range args {
+		bounds := strings.SplitN(arg, "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Errorf("%q is not a level", arg)
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.Atoi(bounds[1])
+			if err != nil || to < from {
+				return nil, errors.Errorf("%q is not a range of levels", arg)
+			}
+		}
+		if from < 1 || to > maxRedStarLevel {
+			return nil, errors.Errorf("the levels have to be between 1 and %d", maxRedStarLevel)
+		}
+		for level := from; level <= to; level++ {
+			unique[level] = true
+		}
+	}
+
+	var levels []int
+	for level := range unique {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+	return levels, nil
+}
+
+// fullRedStarQueue returns the highest of the levels which has a full group queued, with the members who queued first.
+func fullRedStarQueue(entries []redStarEntry, levels []int) (int, []redStarEntry, bool) {
+	queues := make(map[int][]redStarEntry)
+	for _, e := range entries {
+		queues[e.level] = append(queues[e.level], e)
+	}
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		queue := queues[levels[i]]
+		if len(queue) < redStarGroupSize {
+			continue
+		}
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].joined.Before(queue[j].joined) })
+		return levels[i], queue[:redStarGroupSize], true
+	}
+	return 0, nil, false
+}
+
+// RedStarCommand for finding a group for Red Stars.
+func RedStarCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "rs",
+		Permission:      commands.Members,
+		HelpDescription: "Queue for and log Red Stars",
+		Handler:         HandleRedStarList,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "q",
+				Permission:      commands.Members,
+				HelpDescription: "Join the queue of Red Star levels",
+				Handler:         HandleRedStarQueue,
+				Help: commands.Help{
+					Summary: "Join the queue of Red Star levels",
+					DetailedDescription: fmt.Sprintf("Join the queue of one or more Red Star levels, up to the level you've recorded with `rs level`. "+
+						"When %d are queued for a level they're pinged and removed from all queues. "+
+						"Queuing again for a level keeps your place and restarts the time until you're removed, see it with `rs expiry`.", redStarGroupSize),
+					Syntax:  "rs q <level|from-to> [level...]",
+					Example: "rs q 5 6",
+				},
+			},
+			{
+				CallPhrase:      "leave",
+				Permission:      commands.Members,
+				HelpDescription: "Leave the Red Star queues",
+				Handler:         HandleRedStarLeave,
+				Help: commands.Help{
+					Summary:             "Leave the Red Star queues",
+					DetailedDescription: "Leave the queues of the levels, or all of them if no level is given.",
+					Syntax:              "rs leave [level|from-to...]",
+					Example:             "rs leave 6",
+				},
+			},
+			{
+				CallPhrase:      "list",
+				Permission:      commands.Members,
+				HelpDescription: "Show the Red Star queues",
+				Handler:         HandleRedStarList,
+				Help: commands.Help{
+					Summary:             "Show the Red Star queues",
+					DetailedDescription: "Show who's queued for each Red Star level and when they're removed from the queue.",
+					Syntax:              "rs list",
+				},
+			},
+			{
+				CallPhrase:      "level",
+				Permission:      commands.Members,
+				HelpDescription: "Show or set your Red Star level",
+				Handler:         HandleRedStarLevel,
+				Help: commands.Help{
+					Summary: "Show or set your Red Star level",
+					DetailedDescription: "Show or set the highest Red Star level you can run, you can only queue up to it. " +
+						"Lowering it removes you from the queues above it.",
+					Syntax:  "rs level [level]",
+					Example: "rs level 7",
+				},
+			},
+			{
+				CallPhrase:      "expiry",
+				Permission:      commands.Officers,
+				HelpDescription: "Show or set how long members stay queued",
+				Handler:         HandleRedStarExpiry,
+				Help: commands.Help{
+					Summary:             "Show or set how long members stay queued",
+					DetailedDescription: "Show or set how long members stay in a Red Star queue before they're removed from it.",
+					Syntax:              "rs expiry [duration]",
+					Example:             "rs expiry 45m",
+				},
+			},
+			StarLogCommand(redStar),
+			StarStatsCommand(redStar),
+			RedStarSummaryCommand(),
+		},
+		Help: commands.Help{
+			Summary: "Queue for and log Red Stars",
+			DetailedDescription: "Find a group for a Red Star: record your level with `rs level`, queue with `rs q` and you're pinged when the group is full. " +
+				"Log your runs with `rs log` and see the stats with `rs stats`. Without a subcommand the queues are shown.",
+			Syntax:  "rs",
+			Example: "rs q 5",
+		},
+	}
+}
+
+// HandleRedStarQueue handles joining the queues, pinging the group when one fills up.
+func HandleRedStarQueue(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	levels, err := parseRedStarLevels(strings.Fields(msg))
+	if err != nil || len(levels) == 0 {
+		reason := "missing level"
+		if err != nil {
+			reason = err.Error()
+		}
+		sendFailMessage(fmt.Sprintf("Incorrect syntax, %v. Check `!help rs q`.", reason), s, m)
+		return
+	}
+
+	maxLevel, err := getRedStarLevelFromDatabase(db, m.Author.ID)
+	if err != nil {
+		fmt.Println("Failed to get Red Star level:", err.Error())
+		return
+	}
+	if maxLevel == 0 {
+		sendFailMessage("Record your Red Star level with `!rs level <level>` first.", s, m)
+		return
+	}
+	if levels[len(levels)-1] > maxLevel {
+		sendFailMessage(fmt.Sprintf("You can only queue up to your Red Star level %d, change it with `!rs level`.", maxLevel), s, m)
+		return
+	}
+
+	expiry, err := getRedStarQueueExpiryFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get Red Star queue expiry, using the default:", err.Error())
+		expiry = defaultRedStarQueueExpiry
+	}
+
+	now := time.Now()
+	name := displayName(s, guildID, m.Author.ID, m.Author.Username)
+	for _, level := range levels {
+		e := redStarEntry{level: level, userID: m.Author.ID, name: name, channelID: m.ChannelID, joined: now, expires: now.Add(expiry)}
+		err = setRedStarEntryInDatabase(db, e)
+		if err != nil {
+			fmt.Println("Failed to queue for Red Star:", err.Error())
+			return
+		}
+	}
+
+	entries, err := getRedStarEntriesFromDatabase(db, now)
+	if err != nil {
+		fmt.Println("Failed to get Red Star queues:", err.Error())
+		return
+	}
+	if level, group, full := fullRedStarQueue(entries, levels); full {
+		sendRedStarGroup(level, group, s, m, db)
+		return
+	}
+
+	var content string
+	for _, level := range levels {
+		var queued int
+		for _, e := range entries {
+			if e.level == level {
+				queued++
+			}
+		}
+		content += fmt.Sprintf("Red Star %d: %d/%d\n", level, queued, redStarGroupSize)
+	}
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("You're queued, %v!", name),
+		Color:       successColor,
+		Description: content + fmt.Sprintf("You're removed from the queue in %v.", formatDuration(expiry)),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// sendRedStarGroup removes the members of the full group from all queues and pings them.
+func sendRedStarGroup(level int, group []redStarEntry, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) {
+	var mentions, names []string
+	for _, e := range group {
+		_, err := deleteRedStarEntriesFromDatabase(db, e.userID, nil)
+		if err != nil {
+			fmt.Println("Failed to remove member from the Red Star queues:", err.Error())
+		}
+		mentions = append(mentions, fmt.Sprintf("<@%v>", e.userID))
+		names = append(names, e.name)
+	}
+
+	msg := discordgo.MessageSend{
+		Content: strings.Join(mentions, " "),
+		Embed: &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("Red Star %d is ready!", level),
+			Color:       successColor,
+			Description: fmt.Sprintf("%v, you've been removed from all queues.", strings.Join(names, ", ")),
+		},
+	}
+	_, err := s.ChannelMessageSendComplex(m.ChannelID, &msg)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleRedStarLeave handles leaving the queues.
+func HandleRedStarLeave(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	levels, err := parseRedStarLevels(strings.Fields(msg))
+	if err != nil {
+		sendFailMessage(fmt.Sprintf("Incorrect syntax, %v. Check `!help rs leave`.", err.Error()), s, m)
+		return
+	}
+
+	left, err := deleteRedStarEntriesFromDatabase(db, m.Author.ID, levels)
+	if err != nil {
+		fmt.Println("Failed to leave the Red Star queues:", err.Error())
+		return
+	}
+	if left == 0 {
+		sendFailMessage("You're not in those queues.", s, m)
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title: fmt.Sprintf("You've left the queue, %v!", m.Author.Username),
+		Color: successColor,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleRedStarList handles showing the queues.
+func HandleRedStarList(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	now := time.Now()
+	entries, err := getRedStarEntriesFromDatabase(db, now)
+	if err != nil {
+		fmt.Println("Failed to get Red Star queues:", err.Error())
+		return
+	}
+
+	queues := make(map[int][]redStarEntry)
+	var levels []int
+	for _, e := range entries {
+		if len(queues[e.level]) == 0 {
+			levels = append(levels, e.level)
+		}
+		queues[e.level] = append(queues[e.level], e)
+	}
+	sort.Ints(levels)
+
+	var fields []*discordgo.MessageEmbedField
+	for _, level := range levels {
+		var content string
+		for _, e := range queues[level] {
+			content += fmt.Sprintf("%v (%v left)\n", displayName(s, guildID, e.userID, e.name), formatDuration(e.expires.Sub(now)))
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{
+			Name:   fmt.Sprintf("Red Star %d (%d/%d)", level, len(queues[level]), redStarGroupSize),
+			Value:  content,
+			Inline: true,
+		})
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:  "Red Star queues",
+		Color:  infoColor,
+		Fields: fields,
+	}
+	if len(fields) == 0 {
+		response.Description = "Nobody is queued, join with `!rs q <level>`."
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleRedStarLevel handles showing or setting the member's Red Star level.
+func HandleRedStarLevel(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	if msg == "" {
+		level, err := getRedStarLevelFromDatabase(db, m.Author.ID)
+		if err != nil {
+			fmt.Println("Failed to get Red Star level:", err.Error())
+			return
+		}
+		description := "You haven't recorded your Red Star level, do it with `!rs level <level>`."
+		if level > 0 {
+			description = fmt.Sprintf("Your Red Star level is %d.", level)
+		}
+		response := discordgo.MessageEmbed{
+			Color:       infoColor,
+			Description: description,
+		}
+		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return
+	}
+
+	level, err := strconv.Atoi(msg)
+	if err != nil || level < 1 || level > maxRedStarLevel {
+		sendFailMessage(fmt.Sprintf("Incorrect level %q, it has to be between 1 and %d.", msg, maxRedStarLevel), s, m)
+		return
+	}
+
+	err = setRedStarLevelInDatabase(db, m.Author.ID, level)
+	if err != nil {
+		fmt.Println("Failed to set Red Star level:", err.Error())
+		return
+	}
+	var above []int
+	for l := level + 1; l <= maxRedStarLevel; l++ {
+		above = append(above, l)
+	}
+	if len(above) > 0 {
+		_, err = deleteRedStarEntriesFromDatabase(db, m.Author.ID, above)
+		if err != nil {
+			fmt.Println("Failed to leave the Red Star queues above the level:", err.Error())
+		}
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       "Red Star level set!",
+		Color:       successColor,
+		Description: fmt.Sprintf("Your Red Star level is %d.", level),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleRedStarExpiry handles showing or setting how long members stay queued.
+func HandleRedStarExpiry(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	title := "Red Star queue expiry"
+	if msg != "" {
+		expiry, err := time.ParseDuration(msg)
+		if err != nil || expiry <= 0 {
+			sendFailMessage(fmt.Sprintf("Incorrect expiry %q, it has to be a duration like 45m.", msg), s, m)
+			return
+		}
+		err = setRedStarQueueExpiryInDatabase(db, guildID, expiry)
+		if err != nil {
+			fmt.Println("Failed to set Red Star queue expiry:", err.Error())
+			return
+		}
+		title = "Red Star queue expiry set!"
+	}
+
+	expiry, err := getRedStarQueueExpiryFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get Red Star queue expiry:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       title,
+		Color:       successColor,
+		Description: fmt.Sprintf("Members are removed from the queues %v after queuing.", formatDuration(expiry)),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// getRedStarLevelFromDatabase returns the Red Star level of the member, 0 if it's not recorded.
+func getRedStarLevelFromDatabase(db *sql.DB, userID string) (int, error) {
+	var level int
+	err := db.QueryRow("SELECT level FROM rs_levels WHERE user_id = $1", userID).Scan(&level)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return level, errors.Wrap(err, "failed to do query")
+}
+
+func setRedStarLevelInDatabase(db *sql.DB, userID string, level int) error {
+	statement := `INSERT INTO rs_levels (user_id, level) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET level = $2`
+	_, err := db.Exec(statement, userID, level)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getRedStarQueueExpiryFromDatabase returns how long members stay queued, the default if it's not configured.
+func getRedStarQueueExpiryFromDatabase(db *sql.DB, guildID string) (time.Duration, error) {
+	var seconds int64
+	err := db.QueryRow("SELECT expiry FROM rs_queue_expiry WHERE guild_id = $1", guildID).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return defaultRedStarQueueExpiry, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to do query")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func setRedStarQueueExpiryInDatabase(db *sql.DB, guildID string, expiry time.Duration) error {
+	statement := `INSERT INTO rs_queue_expiry (guild_id, expiry) VALUES ($1, $2)
+	ON CONFLICT (guild_id) DO UPDATE SET expiry = $2`
+	_, err := db.Exec(statement, guildID, int64(expiry/time.Second))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getRedStarEntriesFromDatabase removes the expired entries and returns the rest, the first to queue first.
+func getRedStarEntriesFromDatabase(db *sql.DB, now time.Time) ([]redStarEntry, error) {
+	_, err := db.Exec("DELETE FROM rs_queue WHERE expires_at <= $1", now.UTC().Format(dbTimeFormat))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to delete expired entries")
+	}
+
+	rows, err := db.Query("SELECT level, user_id, name, channel_id, joined_at, expires_at FROM rs_queue ORDER BY joined_at")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var entries []redStarEntry
+	for rows.Next() {
+		var e redStarEntry
+		err = rows.Scan(&e.level, &e.userID, &e.name, &e.channelID, &e.joined, &e.expires)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// setRedStarEntryInDatabase queues the member, keeping their place if they're already queued for the level.
+func setRedStarEntryInDatabase(db *sql.DB, e redStarEntry) error {
+	statement := `INSERT INTO rs_queue (level, user_id, name, channel_id, joined_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (level, user_id) DO UPDATE SET name = $3, channel_id = $4, expires_at = $6`
+	_, err := db.Exec(statement, e.level, e.userID, e.name, e.channelID,
+		e.joined.UTC().Format(dbTimeFormat), e.expires.UTC().Format(dbTimeFormat))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// deleteRedStarEntriesFromDatabase removes the member from the queues of the levels, or all queues if there are none.
+// The number of queues the member was removed from is returned.
+func deleteRedStarEntriesFromDatabase(db *sql.DB, userID string, levels []int) (int64, error) {
+	levels64 := make([]int64, 0, len(levels))
+	for _, level := range levels {
+		levels64 = append(levels64, int64(level))
+	}
+
+	statement := "DELETE FROM rs_queue WHERE user_id = $1 AND (cardinality($2::integer[]) = 0 OR level = ANY($2))"
+	result, err := db.Exec(statement, userID, pq.Array(levels64))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to execute query")
+	}
+	affected, err := result.RowsAffected()
+	return affected, errors.Wrap(err, "failed to get affected rows")
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseRedStarLevels(t *testing.T) {
+	testData := []struct {
+		args        []string
+		expected    []int
+		expectError bool
+	}{
+		{args: []string{"5"}, expected: []int{5}},
+		{args: []string{"6", "4", "6"}, expected: []int{4, 6}},
+		{args: []string{"3-5", "8"}, expected: []int{3, 4, 5, 8}},
+		{args: []string{}, expected: nil},
+		{args: []string{"0"}, expectError: true},
+		{args: []string{"13"}, expectError: true},
+		{args: []string{"5-3"}, expectError: true},
+		{args: []string{"five"}, expectError: true},
+	}
+
+	for _, data := range testData {
+		actual, err := parseRedStarLevels(data.args)
+		if data.expectError {
+			if err == nil {
+				t.Errorf("expected an error for %q", data.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", data.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, data.expected) {
+			t.Errorf("%q was parsed to %v, expected %v", data.args, actual, data.expected)
+		}
+	}
+}
+
+func Test_fullRedStarQueue(t *testing.T) {
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	entry := func(level int, userID string, minutes int) redStarEntry {
+		return redStarEntry{level: level, userID: userID, joined: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+	entries := []redStarEntry{
+		entry(5, "a", 0), entry(5, "b", 5), entry(5, "c", 3), entry(5, "d", 1), entry(5, "e", 2),
+		entry(6, "a", 0), entry(6, "b", 5), entry(6, "c", 3),
+		entry(7, "a", 0), entry(7, "b", 1), entry(7, "c", 2), entry(7, "d", 3),
+	}
+
+	testData := []struct {
+		levels        []int
+		expectedLevel int
+		expectedUsers []string
+	}{
+		{levels: []int{5}, expectedLevel: 5, expectedUsers: []string{"a", "d", "e", "c"}},
+		{levels: []int{5, 6, 7}, expectedLevel: 7, expectedUsers: []string{"a", "b", "c", "d"}},
+		{levels: []int{6}},
+		{levels: []int{4, 6}},
+	}
+
+	for _, data := range testData {
+		level, group, full := fullRedStarQueue(entries, data.levels)
+		if full != (data.expectedLevel != 0) || level != data.expectedLevel {
+			t.Errorf("Full level for %v was %v (%v), expected %v", data.levels, level, full, data.expectedLevel)
+			continue
+		}
+		var users []string
+		for _, e := range group {
+			users = append(users, e.userID)
+		}
+		if !reflect.DeepEqual(users, data.expectedUsers) {
+			t.Errorf("Group for %v was %q, expected %q", data.levels, users, data.expectedUsers)
+		}
+	}
+}
@@ -5,79 +5,227 @@ import (
 	"fmt"
 	"github.com/MattiasBerlin/outbot/commands"
 	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-type Role string
-
 const (
-	currentWhitestar Role = "442643047541374977"
+	// roleChangeInterval is the least time between role changes, to stay clear of Discord's rate limits.
+	roleChangeInterval = 500 * time.Millisecond
+	// roleChangeAttempts is how many times a role change is tried before it's reported as failed.
+	roleChangeAttempts = 3
 )
 
-// ClearParticipantsCommand for clearing the participation list.
+// SetRolesCommand for giving the WS roles to the participants.
 func SetRolesCommand() commands.Command {
 	return commands.Command{
 		CallPhrase:      "setroles",
 		Permission:      commands.Officers,
-		HelpDescription: "Set roles after a WS match is found",
+		HelpDescription: "Sync the WS roles with the rosters",
 		Handler:         HandleSetRoles,
 		Help: commands.Help{
-			Summary:             "Set roles after a WS match is found",
-			DetailedDescription: "Set roles after a WS match is found.",
-			Syntax:              "setroles [instance]",
-			Example:             "setroles B",
+			Summary: "Sync the WS roles with the rosters",
+			DetailedDescription: "Give the WS role of the instance to the members on the roster of a matched White Star and remove it from everyone else. " +
+				"The approved roster is used if there is one, otherwise everyone who opted in. This is done automatically when a match is found or ends.",
+			Syntax:  "setroles [instance]",
+			Example: "setroles B",
 		},
 	}
 }
 
-func setRole(s *discordgo.Session, guildID, userID string, role Role) {
-	err := s.GuildMemberRoleAdd(guildID, userID, string(role))
-	if err != nil {
-		fmt.Printf("Failed to set role %v for user %v: %v\n", role, userID, err)
-		return
-	}
+// roleChange adds or removes a role of a member.
+type roleChange struct {
+	userID string
+	// name is shown in the report.
+	name   string
+	roleID string
+	add    bool
 }
 
-func removeRole(s *discordgo.Session, guildID, userID string, role Role) {
-	err := s.GuildMemberRoleRemove(guildID, userID, string(role))
-	if err != nil {
-		fmt.Printf("Failed to remove role %v for user %v: %v\n", role, userID, err)
-		return
+// roleFailure is a role change which could not be done.
+type roleFailure struct {
+	change roleChange
+	err    error
+}
+
+// roleReport is the result of reconciling a role.
+type roleReport struct {
+	added   []roleChange
+	removed []roleChange
+	failed  []roleFailure
+	// left are the members who should have the role but are no longer in the guild.
+	left []roleChange
+}
+
+func (r *roleReport) merge(other roleReport) {
+	r.added = append(r.added, other.added...)
+	r.removed = append(r.removed, other.removed...)
+	r.failed = append(r.failed, other.failed...)
+	r.left = append(r.left, other.left...)
+}
+
+// roleHolders are the names of the members who should have a role, mapped by user ID.
+type roleHolders map[string]string
+
+// diffRoleHolders returns the changes which give the role to exactly the desired members.
+// Desired members who are not in the guild are returned separately.
+func diffRoleHolders(roleID string, desired roleHolders, members []*discordgo.Member) ([]roleChange, []roleChange) {
+	inGuild := make(map[string]bool)
+	var changes []roleChange
+	for _, member := range members {
+		if member.User == nil {
+			continue
+		}
+		inGuild[member.User.ID] = true
+
+		var hasRole bool
+		for _, r := range member.Roles {
+			if r == roleID {
+				hasRole = true
+				break
+			}
+		}
+		_, wanted := desired[member.User.ID]
+		if wanted != hasRole {
+			changes = append(changes, roleChange{userID: member.User.ID, name: memberName(member), roleID: roleID, add: wanted})
+		}
+	}
+
+	var left []roleChange
+	for userID, name := range desired {
+		if !inGuild[userID] {
+			left = append(left, roleChange{userID: userID, name: name, roleID: roleID, add: true})
+		}
+	}
+
+	for _, list := range [][]roleChange{changes, left} {
+		sort.Slice(list, func(i, j int) bool { return list[i].userID < list[j].userID })
 	}
+	return changes, left
 }
 
-// removeRolesForParticipants and return the amount of users affected.
-func removeRolesForParticipants(instance instance, s *discordgo.Session, db *sql.DB, guildID string) int {
-	participants, err := getParticipantsFromDatabase(db, instance)
-	if err != nil {
-		fmt.Println("Failed to get participants:", err.Error())
-		return 0
+// roleWorker applies role changes one at a time, waiting between requests and retrying failed ones.
+type roleWorker struct {
+	interval time.Duration
+	attempts int
+	apply    func(roleChange) error
+}
+
+// roleWorkerMutex makes role workers take turns, so concurrent reconciliations share the rate limit.
+var roleWorkerMutex sync.Mutex
+
+func newRoleWorker(s *discordgo.Session, guildID string) roleWorker {
+	return roleWorker{
+		interval: roleChangeInterval,
+		attempts: roleChangeAttempts,
+		apply: func(c roleChange) error {
+			if c.add {
+				return s.GuildMemberRoleAdd(guildID, c.userID, c.roleID)
+			}
+			return s.GuildMemberRoleRemove(guildID, c.userID, c.roleID)
+		},
 	}
+}
+
+// run applies the changes and reports the result.
+// Members who left the guild in the meantime are reported as left rather than failed.
+func (w roleWorker) run(changes []roleChange) roleReport {
+	roleWorkerMutex.Lock()
+	defer roleWorkerMutex.Unlock()
 
-	for _, p := range participants {
-		go removeRole(s, guildID, p.userID, currentWhitestar)
+	var report roleReport
+	for i, c := range changes {
+		var err error
+		for attempt := 0; attempt < w.attempts; attempt++ {
+			if i > 0 || attempt > 0 {
+				// Back off more for every retry
+				time.Sleep(w.interval * time.Duration(1<<uint(attempt)))
+			}
+			err = w.apply(c)
+			if err == nil || isUnknownMember(err) {
+				break
+			}
+		}
+
+		switch {
+		case err == nil && c.add:
+			report.added = append(report.added, c)
+		case err == nil:
+			report.removed = append(report.removed, c)
+		case isUnknownMember(err):
+			if c.add {
+				report.left = append(report.left, c)
+			}
+		default:
+			report.failed = append(report.failed, roleFailure{change: c, err: err})
+		}
 	}
+	return report
+}
+
+// isUnknownMember returns whether the error is Discord saying the member is not in the guild.
+func isUnknownMember(err error) bool {
+	restErr, ok := err.(*discordgo.RESTError)
+	return ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMember
+}
 
-	return len(participants)
+// formatRoleReport summarises the report, listing the failures and the members who left.
+func formatRoleReport(r roleReport) string {
+	content := fmt.Sprintf("Gave the WS role to %d members and removed it from %d.", len(r.added), len(r.removed))
+	if len(r.failed) > 0 {
+		content += fmt.Sprintf("\n**Failed** (%d):", len(r.failed))
+		for _, f := range r.failed {
+			action := "remove from"
+			if f.change.add {
+				action = "give to"
+			}
+			content += fmt.Sprintf("\nCould not %v %v: %v", action, f.change.name, f.err)
+		}
+	}
+	if len(r.left) > 0 {
+		names := make([]string, len(r.left))
+		for i, c := range r.left {
+			names[i] = c.name
+		}
+		content += fmt.Sprintf("\n**Left the guild** (%d): %v", len(r.left), strings.Join(names, ", "))
+	}
+	return content
 }
 
+// HandleSetRoles handles reconciling the WS role of an instance.
 func HandleSetRoles(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
-	participants, err := getParticipantsFromDatabase(db, channelToInstance(m.ChannelID, msg))
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	i, err := getInstanceFromDatabase(db, instance)
 	if err != nil {
-		fmt.Println("Failed to get participants:", err.Error())
+		fmt.Println("Failed to get instance:", err.Error())
+		return
+	}
+	if i.roleID == "" {
+		sendFailMessage(fmt.Sprintf("%v has no WS role, mention one with `!instance add`.", instance), s, m)
 		return
 	}
 
-	var participating int
-	for _, p := range participants {
-		if p.participating {
-			participating++
-			setRole(s, guildID, p.userID, currentWhitestar)
-		}
+	report, err := reconcileRoles(s, db, guildID, i.roleID)
+	if err != nil {
+		fmt.Println("Failed to reconcile WS roles:", err.Error())
+		sendFailMessage("Failed to sync the WS roles.", s, m)
+		return
 	}
 
 	response := discordgo.MessageEmbed{
+		Title:       "WS roles synced!",
 		Color:       successColor,
-		Description: fmt.Sprintf("Set Current Whitestar role for %d members!", participating),
+		Description: formatRoleReport(report),
+	}
+	if len(report.failed) > 0 {
+		response.Color = failColor
 	}
 	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
 	if err != nil {
@@ -85,3 +233,93 @@ func HandleSetRoles(msg string, s *discordgo.Session, m *discordgo.MessageCreate
 		return
 	}
 }
+
+// reconcileInstanceRole reconciles the WS role of the instance and returns the report to show.
+func reconcileInstanceRole(instance instance, s *discordgo.Session, db *sql.DB, guildID string) string {
+	i, err := getInstanceFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get instance:", err.Error())
+		return "Failed to sync the WS roles, try `!setroles`."
+	}
+	if i.roleID == "" {
+		return fmt.Sprintf("%v has no WS role to give.", instance)
+	}
+
+	report, err := reconcileRoles(s, db, guildID, i.roleID)
+	if err != nil {
+		fmt.Println("Failed to reconcile WS roles:", err.Error())
+		return "Failed to sync the WS roles, try `!setroles`."
+	}
+	return formatRoleReport(report)
+}
+
+// reconcileRoles gives the WS roles to the members who should have them and removes them from everyone else.
+// Only the given roles are reconciled, or every WS role if none are given.
+func reconcileRoles(s *discordgo.Session, db *sql.DB, guildID string, roleIDs ...string) (roleReport, error) {
+	desired, err := desiredRoleHoldersFromDatabase(db)
+	if err != nil {
+		return roleReport{}, errors.Wrap(err, "failed to get desired role holders")
+	}
+	members, err := getGuildMembers(s, guildID)
+	if err != nil {
+		return roleReport{}, err
+	}
+
+	if len(roleIDs) == 0 {
+		for roleID := range desired {
+			roleIDs = append(roleIDs, roleID)
+		}
+		sort.Strings(roleIDs)
+	}
+
+	var (
+		changes []roleChange
+		report  roleReport
+	)
+	for _, roleID := range roleIDs {
+		roleChanges, left := diffRoleHolders(roleID, desired[roleID], members)
+		changes = append(changes, roleChanges...)
+		report.left = append(report.left, left...)
+	}
+
+	report.merge(newRoleWorker(s, guildID).run(changes))
+	return report, nil
+}
+
+// desiredRoleHoldersFromDatabase returns who should have each WS role, mapped by role ID.
+// Instances can share a role. The role is wanted while a match is found or in progress,
+// for the approved roster if there is one and otherwise for everyone who opted in.
+func desiredRoleHoldersFromDatabase(db *sql.DB) (map[string]roleHolders, error) {
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get instances")
+	}
+
+	desired := make(map[string]roleHolders)
+	for _, i := range instances {
+		if i.roleID == "" {
+			continue
+		}
+		if desired[i.roleID] == nil {
+			desired[i.roleID] = make(roleHolders)
+		}
+
+		round, err := getCurrentRoundFromDatabase(db, i.name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get WS round")
+		}
+		if round.phase != matched && round.phase != inProgress {
+			continue
+		}
+
+		team, _, err := getTeamFromDatabase(db, i.name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get team")
+		}
+		for userID, name := range team {
+			desired[i.roleID][userID] = name
+		}
+	}
+
+	return desired, nil
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"reflect"
+	"testing"
+)
+
+func Test_diffRoleHolders(t *testing.T) {
+	const roleID = "ws"
+	members := []*discordgo.Member{
+		{User: &discordgo.User{ID: "1", Username: "amy"}, Roles: []string{roleID}},
+		{User: &discordgo.User{ID: "2", Username: "bob"}},
+		{User: &discordgo.User{ID: "3", Username: "carl"}, Roles: []string{"other", roleID}},
+		{User: &discordgo.User{ID: "4", Username: "dan"}, Roles: []string{"other"}},
+	}
+	desired := roleHolders{"1": "amy", "2": "bob", "5": "gone"}
+
+	changes, left := diffRoleHolders(roleID, desired, members)
+	expectedChanges := []roleChange{
+		{userID: "2", name: "bob", roleID: roleID, add: true},
+		{userID: "3", name: "carl", roleID: roleID, add: false},
+	}
+	expectedLeft := []roleChange{{userID: "5", name: "gone", roleID: roleID, add: true}}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("changes were %+v, expected %+v", changes, expectedChanges)
+	}
+	if !reflect.DeepEqual(left, expectedLeft) {
+		t.Errorf("left were %+v, expected %+v", left, expectedLeft)
+	}
+}
+
+func Test_roleWorker(t *testing.T) {
+	unknownMember := &discordgo.RESTError{Message: &discordgo.APIErrorMessage{Code: discordgo.ErrCodeUnknownMember}}
+	calls := make(map[string]int)
+	w := roleWorker{
+		attempts: 3,
+		apply: func(c roleChange) error {
+			calls[c.userID]++
+			switch c.userID {
+			case "flaky":
+				if calls[c.userID] < 2 {
+					return errors.New("rate limited")
+				}
+			case "broken":
+				return errors.New("missing permissions")
+			case "gone":
+				return unknownMember
+			}
+			return nil
+		},
+	}
+
+	report := w.run([]roleChange{
+		{userID: "ok", add: true},
+		{userID: "flaky", add: false},
+		{userID: "broken", add: true},
+		{userID: "gone", add: true},
+	})
+
+	if len(report.added) != 1 || report.added[0].userID != "ok" {
+		t.Errorf("added were %+v, expected ok", report.added)
+	}
+	if len(report.removed) != 1 || report.removed[0].userID != "flaky" {
+		t.Errorf("removed were %+v, expected flaky", report.removed)
+	}
+	if len(report.failed) != 1 || report.failed[0].change.userID != "broken" {
+		t.Errorf("failed were %+v, expected broken", report.failed)
+	}
+	if len(report.left) != 1 || report.left[0].userID != "gone" {
+		t.Errorf("left were %+v, expected gone", report.left)
+	}
+	expectedCalls := map[string]int{"ok": 1, "flaky": 2, "broken": 3, "gone": 1}
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("calls were %v, expected %v", calls, expectedCalls)
+	}
+}
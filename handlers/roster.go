@@ -0,0 +1,728 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rosterSizes are the sizes a White Star can be played with.
+var rosterSizes = []int{5, 10, 15}
+
+// targetRoles are the preferred roles which have target counts.
+var targetRoles = []wsRole{defense, offense, hunter}
+
+// defaultRosterTargets per roster size, used when an instance has not configured its own.
+var defaultRosterTargets = map[int]rosterTargets{
+	5:  {defense: 2, offense: 2, hunter: 1},
+	10: {defense: 4, offense: 4, hunter: 2},
+	15: {defense: 6, offense: 6, hunter: 3},
+}
+
+// rosterTargets maps the roles to how many players the roster should have of them.
+type rosterTargets map[wsRole]int
+
+// rosterPick is a participant picked for the roster.
+type rosterPick struct {
+	participant
+	// role the participant is picked for, which is not always the preferred one.
+	role   wsRole
+	reason string
+}
+
+// roster of a White Star instance.
+type roster struct {
+	instance instance
+	size     int
+	picks    []rosterPick
+	// notes explaining what the builder could not do.
+	notes    []string
+	approved bool
+	built    time.Time
+}
+
+// buildRoster picks the roster from the participants.
+// locked participants are always picked and excluded ones never, both are mapped by user ID.
+// The targets are filled with participants preferring the role first, then with the ones without a preference
+// assigned to the role missing the most players, locked ones first.
+// The remaining slots are filled with participants without a preference, then extras of the roles and last the fillers.
+func buildRoster(participants []participant, size int, targets rosterTargets, locked map[string]bool, excluded map[string]bool) (roster, error) {
+	r := roster{size: size}
+
+	var candidates []participant
+	for _, p := range participants {
+		if p.participating && !excluded[p.userID] {
+			candidates = append(candidates, p)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return strings.ToLower(candidates[i].name) < strings.ToLower(candidates[j].name)
+	})
+
+	counts := make(map[wsRole]int)
+	picked := make(map[string]bool)
+	pick := func(p participant, role wsRole, reason string) {
+		r.picks = append(r.picks, rosterPick{participant: p, role: role, reason: reason})
+		picked[p.userID] = true
+		counts[role]++
+	}
+	remaining := func(filter func(participant) bool) []participant {
+		var left []participant
+		for _, p := range candidates {
+			if !picked[p.userID] && filter(p) {
+				left = append(left, p)
+			}
+		}
+		return left
+	}
+
+	// Locked picks, the ones without a preference keep their slot until they are assigned a role below
+	var lockedOpen []participant
+	for _, p := range remaining(func(p participant) bool { return locked[p.userID] }) {
+		if p.preferredRole == defaultRole {
+			lockedOpen = append(lockedOpen, p)
+			picked[p.userID] = true
+			continue
+		}
+		pick(p, p.preferredRole, "locked by an officer")
+	}
+	reserved := len(lockedOpen)
+	if len(r.picks)+reserved > size {
+		return r, errors.Errorf("%d participants are locked, which is more than the roster size %d", len(r.picks)+reserved, size)
+	}
+
+	// Targets with participants preferring the role, then with participants without a preference
+	for _, role := range targetRoles {
+		for _, p := range remaining(func(p participant) bool { return p.preferredRole == role }) {
+			if counts[role] >= targets[role] || len(r.picks)+reserved >= size {
+				break
+			}
+			pick(p, role, fmt.Sprintf("%v target (%d/%d)", strings.ToLower(string(role)), counts[role]+1, targets[role]))
+		}
+	}
+	// Participants without a preference go to the role missing the most players
+	for _, p := range append(lockedOpen, remaining(func(p participant) bool { return p.preferredRole == defaultRole })...) {
+		isLocked := locked[p.userID]
+		if isLocked {
+			reserved--
+		} else if len(r.picks)+reserved >= size {
+			break
+		}
+		var role wsRole
+		for _, candidate := range targetRoles {
+			missing := targets[candidate] - counts[candidate]
+			if missing > 0 && (role == "" || missing > targets[role]-counts[role]) {
+				role = candidate
+			}
+		}
+		switch {
+		case role == "" && isLocked:
+			pick(p, defaultRole, "locked by an officer")
+		case role == "":
+		case isLocked:
+			pick(p, role, fmt.Sprintf("locked by an officer, assigned to meet the %v target (%d/%d)", strings.ToLower(string(role)), counts[role]+1, targets[role]))
+		default:
+			pick(p, role, fmt.Sprintf("no preference, assigned to meet the %v target (%d/%d)", strings.ToLower(string(role)), counts[role]+1, targets[role]))
+		}
+	}
+	for _, role := range targetRoles {
+		if counts[role] < targets[role] {
+			r.notes = append(r.notes, fmt.Sprintf("Only %d of the targeted %d %v players are available.", counts[role], targets[role], strings.ToLower(string(role))))
+		}
+	}
+
+	// Open slots
+	topUps := []struct {
+		filter func(participant) bool
+		reason string
+	}{
+		{filter: func(p participant) bool { return p.preferredRole == defaultRole }, reason: "open slot"},
+		{filter: func(p participant) bool { return p.preferredRole != filler }, reason: "open slot, role target already met"},
+		{filter: func(p participant) bool { return p.preferredRole == filler }, reason: "filler topping up"},
+	}
+	for _, topUp := range topUps {
+		for _, p := range remaining(topUp.filter) {
+			if len(r.picks) >= size {
+				break
+			}
+			pick(p, p.preferredRole, topUp.reason)
+		}
+	}
+
+	if len(r.picks) < size {
+		r.notes = append(r.notes, fmt.Sprintf("The roster is %d players short.", size-len(r.picks)))
+	}
+	if left := remaining(func(participant) bool { return true }); len(left) > 0 {
+		names := make([]string, len(left))
+		for i, p := range left {
+			names[i] = p.name
+		}
+		r.notes = append(r.notes, fmt.Sprintf("Left out since the roster is full: %v", strings.Join(names, ", ")))
+	}
+
+	return r, nil
+}
+
+// defaultRosterSize returns the largest roster size the participants can fill, at least the smallest size.
+func defaultRosterSize(participants []participant) int {
+	var available int
+	for _, p := range participants {
+		if p.participating {
+			available++
+		}
+	}
+
+	size := rosterSizes[0]
+	for _, s := range rosterSizes {
+		if s <= available {
+			size = s
+		}
+	}
+	return size
+}
+
+func isRosterSize(size int) bool {
+	for _, s := range rosterSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// formatRoster lists the picks by role with the reason they were picked.
+func formatRoster(r roster) string {
+	var content string
+	for _, role := range []wsRole{defense, offense, hunter, defaultRole, filler} {
+		var lines []string
+		for _, p := range r.picks {
+			if p.role == role {
+				lines = append(lines, fmt.Sprintf("%v - *%v*", p.name, p.reason))
+			}
+		}
+		if len(lines) > 0 {
+			content += fmt.Sprintf("**%v** (%d):\n%v\n", role, len(lines), strings.Join(lines, "\n"))
+		}
+	}
+	if len(r.notes) > 0 {
+		content += "\n" + strings.Join(r.notes, "\n")
+	}
+	return content
+}
+
+// WSRosterCommand for building the roster of a White Star.
+func WSRosterCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "roster",
+		Permission:      commands.Members,
+		HelpDescription: "Show the WS roster",
+		Handler:         HandleRoster,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "build",
+				Permission:      commands.Officers,
+				HelpDescription: "Build the WS roster from the opted in members",
+				Handler:         HandleBuildRoster,
+				Help: commands.Help{
+					Summary: "Build the WS roster from the opted in members",
+					DetailedDescription: "Pick a roster of 5, 10 or 15 from the opted in members, aiming for the role targets " +
+						"(see `ws roster targets`) and topping up with fillers. Locked members are always picked and excluded ones never. " +
+						"The size defaults to the largest one that can be filled. Approve it with `ws roster approve`.",
+					Syntax:  "ws roster build [instance] [size]",
+					Example: "ws roster build A 10",
+				},
+			},
+			{
+				CallPhrase:      "approve",
+				Permission:      commands.Officers,
+				HelpDescription: "Approve the built WS roster",
+				Handler:         HandleApproveRoster,
+				Help: commands.Help{
+					Summary:             "Approve the built WS roster",
+					DetailedDescription: "Approve the latest built roster as the roster of the White Star.",
+					Syntax:              "ws roster approve [instance]",
+					Example:             "ws roster approve A",
+				},
+			},
+			{
+				CallPhrase:      "lock",
+				Permission:      commands.Officers,
+				HelpDescription: "Always pick members for the WS roster",
+				Handler:         rosterPickHandler(rosterLocked),
+				Help: commands.Help{
+					Summary:             "Always pick members for the WS roster",
+					DetailedDescription: "Always pick the mentioned members when building the roster, as long as they've opted in.",
+					Syntax:              "ws roster lock [instance] <members>",
+					Example:             "ws roster lock A @Maro",
+				},
+			},
+			{
+				CallPhrase:      "exclude",
+				Permission:      commands.Officers,
+				HelpDescription: "Never pick members for the WS roster",
+				Handler:         rosterPickHandler(rosterExcluded),
+				Help: commands.Help{
+					Summary:             "Never pick members for the WS roster",
+					DetailedDescription: "Never pick the mentioned members when building the roster.",
+					Syntax:              "ws roster exclude [instance] <members>",
+					Example:             "ws roster exclude A @Maro",
+				},
+			},
+			{
+				CallPhrase:      "release",
+				Permission:      commands.Officers,
+				HelpDescription: "Remove locks and exclusions from members",
+				Handler:         rosterPickHandler(""),
+				Help: commands.Help{
+					Summary:             "Remove locks and exclusions from members",
+					DetailedDescription: "Let the roster builder decide about the mentioned members again.",
+					Syntax:              "ws roster release [instance] <members>",
+					Example:             "ws roster release A @Maro",
+				},
+			},
+			{
+				CallPhrase:      "targets",
+				Permission:      commands.Officers,
+				HelpDescription: "Set the role targets of the WS roster",
+				Handler:         HandleRosterTargets,
+				Help: commands.Help{
+					Summary: "Set the role targets of the WS roster",
+					DetailedDescription: "Set how many defense, offense and hunter players the roster builder aims for with a roster size. " +
+						"Leave out the counts to show the current targets.",
+					Syntax:  "ws roster targets [instance] <size> [defense offense hunter]",
+					Example: "ws roster targets A 15 6 6 3",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "Show the WS roster",
+			DetailedDescription: "Show the latest built roster of the White Star and whether it has been approved.",
+			Syntax:              "ws roster [instance]",
+			Example:             "ws roster A",
+		},
+	}
+}
+
+// HandleRoster handles showing the roster.
+func HandleRoster(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	r, err := getRosterFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get roster:", err.Error())
+		return
+	}
+
+	sendRoster(r, "", s, m)
+}
+
+func sendRoster(r roster, prefix string, s *discordgo.Session, m *discordgo.MessageCreate) {
+	response := discordgo.MessageEmbed{
+		Color: infoColor,
+	}
+	if len(r.picks) == 0 {
+		response.Description = fmt.Sprintf("There's no roster for %v, officers can build one with `!ws roster build`.", r.instance)
+	} else {
+		status := "proposed, approve it with `!ws roster approve`"
+		if r.approved {
+			status = "approved"
+			response.Color = successColor
+		}
+		response.Title = fmt.Sprintf("Roster of %v (%d/%d, %v)", r.instance, len(r.picks), r.size, status)
+		response.Description = prefix + formatRoster(r)
+	}
+
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleBuildRoster handles building the roster.
+func HandleBuildRoster(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	var size int
+	if len(args) > 0 && isNumber(args[len(args)-1]) {
+		size, _ = strconv.Atoi(args[len(args)-1])
+		args = args[:len(args)-1]
+		if !isRosterSize(size) {
+			sendFailMessage(fmt.Sprintf("The roster size has to be 5, 10 or 15, not %d.", size), s, m)
+			return
+		}
+	}
+
+	instance, ok := instanceFromMessage(strings.Join(args, " "), s, m, db)
+	if !ok {
+		return
+	}
+
+	participants, err := getParticipantsFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get participants:", err.Error())
+		return
+	}
+	participants = withDisplayNames(participants, s, guildID)
+	if size == 0 {
+		size = defaultRosterSize(participants)
+	}
+
+	targets, err := getRosterTargetsFromDatabase(db, instance, size)
+	if err != nil {
+		fmt.Println("Failed to get roster targets:", err.Error())
+		return
+	}
+	locked, excluded, err := getRosterPicksFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get roster picks:", err.Error())
+		return
+	}
+
+	r, err := buildRoster(participants, size, targets, locked, excluded)
+	if err != nil {
+		sendFailMessage(strings.ToUpper(err.Error()[:1])+err.Error()[1:]+".", s, m)
+		return
+	}
+	r.instance = instance
+	r.built = time.Now()
+
+	err = setRosterInDatabase(db, r)
+	if err != nil {
+		fmt.Println("Failed to set roster:", err.Error())
+		return
+	}
+
+	sendRoster(r, "", s, m)
+}
+
+// HandleApproveRoster handles approving the roster.
+func HandleApproveRoster(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	r, err := getRosterFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get roster:", err.Error())
+		return
+	}
+	if len(r.picks) == 0 {
+		sendFailMessage(fmt.Sprintf("There's no roster for %v to approve, build one with `!ws roster build`.", instance), s, m)
+		return
+	}
+
+	err = setRosterApprovedInDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to approve roster:", err.Error())
+		return
+	}
+	r.approved = true
+
+	sendRoster(r, "", s, m)
+}
+
+const (
+	rosterLocked   = "locked"
+	rosterExcluded = "excluded"
+)
+
+// rosterPickHandler returns a handler setting how the roster builder treats the mentioned members.
+// An empty pick removes locks and exclusions.
+func rosterPickHandler(pick string) commands.Handler {
+	return func(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+		var args []string
+		for _, arg := range strings.Fields(msg) {
+			if !isMention(arg) {
+				args = append(args, arg)
+			}
+		}
+		instance, ok := instanceFromMessage(strings.Join(args, " "), s, m, db)
+		if !ok {
+			return
+		}
+		if len(m.Mentions) == 0 {
+			sendFailMessage("Mention the members, check `!help ws`.", s, m)
+			return
+		}
+
+		var names []string
+		for _, user := range m.Mentions {
+			err := setRosterPickInDatabase(db, instance, user.ID, pick)
+			if err != nil {
+				fmt.Println("Failed to set roster pick:", err.Error())
+				return
+			}
+			names = append(names, user.Username)
+		}
+
+		description := fmt.Sprintf("%v are no longer locked or excluded in %v.", strings.Join(names, ", "), instance)
+		if pick != "" {
+			description = fmt.Sprintf("%v are %v in %v.", strings.Join(names, ", "), pick, instance)
+		}
+		response := discordgo.MessageEmbed{
+			Color:       successColor,
+			Description: description,
+		}
+		_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+			return
+		}
+	}
+}
+
+// HandleRosterTargets handles setting and showing the role targets.
+func HandleRosterTargets(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+
+	// The numbers at the end are the size and counts, anything before them is the instance
+	numbers := 0
+	for i := len(args) - 1; i >= 0 && isNumber(args[i]); i-- {
+		numbers++
+	}
+	if numbers != 1 && numbers != 1+len(targetRoles) {
+		sendFailMessage("Give the size and optionally the defense, offense and hunter counts, check `!help ws`.", s, m)
+		return
+	}
+	values := make([]int, numbers)
+	for i, arg := range args[len(args)-numbers:] {
+		values[i], _ = strconv.Atoi(arg)
+		if values[i] < 0 {
+			sendFailMessage(fmt.Sprintf("The size and counts can't be negative, %d isn't allowed.", values[i]), s, m)
+			return
+		}
+	}
+	size := values[0]
+	if !isRosterSize(size) {
+		sendFailMessage(fmt.Sprintf("The roster size has to be 5, 10 or 15, not %d.", size), s, m)
+		return
+	}
+
+	instance, ok := instanceFromMessage(strings.Join(args[:len(args)-numbers], " "), s, m, db)
+	if !ok {
+		return
+	}
+
+	title := "Roster targets"
+	if numbers > 1 {
+		targets := make(rosterTargets)
+		total := 0
+		for i, role := range targetRoles {
+			targets[role] = values[i+1]
+			total += values[i+1]
+		}
+		if total > size {
+			sendFailMessage(fmt.Sprintf("The targets add up to %d, which is more than the roster size %d.", total, size), s, m)
+			return
+		}
+
+		err := setRosterTargetsInDatabase(db, instance, size, targets)
+		if err != nil {
+			fmt.Println("Failed to set roster targets:", err.Error())
+			return
+		}
+		title = "Roster targets set!"
+	}
+
+	targets, err := getRosterTargetsFromDatabase(db, instance, size)
+	if err != nil {
+		fmt.Println("Failed to get roster targets:", err.Error())
+		return
+	}
+
+	var content string
+	for _, role := range targetRoles {
+		content += fmt.Sprintf("%v: %d\n", role, targets[role])
+	}
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("%v for %v with %d players", title, instance, size),
+		Color:       successColor,
+		Description: content,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func sendFailMessage(description string, s *discordgo.Session, m *discordgo.MessageCreate) {
+	response := discordgo.MessageEmbed{
+		Color:       failColor,
+		Description: description,
+	}
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+	}
+}
+
+// getRosterTargetsFromDatabase for the size, the default targets are returned if the instance has none.
+func getRosterTargetsFromDatabase(db *sql.DB, instance instance, size int) (rosterTargets, error) {
+	var def, off, hunt int
+	query := "SELECT defense, offense, hunter FROM ws_roster_targets WHERE instance = $1 AND size = $2"
+	err := db.QueryRow(query, instance, size).Scan(&def, &off, &hunt)
+	if err == sql.ErrNoRows {
+		return defaultRosterTargets[size], nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	return rosterTargets{defense: def, offense: off, hunter: hunt}, nil
+}
+
+func setRosterTargetsInDatabase(db *sql.DB, instance instance, size int, targets rosterTargets) error {
+	statement := `INSERT INTO ws_roster_targets (instance, size, defense, offense, hunter) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (instance, size) DO UPDATE SET defense = $3, offense = $4, hunter = $5`
+	_, err := db.Exec(statement, instance, size, targets[defense], targets[offense], targets[hunter])
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getRosterPicksFromDatabase returns the locked and excluded members, mapped by user ID.
+func getRosterPicksFromDatabase(db *sql.DB, instance instance) (map[string]bool, map[string]bool, error) {
+	rows, err := db.Query("SELECT user_id, pick FROM ws_roster_picks WHERE instance = $1", instance)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	locked := make(map[string]bool)
+	excluded := make(map[string]bool)
+	for rows.Next() {
+		var userID, pick string
+		err = rows.Scan(&userID, &pick)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to scan row")
+		}
+
+		switch pick {
+		case rosterLocked:
+			locked[userID] = true
+		case rosterExcluded:
+			excluded[userID] = true
+		}
+	}
+
+	return locked, excluded, nil
+}
+
+// setRosterPickInDatabase sets whether the member is locked or excluded, an empty pick removes it.
+func setRosterPickInDatabase(db *sql.DB, instance instance, userID string, pick string) error {
+	if pick == "" {
+		_, err := db.Exec("DELETE FROM ws_roster_picks WHERE instance = $1 AND user_id = $2", instance, userID)
+		return errors.Wrap(err, "failed to execute query")
+	}
+
+	statement := `INSERT INTO ws_roster_picks (instance, user_id, pick) VALUES ($1, $2, $3)
+	ON CONFLICT (instance, user_id) DO UPDATE SET pick = $3`
+	_, err := db.Exec(statement, instance, userID, pick)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getRosterFromDatabase returns the latest built roster of the instance, without picks if there's none.
+func getRosterFromDatabase(db *sql.DB, instance instance) (roster, error) {
+	r := roster{instance: instance}
+
+	var notes string
+	query := "SELECT size, notes, approved, built_at FROM ws_rosters WHERE instance = $1"
+	err := db.QueryRow(query, instance).Scan(&r.size, &notes, &r.approved, &r.built)
+	if err == sql.ErrNoRows {
+		return r, nil
+	}
+	if err != nil {
+		return r, errors.Wrap(err, "failed to do query")
+	}
+	if notes != "" {
+		r.notes = strings.Split(notes, "\n")
+	}
+
+	rows, err := db.Query("SELECT name, user_id, role, reason FROM ws_roster_picks_built WHERE instance = $1 ORDER BY position", instance)
+	if err != nil {
+		return r, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p rosterPick
+		err = rows.Scan(&p.name, &p.userID, &p.role, &p.reason)
+		if err != nil {
+			return r, errors.Wrap(err, "failed to scan row")
+		}
+		p.participating = true
+		r.picks = append(r.picks, p)
+	}
+
+	return r, nil
+}
+
+// getTeamFromDatabase returns the names of the members on the approved roster of the instance mapped by user ID,
+// or the ones opted in if there's no approved roster. Whether it's the roster is also returned.
+func getTeamFromDatabase(db *sql.DB, instance instance) (map[string]string, bool, error) {
+	team := make(map[string]string)
+	r, err := getRosterFromDatabase(db, instance)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to get roster")
+	}
+	if r.approved {
+		for _, p := range r.picks {
+			team[p.userID] = p.name
+		}
+		return team, true, nil
+	}
+
+	participants, err := getParticipantsFromDatabase(db, instance)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to get participants")
+	}
+	for _, p := range participants {
+		if p.participating {
+			team[p.userID] = p.name
+		}
+	}
+	return team, false, nil
+}
+
+// setRosterInDatabase replaces the roster of the instance with a new, not yet approved, roster.
+func setRosterInDatabase(db *sql.DB, r roster) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	statement := `INSERT INTO ws_rosters (instance, size, notes, approved, built_at) VALUES ($1, $2, $3, false, $4)
+	ON CONFLICT (instance) DO UPDATE SET size = $2, notes = $3, approved = false, built_at = $4`
+	_, err = tx.Exec(statement, r.instance, r.size, strings.Join(r.notes, "\n"), r.built.UTC())
+	if err != nil {
+		return errors.Wrap(err, "failed to set roster")
+	}
+
+	_, err = tx.Exec("DELETE FROM ws_roster_picks_built WHERE instance = $1", r.instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to clear roster")
+	}
+	for i, p := range r.picks {
+		statement = "INSERT INTO ws_roster_picks_built (instance, position, name, user_id, role, reason) VALUES ($1, $2, $3, $4, $5, $6)"
+		_, err = tx.Exec(statement, r.instance, i, p.name, p.userID, p.role, p.reason)
+		if err != nil {
+			return errors.Wrap(err, "failed to add pick")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+func setRosterApprovedInDatabase(db *sql.DB, instance instance) error {
+	_, err := db.Exec("UPDATE ws_rosters SET approved = true WHERE instance = $1", instance)
+	return errors.Wrap(err, "failed to execute query")
+}
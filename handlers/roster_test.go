@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_buildRoster(t *testing.T) {
+	p := func(name string, role wsRole) participant {
+		return participant{name: name, participating: true, preferredRole: role, userID: name}
+	}
+	participants := []participant{
+		p("a", defense), p("b", defense), p("c", defense),
+		p("d", offense), p("e", defaultRole), p("f", filler),
+		{name: "g", participating: false, preferredRole: hunter, userID: "g"},
+		p("h", hunter),
+	}
+
+	testData := []struct {
+		size     int
+		locked   []string
+		excluded []string
+		expected map[string]wsRole
+		fail     bool
+	}{
+		{size: 5, expected: map[string]wsRole{"a": defense, "b": defense, "d": offense, "e": offense, "h": hunter}},
+		{size: 5, locked: []string{"f"}, expected: map[string]wsRole{"a": defense, "b": defense, "d": offense, "h": hunter, "f": filler}},
+		{size: 5, locked: []string{"e"}, expected: map[string]wsRole{"a": defense, "b": defense, "d": offense, "e": offense, "h": hunter}},
+		{size: 5, locked: []string{"c", "e"}, excluded: []string{"d"}, expected: map[string]wsRole{"a": defense, "b": defense, "c": defense, "e": offense, "h": hunter}},
+		{size: 5, excluded: []string{"a", "h"}, expected: map[string]wsRole{"b": defense, "c": defense, "d": offense, "e": offense, "f": filler}},
+		{size: 10, expected: map[string]wsRole{"a": defense, "b": defense, "c": defense, "d": offense, "e": offense, "f": filler, "h": hunter}},
+		{size: 5, locked: []string{"a", "b", "c", "d", "e", "f"}, fail: true},
+	}
+
+	for _, d := range testData {
+		set := func(names []string) map[string]bool {
+			m := make(map[string]bool)
+			for _, n := range names {
+				m[n] = true
+			}
+			return m
+		}
+
+		r, err := buildRoster(participants, d.size, defaultRosterTargets[d.size], set(d.locked), set(d.excluded))
+		if d.fail {
+			if err == nil {
+				t.Errorf("building a roster of %d with %v locked should fail", d.size, d.locked)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("building a roster of %d failed: %v", d.size, err)
+			continue
+		}
+
+		actual := make(map[string]wsRole)
+		for _, pick := range r.picks {
+			actual[pick.name] = pick.role
+		}
+		if !reflect.DeepEqual(actual, d.expected) {
+			t.Errorf("roster of %d with %v locked and %v excluded was %v, expected %v", d.size, d.locked, d.excluded, actual, d.expected)
+		}
+	}
+}
@@ -0,0 +1,680 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSheetsAPIURL is the base URL of the Google Sheets API.
+	DefaultSheetsAPIURL = "https://sheets.googleapis.com/v4/"
+	googleTokenURL      = "https://oauth2.googleapis.com/token"
+	googleAuthURL       = "https://accounts.google.com/o/oauth2/auth"
+	googleSheetsScope   = "https://www.googleapis.com/auth/spreadsheets"
+
+	// DefaultSheetsAuthAddr is the loopback address the consent screen redirects the auth code to.
+	DefaultSheetsAuthAddr = "127.0.0.1:8085"
+	// sheetsAuthTimeout is how long the consent is waited for when the export is first set up.
+	sheetsAuthTimeout = 10 * time.Minute
+
+	googleAPICredentialsFile = "credentials.json"
+	googleAPITokenFile       = "token.json"
+
+	// sheetSyncDelay is how long changes are collected before they're pushed, so a burst of changes is pushed once.
+	sheetSyncDelay = 10 * time.Second
+	// tokenExpiryMargin is how long before it expires an access token is refreshed.
+	tokenExpiryMargin = time.Minute
+)
+
+// SheetsConfig for exporting to a Google spreadsheet.
+type SheetsConfig struct {
+	// APIURL is the base URL of the Sheets API, it can point to a local server when testing.
+	APIURL        string
+	SpreadsheetID string
+	// CredentialsFile is the OAuth client downloaded from the Google API console.
+	CredentialsFile string
+	// TokenFile is where the OAuth token is kept between restarts.
+	TokenFile string
+	// AuthAddr is the loopback address the auth code is received on when there's no token file yet.
+	AuthAddr string
+	// AuthCode is exchanged for a token when there's no token file yet, instead of waiting for it on AuthAddr.
+	// It's the code parameter the consent screen redirected to AuthAddr with.
+	AuthCode string
+	// ParticipantsRange and ModulesRange are the A1 ranges the data is written to, e.g. "Participants" for a whole sheet.
+	ParticipantsRange string
+	ModulesRange      string
+}
+
+// sheetExporter pushes the participation lists and module levels to the spreadsheet.
+type sheetExporter struct {
+	client            *sheetsClient
+	participantsRange string
+	modulesRange      string
+	guildID           string
+
+	mutex    sync.Mutex
+	pending  bool
+	lastSync time.Time
+	lastErr  error
+}
+
+var (
+	// sheets is nil while the export is disabled or waiting to be authorized.
+	sheets      *sheetExporter
+	sheetsMutex sync.Mutex
+)
+
+// enabledSheets returns the export, nil if it's disabled.
+func enabledSheets() *sheetExporter {
+	sheetsMutex.Lock()
+	defer sheetsMutex.Unlock()
+	return sheets
+}
+
+// enableSheets starts exporting with the exporter.
+func enableSheets(exporter *sheetExporter) {
+	sheetsMutex.Lock()
+	defer sheetsMutex.Unlock()
+	sheets = exporter
+}
+
+// EnableSheets sets up the export to the spreadsheet, the first auth code is exchanged for a token if needed.
+// Without a token or an auth code the export is enabled once the consent is given, without waiting for it.
+func EnableSheets(config SheetsConfig, guildID string) error {
+	if config.APIURL == "" {
+		config.APIURL = DefaultSheetsAPIURL
+	}
+	if config.CredentialsFile == "" {
+		config.CredentialsFile = googleAPICredentialsFile
+	}
+	if config.TokenFile == "" {
+		config.TokenFile = googleAPITokenFile
+	}
+	if config.ParticipantsRange == "" {
+		config.ParticipantsRange = "Participants"
+	}
+	if config.ModulesRange == "" {
+		config.ModulesRange = "Modules"
+	}
+	if config.AuthAddr == "" {
+		config.AuthAddr = DefaultSheetsAuthAddr
+	}
+
+	tokens, err := newOAuthTokenSource(config.CredentialsFile, config.TokenFile)
+	if err != nil {
+		return err
+	}
+	exporter := &sheetExporter{
+		client:            newSheetsClient(config.APIURL, config.SpreadsheetID, tokens),
+		participantsRange: config.ParticipantsRange,
+		modulesRange:      config.ModulesRange,
+		guildID:           guildID,
+	}
+
+	switch {
+	case tokens.token.RefreshToken != "":
+	case config.AuthCode != "":
+		err = tokens.exchange(config.AuthCode, "http://"+config.AuthAddr)
+		if err != nil {
+			return errors.Wrap(err, "failed to get a token")
+		}
+	default:
+		// Waiting for the consent here would keep the bot offline
+		go func() {
+			err := authorizeOnLoopback(tokens, config.AuthAddr, sheetsAuthTimeout)
+			if err != nil {
+				fmt.Println("Failed to get a token for the spreadsheet export:", err.Error())
+				return
+			}
+			enableSheets(exporter)
+		}()
+		return nil
+	}
+
+	enableSheets(exporter)
+	return nil
+}
+
+// SheetCommand for the spreadsheet export.
+func SheetCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "sheet",
+		Permission:      commands.Officers,
+		HelpDescription: "Show the spreadsheet export",
+		Handler:         HandleSheet,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "sync",
+				Permission:      commands.Officers,
+				HelpDescription: "Push the WS participants and modules to the spreadsheet",
+				Handler:         HandleSheetSync,
+				Help: commands.Help{
+					Summary: "Push the WS participants and modules to the spreadsheet",
+					DetailedDescription: "Replace the participation lists and the module levels of the members in the spreadsheet. " +
+						"This is also done shortly after they change.",
+					Syntax:  "sheet sync",
+					Example: "sheet sync",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "Show the spreadsheet export",
+			DetailedDescription: "Show which spreadsheet the WS participants and module levels are exported to and when it was last done.",
+			Syntax:              "sheet",
+			Example:             "sheet",
+		},
+	}
+}
+
+// HandleSheet handles showing the status of the export.
+func HandleSheet(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	exporter := enabledSheets()
+	response := discordgo.MessageEmbed{
+		Color:       infoColor,
+		Description: "The spreadsheet export is not set up.",
+	}
+	if exporter != nil {
+		exporter.mutex.Lock()
+		response.Description = fmt.Sprintf("Exporting to the ranges `%v` and `%v` of https://docs.google.com/spreadsheets/d/%v\n",
+			exporter.participantsRange, exporter.modulesRange, exporter.client.spreadsheetID)
+		switch {
+		case exporter.lastErr != nil:
+			response.Description += fmt.Sprintf("The last sync failed: %v", exporter.lastErr)
+			response.Color = failColor
+		case exporter.lastSync.IsZero():
+			response.Description += "It hasn't been synced since the bot started."
+		default:
+			response.Description += fmt.Sprintf("Last synced: %v", formatRelativeTime(exporter.lastSync, time.Now(), userLocation(db, m.Author.ID)))
+		}
+		exporter.mutex.Unlock()
+	}
+
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleSheetSync handles pushing to the spreadsheet.
+func HandleSheetSync(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	exporter := enabledSheets()
+	if exporter == nil {
+		sendFailMessage("The spreadsheet export is not set up.", s, m)
+		return
+	}
+
+	err := exporter.sync(s, db)
+	if err != nil {
+		fmt.Println("Failed to sync spreadsheet:", err.Error())
+		sendFailMessage(fmt.Sprintf("Failed to sync the spreadsheet: %v", err), s, m)
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: "Spreadsheet synced!",
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// scheduleSheetSync pushes to the spreadsheet after a short delay, if the export is set up.
+func scheduleSheetSync(s *discordgo.Session, db *sql.DB) {
+	exporter := enabledSheets()
+	if exporter == nil {
+		return
+	}
+
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	if exporter.pending {
+		return
+	}
+	exporter.pending = true
+	time.AfterFunc(sheetSyncDelay, func() {
+		exporter.mutex.Lock()
+		exporter.pending = false
+		exporter.mutex.Unlock()
+
+		err := exporter.sync(s, db)
+		if err != nil {
+			fmt.Println("Failed to sync spreadsheet:", err.Error())
+		}
+	})
+}
+
+// sync replaces the participants and module levels in the spreadsheet.
+func (e *sheetExporter) sync(s *discordgo.Session, db *sql.DB) error {
+	err := e.push(s, db)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.lastErr = err
+	if err == nil {
+		e.lastSync = time.Now()
+	}
+	return err
+}
+
+func (e *sheetExporter) push(s *discordgo.Session, db *sql.DB) error {
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get instances")
+	}
+	var participants []participant
+	for _, i := range instances {
+		p, err := getParticipantsFromDatabase(db, i.name)
+		if err != nil {
+			return errors.Wrap(err, "failed to get participants")
+		}
+		participants = append(participants, withDisplayNames(p, s, e.guildID)...)
+	}
+
+	levels, err := getAllModuleLevelsFromDatabase(db)
+	if err != nil {
+		return errors.Wrap(err, "failed to get module levels")
+	}
+	names := make(map[string]string)
+	for userID := range levels {
+		names[userID] = displayName(s, e.guildID, userID, userID)
+	}
+
+	err = e.client.replaceValues(e.participantsRange, participantRows(participants))
+	if err != nil {
+		return errors.Wrap(err, "failed to export participants")
+	}
+	err = e.client.replaceValues(e.modulesRange, moduleRows(levels, names))
+	return errors.Wrap(err, "failed to export modules")
+}
+
+// participantRows are the rows of the participants sheet, sorted by instance and name, with a header.
+func participantRows(participants []participant) [][]string {
+	sorted := make([]participant, len(participants))
+	copy(sorted, participants)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].instance != sorted[j].instance {
+			return sorted[i].instance < sorted[j].instance
+		}
+		return strings.ToLower(sorted[i].name) < strings.ToLower(sorted[j].name)
+	})
+
+	rows := [][]string{{"Instance", "Member", "Participating", "Preferred role"}}
+	for _, p := range sorted {
+		participating := "No"
+		if p.participating {
+			participating = "Yes"
+		}
+		rows = append(rows, []string{string(p.instance), p.name, participating, string(p.preferredRole)})
+	}
+	return rows
+}
+
+// moduleRows are the rows of the modules sheet with a member on each row, sorted by name,
+// and a column for each module anyone has, in the order of the canonical list.
+// levels are mapped by user ID and module, names by user ID.
+func moduleRows(levels map[string]map[string]int, names map[string]string) [][]string {
+	header := []string{"Member"}
+	var columns []string
+	for _, def := range moduleDefs {
+		for _, modules := range levels {
+			if modules[def.name] > 0 {
+				header = append(header, def.name)
+				columns = append(columns, def.name)
+				break
+			}
+		}
+	}
+
+	var userIDs []string
+	for userID := range levels {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool {
+		return strings.ToLower(names[userIDs[i]]) < strings.ToLower(names[userIDs[j]])
+	})
+
+	rows := [][]string{header}
+	for _, userID := range userIDs {
+		row := []string{names[userID]}
+		for _, module := range columns {
+			cell := ""
+			if lvl := levels[userID][module]; lvl > 0 {
+				cell = strconv.Itoa(lvl)
+			}
+			row = append(row, cell)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// getAllModuleLevelsFromDatabase returns the module levels of every member, mapped by user ID and module.
+func getAllModuleLevelsFromDatabase(db *sql.DB) (map[string]map[string]int, error) {
+	rows, err := db.Query("SELECT user_id, module, level FROM member_modules")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	levels := make(map[string]map[string]int)
+	for rows.Next() {
+		var (
+			userID string
+			l      moduleLevel
+		)
+		err = rows.Scan(&userID, &l.module, &l.level)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		if levels[userID] == nil {
+			levels[userID] = make(map[string]int)
+		}
+		levels[userID][l.module] = l.level
+	}
+
+	return levels, nil
+}
+
+// sheetsClient does requests to the Sheets API of a spreadsheet.
+type sheetsClient struct {
+	apiURL        string
+	spreadsheetID string
+	tokens        *oauthTokenSource
+	http          *http.Client
+}
+
+func newSheetsClient(apiURL string, spreadsheetID string, tokens *oauthTokenSource) *sheetsClient {
+	if !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+	return &sheetsClient{
+		apiURL:        apiURL,
+		spreadsheetID: spreadsheetID,
+		tokens:        tokens,
+		http:          &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// valueRange is the body of a values update.
+type valueRange struct {
+	Range          string     `json:"range"`
+	MajorDimension string     `json:"majorDimension"`
+	Values         [][]string `json:"values"`
+}
+
+// replaceValues clears the range and writes the rows to it, starting at its top left cell.
+func (c *sheetsClient) replaceValues(rng string, rows [][]string) error {
+	path := fmt.Sprintf("spreadsheets/%v/values/%v", url.PathEscape(c.spreadsheetID), url.PathEscape(rng))
+
+	err := c.do(http.MethodPost, path+":clear", struct{}{})
+	if err != nil {
+		return errors.Wrap(err, "failed to clear range")
+	}
+	err = c.do(http.MethodPut, path+"?valueInputOption=RAW", valueRange{Range: rng, MajorDimension: "ROWS", Values: rows})
+	return errors.Wrap(err, "failed to update range")
+}
+
+// do sends the body as JSON. If the access token is rejected it's refreshed and the request is tried once more.
+func (c *sheetsClient) do(method string, path string, body interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal body")
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.tokens.accessToken(attempt > 0)
+		if err != nil {
+			return errors.Wrap(err, "failed to get access token")
+		}
+
+		req, err := http.NewRequest(method, c.apiURL+path, bytes.NewReader(content))
+		if err != nil {
+			return errors.Wrap(err, "failed to create request")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "failed to do request")
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return errors.Errorf("Sheets API responded with %v: %v", resp.Status, strings.TrimSpace(string(respBody)))
+		}
+		return nil
+	}
+}
+
+// oauthToken as stored in the token file.
+type oauthToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// oauthTokenSource hands out access tokens, refreshing them when they're about to expire.
+type oauthTokenSource struct {
+	mutex        sync.Mutex
+	authURL      string
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	token        oauthToken
+	// file the token is saved to when it changes, it's not saved if empty.
+	file  string
+	clock clock
+	http  *http.Client
+}
+
+// googleCredentials is the OAuth client file downloaded from the Google API console.
+type googleCredentials struct {
+	Installed *googleClient `json:"installed"`
+	Web       *googleClient `json:"web"`
+}
+
+type googleClient struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	AuthURI      string `json:"auth_uri"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// newOAuthTokenSource reads the client from the credentials file and the token from the token file if it exists.
+func newOAuthTokenSource(credentialsFile string, tokenFile string) (*oauthTokenSource, error) {
+	content, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read Google API credentials file")
+	}
+	var credentials googleCredentials
+	err = json.Unmarshal(content, &credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse Google API credentials file")
+	}
+	client := credentials.Installed
+	if client == nil {
+		client = credentials.Web
+	}
+	if client == nil {
+		return nil, errors.New("Google API credentials file has no client")
+	}
+
+	t := &oauthTokenSource{
+		authURL:      client.AuthURI,
+		tokenURL:     client.TokenURI,
+		clientID:     client.ClientID,
+		clientSecret: client.ClientSecret,
+		file:         tokenFile,
+		clock:        systemClock{},
+		http:         &http.Client{Timeout: 30 * time.Second},
+	}
+	if t.authURL == "" {
+		t.authURL = googleAuthURL
+	}
+	if t.tokenURL == "" {
+		t.tokenURL = googleTokenURL
+	}
+
+	content, err = ioutil.ReadFile(tokenFile)
+	if err == nil {
+		err = json.Unmarshal(content, &t.token)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse token file")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "unable to read token file")
+	}
+	return t, nil
+}
+
+// accessToken returns a valid access token, it's refreshed first if it's about to expire or if forced to.
+func (t *oauthTokenSource) accessToken(forceRefresh bool) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !forceRefresh && t.token.AccessToken != "" && t.clock.Now().Add(tokenExpiryMargin).Before(t.token.Expiry) {
+		return t.token.AccessToken, nil
+	}
+	if t.token.RefreshToken == "" {
+		return "", errors.New("no refresh token, a new auth code is needed")
+	}
+
+	err := t.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {t.token.RefreshToken},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to refresh token")
+	}
+	return t.token.AccessToken, nil
+}
+
+// consentURL is the address of the consent screen, which redirects the auth code to the redirect URI.
+func (t *oauthTokenSource) consentURL(redirectURI string) string {
+	return t.authURL + "?" + url.Values{
+		"client_id":     {t.clientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {googleSheetsScope},
+		"access_type":   {"offline"},
+		"prompt":        {"consent"},
+	}.Encode()
+}
+
+// exchange the auth code of the consent screen for a token.
+// The redirect URI has to be the one the consent screen redirected the code to.
+func (t *oauthTokenSource) exchange(code string, redirectURI string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.requestToken(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	})
+}
+
+// authorizeOnLoopback prints the consent URL and waits for the consent screen to redirect the auth code to addr,
+// where it's exchanged for a token.
+func authorizeOnLoopback(t *oauthTokenSource, addr string, timeout time.Duration) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for the auth code")
+	}
+	redirectURI := "http://" + listener.Addr().String()
+
+	done := make(chan error, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			http.Error(w, "Missing auth code", http.StatusBadRequest)
+			return
+		}
+		err := t.exchange(code, redirectURI)
+		if err != nil {
+			http.Error(w, "Failed to get a token, check the log of the bot", http.StatusInternalServerError)
+		} else {
+			fmt.Fprint(w, "The spreadsheet export is set up, you can close this page.")
+		}
+		select {
+		case done <- err:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	fmt.Println("Open this address to allow the spreadsheet export:", t.consentURL(redirectURI))
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.Errorf("no auth code was received within %v", timeout)
+	}
+}
+
+// requestToken from the token endpoint and save it. The mutex has to be held.
+func (t *oauthTokenSource) requestToken(form url.Values) error {
+	form.Set("client_id", t.clientID)
+	form.Set("client_secret", t.clientSecret)
+	resp, err := t.http.PostForm(t.tokenURL, form)
+	if err != nil {
+		return errors.Wrap(err, "failed to do request")
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		RefreshToken     string `json:"refresh_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse token response (%v)", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return errors.Errorf("token endpoint responded with %v: %v %v", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	t.token.AccessToken = body.AccessToken
+	t.token.Expiry = t.clock.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	// Refreshing doesn't return a new refresh token, the old one keeps working
+	if body.RefreshToken != "" {
+		t.token.RefreshToken = body.RefreshToken
+	}
+
+	if t.file == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(t.token, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal token")
+	}
+	return errors.Wrap(ioutil.WriteFile(t.file, content, 0600), "failed to save token")
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSheetsServer is a local stand-in for the token endpoint and the Sheets API.
+type fakeSheetsServer struct {
+	// validToken is the only access token accepted.
+	validToken string
+	refreshes  int
+	// requests are the method and path of the API requests, in order.
+	requests []string
+	values   map[string][][]string
+}
+
+func (f *fakeSheetsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		r.ParseForm()
+		if r.Form.Get("grant_type") == "authorization_code" {
+			if r.Form.Get("code") != "auth" || r.Form.Get("redirect_uri") != "http://127.0.0.1:8085" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "first", "refresh_token": "refresh", "expires_in": 3600, "token_type": "Bearer"}`)
+			return
+		}
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh" || r.Form.Get("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		f.refreshes++
+		f.validToken = fmt.Sprintf("access-%d", f.refreshes)
+		fmt.Fprintf(w, `{"access_token": %q, "expires_in": 3600, "token_type": "Bearer"}`, f.validToken)
+		return
+	}
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.Header.Get("Authorization") != "Bearer "+f.validToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodPut {
+		var body valueRange
+		json.NewDecoder(r.Body).Decode(&body)
+		f.values[body.Range] = body.Values
+	}
+	fmt.Fprint(w, "{}")
+}
+
+func Test_sheetsClient(t *testing.T) {
+	fake := &fakeSheetsServer{validToken: "initial", values: make(map[string][][]string)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)}
+	tokens := &oauthTokenSource{
+		tokenURL:     server.URL + "/token",
+		clientID:     "client",
+		clientSecret: "secret",
+		token:        oauthToken{AccessToken: "initial", RefreshToken: "refresh", Expiry: clock.now.Add(time.Hour)},
+		clock:        clock,
+		http:         server.Client(),
+	}
+	client := newSheetsClient(server.URL+"/v4", "sheet-id", tokens)
+
+	rows := [][]string{{"Instance", "Member"}, {"A", "amy"}}
+	err := client.replaceValues("Participants!A1:D", rows)
+	if err != nil {
+		t.Fatal("Failed to replace values:", err)
+	}
+	if fake.refreshes != 0 {
+		t.Errorf("The token should not be refreshed before it expires, it was refreshed %d times", fake.refreshes)
+	}
+	expectedRequests := []string{
+		"POST /v4/spreadsheets/sheet-id/values/Participants!A1:D:clear",
+		"PUT /v4/spreadsheets/sheet-id/values/Participants!A1:D",
+	}
+	if !reflect.DeepEqual(fake.requests, expectedRequests) {
+		t.Errorf("Requests were %q, expected %q", fake.requests, expectedRequests)
+	}
+	if !reflect.DeepEqual(fake.values["Participants!A1:D"], rows) {
+		t.Errorf("Values were %q, expected %q", fake.values["Participants!A1:D"], rows)
+	}
+
+	// An expired token is refreshed before the request
+	clock.Advance(2 * time.Hour)
+	err = client.replaceValues("Modules", rows)
+	if err != nil {
+		t.Fatal("Failed to replace values with an expired token:", err)
+	}
+	if fake.refreshes != 1 {
+		t.Errorf("The expired token should be refreshed once, it was refreshed %d times", fake.refreshes)
+	}
+
+	// A revoked token is refreshed when it's rejected and the request is tried again
+	fake.validToken = "revoked"
+	fake.requests = nil
+	err = client.replaceValues("Modules", rows)
+	if err != nil {
+		t.Fatal("Failed to replace values with a revoked token:", err)
+	}
+	if fake.refreshes != 2 || len(fake.requests) != 3 {
+		t.Errorf("The rejected token should be refreshed and the request retried, refreshes %d, requests %q", fake.refreshes, fake.requests)
+	}
+
+	// Without a valid refresh token the error is returned
+	tokens.token.RefreshToken = "invalid"
+	fake.validToken = "revoked again"
+	err = client.replaceValues("Modules", rows)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Expected an invalid grant error, got %v", err)
+	}
+}
+
+func Test_oauthTokenSource_exchange(t *testing.T) {
+	server := httptest.NewServer(&fakeSheetsServer{})
+	defer server.Close()
+
+	tokens := &oauthTokenSource{
+		authURL:  "https://accounts.example.com/auth",
+		tokenURL: server.URL + "/token",
+		clientID: "client",
+		clock:    &fakeClock{now: time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)},
+		http:     server.Client(),
+	}
+
+	consent := tokens.consentURL("http://127.0.0.1:8085")
+	if !strings.HasPrefix(consent, tokens.authURL+"?") || !strings.Contains(consent, "redirect_uri=http%3A%2F%2F127.0.0.1%3A8085") {
+		t.Errorf("The consent URL %v should redirect to the loopback address", consent)
+	}
+
+	if err := tokens.exchange("auth", "http://127.0.0.1:8085"); err != nil {
+		t.Fatal("Failed to exchange auth code:", err)
+	}
+	if tokens.token.RefreshToken != "refresh" {
+		t.Errorf("The refresh token should be stored, got %+v", tokens.token)
+	}
+	if err := tokens.exchange("auth", "http://127.0.0.1:9999"); err == nil {
+		t.Error("The code should only be accepted with the redirect URI it was sent to")
+	}
+}
+
+func Test_participantRows(t *testing.T) {
+	participants := []participant{
+		{instance: "B", name: "zed", participating: true, preferredRole: defense},
+		{instance: "A", name: "bob", participating: false},
+		{instance: "A", name: "Amy", participating: true, preferredRole: filler},
+	}
+
+	expected := [][]string{
+		{"Instance", "Member", "Participating", "Preferred role"},
+		{"A", "Amy", "Yes", "Filler"},
+		{"A", "bob", "No", ""},
+		{"B", "zed", "Yes", string(defense)},
+	}
+	actual := participantRows(participants)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Rows were %q, expected %q", actual, expected)
+	}
+}
+
+func Test_moduleRows(t *testing.T) {
+	levels := map[string]map[string]int{
+		"1": {"Time Warp": 5, "Mining Boost": 8},
+		"2": {"Battery": 3, "Time Warp": 2},
+	}
+	names := map[string]string{"1": "zed", "2": "amy"}
+
+	expected := [][]string{
+		{"Member", "Battery", "Time Warp", "Mining Boost"},
+		{"amy", "3", "2", ""},
+		{"zed", "", "5", "8"},
+	}
+	actual := moduleRows(levels, names)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Rows were %q, expected %q", actual, expected)
+	}
+}
@@ -0,0 +1,642 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// shipType is a type of ship which can be destroyed in a White Star.
+type shipType string
+
+const (
+	battleship shipType = "battleship"
+	transport  shipType = "transport"
+	miner      shipType = "miner"
+)
+
+// shipTypes in the order they're listed.
+var shipTypes = []shipType{battleship, transport, miner}
+
+// defaultShipCooldowns are how long destroyed ships take to return unless the guild has configured otherwise.
+var defaultShipCooldowns = map[shipType]time.Duration{
+	battleship: 18 * time.Hour,
+	transport:  12 * time.Hour,
+	miner:      12 * time.Hour,
+}
+
+// shipFromString returns the ship type of its name or abbreviation, e.g. "bs".
+func shipFromString(s string) (shipType, bool) {
+	switch strings.ToLower(s) {
+	case "bs", "battleship":
+		return battleship, true
+	case "ts", "transport":
+		return transport, true
+	case "miner", "mn":
+		return miner, true
+	}
+	return "", false
+}
+
+// shipDown is a destroyed ship waiting for its cooldown.
+type shipDown struct {
+	instance instance
+	enemy    bool
+	// owner is the user ID of our members and the lowercased name of enemy players.
+	owner string
+	name  string
+	ship  shipType
+	// channelID the ship was recorded in, enemy returns and failed DMs are posted to it.
+	channelID string
+	destroyed time.Time
+	returns   time.Time
+}
+
+// parseShipDown parses the words ending with a ship and optionally how long ago it was destroyed, e.g. "B bs 2h".
+// The words before the ship are returned.
+func parseShipDown(args []string) ([]string, shipType, time.Duration, error) {
+	var ago time.Duration
+	if len(args) > 1 {
+		if d, err := time.ParseDuration(args[len(args)-1]); err == nil {
+			if d < 0 {
+				return nil, "", 0, errors.Errorf("%q can't be negative", args[len(args)-1])
+			}
+			ago = d
+			args = args[:len(args)-1]
+		}
+	}
+	if len(args) == 0 {
+		return nil, "", 0, errors.New("missing ship")
+	}
+
+	ship, ok := shipFromString(args[len(args)-1])
+	if !ok {
+		return nil, "", 0, errors.Errorf("unknown ship %q, it has to be bs, ts or miner", args[len(args)-1])
+	}
+	return args[:len(args)-1], ship, ago, nil
+}
+
+// restoreShipTimers starts the timers of the destroyed ships, the ones which returned while the bot was offline are announced now.
+func restoreShipTimers(s *discordgo.Session, db *sql.DB) {
+	downs, err := getShipDownsFromDatabase(db, "")
+	if err != nil {
+		fmt.Println("Failed to get destroyed ships:", err.Error())
+		return
+	}
+	for _, d := range downs {
+		startShipTimer(d, s, db)
+	}
+}
+
+// WSDownCommand for recording that one of your ships was destroyed.
+func WSDownCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "down",
+		Permission:      commands.Members,
+		HelpDescription: "Record that your WS ship was destroyed",
+		Handler:         HandleShipDown,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "remove",
+				Permission:      commands.Members,
+				HelpDescription: "Remove a wrongly recorded WS ship of yours",
+				Handler:         HandleRemoveShipDown,
+				Help: commands.Help{
+					Summary:             "Remove a wrongly recorded WS ship of yours",
+					DetailedDescription: "Remove the record of your destroyed ship, you won't get a DM when it's back.",
+					Syntax:              "ws down remove [instance] <bs|ts|miner>",
+					Example:             "ws down remove bs",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary: "Record that your WS ship was destroyed",
+			DetailedDescription: "Record that your battleship, transport or miner was destroyed in the White Star, give how long ago if it wasn't just now. " +
+				"You get a DM when it's back, see the cooldowns with `ws ships cooldown`. Ships can only be recorded during a match.",
+			Syntax:  "ws down [instance] <bs|ts|miner> [ago]",
+			Example: "ws down bs 20m",
+		},
+	}
+}
+
+// WSEnemyCommand for tracking the ships of the opponent.
+func WSEnemyCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "enemy",
+		Permission:      commands.Members,
+		HelpDescription: "Track the ships of the WS opponent",
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "down",
+				Permission:      commands.Members,
+				HelpDescription: "Record that an enemy WS ship was destroyed",
+				Handler:         HandleEnemyShipDown,
+				Help: commands.Help{
+					Summary: "Record that an enemy WS ship was destroyed",
+					DetailedDescription: "Record that a battleship, transport or miner of the opponent was destroyed, give how long ago if it wasn't just now. " +
+						"It's announced in this channel when the ship is back. Ships can only be recorded during a match. " +
+						"The instance of the channel is used unless the player is preceded by the full name of an instance, or by a code only one instance has.",
+					Syntax:  "ws enemy down [instance] <player> <bs|ts|miner> [ago]",
+					Example: "ws enemy down Darth Vader bs 1h",
+				},
+			},
+			{
+				CallPhrase:      "remove",
+				Permission:      commands.Members,
+				HelpDescription: "Remove a wrongly recorded enemy WS ship",
+				Handler:         HandleRemoveEnemyShipDown,
+				Help: commands.Help{
+					Summary:             "Remove a wrongly recorded enemy WS ship",
+					DetailedDescription: "Remove the record of a destroyed ship of the opponent, it won't be announced when it's back.",
+					Syntax:              "ws enemy remove [instance] <player> <bs|ts|miner>",
+					Example:             "ws enemy remove Darth Vader bs",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "Track the ships of the WS opponent",
+			DetailedDescription: "Track when the destroyed ships of the White Star opponent return.",
+			Syntax:              "ws enemy down [instance] <player> <bs|ts|miner> [ago]",
+			Example:             "ws enemy down Darth Vader bs 1h",
+		},
+	}
+}
+
+// WSShipsCommand for showing the destroyed ships.
+func WSShipsCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "ships",
+		Permission:      commands.Officers,
+		HelpDescription: "Show the destroyed WS ships",
+		Handler:         HandleShips,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "cooldown",
+				Permission:      commands.Officers,
+				HelpDescription: "Show or set the WS ship cooldowns",
+				Handler:         HandleShipCooldown,
+				Help: commands.Help{
+					Summary: "Show or set the WS ship cooldowns",
+					DetailedDescription: "Show how long destroyed ships take to return, or set it for a type of ship. " +
+						"Ships which are already down keep the cooldown they were recorded with.",
+					Syntax:  "ws ships cooldown [<bs|ts|miner> <duration>]",
+					Example: "ws ships cooldown bs 18h",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "Show the destroyed WS ships",
+			DetailedDescription: "Show our and the opponent's destroyed ships in the White Star and when they return.",
+			Syntax:              "ws ships [instance]",
+			Example:             "ws ships B",
+		},
+	}
+}
+
+// HandleShipDown handles recording a ship of the author being destroyed.
+func HandleShipDown(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	rest, ship, ago, err := parseShipDown(strings.Fields(msg))
+	if err != nil {
+		sendFailMessage(fmt.Sprintf("%v, check `!help ws down`.", strings.ToUpper(err.Error()[:1])+err.Error()[1:]), s, m)
+		return
+	}
+	instance, ok := instanceFromMessage(strings.Join(rest, " "), s, m, db)
+	if !ok {
+		return
+	}
+
+	d := shipDown{
+		instance:  instance,
+		owner:     m.Author.ID,
+		name:      displayName(s, guildID, m.Author.ID, m.Author.Username),
+		ship:      ship,
+		channelID: m.ChannelID,
+	}
+	recordShipDown(d, ago, s, m, db, guildID)
+}
+
+// HandleEnemyShipDown handles recording a ship of the opponent being destroyed.
+func HandleEnemyShipDown(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	rest, ship, ago, err := parseShipDown(strings.Fields(msg))
+	if err == nil && len(rest) == 0 {
+		err = errors.New("missing player")
+	}
+	if err != nil {
+		sendFailMessage(fmt.Sprintf("%v, check `!help ws enemy down`.", strings.ToUpper(err.Error()[:1])+err.Error()[1:]), s, m)
+		return
+	}
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get instances:", err.Error())
+	}
+	instanceArg, rest := leadingInstanceArg(instances, rest, 1)
+	instance, ok := instanceFromMessage(instanceArg, s, m, db)
+	if !ok {
+		return
+	}
+
+	player := strings.Join(rest, " ")
+	d := shipDown{
+		instance:  instance,
+		enemy:     true,
+		owner:     strings.ToLower(player),
+		name:      player,
+		ship:      ship,
+		channelID: m.ChannelID,
+	}
+	recordShipDown(d, ago, s, m, db, guildID)
+}
+
+// HandleRemoveShipDown handles removing the record of a destroyed ship of the author.
+func HandleRemoveShipDown(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	rest, ship, err := parseShipRemoval(strings.Fields(msg))
+	if err != nil {
+		sendFailMessage(fmt.Sprintf("%v, check `!help ws down remove`.", strings.ToUpper(err.Error()[:1])+err.Error()[1:]), s, m)
+		return
+	}
+	instance, ok := instanceFromMessage(strings.Join(rest, " "), s, m, db)
+	if !ok {
+		return
+	}
+
+	d := shipDown{instance: instance, owner: m.Author.ID, ship: ship}
+	removeShipDown(d, fmt.Sprintf("You have no destroyed %v recorded in %v.", ship, instance), s, m, db)
+}
+
+// HandleRemoveEnemyShipDown handles removing the record of a destroyed ship of the opponent.
+func HandleRemoveEnemyShipDown(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	rest, ship, err := parseShipRemoval(strings.Fields(msg))
+	if err == nil && len(rest) == 0 {
+		err = errors.New("missing player")
+	}
+	if err != nil {
+		sendFailMessage(fmt.Sprintf("%v, check `!help ws enemy remove`.", strings.ToUpper(err.Error()[:1])+err.Error()[1:]), s, m)
+		return
+	}
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get instances:", err.Error())
+	}
+	instanceArg, rest := leadingInstanceArg(instances, rest, 1)
+	instance, ok := instanceFromMessage(instanceArg, s, m, db)
+	if !ok {
+		return
+	}
+
+	player := strings.Join(rest, " ")
+	d := shipDown{instance: instance, enemy: true, owner: strings.ToLower(player), ship: ship}
+	removeShipDown(d, fmt.Sprintf("There's no destroyed %v of %v recorded in %v.", ship, player, instance), s, m, db)
+}
+
+// parseShipRemoval parses the words ending with a ship, the words before it are returned.
+func parseShipRemoval(args []string) ([]string, shipType, error) {
+	if len(args) == 0 {
+		return nil, "", errors.New("missing ship")
+	}
+	ship, ok := shipFromString(args[len(args)-1])
+	if !ok {
+		return nil, "", errors.Errorf("unknown ship %q, it has to be bs, ts or miner", args[len(args)-1])
+	}
+	return args[:len(args)-1], ship, nil
+}
+
+// removeShipDown removes the record of the ship, its timer does nothing when it finds it gone.
+// notFound is sent if the ship isn't recorded.
+func removeShipDown(d shipDown, notFound string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) {
+	removed, err := removeShipDownFromDatabase(db, d)
+	if err != nil {
+		fmt.Println("Failed to remove destroyed ship:", err.Error())
+		return
+	}
+	if !removed {
+		sendFailMessage(notFound, s, m)
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: fmt.Sprintf("The %v is no longer recorded as destroyed in %v.", d.ship, d.instance),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// recordShipDown stores the destroyed ship with its return time from the cooldown and starts its timer.
+// Ships can only be recorded once a match has been found and until it has ended.
+func recordShipDown(d shipDown, ago time.Duration, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string) {
+	round, err := getCurrentRoundFromDatabase(db, d.instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return
+	}
+	if round.phase != matched && round.phase != inProgress {
+		sendFailMessage(fmt.Sprintf("The White Star in %v is *%v*, ships can only be recorded during a match.", d.instance, round.phase), s, m)
+		return
+	}
+
+	cooldowns, err := getShipCooldownsFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get ship cooldowns, using built-in defaults:", err.Error())
+		cooldowns = defaultShipCooldowns
+	}
+
+	d.destroyed = time.Now().Add(-ago).Truncate(time.Second)
+	d.returns = d.destroyed.Add(cooldowns[d.ship])
+	if !d.returns.After(time.Now()) {
+		sendFailMessage(fmt.Sprintf("A %v destroyed %v ago is already back, the cooldown is %v.", d.ship, formatDuration(ago), formatDuration(cooldowns[d.ship])), s, m)
+		return
+	}
+
+	err = setShipDownInDatabase(db, d)
+	if err != nil {
+		fmt.Println("Failed to set destroyed ship:", err.Error())
+		return
+	}
+	startShipTimer(d, s, db)
+
+	description := fmt.Sprintf("Your %v is back <t:%d:f>, in %v. You'll get a DM when it is.", d.ship, d.returns.Unix(), formatDuration(time.Until(d.returns)))
+	if d.enemy {
+		description = fmt.Sprintf("The %v of %v is back <t:%d:f>, in %v.", d.ship, d.name, d.returns.Unix(), formatDuration(time.Until(d.returns)))
+	}
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: description,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleShips handles showing the destroyed ships of the instance.
+func HandleShips(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	downs, err := getShipDownsFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get destroyed ships:", err.Error())
+		return
+	}
+
+	now := time.Now()
+	var ours, theirs string
+	for _, d := range downs {
+		line := fmt.Sprintf("%v's %v: back in %v (<t:%d:t>)\n", d.name, d.ship, formatDuration(d.returns.Sub(now)), d.returns.Unix())
+		if d.enemy {
+			theirs += line
+		} else {
+			ours += line
+		}
+	}
+	if ours == "" {
+		ours = "None"
+	}
+	if theirs == "" {
+		theirs = "None"
+	}
+
+	response := discordgo.MessageEmbed{
+		Title: fmt.Sprintf("Destroyed ships in %v", instance),
+		Color: infoColor,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Ours", Value: ours},
+			{Name: "Enemy", Value: theirs},
+		},
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleShipCooldown handles showing or setting the ship cooldowns.
+func HandleShipCooldown(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	title := "WS ship cooldowns"
+	if len(args) > 0 {
+		ship, ok := shipFromString(args[0])
+		if !ok || len(args) != 2 {
+			sendFailMessage("Incorrect syntax, check `!help ws ships cooldown`.", s, m)
+			return
+		}
+		cooldown, err := time.ParseDuration(args[1])
+		if err != nil || cooldown <= 0 {
+			sendFailMessage(fmt.Sprintf("Incorrect cooldown %q, it has to be a duration like 18h.", args[1]), s, m)
+			return
+		}
+
+		err = setShipCooldownInDatabase(db, guildID, ship, cooldown)
+		if err != nil {
+			fmt.Println("Failed to set ship cooldown:", err.Error())
+			return
+		}
+		title = "WS ship cooldown set!"
+	}
+
+	cooldowns, err := getShipCooldownsFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get ship cooldowns:", err.Error())
+		return
+	}
+	var content string
+	for _, ship := range shipTypes {
+		content += fmt.Sprintf("%v: %v\n", strings.Title(string(ship)), formatDuration(cooldowns[ship]))
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       title,
+		Color:       successColor,
+		Description: content,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func startShipTimer(d shipDown, s *discordgo.Session, db *sql.DB) {
+	go waitForShipTimer(d, time.After(time.Until(d.returns)), s, db)
+}
+
+// waitForShipTimer announces the ship being back when the timer expires.
+// Nothing is done if the ship has been recorded again or cleared in the meantime.
+func waitForShipTimer(d shipDown, c <-chan time.Time, s *discordgo.Session, db *sql.DB) {
+	<-c
+
+	deleted, err := deleteShipDownFromDatabase(db, d)
+	if err != nil {
+		fmt.Println("Failed to delete destroyed ship:", err.Error())
+		return
+	}
+	if !deleted {
+		return
+	}
+	sendShipReturned(d, s)
+}
+
+// sendShipReturned DMs the owner that their ship is back, or pings them if the DM fails.
+// Enemy ships are announced in the channel they were recorded in.
+func sendShipReturned(d shipDown, s *discordgo.Session) {
+	if d.enemy {
+		msg := discordgo.MessageEmbed{
+			Color:       infoColor,
+			Description: fmt.Sprintf("The %v of **%v** is back in %v.", d.ship, d.name, d.instance),
+		}
+		_, err := s.ChannelMessageSendEmbed(d.channelID, &msg)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return
+	}
+
+	channel, err := s.UserChannelCreate(d.owner)
+	if err == nil {
+		msg := discordgo.MessageEmbed{
+			Title:       "White Star",
+			Color:       infoColor,
+			Description: fmt.Sprintf("Your %v is back in %v.", d.ship, d.instance),
+		}
+		_, err = s.ChannelMessageSendEmbed(channel.ID, &msg)
+	}
+	if err != nil {
+		fmt.Println("Failed to DM about returned ship, pinging instead:", err.Error())
+		_, err = s.ChannelMessageSend(d.channelID, fmt.Sprintf("<@%v> your %v is back in %v.", d.owner, d.ship, d.instance))
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+	}
+}
+
+// countShipsDown lists how many of each ship type are destroyed on our and the enemy side.
+func countShipsDown(downs []shipDown) (string, string) {
+	count := func(enemy bool) string {
+		byType := make(map[shipType]int)
+		for _, d := range downs {
+			if d.enemy == enemy {
+				byType[d.ship]++
+			}
+		}
+		var parts []string
+		for _, ship := range shipTypes {
+			if byType[ship] > 0 {
+				parts = append(parts, fmt.Sprintf("%d %v", byType[ship], ship))
+			}
+		}
+		if len(parts) == 0 {
+			return "None"
+		}
+		return strings.Join(parts, ", ")
+	}
+	return count(false), count(true)
+}
+
+// getShipCooldownsFromDatabase returns the cooldowns of the ships, with the defaults for the ones not configured.
+func getShipCooldownsFromDatabase(db *sql.DB, guildID string) (map[shipType]time.Duration, error) {
+	cooldowns := make(map[shipType]time.Duration)
+	for ship, cooldown := range defaultShipCooldowns {
+		cooldowns[ship] = cooldown
+	}
+
+	rows, err := db.Query("SELECT ship, cooldown FROM ws_ship_cooldowns WHERE guild_id = $1", guildID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ship shipType
+		var seconds int64
+		err = rows.Scan(&ship, &seconds)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		cooldowns[ship] = time.Duration(seconds) * time.Second
+	}
+
+	return cooldowns, nil
+}
+
+func setShipCooldownInDatabase(db *sql.DB, guildID string, ship shipType, cooldown time.Duration) error {
+	statement := `INSERT INTO ws_ship_cooldowns (guild_id, ship, cooldown) VALUES ($1, $2, $3)
+	ON CONFLICT (guild_id, ship) DO UPDATE SET cooldown = $3`
+	_, err := db.Exec(statement, guildID, ship, int64(cooldown/time.Second))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getShipDownsFromDatabase returns the destroyed ships of the instance, or of every instance if it's empty,
+// the first to return first.
+func getShipDownsFromDatabase(db *sql.DB, instance instance) ([]shipDown, error) {
+	query := `SELECT instance, enemy, owner, name, ship, channel_id, destroyed_at, returns_at FROM ws_ship_downs
+	WHERE $1 = '' OR instance = $1`
+	rows, err := db.Query(query, instance)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var downs []shipDown
+	for rows.Next() {
+		var d shipDown
+		err = rows.Scan(&d.instance, &d.enemy, &d.owner, &d.name, &d.ship, &d.channelID, &d.destroyed, &d.returns)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		downs = append(downs, d)
+	}
+
+	sort.SliceStable(downs, func(i, j int) bool { return downs[i].returns.Before(downs[j].returns) })
+	return downs, nil
+}
+
+// setShipDownInDatabase stores the destroyed ship, replacing an earlier record of the same ship.
+func setShipDownInDatabase(db *sql.DB, d shipDown) error {
+	statement := `INSERT INTO ws_ship_downs (instance, enemy, owner, name, ship, channel_id, destroyed_at, returns_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (instance, enemy, owner, ship) DO UPDATE SET name = $4, channel_id = $6, destroyed_at = $7, returns_at = $8`
+	_, err := db.Exec(statement, d.instance, d.enemy, d.owner, d.name, d.ship, d.channelID,
+		d.destroyed.UTC().Format(dbTimeFormat), d.returns.UTC().Format(dbTimeFormat))
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// deleteShipDownFromDatabase deletes the record of the ship if it still returns at the same time.
+// Whether it was deleted is returned.
+func deleteShipDownFromDatabase(db *sql.DB, d shipDown) (bool, error) {
+	statement := `DELETE FROM ws_ship_downs WHERE instance = $1 AND enemy = $2 AND owner = $3 AND ship = $4 AND returns_at = $5`
+	result, err := db.Exec(statement, d.instance, d.enemy, d.owner, d.ship, d.returns.UTC().Format(dbTimeFormat))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to execute query")
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, errors.Wrap(err, "failed to get affected rows")
+}
+
+// removeShipDownFromDatabase deletes the record of the ship whenever it returns.
+// Whether it was deleted is returned.
+func removeShipDownFromDatabase(db *sql.DB, d shipDown) (bool, error) {
+	statement := `DELETE FROM ws_ship_downs WHERE instance = $1 AND enemy = $2 AND owner = $3 AND ship = $4`
+	result, err := db.Exec(statement, d.instance, d.enemy, d.owner, d.ship)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to execute query")
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, errors.Wrap(err, "failed to get affected rows")
+}
+
+func clearShipDownsFromDatabase(db *sql.DB, instance instance) error {
+	_, err := db.Exec("DELETE FROM ws_ship_downs WHERE instance = $1", instance)
+	return errors.Wrap(err, "failed to execute query")
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseShipDown(t *testing.T) {
+	testData := []struct {
+		args        []string
+		rest        []string
+		ship        shipType
+		ago         time.Duration
+		expectError bool
+	}{
+		{args: []string{"bs"}, rest: []string{}, ship: battleship},
+		{args: []string{"TS", "20m"}, rest: []string{}, ship: transport, ago: 20 * time.Minute},
+		{args: []string{"B", "miner"}, rest: []string{"B"}, ship: miner},
+		{args: []string{"Darth", "Vader", "battleship", "1h30m"}, rest: []string{"Darth", "Vader"}, ship: battleship, ago: 90 * time.Minute},
+		{args: []string{}, expectError: true},
+		{args: []string{"2h"}, expectError: true},
+		{args: []string{"bs", "-2h"}, expectError: true},
+		{args: []string{"Darth", "cruiser"}, expectError: true},
+	}
+
+	for _, data := range testData {
+		rest, ship, ago, err := parseShipDown(data.args)
+		if data.expectError {
+			if err == nil {
+				t.Errorf("expected an error for %q", data.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", data.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(rest, data.rest) || ship != data.ship || ago != data.ago {
+			t.Errorf("%q was parsed to %q, %v, %v, expected %q, %v, %v", data.args, rest, ship, ago, data.rest, data.ship, data.ago)
+		}
+	}
+}
+
+func Test_countShipsDown(t *testing.T) {
+	downs := []shipDown{
+		{ship: miner},
+		{ship: battleship},
+		{ship: miner},
+		{ship: transport, enemy: true},
+	}
+
+	ours, theirs := countShipsDown(downs)
+	if ours != "1 battleship, 2 miner" {
+		t.Errorf("Our ships down were %q, expected 1 battleship and 2 miners", ours)
+	}
+	if theirs != "1 transport" {
+		t.Errorf("Enemy ships down were %q, expected 1 transport", theirs)
+	}
+	if ours, theirs = countShipsDown(nil); ours != "None" || theirs != "None" {
+		t.Errorf("No ships down should give None, got %q and %q", ours, theirs)
+	}
+}
@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"regexp"
+	"strings"
+)
+
+// optOutEmoji is the reaction for opting out on a sign-up message.
+const optOutEmoji = "\u274c"
+
+// signUpRoles in the order their reactions are added to the sign-up message.
+var signUpRoles = []wsRole{defaultRole, defense, offense, hunter, filler}
+
+// defaultSignUpEmoji used for the roles which have not been configured.
+var defaultSignUpEmoji = map[wsRole]string{
+	defaultRole: "\u2705",
+	defense:     "\U0001f6e1",
+	offense:     "\u2694",
+	hunter:      "\U0001f3f9",
+	filler:      "\U0001f504",
+}
+
+// customEmojiRegex matches custom emoji as they are written in messages, <:name:id> or <a:name:id> if animated.
+var customEmojiRegex = regexp.MustCompile(`^<a?:(\w+):(\d+)>$`)
+
+// signUpMessage posted for an instance, there's at most one per instance.
+type signUpMessage struct {
+	instance  instance
+	guildID   string
+	channelID string
+	messageID string
+}
+
+// emojiAPIName returns the emoji as it's used for reactions: the emoji itself or name:id for custom emoji.
+func emojiAPIName(text string) string {
+	if match := customEmojiRegex.FindStringSubmatch(text); match != nil {
+		return match[1] + ":" + match[2]
+	}
+	return strings.TrimSuffix(text, emojiVariationSelector)
+}
+
+// signUpReaction returns what the reaction means on a sign-up message.
+// ok is false if it's not one of the sign-up reactions.
+func signUpReaction(emoji map[wsRole]string, name string) (role wsRole, participating bool, ok bool) {
+	name = strings.TrimSuffix(name, emojiVariationSelector)
+	if name == optOutEmoji {
+		return defaultRole, false, true
+	}
+	for _, role := range signUpRoles {
+		if emoji[role] == name {
+			return role, true, true
+		}
+	}
+	return defaultRole, false, false
+}
+
+// WSSignUpCommand for reaction based sign-up messages.
+func WSSignUpCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "signup",
+		Permission:      commands.Members,
+		HelpDescription: "Show the sign-up reactions",
+		Handler:         HandleSignUp,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "post",
+				Permission:      commands.Officers,
+				HelpDescription: "Post a WS sign-up message",
+				Handler:         HandlePostSignUp,
+				Help: commands.Help{
+					Summary: "Post a WS sign-up message",
+					DetailedDescription: "Post a message members react to for opting in with a preferred role, or opting out with " + optOutEmoji + ". " +
+						"The message keeps showing who has opted in. An instance has one sign-up message, posting a new one replaces the old one.",
+					Syntax:  "ws signup post [instance]",
+					Example: "ws signup post A",
+				},
+			},
+			{
+				CallPhrase:      "emoji",
+				Permission:      commands.Officers,
+				HelpDescription: "Set the sign-up reaction of a preferred role",
+				Handler:         HandleSignUpEmoji,
+				Help: commands.Help{
+					Summary: "Set the sign-up reaction of a preferred role",
+					DetailedDescription: "Set which emoji opts in with a preferred role: def, off, hunter, filler or none for no preference. " +
+						"Sign-up messages which are already posted keep their reactions, post a new one to use the new emoji.",
+					Syntax:  "ws signup emoji <preferred role> <emoji>",
+					Example: "ws signup emoji hunter \U0001f3af",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary:             "Show the sign-up reactions",
+			DetailedDescription: "Show which reactions opt in with which preferred role on sign-up messages.",
+			Syntax:              "ws signup",
+			Example:             "ws signup",
+		},
+	}
+}
+
+// HandleSignUp handles showing the sign-up reactions.
+func HandleSignUp(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	emoji, err := getSignUpEmojiFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get sign-up emoji:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       "Sign-up reactions",
+		Color:       infoColor,
+		Description: formatSignUpEmoji(emoji),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func formatSignUpEmoji(emoji map[wsRole]string) string {
+	var content string
+	for _, role := range signUpRoles {
+		content += fmt.Sprintf("%v %v\n", formatEmoji(emoji[role]), role)
+	}
+	content += fmt.Sprintf("%v Opt out\n", optOutEmoji)
+	return content
+}
+
+// formatEmoji returns the emoji as it's written in messages.
+func formatEmoji(apiName string) string {
+	if strings.Contains(apiName, ":") {
+		return "<:" + apiName + ">"
+	}
+	return apiName
+}
+
+// HandlePostSignUp handles posting a sign-up message.
+func HandlePostSignUp(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	emoji, err := getSignUpEmojiFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get sign-up emoji:", err.Error())
+		return
+	}
+	embed, err := signUpEmbed(instance, emoji, s, db, guildID)
+	if err != nil {
+		fmt.Println("Failed to render sign-up message:", err.Error())
+		return
+	}
+
+	message, err := s.ChannelMessageSendEmbed(m.ChannelID, embed)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+
+	old, err := getSignUpMessageOfInstanceFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get old sign-up message:", err.Error())
+	} else if old.messageID != "" {
+		err = s.ChannelMessageDelete(old.channelID, old.messageID)
+		if err != nil {
+			fmt.Println("Failed to delete old sign-up message:", err.Error())
+		}
+	}
+
+	err = setSignUpMessageInDatabase(db, signUpMessage{instance: instance, guildID: guildID, channelID: message.ChannelID, messageID: message.ID})
+	if err != nil {
+		fmt.Println("Failed to set sign-up message:", err.Error())
+		return
+	}
+
+	for _, role := range signUpRoles {
+		err = s.MessageReactionAdd(message.ChannelID, message.ID, emoji[role])
+		if err != nil {
+			fmt.Println("Failed to add reaction:", err.Error())
+			return
+		}
+	}
+	err = s.MessageReactionAdd(message.ChannelID, message.ID, optOutEmoji)
+	if err != nil {
+		fmt.Println("Failed to add reaction:", err.Error())
+		return
+	}
+}
+
+// HandleSignUpEmoji handles setting the sign-up reaction of a preferred role.
+func HandleSignUpEmoji(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	if len(args) != 2 || (!isWSRole(args[0]) && strings.ToLower(args[0]) != "none") {
+		sendFailMessage("Incorrect syntax, check `!help ws signup emoji`.", s, m)
+		return
+	}
+	role := wsRoleFromString(args[0])
+	name := emojiAPIName(args[1])
+
+	emoji, err := getSignUpEmojiFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get sign-up emoji:", err.Error())
+		return
+	}
+	if otherRole, _, used := signUpReaction(emoji, name); used && (otherRole != role || name == optOutEmoji) {
+		description := fmt.Sprintf("%v is already used for %v.", args[1], otherRole)
+		if name == optOutEmoji {
+			description = fmt.Sprintf("%v is used for opting out.", args[1])
+		}
+		sendFailMessage(description, s, m)
+		return
+	}
+
+	err = setSignUpEmojiInDatabase(db, guildID, role, name)
+	if err != nil {
+		fmt.Println("Failed to set sign-up emoji:", err.Error())
+		return
+	}
+	emoji[role] = name
+
+	response := discordgo.MessageEmbed{
+		Title:       "Sign-up reactions set!",
+		Color:       successColor,
+		Description: formatSignUpEmoji(emoji),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// signUpEmbed renders the sign-up message of the instance.
+func signUpEmbed(instance instance, emoji map[wsRole]string, s *discordgo.Session, db *sql.DB, guildID string) (*discordgo.MessageEmbed, error) {
+	status, err := optStatus(instance, s, db, guildID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get participation status")
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("White Star sign-up for %v", instance),
+		Color:       successColor,
+		Description: "React to opt in with your preferred role:\n" + formatSignUpEmoji(emoji) + "\n" + status,
+	}
+
+	reason, err := signUpClosedReason(db, instance)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get sign-up status")
+	}
+	if reason != "" {
+		embed.Color = failColor
+		embed.Description = fmt.Sprintf("**Sign-up closed**: %v.\n\n%v", reason, status)
+	}
+
+	return embed, nil
+}
+
+// updateSignUpMessages edits the sign-up message of the instance, if there is one, to show the current participants.
+// The participants are pushed to the spreadsheet as well.
+func updateSignUpMessages(instance instance, s *discordgo.Session, db *sql.DB) {
+	scheduleSheetSync(s, db)
+
+	message, err := getSignUpMessageOfInstanceFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get sign-up message:", err.Error())
+		return
+	}
+	if message.messageID == "" {
+		return
+	}
+
+	emoji, err := getSignUpEmojiFromDatabase(db, message.guildID)
+	if err != nil {
+		fmt.Println("Failed to get sign-up emoji:", err.Error())
+		return
+	}
+	embed, err := signUpEmbed(instance, emoji, s, db, message.guildID)
+	if err != nil {
+		fmt.Println("Failed to render sign-up message:", err.Error())
+		return
+	}
+
+	_, err = s.ChannelMessageEditEmbed(message.channelID, message.messageID, embed)
+	if err != nil {
+		fmt.Println("Failed to edit sign-up message:", err.Error())
+	}
+}
+
+// reactionAuthorized returns whether the member reacting has the permission, like commands require.
+func reactionAuthorized(permission commands.Permission, s *discordgo.Session, r *discordgo.MessageReaction, guildID string) bool {
+	member, err := s.GuildMember(guildID, r.UserID)
+	if err != nil {
+		fmt.Println("Failed to obtain guild member:", err.Error())
+		return false
+	}
+	if !permission.Authorized(*member) {
+		fmt.Println(r.UserID, "tried to react to", r.MessageID, "without the required authorization")
+		return false
+	}
+	return true
+}
+
+// HandleSignUpReaction opts members in or out when they react to a sign-up message.
+// Removing the reaction of the role a member is opted in with opts them out.
+func HandleSignUpReaction(s *discordgo.Session, r *discordgo.MessageReaction, added bool, db *sql.DB, guildID string) {
+	message, err := getSignUpMessageFromDatabase(db, r.MessageID)
+	if err != nil {
+		fmt.Println("Failed to get sign-up message:", err.Error())
+		return
+	}
+	if message.messageID == "" {
+		return
+	}
+	instance := message.instance
+
+	emoji, err := getSignUpEmojiFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get sign-up emoji:", err.Error())
+		return
+	}
+	role, participating, ok := signUpReaction(emoji, r.Emoji.APIName())
+	if !ok {
+		return
+	}
+	if !reactionAuthorized(commands.Members, s, r, guildID) {
+		if added {
+			removeUserReaction(s, r)
+		}
+		return
+	}
+
+	reason, err := signUpClosedReason(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get sign-up status:", err.Error())
+		return
+	}
+	if reason != "" {
+		if added {
+			removeUserReaction(s, r)
+		}
+		return
+	}
+
+	if !added {
+		// Only the reaction matching the current participation counts, the others are removed when switching
+		participants, err := getParticipantsFromDatabase(db, instance)
+		if err != nil {
+			fmt.Println("Failed to get participants:", err.Error())
+			return
+		}
+		var current bool
+		for _, p := range participants {
+			if p.userID == r.UserID && p.participating && participating && p.preferredRole == role {
+				current = true
+			}
+		}
+		if !current {
+			return
+		}
+		role, participating = defaultRole, false
+	}
+
+	user, err := s.User(r.UserID)
+	if err != nil {
+		fmt.Println("Failed to get user:", err.Error())
+		return
+	}
+	err = updateParticipation(newParticipant(user, participating, instance, role, s, guildID), s, db)
+	if err != nil {
+		fmt.Println("Failed to set participation:", err.Error())
+		return
+	}
+
+	if added {
+		removeOtherSignUpReactions(s, r, emoji)
+	}
+}
+
+// removeOtherSignUpReactions of the user, so only the one matching their participation is left.
+// It requires the manage messages permission.
+func removeOtherSignUpReactions(s *discordgo.Session, r *discordgo.MessageReaction, emoji map[wsRole]string) {
+	current := strings.TrimSuffix(r.Emoji.APIName(), emojiVariationSelector)
+	for _, name := range append([]string{optOutEmoji}, signUpEmojiNames(emoji)...) {
+		if name == current {
+			continue
+		}
+		err := s.MessageReactionRemove(r.ChannelID, r.MessageID, name, r.UserID)
+		if err != nil {
+			fmt.Println("Failed to remove reaction:", err.Error())
+			return
+		}
+	}
+}
+
+func signUpEmojiNames(emoji map[wsRole]string) []string {
+	names := make([]string, len(signUpRoles))
+	for i, role := range signUpRoles {
+		names[i] = emoji[role]
+	}
+	return names
+}
+
+// getSignUpEmojiFromDatabase returns the sign-up emoji of the roles, with the defaults for the ones not configured.
+func getSignUpEmojiFromDatabase(db *sql.DB, guildID string) (map[wsRole]string, error) {
+	emoji := make(map[wsRole]string)
+	for role, name := range defaultSignUpEmoji {
+		emoji[role] = name
+	}
+
+	rows, err := db.Query("SELECT role, emoji FROM ws_signup_emoji WHERE guild_id = $1", guildID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role wsRole
+		var name string
+		err = rows.Scan(&role, &name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		emoji[role] = name
+	}
+
+	return emoji, nil
+}
+
+func setSignUpEmojiInDatabase(db *sql.DB, guildID string, role wsRole, emoji string) error {
+	statement := `INSERT INTO ws_signup_emoji (guild_id, role, emoji) VALUES ($1, $2, $3)
+	ON CONFLICT (guild_id, role) DO UPDATE SET emoji = $3`
+	_, err := db.Exec(statement, guildID, role, emoji)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getSignUpMessageFromDatabase returns the sign-up message with the ID.
+// The message ID is empty if it's not a sign-up message.
+func getSignUpMessageFromDatabase(db *sql.DB, messageID string) (signUpMessage, error) {
+	return querySignUpMessage(db, "message_id", messageID)
+}
+
+// getSignUpMessageOfInstanceFromDatabase returns the sign-up message of the instance.
+// The message ID is empty if it has none.
+func getSignUpMessageOfInstanceFromDatabase(db *sql.DB, instance instance) (signUpMessage, error) {
+	return querySignUpMessage(db, "instance", string(instance))
+}
+
+func querySignUpMessage(db *sql.DB, column string, value string) (signUpMessage, error) {
+	var message signUpMessage
+	query := fmt.Sprintf("SELECT instance, guild_id, channel_id, message_id FROM ws_signup_messages WHERE %v = $1", column)
+	err := db.QueryRow(query, value).Scan(&message.instance, &message.guildID, &message.channelID, &message.messageID)
+	if err == sql.ErrNoRows {
+		return signUpMessage{}, nil
+	}
+	return message, errors.Wrap(err, "failed to do query")
+}
+
+func setSignUpMessageInDatabase(db *sql.DB, message signUpMessage) error {
+	statement := `INSERT INTO ws_signup_messages (instance, guild_id, channel_id, message_id) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (instance) DO UPDATE SET guild_id = $2, channel_id = $3, message_id = $4`
+	_, err := db.Exec(statement, message.instance, message.guildID, message.channelID, message.messageID)
+	return errors.Wrap(err, "failed to execute query")
+}
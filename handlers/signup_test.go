@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func Test_emojiAPIName(t *testing.T) {
+	testData := []struct {
+		text     string
+		expected string
+	}{
+		{text: "\U0001f3af", expected: "\U0001f3af"},
+		{text: "⚔️", expected: "⚔"},
+		{text: "<:hunter:1234567890>", expected: "hunter:1234567890"},
+		{text: "<a:spinning:42>", expected: "spinning:42"},
+	}
+
+	for _, d := range testData {
+		actual := emojiAPIName(d.text)
+		if actual != d.expected {
+			t.Errorf("emoji of %q was %q, expected %q", d.text, actual, d.expected)
+		}
+	}
+}
+
+func Test_signUpReaction(t *testing.T) {
+	emoji := map[wsRole]string{
+		defaultRole: "✅",
+		defense:     "\U0001f6e1",
+		offense:     "⚔",
+		hunter:      "hunter:1234567890",
+		filler:      "\U0001f504",
+	}
+
+	testData := []struct {
+		name          string
+		role          wsRole
+		participating bool
+		ok            bool
+	}{
+		{name: "✅", role: defaultRole, participating: true, ok: true},
+		{name: "⚔️", role: offense, participating: true, ok: true},
+		{name: "hunter:1234567890", role: hunter, participating: true, ok: true},
+		{name: optOutEmoji, role: defaultRole, participating: false, ok: true},
+		{name: "\U0001f600", ok: false},
+	}
+
+	for _, d := range testData {
+		role, participating, ok := signUpReaction(emoji, d.name)
+		if ok != d.ok {
+			t.Errorf("%q should be a sign-up reaction: %v", d.name, d.ok)
+			continue
+		}
+		if ok && (role != d.role || participating != d.participating) {
+			t.Errorf("%q was %v participating %v, expected %v participating %v", d.name, role, participating, d.role, d.participating)
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// starKind is the kind of star runs are logged for.
+type starKind string
+
+const (
+	redStar  starKind = "rs"
+	blueStar starKind = "bs"
+)
+
+func (k starKind) String() string {
+	if k == blueStar {
+		return "Blue Star"
+	}
+	return "Red Star"
+}
+
+// starSummaryMembers is how many of the most active members are listed in the weekly summary.
+const starSummaryMembers = 5
+
+// starRun is a logged Red or Blue Star run. Blue Stars have no level.
+type starRun struct {
+	kind  starKind
+	level int
+	// score is 0 if it wasn't given.
+	score   int
+	at      time.Time
+	members []runMember
+}
+
+// runMember is a member who took part in a run.
+type runMember struct {
+	userID string
+	name   string
+}
+
+// starLevelStats are the runs of a level, the level is 0 for Blue Stars.
+type starLevelStats struct {
+	level int
+	runs  int
+	best  int
+}
+
+// starStats are the runs of a member.
+type starStats struct {
+	runs   int
+	levels []starLevelStats
+	// currentStreak and longestStreak are days in a row with a run, the current one still counts if the last run was yesterday.
+	currentStreak int
+	longestStreak int
+}
+
+// summarizeStarRuns counts the runs by level and the days in a row with runs, the days are in the location.
+func summarizeStarRuns(runs []starRun, now time.Time, loc *time.Location) starStats {
+	st := starStats{runs: len(runs), levels: tallyStarLevels(runs)}
+
+	unique := make(map[time.Time]bool)
+	for _, r := range runs {
+		unique[localDay(r.at, loc)] = true
+	}
+	var days []time.Time
+	for day := range unique {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	streak := 0
+	for i, day := range days {
+		if i > 0 && day.Sub(days[i-1]) == 24*time.Hour {
+			streak++
+		} else {
+			streak = 1
+		}
+		if streak > st.longestStreak {
+			st.longestStreak = streak
+		}
+	}
+	if len(days) > 0 && localDay(now, loc).Sub(days[len(days)-1]) <= 24*time.Hour {
+		st.currentStreak = streak
+	}
+	return st
+}
+
+// localDay returns the date of the time in the location, as midnight UTC so days are always 24 hours apart.
+func localDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// tallyStarLevels counts the runs and finds the best score of each level, lowest level first.
+func tallyStarLevels(runs []starRun) []starLevelStats {
+	byLevel := make(map[int]*starLevelStats)
+	var levels []starLevelStats
+	for _, r := range runs {
+		st, ok := byLevel[r.level]
+		if !ok {
+			st = &starLevelStats{level: r.level}
+			byLevel[r.level] = st
+		}
+		st.runs++
+		if r.score > st.best {
+			st.best = r.score
+		}
+	}
+	for _, st := range byLevel {
+		levels = append(levels, *st)
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].level < levels[j].level })
+	return levels
+}
+
+// starWeek is the summary of the runs of a week.
+type starWeek struct {
+	levels map[starKind][]starLevelStats
+	runs   map[starKind]int
+	// members who took part in the most runs, most first.
+	members []memberRuns
+}
+
+type memberRuns struct {
+	name string
+	runs int
+}
+
+// summarizeStarWeek summarizes the runs of the whole corp.
+func summarizeStarWeek(runs []starRun) starWeek {
+	week := starWeek{levels: make(map[starKind][]starLevelStats), runs: make(map[starKind]int)}
+	byKind := make(map[starKind][]starRun)
+	counts := make(map[string]*memberRuns)
+	for _, r := range runs {
+		byKind[r.kind] = append(byKind[r.kind], r)
+		for _, member := range r.members {
+			if counts[member.userID] == nil {
+				counts[member.userID] = &memberRuns{name: member.name}
+			}
+			counts[member.userID].runs++
+		}
+	}
+	for kind, kindRuns := range byKind {
+		week.runs[kind] = len(kindRuns)
+		week.levels[kind] = tallyStarLevels(kindRuns)
+	}
+
+	for _, c := range counts {
+		week.members = append(week.members, *c)
+	}
+	sort.Slice(week.members, func(i, j int) bool {
+		if week.members[i].runs != week.members[j].runs {
+			return week.members[i].runs > week.members[j].runs
+		}
+		return strings.ToLower(week.members[i].name) < strings.ToLower(week.members[j].name)
+	})
+	if len(week.members) > starSummaryMembers {
+		week.members = week.members[:starSummaryMembers]
+	}
+	return week
+}
+
+// startOfWeek returns the start of the week of the time, Monday at midnight UTC.
+func startOfWeek(t time.Time) time.Time {
+	day := localDay(t, time.UTC)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// parseStarRun parses the level, unless it's a Blue Star, and the optional score of a run.
+// Mentions of teammates are skipped.
+func parseStarRun(kind starKind, args []string) (int, int, error) {
+	var numbers []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "<@") {
+			numbers = append(numbers, arg)
+		}
+	}
+
+	var level int
+	if kind == redStar {
+		if len(numbers) == 0 {
+			return 0, 0, errors.New("missing level")
+		}
+		var err error
+		level, err = strconv.Atoi(numbers[0])
+		if err != nil || level < 1 || level > maxRedStarLevel {
+			return 0, 0, errors.Errorf("the level has to be between 1 and %d", maxRedStarLevel)
+		}
+		numbers = numbers[1:]
+	}
+
+	if len(numbers) > 1 {
+		return 0, 0, errors.Errorf("unexpected %q", strings.Join(numbers[1:], " "))
+	}
+	var score int
+	if len(numbers) == 1 {
+		var err error
+		score, err = strconv.Atoi(strings.Replace(numbers[0], ",", "", -1))
+		if err != nil || score < 1 {
+			return 0, 0, errors.Errorf("incorrect score %q", numbers[0])
+		}
+	}
+	return level, score, nil
+}
+
+// StarLogCommand for logging a Red or Blue Star run.
+func StarLogCommand(kind starKind) commands.Command {
+	syntax := fmt.Sprintf("%v log [score] [@teammates]", string(kind))
+	example := fmt.Sprintf("%v log 1500 @Rick @Morty", string(kind))
+	if kind == redStar {
+		syntax = "rs log <level> [score] [@teammates]"
+		example = "rs log 6 52000 @Rick @Morty"
+	}
+	return commands.Command{
+		CallPhrase:      "log",
+		Permission:      commands.Members,
+		HelpDescription: fmt.Sprintf("Log a %v run", kind),
+		Handler:         starLogHandler(kind),
+		Help: commands.Help{
+			Summary: fmt.Sprintf("Log a %v run", kind),
+			DetailedDescription: fmt.Sprintf("Log a %v run you did, optionally with the score and the members you ran it with. "+
+				"It counts for everyone in it, see the stats with `%v stats`.", kind, string(kind)),
+			Syntax:  syntax,
+			Example: example,
+		},
+	}
+}
+
+// StarStatsCommand for showing the Red or Blue Star stats of a member.
+func StarStatsCommand(kind starKind) commands.Command {
+	return commands.Command{
+		CallPhrase:      "stats",
+		Permission:      commands.Members,
+		HelpDescription: fmt.Sprintf("Show the %v stats of a member", kind),
+		Handler:         starStatsHandler(kind),
+		Help: commands.Help{
+			Summary: fmt.Sprintf("Show the %v stats of a member", kind),
+			DetailedDescription: fmt.Sprintf("Show how many %v runs you, or the mentioned member, have logged by level, the best scores "+
+				"and how many days in a row you've done runs.", kind),
+			Syntax:  fmt.Sprintf("%v stats [@member]", string(kind)),
+			Example: fmt.Sprintf("%v stats @Rick", string(kind)),
+		},
+	}
+}
+
+// RedStarSummaryCommand for configuring the weekly summary of the Red and Blue Star runs.
+func RedStarSummaryCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "summary",
+		Permission:      commands.Officers,
+		HelpDescription: "Set the channel of the weekly star summary",
+		Handler:         HandleStarSummary,
+		Init:            InitStarSummary,
+		Help: commands.Help{
+			Summary: "Set the channel of the weekly star summary",
+			DetailedDescription: "Set the channel a summary of the Red and Blue Star runs of the corp is posted to every Monday, " +
+				"or turn it off with `off`. Without arguments the summary of the current week is shown.",
+			Syntax:  "rs summary [#channel|off]",
+			Example: "rs summary #stars",
+		},
+	}
+}
+
+// BlueStarCommand for logging Blue Star runs.
+func BlueStarCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "bs",
+		Permission:      commands.Members,
+		HelpDescription: "Log Blue Star runs",
+		Handler:         starStatsHandler(blueStar),
+		SubCommands: []commands.Command{
+			StarLogCommand(blueStar),
+			StarStatsCommand(blueStar),
+		},
+		Help: commands.Help{
+			Summary:             "Log Blue Star runs",
+			DetailedDescription: "Log your Blue Star runs with `bs log` and see the stats with `bs stats`, which is also shown without a subcommand.",
+			Syntax:              "bs",
+			Example:             "bs log 1500",
+		},
+	}
+}
+
+// starSummary is the weekly summary of the Red and Blue Star runs of the corp.
+var starSummary = weeklyPost{name: "star summary", helpCommand: "rs summary", build: buildStarSummary}
+
+// InitStarSummary starts posting the weekly summaries.
+func InitStarSummary(s *discordgo.Session, db *sql.DB, guildID string) {
+	go startWeeklyPosts(starSummary, s, db, guildID)
+}
+
+// buildStarSummary builds the summary of the runs from the start up until the end.
+func buildStarSummary(start time.Time, end time.Time, db *sql.DB) (*discordgo.MessageEmbed, error) {
+	runs, err := getStarRunsFromDatabase(db, "", start, end)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get star runs")
+	}
+	week := summarizeStarWeek(runs)
+
+	var fields []*discordgo.MessageEmbedField
+	for _, kind := range []starKind{redStar, blueStar} {
+		if week.runs[kind] == 0 {
+			continue
+		}
+		content := fmt.Sprintf("%d runs\n", week.runs[kind])
+		for _, st := range week.levels[kind] {
+			content += formatStarLevelStats(kind, st) + "\n"
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: kind.String() + "s", Value: content, Inline: true})
+	}
+	if len(week.members) > 0 {
+		var content string
+		for _, member := range week.members {
+			content += fmt.Sprintf("%v: %d\n", member.name, member.runs)
+		}
+		fields = append(fields, &discordgo.MessageEmbedField{Name: "Most runs", Value: content, Inline: true})
+	}
+
+	msg := discordgo.MessageEmbed{
+		Title:  fmt.Sprintf("Star runs of the week of %v", start.Format("Jan 2")),
+		Color:  infoColor,
+		Fields: fields,
+	}
+	if len(fields) == 0 {
+		msg.Description = "No runs were logged, log them with `!rs log` and `!bs log`."
+	}
+	return &msg, nil
+}
+
+// formatStarLevelStats formats the runs of a level, e.g. "RS 6: 4 runs, best 52000".
+func formatStarLevelStats(kind starKind, st starLevelStats) string {
+	line := fmt.Sprintf("%d runs", st.runs)
+	if st.level > 0 {
+		line = fmt.Sprintf("%v %d: %v", strings.ToUpper(string(kind)), st.level, line)
+	}
+	if st.best > 0 {
+		line += fmt.Sprintf(", best %d", st.best)
+	}
+	return line
+}
+
+func starLogHandler(kind starKind) commands.Handler {
+	return func(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+		level, score, err := parseStarRun(kind, strings.Fields(msg))
+		if err != nil {
+			sendFailMessage(fmt.Sprintf("Incorrect syntax, %v. Check `!help %v log`.", err.Error(), string(kind)), s, m)
+			return
+		}
+
+		r := starRun{kind: kind, level: level, score: score, at: time.Now()}
+		r.members = append(r.members, runMember{userID: m.Author.ID, name: displayName(s, guildID, m.Author.ID, m.Author.Username)})
+		for _, user := range m.Mentions {
+			if user.ID != m.Author.ID {
+				r.members = append(r.members, runMember{userID: user.ID, name: displayName(s, guildID, user.ID, user.Username)})
+			}
+		}
+		if kind == redStar && len(r.members) > redStarGroupSize {
+			sendFailMessage(fmt.Sprintf("A Red Star has at most %d players.", redStarGroupSize), s, m)
+			return
+		}
+
+		err = addStarRunToDatabase(db, r)
+		if err != nil {
+			fmt.Println("Failed to add star run:", err.Error())
+			return
+		}
+
+		var names []string
+		for _, member := range r.members {
+			names = append(names, member.name)
+		}
+		description := fmt.Sprintf("%v run logged for %v.", kind, strings.Join(names, ", "))
+		if kind == redStar {
+			description = fmt.Sprintf("Red Star %d run logged for %v.", level, strings.Join(names, ", "))
+		}
+		if score > 0 {
+			description += fmt.Sprintf(" Score: %d", score)
+		}
+		response := discordgo.MessageEmbed{
+			Title:       "Run logged!",
+			Color:       successColor,
+			Description: description,
+		}
+		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+			return
+		}
+	}
+}
+
+func starStatsHandler(kind starKind) commands.Handler {
+	return func(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+		user := m.Author
+		if len(m.Mentions) > 0 {
+			user = m.Mentions[0]
+		}
+		name := displayName(s, guildID, user.ID, user.Username)
+
+		runs, err := getStarRunsFromDatabase(db, user.ID, time.Time{}, time.Now())
+		if err != nil {
+			fmt.Println("Failed to get star runs:", err.Error())
+			return
+		}
+		var kindRuns []starRun
+		for _, r := range runs {
+			if r.kind == kind {
+				kindRuns = append(kindRuns, r)
+			}
+		}
+
+		response := discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("%v stats of %v", kind, name),
+			Color:       infoColor,
+			Description: fmt.Sprintf("%v hasn't logged any %v runs, log them with `!%v log`.", name, kind, string(kind)),
+		}
+		if len(kindRuns) > 0 {
+			st := summarizeStarRuns(kindRuns, time.Now(), userLocation(db, user.ID))
+			response.Description = fmt.Sprintf("**Runs**: %d\n**Days in a row**: %d now, %d at most\n",
+				st.runs, st.currentStreak, st.longestStreak)
+			for _, level := range st.levels {
+				response.Description += formatStarLevelStats(kind, level) + "\n"
+			}
+		}
+		_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+			return
+		}
+	}
+}
+
+// HandleStarSummary handles setting the channel of the weekly summary, or showing the summary of the current week.
+func HandleStarSummary(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	handleWeeklyPost(starSummary, msg, s, m, db, guildID)
+}
+
+func addStarRunToDatabase(db *sql.DB, r starRun) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	var id int
+	statement := "INSERT INTO star_runs (kind, level, score, logged_at) VALUES ($1, $2, $3, $4) RETURNING id"
+	err = tx.QueryRow(statement, r.kind, r.level, r.score, r.at.UTC().Format(dbTimeFormat)).Scan(&id)
+	if err != nil {
+		return errors.Wrap(err, "failed to add run")
+	}
+	for _, member := range r.members {
+		_, err = tx.Exec("INSERT INTO star_run_members (run_id, user_id, name) VALUES ($1, $2, $3)", id, member.userID, member.name)
+		if err != nil {
+			return errors.Wrap(err, "failed to add member")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// getStarRunsFromDatabase returns the runs of the member, or of everyone if the user ID is empty, logged from the start up until the end.
+func getStarRunsFromDatabase(db *sql.DB, userID string, start time.Time, end time.Time) ([]starRun, error) {
+	query := `SELECT r.id, r.kind, r.level, r.score, r.logged_at, m.user_id, m.name FROM star_runs r
+	JOIN star_run_members m ON m.run_id = r.id
+	WHERE r.logged_at >= $2 AND r.logged_at < $3
+	AND ($1 = '' OR r.id IN (SELECT run_id FROM star_run_members WHERE user_id = $1))
+	ORDER BY r.logged_at, r.id`
+	rows, err := db.Query(query, userID, start.UTC().Format(dbTimeFormat), end.UTC().Format(dbTimeFormat))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var runs []starRun
+	lastID := -1
+	for rows.Next() {
+		var id int
+		var r starRun
+		var member runMember
+		err = rows.Scan(&id, &r.kind, &r.level, &r.score, &r.at, &member.userID, &member.name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		if id != lastID {
+			runs = append(runs, r)
+			lastID = id
+		}
+		runs[len(runs)-1].members = append(runs[len(runs)-1].members, member)
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseStarRun(t *testing.T) {
+	testData := []struct {
+		kind        starKind
+		args        []string
+		level       int
+		score       int
+		expectError bool
+	}{
+		{kind: redStar, args: []string{"6"}, level: 6},
+		{kind: redStar, args: []string{"6", "52,000", "<@1>", "<@!2>"}, level: 6, score: 52000},
+		{kind: redStar, args: []string{"<@1>", "3", "800"}, level: 3, score: 800},
+		{kind: blueStar, args: []string{}},
+		{kind: blueStar, args: []string{"1500", "<@1>"}, score: 1500},
+		{kind: redStar, args: []string{}, expectError: true},
+		{kind: redStar, args: []string{"13"}, expectError: true},
+		{kind: redStar, args: []string{"6", "-5"}, expectError: true},
+		{kind: redStar, args: []string{"6", "500", "600"}, expectError: true},
+		{kind: blueStar, args: []string{"great"}, expectError: true},
+	}
+
+	for _, data := range testData {
+		level, score, err := parseStarRun(data.kind, data.args)
+		if data.expectError {
+			if err == nil {
+				t.Errorf("expected an error for %v %q", data.kind, data.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v %q: %v", data.kind, data.args, err)
+			continue
+		}
+		if level != data.level || score != data.score {
+			t.Errorf("%v %q was parsed to level %d and score %d, expected %d and %d", data.kind, data.args, level, score, data.level, data.score)
+		}
+	}
+}
+
+func Test_summarizeStarRuns(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	day := func(d int, hour int) time.Time {
+		return time.Date(2018, 10, d, hour, 0, 0, 0, time.UTC)
+	}
+	runs := []starRun{
+		{level: 5, score: 100, at: day(1, 12)},
+		{level: 5, score: 300, at: day(2, 12)},
+		// The 2nd in the location
+		{level: 6, at: day(3, 2)},
+		{level: 6, score: 50, at: day(3, 12)},
+		{level: 5, score: 200, at: day(4, 12)},
+		{level: 6, at: day(7, 12)},
+	}
+
+	testData := []struct {
+		now             time.Time
+		expectedCurrent int
+	}{
+		{now: day(7, 20), expectedCurrent: 1},
+		{now: day(8, 20), expectedCurrent: 1},
+		{now: day(9, 20), expectedCurrent: 0},
+	}
+
+	for _, data := range testData {
+		st := summarizeStarRuns(runs, data.now, loc)
+		if st.runs != 6 || st.longestStreak != 4 || st.currentStreak != data.expectedCurrent {
+			t.Errorf("Stats at %v were %d runs, streak %d now and %d at most, expected 6 runs, streak %d now and 4 at most",
+				data.now, st.runs, st.currentStreak, st.longestStreak, data.expectedCurrent)
+		}
+		expectedLevels := []starLevelStats{{level: 5, runs: 3, best: 300}, {level: 6, runs: 3, best: 50}}
+		if !reflect.DeepEqual(st.levels, expectedLevels) {
+			t.Errorf("Levels were %+v, expected %+v", st.levels, expectedLevels)
+		}
+	}
+}
+
+func Test_summarizeStarWeek(t *testing.T) {
+	amy := runMember{userID: "1", name: "amy"}
+	bob := runMember{userID: "2", name: "Bob"}
+	carl := runMember{userID: "3", name: "carl"}
+	runs := []starRun{
+		{kind: redStar, level: 6, score: 400, members: []runMember{amy, bob}},
+		{kind: redStar, level: 6, score: 500, members: []runMember{carl, bob}},
+		{kind: redStar, level: 4, members: []runMember{amy}},
+		{kind: blueStar, score: 1500, members: []runMember{carl}},
+	}
+
+	week := summarizeStarWeek(runs)
+	if week.runs[redStar] != 3 || week.runs[blueStar] != 1 {
+		t.Errorf("Runs were %v, expected 3 Red Stars and 1 Blue Star", week.runs)
+	}
+	expectedLevels := []starLevelStats{{level: 4, runs: 1}, {level: 6, runs: 2, best: 500}}
+	if !reflect.DeepEqual(week.levels[redStar], expectedLevels) {
+		t.Errorf("Red Star levels were %+v, expected %+v", week.levels[redStar], expectedLevels)
+	}
+	expectedMembers := []memberRuns{{"amy", 2}, {"Bob", 2}, {"carl", 2}}
+	if !reflect.DeepEqual(week.members, expectedMembers) {
+		t.Errorf("Members were %+v, expected %+v", week.members, expectedMembers)
+	}
+}
+
+func Test_startOfWeek(t *testing.T) {
+	monday := time.Date(2018, 10, 15, 0, 0, 0, 0, time.UTC)
+	testData := []time.Time{
+		monday,
+		time.Date(2018, 10, 17, 13, 30, 0, 0, time.UTC),
+		time.Date(2018, 10, 21, 23, 59, 0, 0, time.UTC),
+		// Still Sunday in UTC
+		time.Date(2018, 10, 22, 1, 0, 0, 0, time.FixedZone("UTC+3", 3*60*60)),
+	}
+
+	for _, data := range testData {
+		if actual := startOfWeek(data); !actual.Equal(monday) {
+			t.Errorf("Week of %v started %v, expected %v", data, actual, monday)
+		}
+	}
+}
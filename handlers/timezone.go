@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	localTimeFormat = "Mon 2 Jan 15:04 MST"
+	clockFormat     = "Mon 15:04"
+)
+
+// absoluteTimeLayouts accepted when parsing a time, the number of words each layout spans is the key.
+var absoluteTimeLayouts = map[int][]string{
+	1: {"2006-01-02T15:04", "15:04"},
+	2: {"2006-01-02 15:04"},
+}
+
+// TimeZoneCommand for setting the time zone of a member.
+func TimeZoneCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "tz",
+		Permission:      commands.Members,
+		HelpDescription: "Show or set your time zone",
+		Handler:         HandleTimeZone,
+		SubCommands: []commands.Command{
+			TimeZoneSetCommand(),
+		},
+		Help: commands.Help{
+			Summary: "Show or set your time zone",
+			DetailedDescription: "Show your time zone. Times you type are read in your time zone, " +
+				"and times in listings are shown in it. UTC is used until you set one.",
+			Syntax:  "tz",
+			Example: "tz",
+		},
+	}
+}
+
+// TimeZoneSetCommand for setting the time zone of a member.
+func TimeZoneSetCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "set",
+		Permission:      commands.Members,
+		HelpDescription: "Set your time zone",
+		Handler:         HandleSetTimeZone,
+		Help: commands.Help{
+			Summary:             "Set your time zone",
+			DetailedDescription: "Set your time zone using its IANA name, see https://en.wikipedia.org/wiki/List_of_tz_database_time_zones",
+			Syntax:              "tz set <zone>",
+			Example:             "tz set Europe/Stockholm",
+		},
+	}
+}
+
+// TimeCommand for showing the current time across the corp.
+func TimeCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "time",
+		Permission:      commands.Members,
+		HelpDescription: "Show the current time across the corp's time zones",
+		Handler:         HandleTime,
+		Help: commands.Help{
+			Summary:             "Show the current time across the corp's time zones",
+			DetailedDescription: "Show the current time in every time zone set by a member.",
+			Syntax:              "time",
+			Example:             "time",
+		},
+	}
+}
+
+// HandleTimeZone handles showing the time zone of the caller.
+func HandleTimeZone(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	loc := userLocation(db, m.Author.ID)
+
+	response := discordgo.MessageEmbed{
+		Color:       infoColor,
+		Description: fmt.Sprintf("Your time zone is %v, it's %v.", loc, time.Now().In(loc).Format(localTimeFormat)),
+	}
+	_, err := s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleSetTimeZone handles setting the time zone of the caller.
+func HandleSetTimeZone(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	var response discordgo.MessageEmbed
+
+	loc, err := loadLocation(strings.TrimSpace(msg))
+	if err != nil {
+		response = discordgo.MessageEmbed{
+			Title:       "Incorrect syntax",
+			Color:       failColor,
+			Description: fmt.Sprintf("Unknown time zone %q, use an IANA name like `Europe/Stockholm`", strings.TrimSpace(msg)),
+		}
+	} else if err = setUserTimeZoneInDatabase(db, m.Author.ID, loc.String()); err != nil {
+		fmt.Println("Failed to set time zone:", err.Error())
+		response = discordgo.MessageEmbed{
+			Color:       failColor,
+			Description: "Failed to set time zone",
+		}
+	} else {
+		response = discordgo.MessageEmbed{
+			Title:       "Time zone set!",
+			Color:       successColor,
+			Description: fmt.Sprintf("It's %v in %v.", time.Now().In(loc).Format(localTimeFormat), loc),
+		}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleTime handles showing the current time in the corp's time zones.
+func HandleTime(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	zones, err := getTimeZonesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get time zones:", err.Error())
+		_, err = s.ChannelMessageSend(m.ChannelID, "Failed to get time zones")
+		if err != nil {
+			fmt.Println("Failed to send message:", err.Error())
+		}
+		return
+	}
+
+	now := time.Now()
+	response := discordgo.MessageEmbed{
+		Title:       "Current time",
+		Color:       infoColor,
+		Description: formatCorpTime(now, zones),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// formatCorpTime lists the time in every zone, ordered by UTC offset.
+// zones maps the zone name to the amount of members in it.
+func formatCorpTime(now time.Time, zones map[string]int) string {
+	type zoneTime struct {
+		name    string
+		members int
+		local   time.Time
+		offset  int
+	}
+
+	var times []zoneTime
+	for name, members := range zones {
+		loc, err := loadLocation(name)
+		if err != nil {
+			continue
+		}
+		local := now.In(loc)
+		_, offset := local.Zone()
+		times = append(times, zoneTime{name: name, members: members, local: local, offset: offset})
+	}
+	sort.Slice(times, func(i, j int) bool {
+		if times[i].offset != times[j].offset {
+			return times[i].offset < times[j].offset
+		}
+		return times[i].name < times[j].name
+	})
+
+	content := fmt.Sprintf("**UTC**: %v\n", now.UTC().Format(clockFormat))
+	for _, t := range times {
+		member := "members"
+		if t.members == 1 {
+			member = "member"
+		}
+		content += fmt.Sprintf("**%v** (%d %v): %v\n", t.name, t.members, member, t.local.Format(clockFormat+" MST"))
+	}
+	return content
+}
+
+// loadLocation of an IANA time zone name.
+// Local is not accepted since it depends on where the bot runs.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, errors.Errorf("unknown time zone %q", name)
+	}
+	return time.LoadLocation(name)
+}
+
+// userLocation returns the time zone of the user, UTC is returned if none is set.
+func userLocation(db *sql.DB, userID string) *time.Location {
+	zone, err := getUserTimeZoneFromDatabase(db, userID)
+	if err != nil {
+		fmt.Println("Failed to get time zone:", err.Error())
+		return time.UTC
+	}
+	if zone == "" {
+		return time.UTC
+	}
+
+	loc, err := loadLocation(zone)
+	if err != nil {
+		fmt.Println("Failed to load time zone:", err.Error())
+		return time.UTC
+	}
+	return loc
+}
+
+// parseTime parses either a duration from now or an absolute time in loc from the start of args.
+// The amount of words used is returned together with the time.
+// A time of day without a date refers to the next time it occurs.
+func parseTime(args []string, now time.Time, loc *time.Location) (time.Time, int, error) {
+	if len(args) == 0 {
+		return time.Time{}, 0, errors.New("missing time")
+	}
+
+	if duration, err := time.ParseDuration(args[0]); err == nil {
+		return now.Add(duration), 1, nil
+	}
+
+	// Try the layouts spanning the most words first
+	for words := 2; words >= 1; words-- {
+		if len(args) < words {
+			continue
+		}
+		text := strings.Join(args[:words], " ")
+
+		for _, layout := range absoluteTimeLayouts[words] {
+			t, err := time.ParseInLocation(layout, text, loc)
+			if err != nil {
+				continue
+			}
+
+			if layout == "15:04" {
+				local := now.In(loc)
+				t = time.Date(local.Year(), local.Month(), local.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+				if !t.After(now) {
+					t = t.AddDate(0, 0, 1)
+				}
+			}
+			return t, words, nil
+		}
+	}
+
+	return time.Time{}, 0, errors.Errorf("incorrect time %q", args[0])
+}
+
+// formatRelativeTime shows both how long until (or since) t and the local time in loc.
+func formatRelativeTime(t time.Time, now time.Time, loc *time.Location) string {
+	local := t.In(loc).Format(localTimeFormat)
+	if t.Before(now) {
+		return fmt.Sprintf("%v ago (%v)", formatDuration(now.Sub(t)), local)
+	}
+	return fmt.Sprintf("In %v (%v)", formatDuration(t.Sub(now)), local)
+}
+
+func getUserTimeZoneFromDatabase(db *sql.DB, userID string) (string, error) {
+	var zone string
+	err := db.QueryRow("SELECT zone FROM user_timezones WHERE user_id = $1", userID).Scan(&zone)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return zone, errors.Wrap(err, "failed to do query")
+}
+
+func setUserTimeZoneInDatabase(db *sql.DB, userID string, zone string) error {
+	statement := `INSERT INTO user_timezones (user_id, zone) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET zone = $2`
+	_, err := db.Exec(statement, userID, zone)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getTimeZonesFromDatabase returns every time zone set mapped to the amount of members using it.
+func getTimeZonesFromDatabase(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query("SELECT zone, COUNT(*) FROM user_timezones GROUP BY zone")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	zones := make(map[string]int)
+	for rows.Next() {
+		var (
+			zone  string
+			count int
+		)
+		err = rows.Scan(&zone, &count)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		zones[zone] = count
+	}
+
+	return zones, nil
+}
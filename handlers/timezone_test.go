@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseTime(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip("time zone database not available:", err)
+	}
+	now := time.Date(2018, 11, 24, 18, 30, 0, 0, time.UTC) // 19:30 in Stockholm
+
+	testData := []struct {
+		args     []string
+		expected time.Time
+		used     int
+		fail     bool
+	}{
+		{args: []string{"1h5m", "jump"}, expected: now.Add(time.Hour + 5*time.Minute), used: 1},
+		{args: []string{"20:00", "jump"}, expected: time.Date(2018, 11, 24, 20, 0, 0, 0, stockholm), used: 1},
+		{args: []string{"19:00"}, expected: time.Date(2018, 11, 25, 19, 0, 0, 0, stockholm), used: 1},
+		{args: []string{"2018-11-26", "08:15", "jump"}, expected: time.Date(2018, 11, 26, 8, 15, 0, 0, stockholm), used: 2},
+		{args: []string{"2018-11-26T08:15"}, expected: time.Date(2018, 11, 26, 8, 15, 0, 0, stockholm), used: 1},
+		{args: []string{"tomorrow"}, fail: true},
+		{args: []string{}, fail: true},
+	}
+
+	for _, d := range testData {
+		parsed, used, err := parseTime(d.args, now, stockholm)
+		if d.fail {
+			if err == nil {
+				t.Errorf("%q should not be accepted", d.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q should be accepted: %v", d.args, err)
+			continue
+		}
+		if !parsed.Equal(d.expected) {
+			t.Errorf("%q should be parsed as %v, not %v", d.args, d.expected, parsed)
+		}
+		if used != d.used {
+			t.Errorf("%q should use %d words, not %d", d.args, d.used, used)
+		}
+	}
+}
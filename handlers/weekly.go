@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+// weeklyPost is a message about the last week posted to a channel every Monday.
+type weeklyPost struct {
+	// name is used in the messages and as the key in the database.
+	name string
+	// helpCommand is the command to check the syntax of.
+	helpCommand string
+	// build builds the message about the time from the start up until the end.
+	build func(start time.Time, end time.Time, db *sql.DB) (*discordgo.MessageEmbed, error)
+}
+
+// startWeeklyPosts posts the message about the last week at the start of every week,
+// including the one missed if the bot was offline when it started.
+func startWeeklyPosts(post weeklyPost, s *discordgo.Session, db *sql.DB, guildID string) {
+	for {
+		weekStart := startOfWeek(time.Now())
+		channelID, lastPosted, err := getWeeklyPostFromDatabase(db, guildID, post.name)
+		if err != nil {
+			fmt.Println("Failed to get "+post.name+" channel:", err.Error())
+		} else if channelID != "" && lastPosted.Before(weekStart) {
+			err = setWeeklyPostInDatabase(db, guildID, post.name, channelID, weekStart)
+			if err != nil {
+				fmt.Println("Failed to set "+post.name+" posted:", err.Error())
+			} else {
+				sendWeeklyPost(post, channelID, weekStart.AddDate(0, 0, -7), weekStart, s, db)
+			}
+		}
+
+		<-time.After(time.Until(weekStart.AddDate(0, 0, 7)))
+	}
+}
+
+// sendWeeklyPost posts the message about the time from the start up until the end.
+func sendWeeklyPost(post weeklyPost, channelID string, start time.Time, end time.Time, s *discordgo.Session, db *sql.DB) {
+	msg, err := post.build(start, end, db)
+	if err != nil {
+		fmt.Println("Failed to build "+post.name+":", err.Error())
+		return
+	}
+	_, err = s.ChannelMessageSendEmbed(channelID, msg)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// handleWeeklyPost handles setting the channel of the weekly post, or showing the post about the current week.
+func handleWeeklyPost(post weeklyPost, msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string) {
+	now := time.Now()
+	if msg == "" {
+		sendWeeklyPost(post, m.ChannelID, startOfWeek(now), now, s, db)
+		return
+	}
+
+	var channelID, description string
+	switch {
+	case strings.ToLower(msg) == "off":
+		description = fmt.Sprintf("The weekly %v is turned off.", post.name)
+	case strings.HasPrefix(msg, "<#") && strings.HasSuffix(msg, ">"):
+		channelID = strings.Trim(msg, "<#>")
+		description = fmt.Sprintf("The %v is posted to <#%v> every Monday.", post.name, channelID)
+	default:
+		sendFailMessage(fmt.Sprintf("Incorrect syntax, check `!help %v`.", post.helpCommand), s, m)
+		return
+	}
+
+	// The current week is posted about when it's over, not right away.
+	err := setWeeklyPostInDatabase(db, guildID, post.name, channelID, startOfWeek(now))
+	if err != nil {
+		fmt.Println("Failed to set "+post.name+" channel:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       strings.ToUpper(post.name[:1]) + post.name[1:] + " set!",
+		Color:       successColor,
+		Description: description,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// getWeeklyPostFromDatabase returns the channel of the weekly post, empty if it's off, and the start of the week it was last posted.
+func getWeeklyPostFromDatabase(db *sql.DB, guildID string, name string) (string, time.Time, error) {
+	var channelID string
+	var lastPosted time.Time
+	query := "SELECT channel_id, last_posted_at FROM weekly_posts WHERE guild_id = $1 AND name = $2"
+	err := db.QueryRow(query, guildID, name).Scan(&channelID, &lastPosted)
+	if err == sql.ErrNoRows {
+		return "", lastPosted, nil
+	}
+	return channelID, lastPosted, errors.Wrap(err, "failed to do query")
+}
+
+func setWeeklyPostInDatabase(db *sql.DB, guildID string, name string, channelID string, lastPosted time.Time) error {
+	statement := `INSERT INTO weekly_posts (guild_id, name, channel_id, last_posted_at) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (guild_id, name) DO UPDATE SET channel_id = $3, last_posted_at = $4`
+	_, err := db.Exec(statement, guildID, name, channelID, lastPosted.UTC().Format(dbTimeFormat))
+	return errors.Wrap(err, "failed to execute query")
+}
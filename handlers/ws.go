@@ -0,0 +1,525 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const (
+	// wsDuration is how long a White Star match lasts.
+	wsDuration = 5 * 24 * time.Hour
+)
+
+// wsPhase is the phase of a White Star round in an instance.
+type wsPhase string
+
+const (
+	signUpOpen wsPhase = "Sign-up open"
+	scanning   wsPhase = "Scanning"
+	matched    wsPhase = "Matched"
+	inProgress wsPhase = "In progress"
+	ended      wsPhase = "Ended"
+)
+
+// wsTransition from any of the phases to another phase.
+type wsTransition struct {
+	from []wsPhase
+	to   wsPhase
+}
+
+// wsTransitions maps the callphrase of the commands to the transition they do.
+var wsTransitions = map[string]wsTransition{
+	"scan":    {from: []wsPhase{signUpOpen}, to: scanning},
+	"matched": {from: []wsPhase{scanning}, to: matched},
+	"start":   {from: []wsPhase{matched}, to: inProgress},
+	"end":     {from: []wsPhase{scanning, matched, inProgress}, to: ended},
+}
+
+// nextPhase returns the phase after the transition, or an error explaining why it can't be done.
+func nextPhase(current wsPhase, callPhrase string) (wsPhase, error) {
+	transition, exists := wsTransitions[callPhrase]
+	if !exists {
+		return current, errors.Errorf("unknown transition %q", callPhrase)
+	}
+
+	for _, from := range transition.from {
+		if from == current {
+			return transition.to, nil
+		}
+	}
+
+	allowed := make([]string, len(transition.from))
+	for i, from := range transition.from {
+		allowed[i] = "*" + string(from) + "*"
+	}
+	return current, errors.Errorf("the White Star is *%v*, `ws %v` can only be used when it's %v",
+		current, callPhrase, strings.Join(allowed, " or "))
+}
+
+// wsRound is a White Star round of an instance, from the sign-up opening until the match has ended.
+type wsRound struct {
+	// id is 0 if the round has not been stored yet.
+	id            int
+	instance      instance
+	phase         wsPhase
+	opened        time.Time
+	phaseChanged  time.Time
+	endReminderID int
+}
+
+// optInsLocked returns whether members can no longer opt in or out themselves.
+func (r wsRound) optInsLocked() bool {
+	return r.phase == scanning || r.phase == matched || r.phase == inProgress
+}
+
+// WSCommand for managing the White Star rounds.
+func WSCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "ws",
+		Permission:      commands.Members,
+		HelpDescription: "Show and manage the phase of the WS",
+		Handler:         HandleWS,
+		Init:            InitWS,
+		SubCommands: []commands.Command{
+			WSTransitionCommand("scan", "Start scanning for a WS match",
+				"Start scanning for a White Star match, members can no longer opt in or out themselves."),
+			WSTransitionCommand("matched", "Mark that a WS match was found",
+				"Mark that a White Star match was found, participants get the WS role and a reminder is set for when the match ends."),
+			WSStartCommand(),
+			WSTransitionCommand("end", "End the WS",
+				"End the White Star, the roster is archived and cleared and the WS role is removed from the participants."),
+			WSRosterCommand(),
+			WSSignUpCommand(),
+			WSDeadlineCommand(),
+			WSPendingCommand(),
+			WSNudgesCommand(),
+			WSHistoryCommand(),
+			WSStatsCommand(),
+			WSTimeCommand(),
+			WSOpponentCommand(),
+			WSResultCommand(),
+			WSRecordCommand(),
+			WSDownCommand(),
+			WSEnemyCommand(),
+			WSShipsCommand(),
+			WSTechCommand(),
+			WSAvailabilityCommand(),
+		},
+		Help: commands.Help{
+			Summary: "Show and manage the phase of the WS",
+			DetailedDescription: "Show which phase the White Star is in: sign-up open, scanning, matched, in progress or ended.\n" +
+				"Officers move it along with `scan`, `matched`, `start` and `end`. Opting in after it has ended opens the next sign-up.",
+			Syntax:  "ws [instance]",
+			Example: "ws B",
+		},
+	}
+}
+
+// InitWS resolves participants stored before they were keyed by user ID and restores the timers of the White Star features.
+func InitWS(s *discordgo.Session, db *sql.DB, guildID string) {
+	resolveParticipantPlaceholders(s, db, guildID)
+	restoreDeadlines(s, db, guildID)
+	restoreMatchTimers(s, db)
+	restoreShipTimers(s, db)
+}
+
+// WSTransitionCommand for moving a White Star round to the next phase.
+func WSTransitionCommand(callPhrase string, summary string, description string) commands.Command {
+	return commands.Command{
+		CallPhrase:      callPhrase,
+		Permission:      commands.Officers,
+		HelpDescription: summary,
+		Handler:         wsTransitionHandler(callPhrase),
+		Help: commands.Help{
+			Summary:             summary,
+			DetailedDescription: description,
+			Syntax:              fmt.Sprintf("ws %v [instance]", callPhrase),
+			Example:             fmt.Sprintf("ws %v A", callPhrase),
+		},
+	}
+}
+
+// WSStartCommand for marking that the White Star match has started, which starts the match timer.
+func WSStartCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "start",
+		Permission:      commands.Officers,
+		HelpDescription: "Mark that the WS match has started",
+		Handler:         HandleWSStart,
+		Help: commands.Help{
+			Summary: "Mark that the WS match has started",
+			DetailedDescription: "Mark that the White Star match has started and start the match timer, give how long ago it started if it wasn't just now. " +
+				"Checkpoints are posted to the instance channel every day and 24h, 6h and 1h before the end, see `ws time`.",
+			Syntax:  "ws start [instance] [started ago]",
+			Example: "ws start A 2h30m",
+		},
+	}
+}
+
+// HandleWS handles showing the phase of the White Star.
+func HandleWS(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return
+	}
+
+	description := fmt.Sprintf("**%v** is *%v*", round.instance, round.phase)
+	if !round.phaseChanged.IsZero() {
+		description += fmt.Sprintf(" since %v", formatRelativeTime(round.phaseChanged, time.Now(), userLocation(db, m.Author.ID)))
+	}
+	if round.phase == signUpOpen {
+		deadline, err := getDeadlineFromDatabase(db, instance)
+		if err != nil {
+			fmt.Println("Failed to get deadline:", err.Error())
+		} else if !deadline.time.IsZero() {
+			description += "\n" + formatDeadline(deadline, userLocation(db, m.Author.ID))
+		}
+	}
+	if round.phase == inProgress {
+		t, err := getMatchTimerFromDatabase(db, instance)
+		if err != nil {
+			fmt.Println("Failed to get match timer:", err.Error())
+		} else if !t.started.IsZero() {
+			description += "\n" + formatMatchTime(t, time.Now(), userLocation(db, m.Author.ID))
+		}
+	}
+	response := discordgo.MessageEmbed{
+		Color:       infoColor,
+		Description: description,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// wsTransitionHandler returns a handler moving the White Star to its next phase with the transition of the callphrase.
+func wsTransitionHandler(callPhrase string) commands.Handler {
+	return func(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+		handleWSTransition(callPhrase, msg, time.Now(), s, m, db, guildID)
+	}
+}
+
+// HandleWSStart handles starting the White Star match, optionally some time ago.
+func HandleWSStart(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	started := time.Now()
+	if len(args) > 0 {
+		ago, err := time.ParseDuration(args[len(args)-1])
+		if err == nil {
+			if ago < 0 || ago >= wsDuration {
+				sendFailMessage(fmt.Sprintf("The match can't have started %v ago, it lasts %v.", args[len(args)-1], formatDuration(wsDuration)), s, m)
+				return
+			}
+			started = started.Add(-ago)
+			args = args[:len(args)-1]
+		}
+	}
+
+	handleWSTransition("start", strings.Join(args, " "), started, s, m, db, guildID)
+}
+
+// handleWSTransition moves the White Star to its next phase as of the given time and responds with the result.
+func handleWSTransition(callPhrase string, msg string, at time.Time, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	var response discordgo.MessageEmbed
+	result, err := transitionRound(instance, callPhrase, at, s, db, guildID)
+	if err != nil {
+		response = discordgo.MessageEmbed{
+			Title:       "Not possible right now",
+			Color:       failColor,
+			Description: strings.ToUpper(err.Error()[:1]) + err.Error()[1:] + ".",
+		}
+	} else {
+		response = discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("%v: %v", instance, wsTransitions[callPhrase].to),
+			Color:       successColor,
+			Description: result,
+		}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// transitionRound moves the current round of the instance to its next phase and does the side effects of it.
+// The phase changed at the given time. A description of what was done is returned.
+func transitionRound(instance instance, callPhrase string, at time.Time, s *discordgo.Session, db *sql.DB, guildID string) (string, error) {
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return "", errors.New("failed to get the current phase")
+	}
+
+	phase, err := nextPhase(round.phase, callPhrase)
+	if err != nil {
+		return "", err
+	}
+	round.phase = phase
+	round.phaseChanged = at
+
+	var result string
+	switch phase {
+	case scanning:
+		result = "Members can no longer opt in or out themselves, officers can still use `!setoptin`."
+	case matched:
+		round.endReminderID, err = addWSEndReminder(instance, round.phaseChanged.Add(wsDuration), s, db, guildID)
+		if err != nil {
+			fmt.Println("Failed to add WS end reminder:", err.Error())
+		}
+		result = fmt.Sprintf("The match ends in %v.", formatDuration(wsDuration))
+	case inProgress:
+		err = startMatchTimer(instance, at, s, db)
+		if err != nil {
+			fmt.Println("Failed to start match timer:", err.Error())
+			return "", errors.New("failed to start the match timer, the White Star has not been started")
+		}
+		// The match lasts from when it started, so the end reminder set when it was found is moved
+		if round.endReminderID != 0 {
+			err = deleteEventFromDatabase(db, round.endReminderID)
+			if err != nil {
+				fmt.Println("Failed to delete WS end reminder:", err.Error())
+			}
+		}
+		round.endReminderID, err = addWSEndReminder(instance, at.Add(wsDuration), s, db, guildID)
+		if err != nil {
+			fmt.Println("Failed to add WS end reminder:", err.Error())
+		}
+		result = fmt.Sprintf("Good luck! The match ends in %v, check the time left with `!ws time`.", formatDuration(time.Until(at.Add(wsDuration))))
+	case ended:
+		err = endRound(&round, db)
+		if err != nil {
+			fmt.Println("Failed to archive participants:", err.Error())
+			return "", errors.New("failed to archive the participants, the White Star has not been ended")
+		}
+		result = "Participation list archived and cleared!"
+	}
+
+	err = setRoundInDatabase(db, &round)
+	if err != nil {
+		fmt.Println("Failed to set WS round:", err.Error())
+		return "", errors.New("failed to save the new phase")
+	}
+	updateSignUpMessages(instance, s, db)
+
+	// The roles follow the phase, so they're synced once it's stored
+	if phase == matched || phase == ended {
+		result += "\n" + reconcileInstanceRole(instance, s, db, guildID)
+	}
+
+	return result, nil
+}
+
+// endRound archives the round and clears everything belonging to it: the end reminder, the deadline,
+// the match timer, the destroyed ships and the participation list. The round itself is not stored and the WS roles are left to be reconciled.
+func endRound(round *wsRound, db *sql.DB) error {
+	var err error
+	if round.endReminderID != 0 {
+		err = deleteEventFromDatabase(db, round.endReminderID)
+		if err != nil {
+			fmt.Println("Failed to delete WS end reminder:", err.Error())
+		}
+		round.endReminderID = 0
+	}
+	err = deleteDeadlineFromDatabase(db, round.instance)
+	if err != nil {
+		fmt.Println("Failed to delete deadline:", err.Error())
+	}
+	err = deleteMatchTimerFromDatabase(db, round.instance)
+	if err != nil {
+		fmt.Println("Failed to delete match timer:", err.Error())
+	}
+	err = clearShipDownsFromDatabase(db, round.instance)
+	if err != nil {
+		fmt.Println("Failed to clear destroyed ships:", err.Error())
+	}
+
+	return archiveParticipantsInDatabase(db, *round)
+}
+
+// addWSEndReminder adds an event for when the White Star ends and returns its id.
+func addWSEndReminder(instance instance, end time.Time, s *discordgo.Session, db *sql.DB, guildID string) (int, error) {
+	offsets, err := getDefaultNoticeOffsetsFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get default notice offsets, using built-in defaults:", err.Error())
+		offsets = defaultNoticeOffsets
+	}
+
+	e := event{
+		description: fmt.Sprintf("White Star in %v ends", instance),
+		time:        end,
+	}
+	for _, offset := range offsets {
+		e.notices = append(e.notices, notice{offset: offset})
+	}
+
+	e.id, err = addEventToDatabase(db, e)
+	if err != nil {
+		return 0, err
+	}
+	startEventTimer(e, s, db)
+
+	return e.id, nil
+}
+
+// checkOptInsOpen returns whether members can opt in or out of the instance themselves.
+// If they can't a message is sent explaining why.
+func checkOptInsOpen(instance instance, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) bool {
+	reason, err := signUpClosedReason(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get sign-up status:", err.Error())
+		return true
+	}
+	if reason == "" {
+		return true
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       "Sign-up closed",
+		Color:       failColor,
+		Description: reason + ", ask an officer if you need to change your participation.",
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+	}
+	return false
+}
+
+// signUpClosedReason returns why members can no longer opt in or out of the instance themselves,
+// or an empty string if they can.
+func signUpClosedReason(db *sql.DB, instance instance) (string, error) {
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get WS round")
+	}
+	if round.optInsLocked() {
+		return fmt.Sprintf("The White Star in %v is *%v*", instance, round.phase), nil
+	}
+
+	deadline, err := getDeadlineFromDatabase(db, instance)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get deadline")
+	}
+	if deadline.closed {
+		return fmt.Sprintf("The sign-up deadline for %v was <t:%d:f>", instance, deadline.time.Unix()), nil
+	}
+	return "", nil
+}
+
+// openRoundIfEnded starts the sign-up of a new round if the last one has ended.
+func openRoundIfEnded(db *sql.DB, instance instance) error {
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		return err
+	}
+	if round.id != 0 && round.phase != ended {
+		return nil
+	}
+
+	now := time.Now()
+	round = wsRound{instance: instance, phase: signUpOpen, opened: now, phaseChanged: now}
+	return setRoundInDatabase(db, &round)
+}
+
+// getCurrentRoundFromDatabase returns the latest round of the instance.
+// If there are no rounds yet a round which is open for sign-up is returned.
+func getCurrentRoundFromDatabase(db *sql.DB, instance instance) (wsRound, error) {
+	round := wsRound{instance: instance, phase: signUpOpen}
+	var endReminderID sql.NullInt64
+
+	query := `SELECT id, phase, opened_at, phase_changed_at, end_event_id FROM ws_rounds
+	WHERE instance = $1 ORDER BY id DESC LIMIT 1`
+	err := db.QueryRow(query, instance).Scan(&round.id, &round.phase, &round.opened, &round.phaseChanged, &endReminderID)
+	if err == sql.ErrNoRows {
+		return round, nil
+	}
+	if err != nil {
+		return round, errors.Wrap(err, "failed to do query")
+	}
+	round.endReminderID = int(endReminderID.Int64)
+
+	return round, nil
+}
+
+// setRoundInDatabase inserts the round if it's new, otherwise it's updated.
+func setRoundInDatabase(db *sql.DB, round *wsRound) error {
+	endReminderID := sql.NullInt64{Int64: int64(round.endReminderID), Valid: round.endReminderID != 0}
+
+	if round.id == 0 {
+		if round.opened.IsZero() {
+			round.opened = round.phaseChanged
+		}
+		statement := `INSERT INTO ws_rounds (instance, phase, opened_at, phase_changed_at, end_event_id) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`
+		err := db.QueryRow(statement, round.instance, round.phase, round.opened.UTC(), round.phaseChanged.UTC(), endReminderID).Scan(&round.id)
+		return errors.Wrap(err, "failed to insert round")
+	}
+
+	statement := "UPDATE ws_rounds SET phase = $1, phase_changed_at = $2, end_event_id = $3 WHERE id = $4"
+	_, err := db.Exec(statement, round.phase, round.phaseChanged.UTC(), endReminderID, round.id)
+	return errors.Wrap(err, "failed to update round")
+}
+
+// archiveParticipantsInDatabase stores the participants and the approved roster with the round,
+// then clears the participation list and the roster.
+func archiveParticipantsInDatabase(db *sql.DB, round wsRound) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	if round.id == 0 {
+		return errors.New("round has not been stored")
+	}
+
+	statement := `INSERT INTO ws_round_participants (round_id, name, user_id, participating, preferred_role, roster_role)
+	SELECT $1, p.name, p.user_id, p.participating, p.preferred_role, b.role
+	FROM participants p
+	LEFT JOIN ws_rosters r ON r.instance = p.instance AND r.approved
+	LEFT JOIN ws_roster_picks_built b ON b.instance = r.instance AND b.user_id = p.user_id
+	WHERE p.instance = $2`
+	_, err = tx.Exec(statement, round.id, round.instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to archive participants")
+	}
+
+	statement = `UPDATE ws_rounds SET ended_at = $2,
+	roster_size = (SELECT size FROM ws_rosters WHERE instance = $3 AND approved)
+	WHERE id = $1`
+	_, err = tx.Exec(statement, round.id, round.phaseChanged.UTC(), round.instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to archive roster")
+	}
+
+	_, err = tx.Exec("DELETE FROM ws_rosters WHERE instance = $1", round.instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to clear roster")
+	}
+	_, err = tx.Exec("DELETE FROM participants WHERE instance = $1", round.instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to clear participants")
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
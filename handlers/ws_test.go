@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func Test_nextPhase(t *testing.T) {
+	testData := []struct {
+		from       wsPhase
+		callPhrase string
+		expected   wsPhase
+		fail       bool
+	}{
+		{from: signUpOpen, callPhrase: "scan", expected: scanning},
+		{from: scanning, callPhrase: "matched", expected: matched},
+		{from: matched, callPhrase: "start", expected: inProgress},
+		{from: inProgress, callPhrase: "end", expected: ended},
+		{from: scanning, callPhrase: "end", expected: ended},
+		{from: signUpOpen, callPhrase: "matched", fail: true},
+		{from: signUpOpen, callPhrase: "end", fail: true},
+		{from: ended, callPhrase: "scan", fail: true},
+		{from: inProgress, callPhrase: "scan", fail: true},
+		{from: scanning, callPhrase: "unknown", fail: true},
+	}
+
+	for _, d := range testData {
+		phase, err := nextPhase(d.from, d.callPhrase)
+		if d.fail {
+			if err == nil {
+				t.Errorf("%q should not be possible when %v", d.callPhrase, d.from)
+			}
+			if phase != d.from {
+				t.Errorf("Phase should stay %v after a rejected %q, not %v", d.from, d.callPhrase, phase)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q should be possible when %v: %v", d.callPhrase, d.from, err)
+		}
+		if phase != d.expected {
+			t.Errorf("%q when %v should give %v, not %v", d.callPhrase, d.from, d.expected, phase)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultAvailabilityWindows is how many windows are suggested when officers don't give any.
+	defaultAvailabilityWindows = 8
+	// defaultAvailabilityInterval is the time between the suggested windows.
+	defaultAvailabilityInterval = 3 * time.Hour
+)
+
+// availabilityEmojis are the reactions of the windows, in order.
+var availabilityEmojis = []string{"1\u20e3", "2\u20e3", "3\u20e3", "4\u20e3", "5\u20e3", "6\u20e3", "7\u20e3", "8\u20e3", "9\u20e3"}
+
+// availabilityPoll is a poll of when to start scanning for a White Star round.
+type availabilityPoll struct {
+	roundID   int
+	channelID string
+	messageID string
+	windows   []time.Time
+}
+
+// windowRank is a window with the members who can make it.
+type windowRank struct {
+	// number of the window, starting at 1.
+	number int
+	start  time.Time
+	// attending are the names of the opted in members who can make it.
+	attending []string
+	// others is how many who haven't opted in can make it.
+	others int
+}
+
+// defaultWindows suggests windows at an interval, starting at the next full hour.
+func defaultWindows(now time.Time) []time.Time {
+	start := now.Truncate(time.Hour).Add(time.Hour)
+	windows := make([]time.Time, defaultAvailabilityWindows)
+	for i := range windows {
+		windows[i] = start.Add(time.Duration(i) * defaultAvailabilityInterval)
+	}
+	return windows
+}
+
+// parseAvailabilityWindows parses start times in loc, either durations from now or times like "18:00", in the order they occur.
+func parseAvailabilityWindows(args []string, now time.Time, loc *time.Location) ([]time.Time, error) {
+	var windows []time.Time
+	for len(args) > 0 {
+		t, words, err := parseTime(args, now, loc)
+		if err != nil {
+			return nil, err
+		}
+		if !t.After(now) {
+			return nil, errors.Errorf("%q has already passed", strings.Join(args[:words], " "))
+		}
+		args = args[words:]
+
+		duplicate := false
+		for _, w := range windows {
+			duplicate = duplicate || w.Equal(t)
+		}
+		if !duplicate {
+			windows = append(windows, t)
+		}
+	}
+	if len(windows) > len(availabilityEmojis) {
+		return nil, errors.Errorf("there can be at most %d windows", len(availabilityEmojis))
+	}
+
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Before(windows[j]) })
+	return windows, nil
+}
+
+// rankWindows ranks the windows by how many opted in members can make them, then by how many others can and by time.
+// The votes are the numbers of the windows, starting at 1, mapped by user ID.
+func rankWindows(windows []time.Time, votes map[string][]int, participants []participant) []windowRank {
+	ranks := make([]windowRank, len(windows))
+	for i, start := range windows {
+		ranks[i] = windowRank{number: i + 1, start: start}
+	}
+
+	participating := make(map[string]string)
+	for _, p := range participants {
+		if p.participating {
+			participating[p.userID] = p.name
+		}
+	}
+	for userID, numbers := range votes {
+		for _, number := range numbers {
+			if number < 1 || number > len(ranks) {
+				continue
+			}
+			if name, ok := participating[userID]; ok {
+				ranks[number-1].attending = append(ranks[number-1].attending, name)
+			} else {
+				ranks[number-1].others++
+			}
+		}
+	}
+
+	for _, r := range ranks {
+		sort.Slice(r.attending, func(i, j int) bool { return strings.ToLower(r.attending[i]) < strings.ToLower(r.attending[j]) })
+	}
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if len(ranks[i].attending) != len(ranks[j].attending) {
+			return len(ranks[i].attending) > len(ranks[j].attending)
+		}
+		if ranks[i].others != ranks[j].others {
+			return ranks[i].others > ranks[j].others
+		}
+		return ranks[i].start.Before(ranks[j].start)
+	})
+	return ranks
+}
+
+// formatWindowInZones shows the time in UTC followed by the distinct local times of the zones, e.g. "Mon 18:00 UTC / Mon 20:00 CEST".
+func formatWindowInZones(t time.Time, zones []*time.Location) string {
+	formatted := []string{t.UTC().Format(clockFormat + " MST")}
+	seen := map[string]bool{formatted[0]: true}
+	for _, loc := range zones {
+		local := t.In(loc).Format(clockFormat + " MST")
+		if !seen[local] {
+			seen[local] = true
+			formatted = append(formatted, local)
+		}
+	}
+	return strings.Join(formatted, " / ")
+}
+
+// availabilityVote returns the number of the window the reaction is for, starting at 1, and whether it's one.
+func availabilityVote(emoji string) (int, bool) {
+	emoji = strings.Replace(emoji, emojiVariationSelector, "", -1)
+	for i, e := range availabilityEmojis {
+		if e == emoji {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// WSAvailabilityCommand for finding a time to scan which suits the members.
+func WSAvailabilityCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "availability",
+		Permission:      commands.Members,
+		HelpDescription: "Show when the WS participants can make it",
+		Handler:         HandleWSAvailability,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "open",
+				Permission:      commands.Officers,
+				HelpDescription: "Post a poll of when to scan",
+				Handler:         HandleWSAvailabilityOpen,
+				Help: commands.Help{
+					Summary: "Post a poll of when to scan",
+					DetailedDescription: fmt.Sprintf("Post a poll of start windows for the White Star, shown in the time zones of the members. "+
+						"Give up to %d times in your time zone, or durations from now, otherwise one every %v starting at the next full hour is suggested. "+
+						"Members react with the numbers of the windows they can make. Opening a new poll replaces the old one.",
+						len(availabilityEmojis), formatDuration(defaultAvailabilityInterval)),
+					Syntax:  "ws availability open [instance] [time...]",
+					Example: "ws availability open B 18:00 21:00 2018-10-20T12:00",
+				},
+			},
+			{
+				CallPhrase:      "mark",
+				Permission:      commands.Members,
+				HelpDescription: "Mark the WS windows you can make",
+				Handler:         HandleWSAvailabilityMark,
+				Help: commands.Help{
+					Summary: "Mark the WS windows you can make",
+					DetailedDescription: "Mark the numbers of the windows in the poll you can make, replacing what you've marked before. " +
+						"Marks are kept apart from your reactions to the poll: a window counts if you marked or reacted to it, " +
+						"and removing a reaction doesn't remove a window marked here.",
+					Syntax:  "ws availability mark [instance] <number...>",
+					Example: "ws availability mark 1 3 4",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary: "Show when the WS participants can make it",
+			DetailedDescription: "Show the windows of the availability poll in your time zone, " +
+				"the ones the most opted in members can make first. Officers open the poll with `ws availability open`.",
+			Syntax:  "ws availability [instance]",
+			Example: "ws availability B",
+		},
+	}
+}
+
+// HandleWSAvailabilityOpen handles posting a poll for the current round.
+func HandleWSAvailabilityOpen(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get instances:", err.Error())
+	}
+	instanceArg, args := leadingInstanceArg(instances, args, 0)
+	instance, ok := instanceFromMessage(instanceArg, s, m, db)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	windows := defaultWindows(now)
+	if len(args) > 0 {
+		windows, err = parseAvailabilityWindows(args, now, userLocation(db, m.Author.ID))
+		if err != nil {
+			sendFailMessage(fmt.Sprintf("Incorrect syntax, %v. Check `!help ws availability open`.", err.Error()), s, m)
+			return
+		}
+	}
+
+	err = openRoundIfEnded(db, instance)
+	if err != nil {
+		fmt.Println("Failed to open round:", err.Error())
+		return
+	}
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return
+	}
+	if round.phase == matched || round.phase == inProgress {
+		sendFailMessage(fmt.Sprintf("The White Star in %v has already been matched.", instance), s, m)
+		return
+	}
+
+	var zones []*time.Location
+	zoneNames, err := getTimeZonesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get time zones:", err.Error())
+	}
+	for name := range zoneNames {
+		if loc, err := loadLocation(name); err == nil {
+			zones = append(zones, loc)
+		}
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		_, offsetI := now.In(zones[i]).Zone()
+		_, offsetJ := now.In(zones[j]).Zone()
+		return offsetI < offsetJ
+	})
+
+	var content string
+	for i, w := range windows {
+		content += fmt.Sprintf("%v %v\n", availabilityEmojis[i], formatWindowInZones(w, zones))
+	}
+	poll := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("When can you start the White Star in %v?", instance),
+		Color:       infoColor,
+		Description: content + "\nReact with the windows you can make, see the results in your time zone with `!ws availability`.",
+	}
+	message, err := s.ChannelMessageSendEmbed(m.ChannelID, &poll)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+
+	err = setAvailabilityPollInDatabase(db, availabilityPoll{roundID: round.id, channelID: message.ChannelID, messageID: message.ID, windows: windows})
+	if err != nil {
+		fmt.Println("Failed to set availability poll:", err.Error())
+		return
+	}
+	for i := range windows {
+		err = s.MessageReactionAdd(message.ChannelID, message.ID, availabilityEmojis[i])
+		if err != nil {
+			fmt.Println("Failed to add reaction:", err.Error())
+		}
+	}
+}
+
+// HandleWSAvailabilityMark handles marking the windows a member can make.
+func HandleWSAvailabilityMark(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get instances:", err.Error())
+	}
+	instanceArg, args := leadingInstanceArg(instances, args, 1)
+	instance, ok := instanceFromMessage(instanceArg, s, m, db)
+	if !ok {
+		return
+	}
+
+	poll, ok := currentAvailabilityPoll(instance, s, m, db)
+	if !ok {
+		return
+	}
+
+	var numbers []int
+	for _, arg := range args {
+		number, err := strconv.Atoi(arg)
+		if err != nil || number < 1 || number > len(poll.windows) {
+			sendFailMessage(fmt.Sprintf("Incorrect window %q, it has to be a number between 1 and %d.", arg, len(poll.windows)), s, m)
+			return
+		}
+		numbers = append(numbers, number)
+	}
+	if len(numbers) == 0 {
+		sendFailMessage("Missing the numbers of the windows, check `!help ws availability mark`.", s, m)
+		return
+	}
+
+	err = setAvailabilityVotesInDatabase(db, poll.roundID, m.Author.ID, numbers)
+	if err != nil {
+		fmt.Println("Failed to set availability votes:", err.Error())
+		return
+	}
+
+	loc := userLocation(db, m.Author.ID)
+	var content string
+	for _, number := range numbers {
+		content += fmt.Sprintf("%v %v\n", availabilityEmojis[number-1], poll.windows[number-1].In(loc).Format(localTimeFormat))
+	}
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Availability marked, %v!", m.Author.Username),
+		Color:       successColor,
+		Description: content,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleWSAvailability handles showing the windows ranked by how many can make them.
+func HandleWSAvailability(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+	poll, ok := currentAvailabilityPoll(instance, s, m, db)
+	if !ok {
+		return
+	}
+
+	votes, err := getAvailabilityVotesFromDatabase(db, poll.roundID)
+	if err != nil {
+		fmt.Println("Failed to get availability votes:", err.Error())
+		return
+	}
+	participants, err := getParticipantsFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get participants:", err.Error())
+		return
+	}
+	participants = withDisplayNames(participants, s, guildID)
+
+	now := time.Now()
+	loc := userLocation(db, m.Author.ID)
+	var content string
+	for _, r := range rankWindows(poll.windows, votes, participants) {
+		content += fmt.Sprintf("%v %v: **%d** opted in", availabilityEmojis[r.number-1], formatRelativeTime(r.start, now, loc), len(r.attending))
+		if r.others > 0 {
+			content += fmt.Sprintf(", %d others", r.others)
+		}
+		if len(r.attending) > 0 {
+			content += fmt.Sprintf(" (%v)", strings.Join(r.attending, ", "))
+		}
+		content += "\n"
+	}
+
+	var unanswered []string
+	for _, p := range participants {
+		if _, ok := votes[p.userID]; p.participating && !ok {
+			unanswered = append(unanswered, p.name)
+		}
+	}
+	if len(unanswered) > 0 {
+		sort.Slice(unanswered, func(i, j int) bool { return strings.ToLower(unanswered[i]) < strings.ToLower(unanswered[j]) })
+		content += fmt.Sprintf("\nOpted in without answering: %v", strings.Join(unanswered, ", "))
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Availability for the White Star in %v", instance),
+		Color:       infoColor,
+		Description: content,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// currentAvailabilityPoll returns the poll of the current round of the instance.
+// If there's none a message is sent about it and false is returned.
+func currentAvailabilityPoll(instance instance, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) (availabilityPoll, bool) {
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return availabilityPoll{}, false
+	}
+	poll, err := getAvailabilityPollFromDatabase(db, round.id)
+	if err != nil {
+		fmt.Println("Failed to get availability poll:", err.Error())
+		return availabilityPoll{}, false
+	}
+	if poll.roundID == 0 {
+		sendFailMessage(fmt.Sprintf("There's no availability poll for the White Star in %v, officers open one with `!ws availability open`.", instance), s, m)
+		return poll, false
+	}
+	return poll, true
+}
+
+// HandleAvailabilityReaction marks or unmarks the window of the reaction on an availability poll.
+func HandleAvailabilityReaction(s *discordgo.Session, r *discordgo.MessageReaction, added bool, db *sql.DB, guildID string) {
+	number, ok := availabilityVote(r.Emoji.APIName())
+	if !ok {
+		return
+	}
+	poll, err := getAvailabilityPollByMessageFromDatabase(db, r.MessageID)
+	if err != nil {
+		fmt.Println("Failed to get availability poll:", err.Error())
+		return
+	}
+	if poll.roundID == 0 || number > len(poll.windows) {
+		return
+	}
+	if !reactionAuthorized(commands.Members, s, r, guildID) {
+		if added {
+			removeUserReaction(s, r)
+		}
+		return
+	}
+
+	if added {
+		err = addAvailabilityVoteToDatabase(db, poll.roundID, r.UserID, number)
+	} else {
+		err = deleteAvailabilityVoteFromDatabase(db, poll.roundID, r.UserID, number)
+	}
+	if err != nil {
+		fmt.Println("Failed to update availability vote:", err.Error())
+	}
+}
+
+// getAvailabilityPollFromDatabase returns the poll of the round, with round ID 0 if there's none.
+func getAvailabilityPollFromDatabase(db *sql.DB, roundID int) (availabilityPoll, error) {
+	return queryAvailabilityPoll(db, "round_id = $1", roundID)
+}
+
+// getAvailabilityPollByMessageFromDatabase returns the poll posted in the message, with round ID 0 if there's none.
+func getAvailabilityPollByMessageFromDatabase(db *sql.DB, messageID string) (availabilityPoll, error) {
+	return queryAvailabilityPoll(db, "message_id = $1", messageID)
+}
+
+func queryAvailabilityPoll(db *sql.DB, condition string, arg interface{}) (availabilityPoll, error) {
+	var poll availabilityPoll
+	query := "SELECT round_id, channel_id, message_id FROM ws_availability_polls WHERE " + condition
+	err := db.QueryRow(query, arg).Scan(&poll.roundID, &poll.channelID, &poll.messageID)
+	if err == sql.ErrNoRows {
+		return poll, nil
+	}
+	if err != nil {
+		return poll, errors.Wrap(err, "failed to do query")
+	}
+
+	rows, err := db.Query("SELECT starts_at FROM ws_availability_windows WHERE round_id = $1 ORDER BY number", poll.roundID)
+	if err != nil {
+		return poll, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var start time.Time
+		err = rows.Scan(&start)
+		if err != nil {
+			return poll, errors.Wrap(err, "failed to scan row")
+		}
+		poll.windows = append(poll.windows, start)
+	}
+
+	return poll, nil
+}
+
+// setAvailabilityPollInDatabase replaces the poll of the round, clearing the votes.
+func setAvailabilityPollInDatabase(db *sql.DB, poll availabilityPoll) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		"DELETE FROM ws_availability_votes WHERE round_id = $1",
+		"DELETE FROM ws_availability_windows WHERE round_id = $1",
+	} {
+		_, err = tx.Exec(statement, poll.roundID)
+		if err != nil {
+			return errors.Wrap(err, "failed to clear poll")
+		}
+	}
+
+	statement := `INSERT INTO ws_availability_polls (round_id, channel_id, message_id) VALUES ($1, $2, $3)
+	ON CONFLICT (round_id) DO UPDATE SET channel_id = $2, message_id = $3`
+	_, err = tx.Exec(statement, poll.roundID, poll.channelID, poll.messageID)
+	if err != nil {
+		return errors.Wrap(err, "failed to set poll")
+	}
+	for i, start := range poll.windows {
+		statement = "INSERT INTO ws_availability_windows (round_id, number, starts_at) VALUES ($1, $2, $3)"
+		_, err = tx.Exec(statement, poll.roundID, i+1, start.UTC().Format(dbTimeFormat))
+		if err != nil {
+			return errors.Wrap(err, "failed to add window")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+// getAvailabilityVotesFromDatabase returns the numbers of the windows the members can make, mapped by user ID.
+// Windows both marked and reacted to are only returned once.
+func getAvailabilityVotesFromDatabase(db *sql.DB, roundID int) (map[string][]int, error) {
+	rows, err := db.Query("SELECT DISTINCT user_id, number FROM ws_availability_votes WHERE round_id = $1 ORDER BY number", roundID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	votes := make(map[string][]int)
+	for rows.Next() {
+		var userID string
+		var number int
+		err = rows.Scan(&userID, &number)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		votes[userID] = append(votes[userID], number)
+	}
+
+	return votes, nil
+}
+
+// setAvailabilityVotesInDatabase replaces the windows the member marked they can make, their reactions are kept.
+func setAvailabilityVotesInDatabase(db *sql.DB, roundID int, userID string, numbers []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM ws_availability_votes WHERE round_id = $1 AND user_id = $2 AND NOT by_reaction", roundID, userID)
+	if err != nil {
+		return errors.Wrap(err, "failed to clear votes")
+	}
+	for _, number := range numbers {
+		statement := `INSERT INTO ws_availability_votes (round_id, user_id, number) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`
+		_, err = tx.Exec(statement, roundID, userID, number)
+		if err != nil {
+			return errors.Wrap(err, "failed to add vote")
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "failed to commit transaction")
+}
+
+func addAvailabilityVoteToDatabase(db *sql.DB, roundID int, userID string, number int) error {
+	statement := `INSERT INTO ws_availability_votes (round_id, user_id, number, by_reaction) VALUES ($1, $2, $3, true)
+	ON CONFLICT DO NOTHING`
+	_, err := db.Exec(statement, roundID, userID, number)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func deleteAvailabilityVoteFromDatabase(db *sql.DB, roundID int, userID string, number int) error {
+	statement := "DELETE FROM ws_availability_votes WHERE round_id = $1 AND user_id = $2 AND number = $3 AND by_reaction"
+	_, err := db.Exec(statement, roundID, userID, number)
+	return errors.Wrap(err, "failed to execute query")
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseAvailabilityWindows(t *testing.T) {
+	now := time.Date(2018, 10, 1, 12, 30, 0, 0, time.UTC)
+	loc := time.FixedZone("UTC+2", 2*60*60)
+
+	testData := []struct {
+		args        []string
+		expected    []time.Time
+		expectError bool
+	}{
+		{
+			args: []string{"20:00", "2h", "15:00"},
+			expected: []time.Time{
+				time.Date(2018, 10, 1, 13, 0, 0, 0, time.UTC),
+				now.Add(2 * time.Hour),
+				time.Date(2018, 10, 1, 18, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			args:     []string{"2018-10-03", "09:00", "2018-10-03T09:00"},
+			expected: []time.Time{time.Date(2018, 10, 3, 7, 0, 0, 0, time.UTC)},
+		},
+		{args: []string{"tomorrow"}, expectError: true},
+		{args: []string{"2018-09-30T12:00"}, expectError: true},
+		{args: []string{"1h", "2h", "3h", "4h", "5h", "6h", "7h", "8h", "9h", "10h"}, expectError: true},
+	}
+
+	for _, data := range testData {
+		actual, err := parseAvailabilityWindows(data.args, now, loc)
+		if data.expectError {
+			if err == nil {
+				t.Errorf("expected an error for %q", data.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", data.args, err)
+			continue
+		}
+		if len(actual) != len(data.expected) {
+			t.Errorf("%q was parsed to %v, expected %v", data.args, actual, data.expected)
+			continue
+		}
+		for i := range actual {
+			if !actual[i].Equal(data.expected[i]) {
+				t.Errorf("%q was parsed to %v, expected %v", data.args, actual, data.expected)
+				break
+			}
+		}
+	}
+}
+
+func Test_rankWindows(t *testing.T) {
+	start := time.Date(2018, 10, 1, 18, 0, 0, 0, time.UTC)
+	windows := []time.Time{start, start.Add(3 * time.Hour), start.Add(6 * time.Hour)}
+	participants := []participant{
+		{userID: "1", name: "zed", participating: true},
+		{userID: "2", name: "amy", participating: true},
+		{userID: "3", name: "bob", participating: false},
+	}
+	votes := map[string][]int{
+		"1": {2, 3},
+		"2": {3, 2},
+		"3": {2},
+		"4": {1, 9},
+	}
+
+	expected := []windowRank{
+		{number: 2, start: windows[1], attending: []string{"amy", "zed"}, others: 1},
+		{number: 3, start: windows[2], attending: []string{"amy", "zed"}},
+		{number: 1, start: windows[0], others: 1},
+	}
+	actual := rankWindows(windows, votes, participants)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Windows were ranked %+v, expected %+v", actual, expected)
+	}
+}
+
+func Test_formatWindowInZones(t *testing.T) {
+	window := time.Date(2018, 10, 1, 18, 0, 0, 0, time.UTC)
+	zones := []*time.Location{
+		time.FixedZone("EDT", -4*60*60),
+		time.UTC,
+		time.FixedZone("CEST", 2*60*60),
+		time.FixedZone("CEST", 2*60*60),
+	}
+
+	expected := "Mon 18:00 UTC / Mon 14:00 EDT / Mon 20:00 CEST"
+	if actual := formatWindowInZones(window, zones); actual != expected {
+		t.Errorf("Window was formatted %q, expected %q", actual, expected)
+	}
+}
@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	wsHistoryPageSize = 10
+	wsStatsPageSize   = 20
+)
+
+// pastRound is an archived White Star round.
+type pastRound struct {
+	id         int
+	instance   instance
+	opened     time.Time
+	ended      time.Time
+	optedIn    int
+	optedOut   int
+	rosterSize int
+	rostered   int
+	opponent   string
+	outcome    matchOutcome
+	ourScore   int
+	theirScore int
+}
+
+// participationRecord is the answer of a member to the sign-up of an archived round.
+type participationRecord struct {
+	roundID       int
+	userID        string
+	name          string
+	participating bool
+	preferredRole wsRole
+	// rosterRole is empty if the member was not on the approved roster.
+	rosterRole wsRole
+}
+
+// memberStats summarises the participation records of a member.
+type memberStats struct {
+	userID string
+	// name the member had in the latest round.
+	name     string
+	rounds   int
+	optedIn  int
+	rostered int
+	// currentOptOutStreak is how many of the latest rounds in a row the member opted out of.
+	currentOptOutStreak int
+	longestOptOutStreak int
+	preferredRoles      map[wsRole]int
+	rosterRoles         map[wsRole]int
+}
+
+// attendance returns the share of the rounds the member opted in to.
+func (s memberStats) attendance() float64 {
+	if s.rounds == 0 {
+		return 0
+	}
+	return float64(s.optedIn) / float64(s.rounds)
+}
+
+// participationStats summarises the records of each member, the records have to be sorted with the oldest round first.
+// The stats are sorted by attendance, highest first.
+func participationStats(records []participationRecord) []memberStats {
+	byUser := make(map[string]*memberStats)
+	var order []string
+	for _, r := range records {
+		stats, exists := byUser[r.userID]
+		if !exists {
+			stats = &memberStats{
+				userID:         r.userID,
+				preferredRoles: make(map[wsRole]int),
+				rosterRoles:    make(map[wsRole]int),
+			}
+			byUser[r.userID] = stats
+			order = append(order, r.userID)
+		}
+
+		stats.name = r.name
+		stats.rounds++
+		if r.participating {
+			stats.optedIn++
+			stats.preferredRoles[r.preferredRole]++
+			stats.currentOptOutStreak = 0
+		} else {
+			stats.currentOptOutStreak++
+			if stats.currentOptOutStreak > stats.longestOptOutStreak {
+				stats.longestOptOutStreak = stats.currentOptOutStreak
+			}
+		}
+		if r.rosterRole != "" {
+			stats.rostered++
+			stats.rosterRoles[r.rosterRole]++
+		}
+	}
+
+	stats := make([]memberStats, len(order))
+	for i, userID := range order {
+		stats[i] = *byUser[userID]
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].attendance() != stats[j].attendance() {
+			return stats[i].attendance() > stats[j].attendance()
+		}
+		return strings.ToLower(stats[i].name) < strings.ToLower(stats[j].name)
+	})
+	return stats
+}
+
+// formatRoleCounts lists the roles with their counts, most common first.
+func formatRoleCounts(counts map[wsRole]int) string {
+	var roles []wsRole
+	for role := range counts {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		if counts[roles[i]] != counts[roles[j]] {
+			return counts[roles[i]] > counts[roles[j]]
+		}
+		return roles[i] < roles[j]
+	})
+
+	formatted := make([]string, len(roles))
+	for i, role := range roles {
+		formatted[i] = fmt.Sprintf("%v %d", role, counts[role])
+	}
+	if len(formatted) == 0 {
+		return "-"
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// WSHistoryCommand for listing the past White Stars.
+func WSHistoryCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "history",
+		Permission:      commands.Members,
+		HelpDescription: "List past WS rounds",
+		Handler:         HandleWSHistory,
+		Help: commands.Help{
+			Summary:             "List past WS rounds",
+			DetailedDescription: "List the past White Stars of the instance with their dates, participation, roster and outcome, newest first.",
+			Syntax:              "ws history [instance] [page]",
+			Example:             "ws history A 2",
+		},
+	}
+}
+
+// WSStatsCommand for the participation statistics of members.
+func WSStatsCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "stats",
+		Permission:      commands.Members,
+		HelpDescription: "Show WS participation statistics",
+		Handler:         HandleWSStats,
+		Help: commands.Help{
+			Summary: "Show WS participation statistics",
+			DetailedDescription: "Show how often members opted in to the past White Stars they answered, how many in a row they opted out of " +
+				"and which roles they preferred and played. Mention a member to show the details of only them.",
+			Syntax:  "ws stats [@member]",
+			Example: "ws stats @Maro",
+		},
+	}
+}
+
+// HandleWSHistory handles listing the past rounds.
+func HandleWSHistory(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	page := 1
+	if len(args) > 0 && isNumber(args[len(args)-1]) {
+		page, _ = strconv.Atoi(args[len(args)-1])
+		args = args[:len(args)-1]
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	instance, ok := instanceFromMessage(strings.Join(args, " "), s, m, db)
+	if !ok {
+		return
+	}
+
+	err := sendPagedMessage(s, m.ChannelID, db, page, wsHistoryPage(instance, userLocation(db, m.Author.ID)))
+	if err != nil {
+		fmt.Println("Failed to send WS history:", err.Error())
+		return
+	}
+}
+
+// wsHistoryPage renders pages of the past rounds of the instance with dates in loc.
+func wsHistoryPage(instance instance, loc *time.Location) renderPage {
+	return func(db *sql.DB, page int) (*discordgo.MessageEmbed, int, error) {
+		rounds, total, err := getPastRoundsFromDatabase(db, instance, wsHistoryPageSize, (page-1)*wsHistoryPageSize)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var content string
+		for _, r := range rounds {
+			content += fmt.Sprintf("**#%d** %v - %v: %d opted in, %d out",
+				r.id, r.opened.In(loc).Format(historyDateFormat), r.ended.In(loc).Format(historyDateFormat), r.optedIn, r.optedOut)
+			if r.rosterSize != 0 {
+				content += fmt.Sprintf(", roster %d/%d", r.rostered, r.rosterSize)
+			}
+			if result := formatMatchResult(r.opponent, r.outcome, r.ourScore, r.theirScore); result != "" {
+				content += ", " + result
+			}
+			content += "\n"
+		}
+		if content == "" {
+			content = fmt.Sprintf("No White Stars have ended in %v yet", instance)
+		}
+
+		pages := (total + wsHistoryPageSize - 1) / wsHistoryPageSize
+		msg := &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("Past White Stars in %v", instance),
+			Color:       infoColor,
+			Description: content,
+			Footer: &discordgo.MessageEmbedFooter{
+				Text: fmt.Sprintf("Page %d of %d (%d rounds)", page, pages, total),
+			},
+		}
+		return msg, pages, nil
+	}
+}
+
+// HandleWSStats handles showing the participation statistics.
+func HandleWSStats(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	if len(m.Mentions) > 0 {
+		sendMemberStats(m.Mentions[0], s, m, db)
+		return
+	}
+
+	err := sendPagedMessage(s, m.ChannelID, db, 1, wsStatsPage)
+	if err != nil {
+		fmt.Println("Failed to send WS stats:", err.Error())
+		return
+	}
+}
+
+func sendMemberStats(user *discordgo.User, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) {
+	records, err := getParticipationRecordsFromDatabase(db, user.ID)
+	if err != nil {
+		fmt.Println("Failed to get participation records:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("WS stats of %v", user.Username),
+		Color:       infoColor,
+		Description: fmt.Sprintf("%v hasn't answered the sign-up of any past White Star.", user.Username),
+	}
+	if stats := participationStats(records); len(stats) > 0 {
+		st := stats[0]
+		response.Description = fmt.Sprintf("**Attendance**: %.0f%% (%d of %d White Stars)\n"+
+			"**Opted out in a row**: %d now, %d at most\n"+
+			"**On the roster**: %d times\n"+
+			"**Preferred roles**: %v\n"+
+			"**Roster roles**: %v",
+			st.attendance()*100, st.optedIn, st.rounds,
+			st.currentOptOutStreak, st.longestOptOutStreak,
+			st.rostered,
+			formatRoleCounts(st.preferredRoles),
+			formatRoleCounts(st.rosterRoles))
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// wsStatsPage renders pages of the statistics of every member, highest attendance first.
+func wsStatsPage(db *sql.DB, page int) (*discordgo.MessageEmbed, int, error) {
+	records, err := getParticipationRecordsFromDatabase(db, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	stats := participationStats(records)
+
+	pages := (len(stats) + wsStatsPageSize - 1) / wsStatsPageSize
+	start := (page - 1) * wsStatsPageSize
+	end := start + wsStatsPageSize
+	if end > len(stats) {
+		end = len(stats)
+	}
+
+	var content string
+	for i := start; i < end; i++ {
+		st := stats[i]
+		content += fmt.Sprintf("%v: %.0f%% (%d/%d)", st.name, st.attendance()*100, st.optedIn, st.rounds)
+		if st.currentOptOutStreak > 1 {
+			content += fmt.Sprintf(", opted out %d in a row", st.currentOptOutStreak)
+		}
+		content += "\n"
+	}
+	if content == "" {
+		content = "No White Stars have been archived yet"
+	}
+
+	msg := &discordgo.MessageEmbed{
+		Title:       "WS attendance",
+		Color:       infoColor,
+		Description: content,
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("Page %d of %d (%d members)", page, pages, len(stats)),
+		},
+	}
+	return msg, pages, nil
+}
+
+// getPastRoundsFromDatabase returns a page of the ended rounds of the instance, newest first, and the total amount.
+func getPastRoundsFromDatabase(db *sql.DB, instance instance, limit int, offset int) ([]pastRound, int, error) {
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM ws_rounds WHERE instance = $1 AND ended_at IS NOT NULL", instance).Scan(&total)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to count rounds")
+	}
+
+	query := `SELECT r.id, r.opened_at, r.ended_at, COALESCE(r.roster_size, 0), COALESCE(r.opponent, ''), COALESCE(r.outcome, ''),
+	COALESCE(r.our_score, 0), COALESCE(r.their_score, 0),
+	COUNT(p.name) FILTER (WHERE p.participating),
+	COUNT(p.name) FILTER (WHERE NOT p.participating),
+	COUNT(p.roster_role)
+	FROM ws_rounds r LEFT JOIN ws_round_participants p ON p.round_id = r.id
+	WHERE r.instance = $1 AND r.ended_at IS NOT NULL
+	GROUP BY r.id ORDER BY r.ended_at DESC LIMIT $2 OFFSET $3`
+	rows, err := db.Query(query, instance, limit, offset)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var rounds []pastRound
+	for rows.Next() {
+		r := pastRound{instance: instance}
+		err = rows.Scan(&r.id, &r.opened, &r.ended, &r.rosterSize, &r.opponent, &r.outcome, &r.ourScore, &r.theirScore, &r.optedIn, &r.optedOut, &r.rostered)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to scan row")
+		}
+		rounds = append(rounds, r)
+	}
+
+	return rounds, total, nil
+}
+
+// getParticipationRecordsFromDatabase returns the records of the member, or of everyone if userID is empty,
+// with the oldest round first.
+func getParticipationRecordsFromDatabase(db *sql.DB, userID string) ([]participationRecord, error) {
+	query := `SELECT p.round_id, p.user_id, p.name, p.participating, p.preferred_role, COALESCE(p.roster_role, '')
+	FROM ws_round_participants p JOIN ws_rounds r ON r.id = p.round_id
+	WHERE $1 = '' OR p.user_id = $1
+	ORDER BY r.ended_at, r.id`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var records []participationRecord
+	for rows.Next() {
+		var r participationRecord
+		err = rows.Scan(&r.roundID, &r.userID, &r.name, &r.participating, &r.preferredRole, &r.rosterRole)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		records = append(records, r)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_participationStats(t *testing.T) {
+	records := []participationRecord{
+		{roundID: 1, userID: "1", name: "amy", participating: true, preferredRole: defense, rosterRole: defense},
+		{roundID: 1, userID: "2", name: "bob", participating: false},
+		{roundID: 2, userID: "1", name: "amy", participating: false},
+		{roundID: 2, userID: "2", name: "bob", participating: false},
+		{roundID: 3, userID: "1", name: "amy", participating: true, preferredRole: offense, rosterRole: hunter},
+		{roundID: 3, userID: "2", name: "bobby", participating: true, preferredRole: filler},
+		{roundID: 4, userID: "2", name: "bobby", participating: false},
+	}
+
+	expected := []memberStats{
+		{userID: "1", name: "amy", rounds: 3, optedIn: 2, rostered: 2, currentOptOutStreak: 0, longestOptOutStreak: 1,
+			preferredRoles: map[wsRole]int{defense: 1, offense: 1}, rosterRoles: map[wsRole]int{defense: 1, hunter: 1}},
+		{userID: "2", name: "bobby", rounds: 4, optedIn: 1, rostered: 0, currentOptOutStreak: 1, longestOptOutStreak: 2,
+			preferredRoles: map[wsRole]int{filler: 1}, rosterRoles: map[wsRole]int{}},
+	}
+
+	actual := participationStats(records)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("stats were %+v, expected %+v", actual, expected)
+	}
+}
@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// matchOutcome is how a White Star match went for us.
+type matchOutcome string
+
+const (
+	win  matchOutcome = "win"
+	loss matchOutcome = "loss"
+	draw matchOutcome = "draw"
+)
+
+// matchResult is the result of a White Star match of an instance.
+type matchResult struct {
+	instance   instance
+	opponent   string
+	outcome    matchOutcome
+	ourScore   int
+	theirScore int
+}
+
+// winLossRecord counts the outcomes of matches.
+type winLossRecord struct {
+	wins   int
+	losses int
+	draws  int
+	// marginTotal is the sum of our score minus theirs.
+	marginTotal int
+}
+
+func (r *winLossRecord) add(result matchResult) {
+	switch result.outcome {
+	case win:
+		r.wins++
+	case loss:
+		r.losses++
+	case draw:
+		r.draws++
+	}
+	r.marginTotal += result.ourScore - result.theirScore
+}
+
+func (r winLossRecord) played() int {
+	return r.wins + r.losses + r.draws
+}
+
+func (r winLossRecord) averageMargin() float64 {
+	if r.played() == 0 {
+		return 0
+	}
+	return float64(r.marginTotal) / float64(r.played())
+}
+
+func (r winLossRecord) String() string {
+	return fmt.Sprintf("%dW %dL %dD", r.wins, r.losses, r.draws)
+}
+
+// instanceRecord is the record of an instance.
+type instanceRecord struct {
+	instance instance
+	winLossRecord
+}
+
+// opponentRecord is the record against an opponent.
+type opponentRecord struct {
+	opponent string
+	winLossRecord
+}
+
+// summarizeResults returns the record of each instance, sorted by name, and the record against each opponent
+// faced more than once, most played first. Opponents are compared ignoring case and named as in the first result.
+func summarizeResults(results []matchResult) ([]instanceRecord, []opponentRecord) {
+	byInstance := make(map[instance]*instanceRecord)
+	byOpponent := make(map[string]*opponentRecord)
+	for _, result := range results {
+		ir, exists := byInstance[result.instance]
+		if !exists {
+			ir = &instanceRecord{instance: result.instance}
+			byInstance[result.instance] = ir
+		}
+		ir.add(result)
+
+		if result.opponent == "" {
+			continue
+		}
+		key := strings.ToLower(result.opponent)
+		or, exists := byOpponent[key]
+		if !exists {
+			or = &opponentRecord{opponent: result.opponent}
+			byOpponent[key] = or
+		}
+		or.add(result)
+	}
+
+	instances := make([]instanceRecord, 0, len(byInstance))
+	for _, ir := range byInstance {
+		instances = append(instances, *ir)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].instance < instances[j].instance })
+
+	var opponents []opponentRecord
+	for _, or := range byOpponent {
+		if or.played() > 1 {
+			opponents = append(opponents, *or)
+		}
+	}
+	sort.Slice(opponents, func(i, j int) bool {
+		if opponents[i].played() != opponents[j].played() {
+			return opponents[i].played() > opponents[j].played()
+		}
+		return strings.ToLower(opponents[i].opponent) < strings.ToLower(opponents[j].opponent)
+	})
+
+	return instances, opponents
+}
+
+// parseMatchResult parses an outcome and a score such as "120-80", checking that they agree.
+func parseMatchResult(outcome string, score string) (matchResult, error) {
+	result := matchResult{outcome: matchOutcome(strings.ToLower(outcome))}
+	if result.outcome != win && result.outcome != loss && result.outcome != draw {
+		return result, errors.Errorf("unknown outcome %q, it has to be win, loss or draw", outcome)
+	}
+
+	scores := strings.Split(score, "-")
+	if len(scores) != 2 {
+		return result, errors.Errorf("incorrect score %q, it has to be our score and theirs like 120-80", score)
+	}
+	var err error
+	result.ourScore, err = strconv.Atoi(scores[0])
+	if err != nil || result.ourScore < 0 {
+		return result, errors.Errorf("incorrect score %q, it has to be our score and theirs like 120-80", score)
+	}
+	result.theirScore, err = strconv.Atoi(scores[1])
+	if err != nil || result.theirScore < 0 {
+		return result, errors.Errorf("incorrect score %q, it has to be our score and theirs like 120-80", score)
+	}
+
+	var agrees bool
+	switch result.outcome {
+	case win:
+		agrees = result.ourScore > result.theirScore
+	case loss:
+		agrees = result.ourScore < result.theirScore
+	case draw:
+		agrees = result.ourScore == result.theirScore
+	}
+	if !agrees {
+		return result, errors.Errorf("a score of %v isn't a %v", score, result.outcome)
+	}
+	return result, nil
+}
+
+// formatMatchResult such as "win 120-80 vs Corp", leaving out what's not known.
+func formatMatchResult(opponent string, outcome matchOutcome, ourScore int, theirScore int) string {
+	var parts []string
+	if outcome != "" {
+		parts = append(parts, fmt.Sprintf("%v %d-%d", outcome, ourScore, theirScore))
+	}
+	if opponent != "" {
+		parts = append(parts, "vs "+opponent)
+	}
+	return strings.Join(parts, " ")
+}
+
+// WSOpponentCommand for recording who the White Star match is against.
+func WSOpponentCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "opponent",
+		Permission:      commands.Officers,
+		HelpDescription: "Set the opponent of the WS match",
+		Handler:         HandleWSOpponent,
+		Help: commands.Help{
+			Summary: "Set the opponent of the WS match",
+			DetailedDescription: "Record the corp the White Star match is against, once a match has been found. " +
+				"The instance of the channel is used unless the corp name is preceded by the full name of an instance, " +
+				"or by a code only one instance has.",
+			Syntax:  "ws opponent [instance] <corp name>",
+			Example: "ws opponent B The Empire",
+		},
+	}
+}
+
+// WSResultCommand for recording how the White Star match went.
+func WSResultCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "result",
+		Permission:      commands.Officers,
+		HelpDescription: "Set the result of the WS match",
+		Handler:         HandleWSResult,
+		Help: commands.Help{
+			Summary: "Set the result of the WS match",
+			DetailedDescription: "Record the outcome and the score of the White Star match, our score first. " +
+				"It can be set while the match is running and after it has ended, until the next sign-up opens.",
+			Syntax:  "ws result [instance] <win|loss|draw> <our score>-<their score>",
+			Example: "ws result B win 120-85",
+		},
+	}
+}
+
+// WSRecordCommand for showing the results of past White Stars.
+func WSRecordCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "record",
+		Permission:      commands.Members,
+		HelpDescription: "Show the WS win/loss record",
+		Handler:         HandleWSRecord,
+		Help: commands.Help{
+			Summary: "Show the WS win/loss record",
+			DetailedDescription: "Show the wins, losses and draws with the average score margin of every instance, " +
+				"and the record against the corps we have fought more than once.",
+			Syntax:  "ws record",
+			Example: "ws record",
+		},
+	}
+}
+
+// HandleWSOpponent handles setting the opponent of the current round.
+func HandleWSOpponent(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	if len(args) == 0 {
+		sendFailMessage("Missing corp name, check `!help ws opponent`.", s, m)
+		return
+	}
+
+	instances, err := getInstancesFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get instances:", err.Error())
+	}
+	instanceArg, args := leadingInstanceArg(instances, args, 1)
+	instance, ok := instanceFromMessage(instanceArg, s, m, db)
+	if !ok {
+		return
+	}
+
+	round, ok := resultRound(instance, s, m, db)
+	if !ok {
+		return
+	}
+	opponent := strings.Join(args, " ")
+	err = setOpponentInDatabase(db, round.id, opponent)
+	if err != nil {
+		fmt.Println("Failed to set opponent:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: fmt.Sprintf("The White Star in %v is against **%v**.", instance, opponent),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleWSResult handles setting the result of the current round.
+func HandleWSResult(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	args := strings.Fields(msg)
+	if len(args) < 2 {
+		sendFailMessage("Incorrect syntax, check `!help ws result`.", s, m)
+		return
+	}
+
+	// The outcome and score are the last words, anything before them is the instance
+	result, err := parseMatchResult(args[len(args)-2], args[len(args)-1])
+	if err != nil {
+		sendFailMessage(strings.ToUpper(err.Error()[:1])+err.Error()[1:]+".", s, m)
+		return
+	}
+	instance, ok := instanceFromMessage(strings.Join(args[:len(args)-2], " "), s, m, db)
+	if !ok {
+		return
+	}
+
+	round, ok := resultRound(instance, s, m, db)
+	if !ok {
+		return
+	}
+	err = setResultInDatabase(db, round.id, result)
+	if err != nil {
+		fmt.Println("Failed to set result:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Color:       successColor,
+		Description: fmt.Sprintf("Recorded a %v for %v, %d-%d.", result.outcome, instance, result.ourScore, result.theirScore),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// resultRound returns the current round of the instance if a match has been found in it.
+// Otherwise a message is sent about it and false is returned.
+func resultRound(instance instance, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB) (wsRound, bool) {
+	round, err := getCurrentRoundFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get WS round:", err.Error())
+		return round, false
+	}
+	if round.id == 0 || (round.phase != matched && round.phase != inProgress && round.phase != ended) {
+		sendFailMessage(fmt.Sprintf("The White Star in %v is *%v*, a match has to be found first.", instance, round.phase), s, m)
+		return round, false
+	}
+	return round, true
+}
+
+// HandleWSRecord handles showing the win/loss record.
+func HandleWSRecord(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	results, err := getMatchResultsFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get match results:", err.Error())
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       "WS record",
+		Color:       infoColor,
+		Description: "No White Star results have been recorded yet, officers add them with `!ws result`.",
+	}
+	instances, opponents := summarizeResults(results)
+	if len(instances) > 0 {
+		response.Description = ""
+		for _, r := range instances {
+			response.Description += fmt.Sprintf("**%v**: %v, average margin %+.0f\n", r.instance, r.winLossRecord, r.averageMargin())
+		}
+	}
+	if len(opponents) > 0 {
+		var content string
+		for _, r := range opponents {
+			content += fmt.Sprintf("%v: %v, average margin %+.0f\n", r.opponent, r.winLossRecord, r.averageMargin())
+		}
+		response.Fields = []*discordgo.MessageEmbedField{{Name: "Head-to-head", Value: content}}
+	}
+
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// getOpponentFromDatabase returns the opponent of the round, empty if it has not been set.
+func getOpponentFromDatabase(db *sql.DB, roundID int) (string, error) {
+	var opponent string
+	err := db.QueryRow("SELECT COALESCE(opponent, '') FROM ws_rounds WHERE id = $1", roundID).Scan(&opponent)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return opponent, errors.Wrap(err, "failed to do query")
+}
+
+func setOpponentInDatabase(db *sql.DB, roundID int, opponent string) error {
+	_, err := db.Exec("UPDATE ws_rounds SET opponent = $2 WHERE id = $1", roundID, opponent)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+func setResultInDatabase(db *sql.DB, roundID int, result matchResult) error {
+	statement := "UPDATE ws_rounds SET outcome = $2, our_score = $3, their_score = $4 WHERE id = $1"
+	_, err := db.Exec(statement, roundID, result.outcome, result.ourScore, result.theirScore)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// getMatchResultsFromDatabase returns the results of every round with one, oldest first.
+func getMatchResultsFromDatabase(db *sql.DB) ([]matchResult, error) {
+	query := `SELECT instance, COALESCE(opponent, ''), outcome, our_score, their_score FROM ws_rounds
+	WHERE outcome IS NOT NULL AND our_score IS NOT NULL
+	ORDER BY id`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var results []matchResult
+	for rows.Next() {
+		var r matchResult
+		err = rows.Scan(&r.instance, &r.opponent, &r.outcome, &r.ourScore, &r.theirScore)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseMatchResult(t *testing.T) {
+	testData := []struct {
+		outcome     string
+		score       string
+		expected    matchResult
+		expectError bool
+	}{
+		{outcome: "win", score: "120-80", expected: matchResult{outcome: win, ourScore: 120, theirScore: 80}},
+		{outcome: "Loss", score: "40-95", expected: matchResult{outcome: loss, ourScore: 40, theirScore: 95}},
+		{outcome: "draw", score: "50-50", expected: matchResult{outcome: draw, ourScore: 50, theirScore: 50}},
+		{outcome: "win", score: "80-120", expectError: true},
+		{outcome: "draw", score: "51-50", expectError: true},
+		{outcome: "tie", score: "50-50", expectError: true},
+		{outcome: "win", score: "120", expectError: true},
+		{outcome: "win", score: "120--5", expectError: true},
+		{outcome: "win", score: "a-b", expectError: true},
+	}
+
+	for _, data := range testData {
+		actual, err := parseMatchResult(data.outcome, data.score)
+		if data.expectError {
+			if err == nil {
+				t.Errorf("expected an error for %v %v", data.outcome, data.score)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v %v: %v", data.outcome, data.score, err)
+			continue
+		}
+		if actual != data.expected {
+			t.Errorf("result of %v %v was %+v, expected %+v", data.outcome, data.score, actual, data.expected)
+		}
+	}
+}
+
+func Test_summarizeResults(t *testing.T) {
+	results := []matchResult{
+		{instance: "B", opponent: "Empire", outcome: win, ourScore: 120, theirScore: 80},
+		{instance: "A", opponent: "Rebels", outcome: loss, ourScore: 30, theirScore: 90},
+		{instance: "A", opponent: "empire", outcome: draw, ourScore: 60, theirScore: 60},
+		{instance: "A", outcome: win, ourScore: 100, theirScore: 70},
+		{instance: "B", opponent: "Empire", outcome: loss, ourScore: 50, theirScore: 60},
+	}
+
+	expectedInstances := []instanceRecord{
+		{instance: "A", winLossRecord: winLossRecord{wins: 1, losses: 1, draws: 1, marginTotal: -30}},
+		{instance: "B", winLossRecord: winLossRecord{wins: 1, losses: 1, marginTotal: 30}},
+	}
+	expectedOpponents := []opponentRecord{
+		{opponent: "Empire", winLossRecord: winLossRecord{wins: 1, losses: 1, draws: 1, marginTotal: 30}},
+	}
+
+	instances, opponents := summarizeResults(results)
+	if !reflect.DeepEqual(instances, expectedInstances) {
+		t.Errorf("instance records were %+v, expected %+v", instances, expectedInstances)
+	}
+	if !reflect.DeepEqual(opponents, expectedOpponents) {
+		t.Errorf("opponent records were %+v, expected %+v", opponents, expectedOpponents)
+	}
+	if margin := instances[0].averageMargin(); margin != -10 {
+		t.Errorf("average margin of A was %v, expected -10", margin)
+	}
+}
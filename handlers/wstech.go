@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/MattiasBerlin/outbot/commands"
+	"github.com/bwmarrin/discordgo"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// requirementMetEmoji marks the requirements the team fulfills, the others are marked with optOutEmoji.
+const requirementMetEmoji = "\u2705"
+
+// techRequirement is a module officers want a number of the team to have at least at a level.
+type techRequirement struct {
+	module   string
+	minLevel int
+	count    int
+}
+
+func (r techRequirement) String() string {
+	return fmt.Sprintf("%v %d+", r.module, r.minLevel)
+}
+
+// moduleHolder is a member of the team with a module.
+type moduleHolder struct {
+	name  string
+	level int
+}
+
+// moduleTally is how many of the team have a module, by level.
+type moduleTally struct {
+	module  string
+	byLevel map[int]int
+	// holders with the highest level first.
+	holders []moduleHolder
+}
+
+// requirementStatus is a requirement with the members of the team fulfilling it.
+type requirementStatus struct {
+	techRequirement
+	holders []moduleHolder
+}
+
+func (r requirementStatus) met() bool {
+	return len(r.holders) >= r.count
+}
+
+// teamTech is what the team brings to a White Star.
+type teamTech struct {
+	// modules anyone in the team has, in the order of the module list.
+	modules      []moduleTally
+	requirements []requirementStatus
+	// unrecorded are the names of the members who haven't recorded any modules.
+	unrecorded []string
+}
+
+// summarizeTeamTech tallies the module levels, mapped by user ID and module, of the team, mapped by user ID.
+// The requirements are listed in the order of the module list.
+func summarizeTeamTech(team map[string]string, levels map[string]map[string]int, requirements []techRequirement) teamTech {
+	var summary teamTech
+	holders := make(map[string][]moduleHolder)
+	for userID, name := range team {
+		if len(levels[userID]) == 0 {
+			summary.unrecorded = append(summary.unrecorded, name)
+			continue
+		}
+		for module, level := range levels[userID] {
+			holders[module] = append(holders[module], moduleHolder{name: name, level: level})
+		}
+	}
+	sort.Slice(summary.unrecorded, func(i, j int) bool {
+		return strings.ToLower(summary.unrecorded[i]) < strings.ToLower(summary.unrecorded[j])
+	})
+
+	positions := make(map[string]int)
+	for i, def := range moduleDefs {
+		positions[def.name] = i
+		h := holders[def.name]
+		if len(h) == 0 {
+			continue
+		}
+		sort.Slice(h, func(i, j int) bool {
+			if h[i].level != h[j].level {
+				return h[i].level > h[j].level
+			}
+			return strings.ToLower(h[i].name) < strings.ToLower(h[j].name)
+		})
+		t := moduleTally{module: def.name, byLevel: make(map[int]int), holders: h}
+		for _, holder := range h {
+			t.byLevel[holder.level]++
+		}
+		summary.modules = append(summary.modules, t)
+	}
+
+	for _, r := range requirements {
+		status := requirementStatus{techRequirement: r}
+		for _, h := range holders[r.module] {
+			if h.level >= r.minLevel {
+				status.holders = append(status.holders, h)
+			}
+		}
+		summary.requirements = append(summary.requirements, status)
+	}
+	sort.SliceStable(summary.requirements, func(i, j int) bool {
+		return positions[summary.requirements[i].module] < positions[summary.requirements[j].module]
+	})
+
+	return summary
+}
+
+// parseTechRequirement parses a module followed by the minimum level and optionally how many need it, e.g. "Barrier 5 2".
+func parseTechRequirement(args []string) (techRequirement, error) {
+	r := techRequirement{count: 1}
+	if len(args) < 2 {
+		return r, errors.New("missing module or level")
+	}
+
+	numbers := []int{}
+	for len(args) > 1 && len(numbers) < 2 {
+		n, err := strconv.Atoi(args[len(args)-1])
+		if err != nil {
+			break
+		}
+		numbers = append([]int{n}, numbers...)
+		args = args[:len(args)-1]
+	}
+	if len(numbers) == 0 {
+		return r, errors.New("missing level")
+	}
+
+	def, ok := findModule(strings.Join(args, " "))
+	if !ok {
+		return r, errors.Errorf("unknown module %q", strings.Join(args, " "))
+	}
+	r.module = def.name
+
+	r.minLevel = numbers[0]
+	if r.minLevel < 1 || r.minLevel > maxModuleLevel {
+		return r, errors.Errorf("the level has to be between 1 and %d", maxModuleLevel)
+	}
+	if len(numbers) > 1 {
+		r.count = numbers[1]
+		if r.count < 1 {
+			return r, errors.New("at least one member has to have it")
+		}
+	}
+	return r, nil
+}
+
+// WSTechCommand for showing the modules of the WS team.
+func WSTechCommand() commands.Command {
+	return commands.Command{
+		CallPhrase:      "tech",
+		Permission:      commands.Members,
+		HelpDescription: "Show the modules of the WS team",
+		Handler:         HandleWSTech,
+		SubCommands: []commands.Command{
+			{
+				CallPhrase:      "require",
+				Permission:      commands.Officers,
+				HelpDescription: "Set a module the WS team must have",
+				Handler:         HandleWSTechRequire,
+				Help: commands.Help{
+					Summary: "Set a module the WS team must have",
+					DetailedDescription: "Set a module the White Star team must have at a minimum level, optionally how many of the team need it. " +
+						"`ws tech` shows whether the team has enough of them.",
+					Syntax:  "ws tech require <module> <level> [members]",
+					Example: "ws tech require Barrier 5 2",
+				},
+			},
+			{
+				CallPhrase:      "unrequire",
+				Permission:      commands.Officers,
+				HelpDescription: "Remove a module the WS team must have",
+				Handler:         HandleWSTechUnrequire,
+				Help: commands.Help{
+					Summary:             "Remove a module the WS team must have",
+					DetailedDescription: "Remove a module from the ones the White Star team must have.",
+					Syntax:              "ws tech unrequire <module>",
+					Example:             "ws tech unrequire Barrier",
+				},
+			},
+		},
+		Help: commands.Help{
+			Summary: "Show the modules of the WS team",
+			DetailedDescription: "Show how many of the White Star team have each module by level, counting the approved roster or everyone opted in if there's none. " +
+				"The modules officers set with `ws tech require` are listed with who has them and whether the team has enough. " +
+				"Members record their modules with `mods set`.",
+			Syntax:  "ws tech [instance]",
+			Example: "ws tech B",
+		},
+	}
+}
+
+// HandleWSTech handles showing the modules of the team.
+func HandleWSTech(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	instance, ok := instanceFromMessage(msg, s, m, db)
+	if !ok {
+		return
+	}
+
+	team, fromRoster, err := getTeamFromDatabase(db, instance)
+	if err != nil {
+		fmt.Println("Failed to get team:", err.Error())
+		return
+	}
+	if len(team) == 0 {
+		sendFailMessage(fmt.Sprintf("Nobody has opted in to the White Star in %v.", instance), s, m)
+		return
+	}
+	levels, err := getAllModuleLevelsFromDatabase(db)
+	if err != nil {
+		fmt.Println("Failed to get module levels:", err.Error())
+		return
+	}
+	requirements, err := getTechRequirementsFromDatabase(db, guildID)
+	if err != nil {
+		fmt.Println("Failed to get tech requirements:", err.Error())
+		return
+	}
+	summary := summarizeTeamTech(team, levels, requirements)
+
+	description := fmt.Sprintf("%d opted in", len(team))
+	if fromRoster {
+		description = fmt.Sprintf("%d on the approved roster", len(team))
+	}
+	if len(summary.unrecorded) > 0 {
+		description += fmt.Sprintf("\nNo modules recorded: %v", strings.Join(summary.unrecorded, ", "))
+	}
+
+	content := "None, officers set them with `!ws tech require`."
+	if len(summary.requirements) > 0 {
+		content = ""
+		for _, r := range summary.requirements {
+			content += formatRequirementStatus(r) + "\n"
+		}
+	}
+	fields := []*discordgo.MessageEmbedField{{Name: "Must have", Value: content}}
+
+	for _, category := range moduleCategories {
+		content = ""
+		for _, t := range summary.modules {
+			def, _ := findModule(t.module)
+			if def.category == category {
+				content += formatModuleTally(t) + "\n"
+			}
+		}
+		if content != "" {
+			fields = append(fields, &discordgo.MessageEmbedField{Name: string(category), Value: content, Inline: true})
+		}
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Team tech of %v", instance),
+		Color:       infoColor,
+		Description: description,
+		Fields:      fields,
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// formatRequirementStatus formats the requirement with whether it's met and who has the module, e.g. "✅ Barrier 5+: 2/2 (amy 7, bob 5)".
+func formatRequirementStatus(r requirementStatus) string {
+	emoji := optOutEmoji
+	if r.met() {
+		emoji = requirementMetEmoji
+	}
+	line := fmt.Sprintf("%v %v: %d/%d", emoji, r, len(r.holders), r.count)
+	if len(r.holders) > 0 {
+		var names []string
+		for _, h := range r.holders {
+			names = append(names, fmt.Sprintf("%v %d", h.name, h.level))
+		}
+		line += fmt.Sprintf(" (%v)", strings.Join(names, ", "))
+	}
+	return line
+}
+
+// formatModuleTally formats how many have the module by level, highest first, e.g. "Barrier: 3 (7×1, 5×2)".
+func formatModuleTally(t moduleTally) string {
+	var levels []int
+	for level := range t.byLevel {
+		levels = append(levels, level)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(levels)))
+
+	var counts []string
+	for _, level := range levels {
+		counts = append(counts, fmt.Sprintf("%d×%d", level, t.byLevel[level]))
+	}
+	return fmt.Sprintf("%v: %d (%v)", t.module, len(t.holders), strings.Join(counts, ", "))
+}
+
+// HandleWSTechRequire handles setting a module the team must have.
+func HandleWSTechRequire(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	r, err := parseTechRequirement(strings.Fields(msg))
+	if err != nil {
+		sendFailMessage(fmt.Sprintf("Incorrect syntax, %v. Check `!help ws tech require`.", err.Error()), s, m)
+		return
+	}
+
+	err = setTechRequirementInDatabase(db, guildID, r)
+	if err != nil {
+		fmt.Println("Failed to set tech requirement:", err.Error())
+		return
+	}
+
+	members := "member"
+	if r.count != 1 {
+		members = "members"
+	}
+	response := discordgo.MessageEmbed{
+		Title:       "Module required!",
+		Color:       successColor,
+		Description: fmt.Sprintf("The White Star team must have %d %v with %v.", r.count, members, r),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+// HandleWSTechUnrequire handles removing a module the team must have.
+func HandleWSTechUnrequire(msg string, s *discordgo.Session, m *discordgo.MessageCreate, db *sql.DB, guildID string, cmds []commands.Command) {
+	def, ok := findModule(msg)
+	if !ok {
+		sendFailMessage(fmt.Sprintf("Unknown module %q, see the modules with `!mods list`.", msg), s, m)
+		return
+	}
+
+	removed, err := deleteTechRequirementFromDatabase(db, guildID, def.name)
+	if err != nil {
+		fmt.Println("Failed to delete tech requirement:", err.Error())
+		return
+	}
+	if !removed {
+		sendFailMessage(fmt.Sprintf("%v isn't required.", def.name), s, m)
+		return
+	}
+
+	response := discordgo.MessageEmbed{
+		Title:       "Module no longer required!",
+		Color:       successColor,
+		Description: fmt.Sprintf("The White Star team no longer needs %v.", def.name),
+	}
+	_, err = s.ChannelMessageSendEmbed(m.ChannelID, &response)
+	if err != nil {
+		fmt.Println("Failed to send message:", err.Error())
+		return
+	}
+}
+
+func getTechRequirementsFromDatabase(db *sql.DB, guildID string) ([]techRequirement, error) {
+	rows, err := db.Query("SELECT module, min_level, count FROM ws_tech_requirements WHERE guild_id = $1", guildID)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to do query")
+	}
+	defer rows.Close()
+
+	var requirements []techRequirement
+	for rows.Next() {
+		var r techRequirement
+		err = rows.Scan(&r.module, &r.minLevel, &r.count)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		requirements = append(requirements, r)
+	}
+
+	return requirements, nil
+}
+
+func setTechRequirementInDatabase(db *sql.DB, guildID string, r techRequirement) error {
+	statement := `INSERT INTO ws_tech_requirements (guild_id, module, min_level, count) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (guild_id, module) DO UPDATE SET min_level = $3, count = $4`
+	_, err := db.Exec(statement, guildID, r.module, r.minLevel, r.count)
+	return errors.Wrap(err, "failed to execute query")
+}
+
+// deleteTechRequirementFromDatabase deletes the requirement of the module, returning whether there was one.
+func deleteTechRequirementFromDatabase(db *sql.DB, guildID string, module string) (bool, error) {
+	res, err := db.Exec("DELETE FROM ws_tech_requirements WHERE guild_id = $1 AND module = $2", guildID, module)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to execute query")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get affected rows")
+	}
+	return n > 0, nil
+}
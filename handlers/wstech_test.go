@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_summarizeTeamTech(t *testing.T) {
+	team := map[string]string{"1": "amy", "2": "Bob", "3": "carl", "4": "dave"}
+	levels := map[string]map[string]int{
+		"1": {"Barrier": 5, "Teleport": 2},
+		"2": {"Barrier": 7},
+		"3": {"Barrier": 3, "Battery": 4},
+		// Not on the team
+		"5": {"Teleport": 9},
+	}
+	requirements := []techRequirement{
+		{module: "Teleport", minLevel: 3, count: 1},
+		{module: "Barrier", minLevel: 5, count: 2},
+	}
+
+	summary := summarizeTeamTech(team, levels, requirements)
+
+	expectedModules := []moduleTally{
+		{module: "Battery", byLevel: map[int]int{4: 1}, holders: []moduleHolder{{"carl", 4}}},
+		{module: "Teleport", byLevel: map[int]int{2: 1}, holders: []moduleHolder{{"amy", 2}}},
+		{module: "Barrier", byLevel: map[int]int{7: 1, 5: 1, 3: 1}, holders: []moduleHolder{{"Bob", 7}, {"amy", 5}, {"carl", 3}}},
+	}
+	if !reflect.DeepEqual(summary.modules, expectedModules) {
+		t.Errorf("Modules were %+v, expected %+v", summary.modules, expectedModules)
+	}
+
+	expectedRequirements := []requirementStatus{
+		{techRequirement: requirements[0]},
+		{techRequirement: requirements[1], holders: []moduleHolder{{"Bob", 7}, {"amy", 5}}},
+	}
+	if !reflect.DeepEqual(summary.requirements, expectedRequirements) {
+		t.Errorf("Requirements were %+v, expected %+v", summary.requirements, expectedRequirements)
+	}
+	if summary.requirements[0].met() || !summary.requirements[1].met() {
+		t.Error("Only the Barrier requirement should be met")
+	}
+
+	if !reflect.DeepEqual(summary.unrecorded, []string{"dave"}) {
+		t.Errorf("Members without modules were %q, expected only dave", summary.unrecorded)
+	}
+}
+
+func Test_parseTechRequirement(t *testing.T) {
+	testData := []struct {
+		args        []string
+		expected    techRequirement
+		expectError bool
+	}{
+		{args: []string{"Barrier", "5"}, expected: techRequirement{module: "Barrier", minLevel: 5, count: 1}},
+		{args: []string{"tp", "3", "2"}, expected: techRequirement{module: "Teleport", minLevel: 3, count: 2}},
+		{args: []string{"Red", "Star", "Life", "Extender", "2"}, expected: techRequirement{module: "Red Star Life Extender", minLevel: 2, count: 1}},
+		{args: []string{"Barrier"}, expectError: true},
+		{args: []string{"5"}, expectError: true},
+		{args: []string{"Barrier", "13"}, expectError: true},
+		{args: []string{"Barrier", "5", "0"}, expectError: true},
+		{args: []string{"Warp", "drive", "5"}, expectError: true},
+	}
+
+	for _, data := range testData {
+		actual, err := parseTechRequirement(data.args)
+		if data.expectError {
+			if err == nil {
+				t.Errorf("expected an error for %q", data.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", data.args, err)
+			continue
+		}
+		if actual != data.expected {
+			t.Errorf("%q was parsed to %+v, expected %+v", data.args, actual, data.expected)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"flag"
 	"fmt"
 	"github.com/MattiasBerlin/outbot/database"
+	"github.com/MattiasBerlin/outbot/handlers"
 	"github.com/bwmarrin/discordgo"
 	"github.com/lestrrat-go/file-rotatelogs"
 	"github.com/pkg/errors"
 	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -51,7 +53,38 @@ func main() {
 
 	router := NewRouter(prefix, guildID, session, db)
 
+	// The calendar feed is only served if an address to listen on is given
+	if feedAddr := os.Getenv("OB_FEED_ADDR"); feedAddr != "" {
+		handlers.CalendarFeedURL = os.Getenv("OB_FEED_URL")
+		go func() {
+			err := http.ListenAndServe(feedAddr, handlers.NewCalendarFeed(db))
+			fmt.Println("Calendar feed stopped:", err)
+		}()
+	}
+
+	// The spreadsheet export is only enabled if a spreadsheet is given
+	if spreadsheetID := os.Getenv("OB_SHEETS_ID"); spreadsheetID != "" {
+		err = handlers.EnableSheets(handlers.SheetsConfig{
+			APIURL:            os.Getenv("OB_SHEETS_API_URL"),
+			SpreadsheetID:     spreadsheetID,
+			CredentialsFile:   os.Getenv("OB_SHEETS_CREDENTIALS"),
+			TokenFile:         os.Getenv("OB_SHEETS_TOKEN"),
+			AuthAddr:          os.Getenv("OB_SHEETS_AUTH_ADDR"),
+			AuthCode:          os.Getenv("OB_SHEETS_AUTH_CODE"),
+			ParticipantsRange: os.Getenv("OB_SHEETS_PARTICIPANTS_RANGE"),
+			ModulesRange:      os.Getenv("OB_SHEETS_MODULES_RANGE"),
+		}, guildID)
+		if err != nil {
+			fmt.Println("Failed to set up spreadsheet export:", err)
+		}
+	}
+
 	session.AddHandler(router.OnMessageSent)
+	session.AddHandler(router.OnReactionAdded)
+	session.AddHandler(router.OnReactionRemoved)
+	session.AddHandler(router.OnMemberAdded)
+	session.AddHandler(router.OnMemberUpdated)
+	session.AddHandler(router.OnMemberRemoved)
 
 	err = session.Open()
 	if err != nil {
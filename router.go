@@ -12,33 +12,40 @@ import (
 
 // Router for commands.
 type Router struct {
-	commands map[string]*commands.Command
-	prefix   string
-	guildID  string
-	db       *sql.DB
+	commands         map[string]*commands.Command
+	reactionHandlers []commands.ReactionHandler
+	prefix           string
+	guildID          string
+	db               *sql.DB
 }
 
 // NewRouter adds and initializes the commands.
 func NewRouter(prefix string, guildID string, s *discordgo.Session, db *sql.DB) *Router {
 	r := &Router{
-		commands: make(map[string]*commands.Command),
-		prefix:   prefix,
-		guildID:  guildID,
-		db:       db,
+		commands:         make(map[string]*commands.Command),
+		reactionHandlers: getReactionHandlers(),
+		prefix:           prefix,
+		guildID:          guildID,
+		db:               db,
 	}
 
 	cmds := getCommands()
 
-	// Init commands
+	initCommands(cmds, s, db, guildID)
+
+	r.AddCommands(cmds)
+	return r
+}
+
+// initCommands calls the Init of the commands and their subcommands.
+func initCommands(cmds []commands.Command, s *discordgo.Session, db *sql.DB, guildID string) {
 	for _, cmd := range cmds {
 		if cmd.Init != nil {
 			fmt.Println("Initializing handler:", cmd.CallPhrase)
-			cmd.Init(s, db)
+			cmd.Init(s, db, guildID)
 		}
+		initCommands(cmd.SubCommands, s, db, guildID)
 	}
-
-	r.AddCommands(cmds)
-	return r
 }
 
 // AddCommand to the router.
@@ -101,6 +108,10 @@ func (r *Router) getCommand(msg string) (*commands.Command, string) {
 }
 
 func (r *Router) getSubCommand(cmd *commands.Command, trail []string) *commands.Command {
+	if len(trail) == 0 {
+		return nil
+	}
+
 	for _, sub := range cmd.SubCommands {
 		if sub.CallPhrase == trail[0] {
 			return &sub
@@ -171,6 +182,55 @@ func (r *Router) OnMessageSent(s *discordgo.Session, m *discordgo.MessageCreate)
 	}
 }
 
+// OnReactionAdded gets called when a reaction is added to a message and passes it on to the reaction handlers.
+func (r *Router) OnReactionAdded(s *discordgo.Session, reaction *discordgo.MessageReactionAdd) {
+	r.handleReaction(s, reaction.MessageReaction, true)
+}
+
+// OnReactionRemoved gets called when a reaction is removed from a message and passes it on to the reaction handlers.
+func (r *Router) OnReactionRemoved(s *discordgo.Session, reaction *discordgo.MessageReactionRemove) {
+	r.handleReaction(s, reaction.MessageReaction, false)
+}
+
+func (r *Router) handleReaction(s *discordgo.Session, reaction *discordgo.MessageReaction, added bool) {
+	if s.State.User != nil && reaction.UserID == s.State.User.ID {
+		return
+	}
+
+	for _, handler := range r.reactionHandlers {
+		handler(s, reaction, added, r.db, r.guildID)
+	}
+}
+
+// OnMemberAdded gets called when a member joins a guild and records it.
+func (r *Router) OnMemberAdded(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	if m.GuildID == r.guildID {
+		handlers.HandleMemberAdd(s, m, r.db, r.guildID)
+	}
+}
+
+// OnMemberUpdated gets called when the roles or nickname of a member change and records the role changes.
+func (r *Router) OnMemberUpdated(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if m.GuildID == r.guildID {
+		handlers.HandleMemberUpdate(s, m, r.db, r.guildID)
+	}
+}
+
+// OnMemberRemoved gets called when a member leaves a guild and records it.
+func (r *Router) OnMemberRemoved(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+	if m.GuildID == r.guildID {
+		handlers.HandleMemberRemove(s, m, r.db, r.guildID)
+	}
+}
+
+func getReactionHandlers() []commands.ReactionHandler {
+	return []commands.ReactionHandler{
+		handlers.HandlePageReaction,
+		handlers.HandleSignUpReaction,
+		handlers.HandleAvailabilityReaction,
+	}
+}
+
 func getCommands() []commands.Command {
 	return []commands.Command{
 		handlers.HelpCommand(),
@@ -183,5 +243,15 @@ func getCommands() []commands.Command {
 		handlers.ClearParticipantsCommand(),
 		handlers.StatusCommand(),
 		handlers.SetRolesCommand(),
+		handlers.TimeZoneCommand(),
+		handlers.TimeCommand(),
+		handlers.WSCommand(),
+		handlers.InstanceCommand(),
+		handlers.ModCommand(),
+		handlers.ModInfoCommand(),
+		handlers.SheetCommand(),
+		handlers.RedStarCommand(),
+		handlers.BlueStarCommand(),
+		handlers.MemberCommand(),
 	}
 }
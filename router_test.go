@@ -28,6 +28,32 @@ func TestAddAndGetCommand(t *testing.T) {
 		{msg: "event", expectedTrail: "", cmd: handlers.EventCommand()},
 		{msg: "ping", expectedTrail: "", cmd: handlers.PingCommand()},
 		{msg: "help event", expectedTrail: "event", cmd: handlers.HelpCommand()},
+		{msg: "event remove 12", expectedTrail: "12", cmd: handlers.EventRemoveCommand()},
+		{msg: "event ics", expectedTrail: "", cmd: handlers.EventCalendarCommand()},
+		{msg: "event ics feed reset", expectedTrail: "reset", cmd: handlers.EventCalendarFeedCommand()},
+		{msg: "ws", expectedTrail: "", cmd: handlers.WSCommand()},
+		{msg: "ws end B", expectedTrail: "B", cmd: handlers.WSTransitionCommand("end", "", "")},
+		{msg: "ws roster A", expectedTrail: "A", cmd: handlers.WSRosterCommand()},
+		{msg: "ws signup", expectedTrail: "", cmd: handlers.WSSignUpCommand()},
+		{msg: "ws deadline A", expectedTrail: "A", cmd: handlers.WSDeadlineCommand()},
+		{msg: "ws pending A", expectedTrail: "A", cmd: handlers.WSPendingCommand()},
+		{msg: "ws history A 2", expectedTrail: "A 2", cmd: handlers.WSHistoryCommand()},
+		{msg: "ws start A 2h", expectedTrail: "A 2h", cmd: handlers.WSStartCommand()},
+		{msg: "ws time A", expectedTrail: "A", cmd: handlers.WSTimeCommand()},
+		{msg: "ws result A win 120-80", expectedTrail: "A win 120-80", cmd: handlers.WSResultCommand()},
+		{msg: "ws enemy down Darth bs 1h", expectedTrail: "Darth bs 1h", cmd: handlers.WSEnemyCommand().SubCommands[0]},
+		{msg: "ws enemy remove Darth bs", expectedTrail: "Darth bs", cmd: handlers.WSEnemyCommand().SubCommands[1]},
+		{msg: "ws down remove bs", expectedTrail: "bs", cmd: handlers.WSDownCommand().SubCommands[0]},
+		{msg: "ws tech require Barrier 5 2", expectedTrail: "Barrier 5 2", cmd: handlers.WSTechCommand().SubCommands[0]},
+		{msg: "rs q 5 6", expectedTrail: "5 6", cmd: handlers.RedStarCommand().SubCommands[0]},
+		{msg: "rs", expectedTrail: "", cmd: handlers.RedStarCommand()},
+		{msg: "rs log 6 52000 <@1>", expectedTrail: "6 52000 <@1>", cmd: handlers.StarLogCommand("rs")},
+		{msg: "bs stats", expectedTrail: "", cmd: handlers.StarStatsCommand("bs")},
+		{msg: "member history <@1>", expectedTrail: "<@1>", cmd: handlers.MemberCommand().SubCommands[0]},
+		{msg: "ws availability open B 18:00", expectedTrail: "B 18:00", cmd: handlers.WSAvailabilityCommand().SubCommands[0]},
+		{msg: "ws availability B", expectedTrail: "B", cmd: handlers.WSAvailabilityCommand()},
+		{msg: "mods set tw 5", expectedTrail: "tw 5", cmd: handlers.ModCommand().SubCommands[0]},
+		{msg: "modinfo tw 5", expectedTrail: "tw 5", cmd: handlers.ModInfoCommand()},
 	}
 
 	r := testRouter()